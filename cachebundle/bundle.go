@@ -0,0 +1,338 @@
+// Package cachebundle moves build cache entries and their images between machines, as a
+// tarball or through a registry
+package cachebundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"dockstep.dev/docker"
+	"dockstep.dev/store"
+)
+
+// IndexVersion is the version of the bundle index format
+const IndexVersion = 1
+
+const (
+	// indexFile and imagesFile are the members of a tarball bundle, in order
+	indexFile  = "index.json"
+	imagesFile = "images.tar"
+	// indexTag is the tag of the image holding the index in a registry bundle
+	indexTag = "index"
+	// indexLabel is the label of the index image that holds the index
+	indexLabel = "dev.dockstep.cache-index"
+	// fileRepository is the repository images are tagged in within tarball bundles
+	fileRepository = "dockstep-cache"
+)
+
+// Index lists the cache entries in a bundle
+type Index struct {
+	Version int     `json:"version"`
+	Project string  `json:"project,omitempty"`
+	Entries []Entry `json:"entries"`
+}
+
+// Entry maps a block hash to the image built for it
+type Entry struct {
+	Hash   string `json:"hash"`
+	Digest string `json:"digest"` // image ID
+	Ref    string `json:"ref"`    // tag the image is bundled under
+}
+
+// Images is the part of the Docker client that bundles use
+type Images interface {
+	ImageInfo(ctx context.Context, ref string) (string, map[string]string, error)
+	TagImage(ctx context.Context, source, target string) error
+	SaveImages(ctx context.Context, refs []string, w io.Writer) error
+	LoadImages(ctx context.Context, r io.Reader) error
+	PushImage(ctx context.Context, ref string) error
+	PullImage(ctx context.Context, ref string) error
+	BuildImageWithOptions(ctx context.Context, contextDir, dockerfileContent string, opts docker.BuildOptions, logCallback func([]byte)) (string, error)
+}
+
+// IsFile reports whether a target names a tarball (.tar, .tar.gz or .tgz, or - for
+// stdin and stdout) rather than a registry repository
+func IsFile(target string) bool {
+	return target == "-" || strings.HasSuffix(target, ".tar") || strings.HasSuffix(target, ".tar.gz") || strings.HasSuffix(target, ".tgz")
+}
+
+// Export bundles the cache entries whose image exists locally into target, a tarball or a
+// registry repository, and returns the exported index
+func Export(ctx context.Context, images Images, cache *store.Cache, project, target string) (*Index, error) {
+	entries, err := cache.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+
+	index := &Index{Version: IndexVersion, Project: project}
+	var refs []string
+	for _, entry := range entries {
+		id, _, err := images.ImageInfo(ctx, entry.Digest)
+		if err != nil {
+			// Images removed since they were cached cannot be exported
+			continue
+		}
+		ref := fileRepository + ":" + tag(entry.Hash)
+		if !IsFile(target) {
+			ref = target + ":" + tag(entry.Hash)
+		}
+		if err := images.TagImage(ctx, id, ref); err != nil {
+			return nil, err
+		}
+		index.Entries = append(index.Entries, Entry{Hash: entry.Hash, Digest: id, Ref: ref})
+		refs = append(refs, ref)
+	}
+	if len(index.Entries) == 0 {
+		return nil, fmt.Errorf("no cached images to export")
+	}
+
+	if IsFile(target) {
+		return index, exportFile(ctx, images, index, refs, target)
+	}
+	return index, exportRegistry(ctx, images, index, refs, target)
+}
+
+// tag returns the tag of a cached image within a bundle
+func tag(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// exportFile writes the index and the images to a tarball
+func exportFile(ctx context.Context, images Images, index *Index, refs []string, path string) (err error) {
+	// Images are saved to a temporary file first, since tar headers need their size
+	saved, err := os.CreateTemp("", "dockstep-cache-*.tar")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(saved.Name())
+	defer saved.Close()
+	if err := images.SaveImages(ctx, refs, saved); err != nil {
+		return err
+	}
+	size, err := saved.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := saved.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = file
+	}
+	if strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".tgz") {
+		gz := gzip.NewWriter(out)
+		defer func() {
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		out = gz
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(out)
+	now := time.Now()
+	if err := tw.WriteHeader(&tar.Header{Name: indexFile, Mode: 0644, Size: int64(len(data)), ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: imagesFile, Mode: 0644, Size: size, ModTime: now}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, saved); err != nil {
+		return fmt.Errorf("failed to write images: %w", err)
+	}
+	return tw.Close()
+}
+
+// exportRegistry pushes the images, then an image whose label holds the index
+func exportRegistry(ctx context.Context, images Images, index *Index, refs []string, repository string) error {
+	for _, ref := range refs {
+		if err := images.PushImage(ctx, ref); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "dockstep-cache-index-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	// The index is also copied into the image, which gives it the layer registries expect
+	dockerfile := "FROM scratch\nCOPY " + indexFile + " /\n"
+	if err := os.WriteFile(filepath.Join(dir, indexFile), data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		return err
+	}
+	ref := repository + ":" + indexTag
+	opts := docker.BuildOptions{Tag: ref, Labels: map[string]string{indexLabel: string(data)}}
+	if _, err := images.BuildImageWithOptions(ctx, dir, dockerfile, opts, nil); err != nil {
+		return fmt.Errorf("failed to build index image: %w", err)
+	}
+	return images.PushImage(ctx, ref)
+}
+
+// Import restores the images of a bundle and adds its cache entries, keeping local entries
+// whose image still exists. It returns the bundle's index and the number of entries added.
+func Import(ctx context.Context, images Images, cache *store.Cache, source string) (*Index, int, error) {
+	var index *Index
+	var err error
+	if IsFile(source) {
+		index, err = importFile(ctx, images, source)
+	} else {
+		index, err = importRegistry(ctx, images, source)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	added := 0
+	for _, entry := range index.Entries {
+		id, _, err := images.ImageInfo(ctx, entry.Ref)
+		if err != nil {
+			return nil, added, fmt.Errorf("bundle is missing the image of %s: %w", entry.Hash, err)
+		}
+		if digest, ok := cache.GetCachedDigest(entry.Hash); ok && cache.ImageExists(ctx, digest) {
+			continue
+		}
+		if err := cache.SetCachedDigest(entry.Hash, id); err != nil {
+			return nil, added, fmt.Errorf("failed to update cache: %w", err)
+		}
+		added++
+	}
+	return index, added, nil
+}
+
+// importFile reads the index of a tarball and loads its images
+func importFile(ctx context.Context, images Images, path string) (*Index, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	// Accept compressed bundles whatever their name
+	buffered := bufio.NewReader(in)
+	if magic, err := buffered.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer gz.Close()
+		in = gz
+	} else {
+		in = buffered
+	}
+
+	var index *Index
+	tr := tar.NewReader(in)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		switch header.Name {
+		case indexFile:
+			if index, err = decodeIndex(tr); err != nil {
+				return nil, err
+			}
+		case imagesFile:
+			if index == nil {
+				return nil, fmt.Errorf("bundle has no %s before its images", indexFile)
+			}
+			if err := images.LoadImages(ctx, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if index == nil {
+		return nil, fmt.Errorf("%s is not a cache bundle: no %s", path, indexFile)
+	}
+	return index, nil
+}
+
+// importRegistry reads the index from the index image of a repository and pulls its images
+func importRegistry(ctx context.Context, images Images, repository string) (*Index, error) {
+	ref := repository + ":" + indexTag
+	if err := images.PullImage(ctx, ref); err != nil {
+		return nil, err
+	}
+	_, labels, err := images.ImageInfo(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := labels[indexLabel]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a cache bundle index", ref)
+	}
+	index, err := decodeIndex(strings.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	pulled := make(map[string]bool)
+	for _, entry := range index.Entries {
+		if pulled[entry.Ref] {
+			continue
+		}
+		if err := images.PullImage(ctx, entry.Ref); err != nil {
+			return nil, err
+		}
+		pulled[entry.Ref] = true
+	}
+	return index, nil
+}
+
+// decodeIndex reads a bundle index, rejecting versions this dockstep does not know
+func decodeIndex(r io.Reader) (*Index, error) {
+	var index Index
+	if err := json.NewDecoder(r).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+	if index.Version > IndexVersion {
+		return nil, fmt.Errorf("bundle index version %d is newer than this dockstep supports (%d); upgrade dockstep", index.Version, IndexVersion)
+	}
+	return &index, nil
+}
@@ -0,0 +1,182 @@
+package cachebundle
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dockstep.dev/docker"
+	"dockstep.dev/store"
+)
+
+// fakeImages is an in-memory Docker daemon with an in-memory registry. Saved archives are
+// JSON maps of tags to images.
+type fakeImages struct {
+	images   map[string]string            // image ID by ID and tag
+	labels   map[string]map[string]string // labels by image ID
+	registry map[string]string            // image ID by pushed tag
+}
+
+func newFakeImages(ids ...string) *fakeImages {
+	f := &fakeImages{images: make(map[string]string), labels: make(map[string]map[string]string), registry: make(map[string]string)}
+	for _, id := range ids {
+		f.images[id] = id
+	}
+	return f
+}
+
+func (f *fakeImages) ImageInfo(ctx context.Context, ref string) (string, map[string]string, error) {
+	id, ok := f.images[ref]
+	if !ok {
+		return "", nil, fmt.Errorf("no such image: %s", ref)
+	}
+	return id, f.labels[id], nil
+}
+
+func (f *fakeImages) TagImage(ctx context.Context, source, target string) error {
+	id, ok := f.images[source]
+	if !ok {
+		return fmt.Errorf("no such image: %s", source)
+	}
+	f.images[target] = id
+	return nil
+}
+
+func (f *fakeImages) SaveImages(ctx context.Context, refs []string, w io.Writer) error {
+	saved := make(map[string]string)
+	for _, ref := range refs {
+		saved[ref] = f.images[ref]
+	}
+	return json.NewEncoder(w).Encode(saved)
+}
+
+func (f *fakeImages) LoadImages(ctx context.Context, r io.Reader) error {
+	var saved map[string]string
+	if err := json.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+	for ref, id := range saved {
+		f.images[ref] = id
+		f.images[id] = id
+	}
+	return nil
+}
+
+func (f *fakeImages) PushImage(ctx context.Context, ref string) error {
+	f.registry[ref] = f.images[ref]
+	return nil
+}
+
+func (f *fakeImages) PullImage(ctx context.Context, ref string) error {
+	id, ok := f.registry[ref]
+	if !ok {
+		return fmt.Errorf("manifest unknown: %s", ref)
+	}
+	f.images[ref] = id
+	f.images[id] = id
+	return nil
+}
+
+func (f *fakeImages) BuildImageWithOptions(ctx context.Context, contextDir, dockerfileContent string, opts docker.BuildOptions, logCallback func([]byte)) (string, error) {
+	if _, err := os.Stat(filepath.Join(contextDir, "Dockerfile")); err != nil {
+		return "", err
+	}
+	id := "sha256:index"
+	f.images[opts.Tag] = id
+	f.labels[id] = opts.Labels
+	return id, nil
+}
+
+// newCache returns the cache of a fresh store
+func newCache(t *testing.T) *store.Cache {
+	t.Helper()
+	s := store.New(t.TempDir())
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return s.NewCache()
+}
+
+func TestIsFile(t *testing.T) {
+	for target, want := range map[string]bool{
+		"cache.tar":                   true,
+		"out/cache.tar.gz":            true,
+		"cache.tgz":                   true,
+		"-":                           true,
+		"localhost:5000/team/cache":   false,
+		"ghcr.io/acme/dockstep-cache": false,
+	} {
+		if got := IsFile(target); got != want {
+			t.Errorf("IsFile(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, target := range []string{"cache.tar", "cache.tar.gz", "localhost:5000/team/cache"} {
+		t.Run(target, func(t *testing.T) {
+			if IsFile(target) {
+				target = filepath.Join(t.TempDir(), target)
+			}
+			ctx := context.Background()
+
+			// The laptop has built two blocks; the image of a third entry was pruned
+			laptop := newFakeImages("sha256:base", "sha256:app")
+			laptopCache := newCache(t)
+			laptopCache.SetCachedDigest("1111111111111111aaaa", "sha256:base")
+			laptopCache.SetCachedDigest("2222222222222222bbbb", "sha256:app")
+			laptopCache.SetCachedDigest("3333333333333333cccc", "sha256:pruned")
+
+			index, err := Export(ctx, laptop, laptopCache, "shop", target)
+			if err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			if len(index.Entries) != 2 {
+				t.Fatalf("Expected the 2 entries with images to be exported, got %+v", index.Entries)
+			}
+
+			// A fresh CI runner shares nothing with the laptop but the bundle
+			runner := newFakeImages()
+			runner.registry = laptop.registry
+			runner.labels = laptop.labels // labels travel with the pushed image
+			runnerCache := newCache(t)
+			runnerCache.SetImageCheck(func(ctx context.Context, digest string) (bool, error) {
+				_, ok := runner.images[digest]
+				return ok, nil
+			}, 0)
+			imported, added, err := Import(ctx, runner, runnerCache, target)
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			if added != 2 || imported.Project != "shop" {
+				t.Errorf("Expected 2 entries from project shop, got %d from %q", added, imported.Project)
+			}
+			for hash, want := range map[string]string{"1111111111111111aaaa": "sha256:base", "2222222222222222bbbb": "sha256:app"} {
+				digest, hit, _ := runnerCache.GetVerifiedDigest(ctx, hash)
+				if !hit || digest != want {
+					t.Errorf("Expected %s to hit %s after import, got %q %v", hash, want, digest, hit)
+				}
+			}
+
+			// Importing again adds nothing
+			if _, added, err := Import(ctx, runner, runnerCache, target); err != nil || added != 0 {
+				t.Errorf("Expected a second import to add nothing, got %d, %v", added, err)
+			}
+		})
+	}
+}
+
+func TestImportRejectsNewerIndex(t *testing.T) {
+	images := newFakeImages()
+	images.registry["localhost:5000/cache:index"] = "sha256:index"
+	images.labels["sha256:index"] = map[string]string{indexLabel: `{"version": 99, "entries": []}`}
+
+	_, _, err := Import(context.Background(), images, newCache(t), "localhost:5000/cache")
+	if err == nil || err.Error() != "bundle index version 99 is newer than this dockstep supports (1); upgrade dockstep" {
+		t.Errorf("Expected a version error, got %v", err)
+	}
+}
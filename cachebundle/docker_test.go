@@ -0,0 +1,75 @@
+package cachebundle
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dockstep.dev/docker"
+)
+
+// TestDockerRoundTrip exports a cached image and imports it again after removing it. It
+// needs a Docker daemon (DOCKSTEP_TEST_DOCKER=1), and a registry such as
+// `docker run -d -p 5000:5000 registry:2` for the registry case (DOCKSTEP_TEST_REGISTRY=localhost:5000).
+func TestDockerRoundTrip(t *testing.T) {
+	targets := map[string]string{}
+	if os.Getenv("DOCKSTEP_TEST_DOCKER") != "" {
+		targets["tarball"] = filepath.Join(t.TempDir(), "cache.tar.gz")
+	}
+	if registry := os.Getenv("DOCKSTEP_TEST_REGISTRY"); registry != "" {
+		targets["registry"] = registry + "/dockstep-cache-test"
+	}
+	if len(targets) == 0 {
+		t.Skip("set DOCKSTEP_TEST_DOCKER or DOCKSTEP_TEST_REGISTRY to run against Docker")
+	}
+
+	client, err := docker.NewClient()
+	if err != nil {
+		t.Fatalf("Failed to create Docker client: %v", err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			// A unique image, so the import cannot find it locally
+			dir := t.TempDir()
+			content := fmt.Sprintf("%s %d\n", name, time.Now().UnixNano())
+			if err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			dockerfile := "FROM scratch\nCOPY hello.txt /\n"
+			if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+				t.Fatal(err)
+			}
+			id, err := client.BuildImageWithOptions(ctx, dir, dockerfile, docker.BuildOptions{Tag: "dockstep-bundle-test:" + name}, nil)
+			if err != nil {
+				t.Fatalf("Failed to build test image: %v", err)
+			}
+
+			hash := fmt.Sprintf("%064x", time.Now().UnixNano())
+			cache := newCache(t)
+			cache.SetCachedDigest(hash, id)
+			if _, err := Export(ctx, client, cache, "bundle-test", target); err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			if _, _, err := client.RemoveImages(ctx, []string{id}); err != nil {
+				t.Fatalf("Failed to remove test image: %v", err)
+			}
+
+			imported := newCache(t)
+			imported.SetImageCheck(client.ImageExists, 0)
+			if _, added, err := Import(ctx, client, imported, target); err != nil || added != 1 {
+				t.Fatalf("Expected 1 imported entry, got %d, %v", added, err)
+			}
+			digest, hit, _ := imported.GetVerifiedDigest(ctx, hash)
+			if !hit || digest != id {
+				t.Errorf("Expected a cache hit on %s after import, got %q %v", id, digest, hit)
+			}
+			client.RemoveImages(ctx, []string{id})
+		})
+	}
+}
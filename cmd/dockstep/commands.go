@@ -2,21 +2,40 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"dockstep.dev/cachebundle"
+	"dockstep.dev/config"
 	"dockstep.dev/docker"
 	"dockstep.dev/engine"
 	"dockstep.dev/export"
+	"dockstep.dev/importer"
+	"dockstep.dev/lint"
 	"dockstep.dev/store"
 	"dockstep.dev/types"
 )
 
 // cmdInit creates skeleton dockstep.yaml and .dockstep/ structure
 func cmdInit(args []string) error {
+	initFlags := flag.NewFlagSet("init", flag.ExitOnError)
+	fromDockerfile := initFlags.String("from-dockerfile", "", "Generate blocks from an existing Dockerfile")
+	splitOn := initFlags.String("split-on", string(importer.SplitStage), "How to split the Dockerfile into blocks (stage, comment, every-run)")
+
+	if err := initFlags.Parse(args); err != nil {
+		return err
+	}
+
 	// Check if dockstep.yaml already exists
 	if _, err := os.Stat("dockstep.yaml"); err == nil {
 		fmt.Println("dockstep.yaml already exists in current directory")
@@ -29,6 +48,16 @@ func cmdInit(args []string) error {
 	if err := store.Init(); err != nil {
 		return fmt.Errorf("failed to initialize .dockstep directory: %w", err)
 	}
+	defer store.Close()
+
+	if *fromDockerfile != "" {
+		if err := importDockerfile(*fromDockerfile, "dockstep.yaml", *splitOn); err != nil {
+			return err
+		}
+		fmt.Println("Initialized dockstep project")
+		fmt.Println("Created .dockstep/ directory structure")
+		return nil
+	}
 
 	// Create skeleton dockstep.yaml
 	configContent := `version: "1.0"
@@ -54,6 +83,509 @@ blocks:
 	return nil
 }
 
+// cmdImport generates dockstep.yaml from an existing Dockerfile or image
+func cmdImport(args []string, projectRoot string) error {
+	importFlags := flag.NewFlagSet("import", flag.ExitOnError)
+	splitOn := importFlags.String("split-on", string(importer.SplitStage), "How to split the Dockerfile into blocks (stage, comment, every-run)")
+	output := importFlags.String("output", "", "Config file to write (default: dockstep.yaml in the project root)")
+	force := importFlags.Bool("force", false, "Overwrite an existing config file")
+
+	// Accept flags both before and after the positional arguments
+	var positional []string
+	for {
+		if err := importFlags.Parse(args); err != nil {
+			return err
+		}
+		if importFlags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, importFlags.Arg(0))
+		args = importFlags.Args()[1:]
+	}
+
+	var source string
+	switch {
+	case len(positional) == 2 && positional[0] == "image":
+		source = positional[1]
+	case len(positional) == 1 && positional[0] != "image":
+		source = positional[0]
+	default:
+		return fmt.Errorf("usage: dockstep import <Dockerfile> | dockstep import image <ref>")
+	}
+
+	configPath := *output
+	if configPath == "" {
+		configPath = filepath.Join(projectRoot, "dockstep.yaml")
+	}
+	if _, err := os.Stat(configPath); err == nil && !*force {
+		return fmt.Errorf("%s already exists (use --force to overwrite)", configPath)
+	}
+
+	// Import only writes the config; the store is created by the first command that needs it
+	if positional[0] == "image" {
+		return importImage(source, configPath)
+	}
+	return importDockerfile(source, configPath, *splitOn)
+}
+
+// importDockerfile converts a Dockerfile into a config file
+func importDockerfile(dockerfilePath, configPath, splitOn string) error {
+	mode, err := importer.ParseSplitMode(splitOn)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open Dockerfile: %w", err)
+	}
+	defer file.Close()
+
+	result, err := importer.ImportDockerfile(file, importedProjectName(configPath), mode)
+	if err != nil {
+		return err
+	}
+	return writeImport(result, dockerfilePath, configPath)
+}
+
+// importImage reconstructs blocks from the history of a local image, starting from the
+// local image that shares the most layers with it
+func importImage(ref, configPath string) error {
+	dockerClient, err := docker.NewClient()
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer dockerClient.Close()
+
+	ctx := context.Background()
+	history, err := dockerClient.ImageHistory(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	// Every other local image is a candidate base
+	refs, err := dockerClient.ImageRefs(ctx)
+	if err != nil {
+		return err
+	}
+	var bases []importer.BaseImage
+	for _, baseRef := range refs {
+		baseHistory, err := dockerClient.ImageHistory(ctx, baseRef)
+		if err != nil {
+			continue
+		}
+		bases = append(bases, importer.BaseImage{Ref: baseRef, History: baseHistory})
+	}
+
+	result, err := importer.ImportImage(ref, history, bases, importedProjectName(configPath))
+	if err != nil {
+		return err
+	}
+	return writeImport(result, ref, configPath)
+}
+
+// importedProjectName names an imported project after the directory its config is written to
+func importedProjectName(configPath string) string {
+	dir, err := filepath.Abs(filepath.Dir(configPath))
+	if err != nil {
+		return "my-project"
+	}
+	return filepath.Base(dir)
+}
+
+// writeImport validates and writes an imported project, printing anything that could not
+// be carried over
+func writeImport(result *importer.Result, source, configPath string) error {
+	if err := config.Validate(result.Project); err != nil {
+		return fmt.Errorf("imported config is invalid: %w", err)
+	}
+	if err := config.Write(result.Project, configPath); err != nil {
+		return err
+	}
+
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	fmt.Printf("Imported %s into %s (%d blocks)\n", source, configPath, len(result.Project.Blocks))
+	return nil
+}
+
+// cmdMigrate upgrades the config file to the current schema version
+func cmdMigrate(args []string, projectRoot string) error {
+	migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := migrateFlags.Bool("dry-run", false, "Print the changes as a diff without writing them")
+
+	if err := migrateFlags.Parse(args); err != nil {
+		return err
+	}
+
+	configPath, err := config.FindConfigFile(projectRoot)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	migrated, changes, err := config.Migrate(data)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("%s is up to date (schema version %s)\n", configPath, config.SchemaVersion)
+		return nil
+	}
+
+	// The migrated config must load, or it is not written
+	project, err := config.ParseData(migrated, configPath)
+	if err != nil {
+		return fmt.Errorf("migrated config does not parse: %w", err)
+	}
+	if err := config.Validate(project); err != nil {
+		return fmt.Errorf("migrated config is invalid: %w", err)
+	}
+
+	for _, change := range changes {
+		fmt.Fprintf(os.Stderr, "%s\n", change)
+	}
+	if *dryRun {
+		fmt.Print(unifiedDiff(filepath.Base(configPath), data, migrated))
+		return nil
+	}
+	if err := config.WriteData(configPath, migrated); err != nil {
+		return err
+	}
+	fmt.Printf("Migrated %s to schema version %s (%d changes)\n", configPath, config.SchemaVersion, len(changes))
+	return nil
+}
+
+// unifiedDiff returns a unified diff between two versions of a file, with three lines of context
+func unifiedDiff(name string, a, b []byte) string {
+	before := strings.SplitAfter(strings.TrimSuffix(string(a), "\n"), "\n")
+	after := strings.SplitAfter(strings.TrimSuffix(string(b), "\n"), "\n")
+	if len(a) > 0 && a[len(a)-1] == '\n' {
+		before[len(before)-1] += "\n"
+	}
+	if len(b) > 0 && b[len(b)-1] == '\n' {
+		after[len(after)-1] += "\n"
+	}
+
+	// Longest common subsequence of lines, computed from the end
+	lcs := make([][]int, len(before)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(after)+1)
+	}
+	for i := len(before) - 1; i >= 0; i-- {
+		for j := len(after) - 1; j >= 0; j-- {
+			if before[i] == after[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	// Walk the table into a list of kept, removed and added lines
+	type op struct {
+		kind byte
+		text string
+		i, j int // line indexes in before and after
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case i < len(before) && j < len(after) && before[i] == after[j]:
+			ops = append(ops, op{' ', before[i], i, j})
+			i, j = i+1, j+1
+		case i < len(before) && (j == len(after) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', before[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', after[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	const context = 3
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are within twice the context of each other
+		first := max(start-context, 0)
+		end := start
+		for k := start; k < len(ops) && k-end <= 2*context; k++ {
+			if ops[k].kind != ' ' {
+				end = k
+			}
+		}
+		last := min(end+context, len(ops)-1)
+
+		removed, added := 0, 0
+		for _, o := range ops[first : last+1] {
+			if o.kind != '+' {
+				removed++
+			}
+			if o.kind != '-' {
+				added++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[first].i+1, removed, ops[first].j+1, added)
+		for _, o := range ops[first : last+1] {
+			text := o.text
+			if !strings.HasSuffix(text, "\n") {
+				text += "\n\\ No newline at end of file\n"
+			}
+			out.WriteString(string(o.kind) + text)
+		}
+		start = last + 1
+	}
+	return out.String()
+}
+
+// cmdStore shows the backend of the project's store, or moves the store to another one
+func cmdStore(args []string, projectRoot string) error {
+	projectStore := store.New(projectRoot)
+	if err := projectStore.Init(); err != nil {
+		return fmt.Errorf("failed to initialize project store: %w", err)
+	}
+	defer projectStore.Close()
+	reportLayoutUpgrades(projectStore)
+	if len(args) == 0 {
+		fmt.Printf("Store backend: %s\n", projectStore.Backend().Name())
+		return nil
+	}
+
+	switch args[0] {
+	case "migrate":
+		return cmdStoreMigrate(args[1:], projectStore)
+	default:
+		return fmt.Errorf("unknown store command: %s", args[0])
+	}
+}
+
+// cmdStoreMigrate copies the store into another backend and switches the project to it
+func cmdStoreMigrate(args []string, projectStore *store.Store) error {
+	migrateFlags := flag.NewFlagSet("store migrate", flag.ExitOnError)
+	to := migrateFlags.String("to", "", "Backend to move the store to (file or bolt)")
+
+	if err := migrateFlags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return fmt.Errorf("--to is required (%s or %s)", store.FileBackendName, store.BoltBackendName)
+	}
+
+	lock, err := projectStore.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	migration, err := projectStore.MigrateBackend(*to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Moved the store from %s to %s (%d values, %d history records)\n",
+		migration.From, migration.To, migration.Values, migration.Records)
+	return nil
+}
+
+// cmdSchema prints the JSON Schema for dockstep.yaml
+func cmdSchema(args []string) error {
+	schemaFlags := flag.NewFlagSet("schema", flag.ExitOnError)
+	output := schemaFlags.String("output", "", "Write the schema to a file instead of stdout")
+
+	if err := schemaFlags.Parse(args); err != nil {
+		return err
+	}
+
+	schema, err := config.JSONSchema()
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err := os.Stdout.Write(schema)
+		return err
+	}
+	if err := os.WriteFile(*output, schema, 0644); err != nil {
+		return fmt.Errorf("failed to write schema: %w", err)
+	}
+	fmt.Printf("Wrote JSON Schema to %s\n", *output)
+	return nil
+}
+
+// diagnostic is a validation error or warning, located in the config when possible
+type diagnostic struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Block    string `json:"block,omitempty"`
+	Index    *int   `json:"index,omitempty"`  // instruction index
+	Source   string `json:"source,omitempty"` // included file the block is declared in
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+}
+
+// validationResult is the output of dockstep validate --json
+type validationResult struct {
+	File        string       `json:"file"`
+	Valid       bool         `json:"valid"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+var (
+	// yamlLinePattern matches the line number in YAML syntax errors
+	yamlLinePattern = regexp.MustCompile(`\bline (\d+)\b`)
+	// blockErrorPattern matches validation errors about a block
+	blockErrorPattern = regexp.MustCompile(`^block ([^ :]+)`)
+)
+
+// cmdValidate parses and validates a config file without a Docker daemon
+func cmdValidate(args []string, projectRoot string) error {
+	validateFlags := flag.NewFlagSet("validate", flag.ExitOnError)
+	jsonOutput := validateFlags.Bool("json", false, "Print the result as JSON")
+
+	// Accept flags both before and after the file argument
+	var positional []string
+	for {
+		if err := validateFlags.Parse(args); err != nil {
+			return err
+		}
+		if validateFlags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, validateFlags.Arg(0))
+		args = validateFlags.Args()[1:]
+	}
+
+	var configPath string
+	switch len(positional) {
+	case 0:
+		path, err := config.FindConfigFile(projectRoot)
+		if err != nil {
+			return err
+		}
+		configPath = path
+	case 1:
+		configPath = positional[0]
+	default:
+		return fmt.Errorf("usage: dockstep validate [file] [--json]")
+	}
+
+	result := validateConfig(configPath)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return fmt.Errorf("failed to encode result: %w", err)
+		}
+	} else {
+		for _, d := range result.Diagnostics {
+			location := configPath
+			if d.Source != "" {
+				location = d.Source
+			}
+			if d.Line > 0 {
+				location += fmt.Sprintf(":%d:%d", d.Line, max(d.Column, 1))
+			}
+			fmt.Printf("%s: %s: %s\n", location, d.Severity, d.Message)
+		}
+		if result.Valid {
+			fmt.Printf("%s is valid\n", configPath)
+		}
+	}
+
+	if !result.Valid {
+		return fmt.Errorf("%s is invalid", configPath)
+	}
+	return nil
+}
+
+// validateConfig parses and validates a config file, collecting every diagnostic
+func validateConfig(configPath string) validationResult {
+	result := validationResult{File: configPath, Diagnostics: []diagnostic{}}
+
+	project, warnings, err := config.ParseWithWarnings(configPath)
+	for _, warning := range warnings {
+		result.Diagnostics = append(result.Diagnostics, diagnostic{Severity: "warning", Message: warning})
+	}
+	if err == nil {
+		err = config.Validate(project)
+	}
+	if err == nil {
+		result.Valid = true
+		return result
+	}
+
+	d := diagnostic{Severity: "error", Message: err.Error()}
+	var verr *config.ValidationError
+	switch {
+	case errors.As(err, &verr):
+		index := verr.Index
+		d.Block, d.Index, d.Source = verr.Block, &index, verr.Source
+		d.Line, d.Column = verr.Position.Line, verr.Position.Column
+	case project == nil:
+		// YAML syntax errors carry the line number in their message
+		if match := yamlLinePattern.FindStringSubmatch(err.Error()); match != nil {
+			d.Line, _ = strconv.Atoi(match[1])
+		}
+	default:
+		if match := blockErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+			for _, block := range project.Blocks {
+				if block.ID == match[1] {
+					d.Block, d.Source = block.ID, block.Source
+					d.Line, d.Column = block.Position.Line, block.Position.Column
+					break
+				}
+			}
+		}
+	}
+	result.Diagnostics = append(result.Diagnostics, d)
+	return result
+}
+
+// cmdLint checks blocks against the lint rules and fails when any finding is an error
+func cmdLint(args []string, project *types.Project) error {
+	lintFlags := flag.NewFlagSet("lint", flag.ExitOnError)
+	jsonOutput := lintFlags.Bool("json", false, "Print findings as JSON")
+
+	if err := lintFlags.Parse(args); err != nil {
+		return err
+	}
+
+	findings, err := lint.Lint(project)
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if findings == nil {
+			findings = []lint.Finding{}
+		}
+		if err := encoder.Encode(findings); err != nil {
+			return fmt.Errorf("failed to encode findings: %w", err)
+		}
+	} else {
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if len(findings) == 0 {
+			fmt.Println("No lint findings")
+		}
+	}
+
+	if errors := lint.Count(findings, lint.SeverityError); errors > 0 {
+		return fmt.Errorf("lint found %d error(s)", errors)
+	}
+	return nil
+}
+
 // cmdStatus shows ordered blocks with state
 func cmdStatus(ctx context.Context, args []string, engine *engine.Engine, store *store.Store) error {
 	// Load all block states
@@ -65,7 +597,18 @@ func cmdStatus(ctx context.Context, args []string, engine *engine.Engine, store
 	fmt.Println("Block Status:")
 	fmt.Println("============")
 
+	printedTemplates := make(map[string]bool)
 	for _, block := range engine.GetProject().Blocks {
+		// Group matrix variants under the block they were expanded from
+		indent := "  "
+		if block.Template != nil {
+			if !printedTemplates[block.Template.ID] {
+				printedTemplates[block.Template.ID] = true
+				fmt.Printf("  %s (matrix):\n", block.Template.ID)
+			}
+			indent = "    "
+		}
+
 		state, exists := states[block.ID]
 		if !exists {
 			state = &types.BlockState{
@@ -82,7 +625,7 @@ func cmdStatus(ctx context.Context, args []string, engine *engine.Engine, store
 			status += fmt.Sprintf(" (hash: %s)", state.Hash[:8])
 		}
 
-		fmt.Printf("  %s: %s\n", block.ID, status)
+		fmt.Printf("%s%s: %s\n", indent, block.ID, status)
 	}
 
 	return nil
@@ -94,6 +637,8 @@ func cmdUp(ctx context.Context, args []string, engine *engine.Engine) error {
 	force := upFlags.Bool("force", false, "Ignore cache for all blocks")
 	from := upFlags.String("from", "", "Start from a specific block")
 	continueOnError := upFlags.Bool("continue-on-error", false, "Continue despite failures")
+	only := upFlags.String("only", "", "Only run these blocks (comma-separated; a matrix block selects all variants)")
+	resume := upFlags.Bool("resume", false, "Continue from the first block that did not finish")
 
 	if err := upFlags.Parse(args); err != nil {
 		return err
@@ -103,6 +648,14 @@ func cmdUp(ctx context.Context, args []string, engine *engine.Engine) error {
 		Force:           *force,
 		FromBlock:       *from,
 		ContinueOnError: *continueOnError,
+		Resume:          *resume,
+	}
+	if *only != "" {
+		for _, id := range strings.Split(*only, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				opts.Only = append(opts.Only, id)
+			}
+		}
 	}
 
 	fmt.Println("Executing blocks...")
@@ -135,12 +688,20 @@ func cmdRun(ctx context.Context, args []string, engine *engine.Engine) error {
 		KeepContainer: *keepContainer,
 	}
 
-	fmt.Printf("Executing block: %s\n", blockID)
-	if err := engine.RunBlock(ctx, blockID, opts); err != nil {
-		return err
+	// A matrix block ID runs every variant
+	blockIDs := config.MatchBlocks(engine.GetProject(), blockID)
+	if len(blockIDs) == 0 {
+		blockIDs = []string{blockID}
 	}
 
-	fmt.Printf("Block %s completed successfully\n", blockID)
+	for _, id := range blockIDs {
+		fmt.Printf("Executing block: %s\n", id)
+		if err := engine.RunBlock(ctx, id, opts); err != nil {
+			return err
+		}
+
+		fmt.Printf("Block %s completed successfully\n", id)
+	}
 	return nil
 }
 
@@ -196,7 +757,7 @@ func cmdExport(ctx context.Context, args []string, engine *engine.Engine, store
 
 	switch exportType {
 	case "dockerfile":
-		return cmdExportDockerfile(ctx, exportArgs, engine)
+		return cmdExportDockerfile(ctx, exportArgs, engine, store)
 	case "image":
 		return cmdExportImage(ctx, exportArgs, engine, store, dockerClient)
 	default:
@@ -205,28 +766,47 @@ func cmdExport(ctx context.Context, args []string, engine *engine.Engine, store
 }
 
 // cmdExportDockerfile generates a Dockerfile
-func cmdExportDockerfile(ctx context.Context, args []string, engine *engine.Engine) error {
+func cmdExportDockerfile(ctx context.Context, args []string, engine *engine.Engine, store *store.Store) error {
 	dockerfileFlags := flag.NewFlagSet("export dockerfile", flag.ExitOnError)
 	output := dockerfileFlags.String("output", "", "Output file path")
 	collapseRuns := dockerfileFlags.Bool("collapse-runs", false, "Collapse adjacent RUN commands")
 	pinDigests := dockerfileFlags.Bool("pin-digests", false, "Pin base images to digests")
+	multiStage := dockerfileFlags.Bool("multi-stage", false, "Emit one build stage per block")
 
 	if err := dockerfileFlags.Parse(args); err != nil {
 		return err
 	}
 
-	if len(dockerfileFlags.Args()) == 0 {
+	targets := dockerfileFlags.Args()
+	if len(targets) == 0 {
 		return fmt.Errorf("block ID required")
 	}
-	endBlockID := dockerfileFlags.Args()[0]
+	if len(targets) > 1 && !*multiStage {
+		return fmt.Errorf("exporting several blocks requires --multi-stage")
+	}
 
 	opts := types.DockerfileOptions{
 		Output:       *output,
 		CollapseRuns: *collapseRuns,
 		PinDigests:   *pinDigests,
+		MultiStage:   *multiStage,
+		Variables:    engine.Variables(),
+	}
+	if opts.PinDigests {
+		digests, err := baseDigests(store)
+		if err != nil {
+			return err
+		}
+		opts.Digests = digests
 	}
 
-	dockerfile, err := export.GenerateDockerfile(engine.GetProject(), endBlockID, opts)
+	var dockerfile string
+	var err error
+	if opts.MultiStage {
+		dockerfile, err = export.GenerateMultiStageDockerfile(engine.GetProject(), targets, opts)
+	} else {
+		dockerfile, err = export.GenerateDockerfile(engine.GetProject(), targets[0], opts)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to generate Dockerfile: %w", err)
 	}
@@ -243,6 +823,424 @@ func cmdExportDockerfile(ctx context.Context, args []string, engine *engine.Engi
 	return nil
 }
 
+// baseDigests returns the digests base images are pinned to: those in dockstep.lock,
+// falling back to the digests recorded during the last builds
+func baseDigests(store *store.Store) (map[string]string, error) {
+	digests, err := store.LoadBaseDigests()
+	if err != nil {
+		return nil, err
+	}
+	lock, err := config.ReadLock(filepath.Join(store.RootPath(), config.LockFileName))
+	if err != nil {
+		return nil, err
+	}
+	for image, digest := range lock.Images {
+		digests[image] = digest
+	}
+	return digests, nil
+}
+
+// cmdLock resolves the base images of every block and pins them in dockstep.lock
+func cmdLock(ctx context.Context, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
+	lockFlags := flag.NewFlagSet("lock", flag.ExitOnError)
+	if err := lockFlags.Parse(args); err != nil {
+		return err
+	}
+
+	project := engine.GetProject()
+	lock := &types.Lock{Images: make(map[string]string)}
+	for _, b := range project.Blocks {
+		image := config.ResolveBlock(project, b, engine.Variables()).From
+		if image == "" || image == "scratch" || strings.Contains(image, "@") {
+			continue
+		}
+		if _, done := lock.Images[image]; done {
+			continue
+		}
+
+		if err := dockerClient.PullImage(ctx, image); err != nil {
+			return fmt.Errorf("failed to pull image %s: %w", image, err)
+		}
+		digest, err := dockerClient.RepoDigest(ctx, image)
+		if err != nil {
+			return err
+		}
+		if digest == "" {
+			return fmt.Errorf("image %s has no registry digest", image)
+		}
+		lock.Images[image] = digest
+		fmt.Printf("%s -> %s\n", image, digest)
+	}
+
+	path := filepath.Join(store.RootPath(), config.LockFileName)
+	if err := config.WriteLock(lock, path); err != nil {
+		return err
+	}
+	fmt.Printf("Pinned %d base images in %s\n", len(lock.Images), config.LockFileName)
+	return nil
+}
+
+// cmdCache manages the build cache
+func cmdCache(ctx context.Context, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
+	if len(args) == 0 {
+		return fmt.Errorf("cache command required (verify, export or import)")
+	}
+
+	switch args[0] {
+	case "verify":
+		return cmdCacheVerify(ctx, args[1:], store, dockerClient)
+	case "export":
+		return cmdCacheExport(ctx, args[1:], engine, store, dockerClient)
+	case "import":
+		return cmdCacheImport(ctx, args[1:], store, dockerClient)
+	default:
+		return fmt.Errorf("unknown cache command: %s", args[0])
+	}
+}
+
+// cmdCacheVerify checks that the image of every cache entry still exists and evicts the
+// entries whose image was removed
+func cmdCacheVerify(ctx context.Context, args []string, store *store.Store, dockerClient *docker.Client) error {
+	verifyFlags := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	dryRun := verifyFlags.Bool("dry-run", false, "Report missing images without evicting their entries")
+	shared := verifyFlags.Bool("shared", false, "Verify the machine-wide cache instead of the project's")
+	if err := verifyFlags.Parse(args); err != nil {
+		return err
+	}
+
+	cache := store.NewCache()
+	if *shared {
+		var err error
+		if cache, err = openSharedCache(); err != nil {
+			return err
+		}
+	}
+	cache.SetImageCheck(dockerClient.ImageExists, 0)
+	report, err := cache.Verify(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, entry := range report.Missing {
+		fmt.Printf("Missing image %s (hash %s)\n", entry.Digest, entry.Hash)
+	}
+	switch {
+	case len(report.Missing) == 0:
+		fmt.Printf("Checked %d cache entries; all images exist\n", report.Checked)
+	case *dryRun:
+		fmt.Printf("Checked %d cache entries; %d would be evicted\n", report.Checked, len(report.Missing))
+	default:
+		fmt.Printf("Checked %d cache entries; evicted %d\n", report.Checked, len(report.Missing))
+	}
+	return nil
+}
+
+// cmdCacheExport bundles the cached block images and their cache entries into a tarball
+// or a registry repository
+func cmdCacheExport(ctx context.Context, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
+	exportFlags := flag.NewFlagSet("cache export", flag.ExitOnError)
+	if err := exportFlags.Parse(args); err != nil {
+		return err
+	}
+	if exportFlags.NArg() != 1 {
+		return fmt.Errorf("usage: dockstep cache export <file.tar[.gz]|registry-ref>")
+	}
+	target := exportFlags.Arg(0)
+
+	index, err := cachebundle.Export(ctx, dockerClient, store.NewCache(), engine.GetProject().Name, target)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(cacheOutput(target), "Exported %d cache entries to %s\n", len(index.Entries), target)
+	return nil
+}
+
+// cmdCacheImport restores cached block images and their cache entries from a bundle
+func cmdCacheImport(ctx context.Context, args []string, store *store.Store, dockerClient *docker.Client) error {
+	importFlags := flag.NewFlagSet("cache import", flag.ExitOnError)
+	if err := importFlags.Parse(args); err != nil {
+		return err
+	}
+	if importFlags.NArg() != 1 {
+		return fmt.Errorf("usage: dockstep cache import <file.tar[.gz]|registry-ref>")
+	}
+	source := importFlags.Arg(0)
+
+	cache := store.NewCache()
+	cache.SetImageCheck(dockerClient.ImageExists, 0)
+	index, added, err := cachebundle.Import(ctx, dockerClient, cache, source)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d of %d cache entries from %s", added, len(index.Entries), source)
+	if index.Project != "" {
+		fmt.Printf(" (project %s)", index.Project)
+	}
+	fmt.Println()
+	return nil
+}
+
+// cacheOutput returns where to report on a bundle: stderr when it is written to stdout
+func cacheOutput(target string) io.Writer {
+	if target == "-" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// cmdGC removes images, cache entries, snapshots and logs no longer referenced by the
+// current state or the kept image history
+func cmdGC(ctx context.Context, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
+	project := engine.GetProject()
+	gcFlags := flag.NewFlagSet("gc", flag.ExitOnError)
+	keep := gcFlags.Int("keep", project.Settings.Retention.KeepCount(), "Images kept per block, newest first (0 keeps all)")
+	olderThan := gcFlags.String("older-than", project.Settings.Retention.MaxAge, "Remove images older than this, such as 72h or 7d")
+	dryRun := gcFlags.Bool("dry-run", false, "Show what would be removed without removing it")
+	if err := gcFlags.Parse(args); err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("--keep must not be negative")
+	}
+
+	opts := gcOptions(project, *keep)
+	if *olderThan != "" {
+		age, err := config.ParseAge(*olderThan)
+		if err != nil {
+			return fmt.Errorf("invalid --older-than: %w", err)
+		}
+		opts.OlderThan = age
+	}
+	plan, err := store.PlanGC(opts)
+	if err != nil {
+		return fmt.Errorf("failed to plan garbage collection: %w", err)
+	}
+
+	// Images labeled for this checkout of the project that nothing references any more, such
+	// as those of runs whose history was lost. Other checkouts with the same project name
+	// have their own project ID.
+	labeled, err := dockerClient.ProjectImages(ctx, store.ProjectID())
+	if err != nil {
+		return err
+	}
+	for id, digests := range labeled {
+		referenced := plan.Kept[id]
+		for _, digest := range digests {
+			referenced = referenced || plan.Kept[digest]
+		}
+		if !referenced && !slices.Contains(plan.Images, id) {
+			plan.Images = append(plan.Images, id)
+		}
+	}
+
+	// Images in the shared cache may be used by other projects
+	if project.Settings.SharedCache {
+		shared, err := sharedImages()
+		if err != nil {
+			return err
+		}
+		plan.Images = slices.DeleteFunc(plan.Images, func(digest string) bool { return shared[digest] })
+	}
+
+	layersBefore, sizes, err := dockerClient.ImageDiskUsage(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		var imageSize int64
+		for _, digest := range plan.Images {
+			fmt.Printf("Would remove image %s\n", digest)
+			imageSize += sizes[digest]
+		}
+		for _, file := range plan.Files {
+			fmt.Printf("Would remove %s\n", filepath.Join(".dockstep", file))
+		}
+		fmt.Printf("Would remove %d image(s), %d cache entries, %d history record(s) and %d file(s), reclaiming about %s\n",
+			len(plan.Images), len(plan.CacheEntries), plan.Records, len(plan.Files), formatBytes(imageSize+plan.FileSize))
+		return nil
+	}
+
+	removed, skipped, err := dockerClient.RemoveImages(ctx, plan.Images)
+	if err != nil {
+		return err
+	}
+	for _, id := range skipped {
+		fmt.Printf("Kept image %s, which is still in use\n", id)
+	}
+	if err := store.ApplyGC(plan); err != nil {
+		return err
+	}
+
+	layersAfter, _, err := dockerClient.ImageDiskUsage(ctx)
+	if err != nil {
+		return err
+	}
+	reclaimed := plan.FileSize
+	if layersBefore > layersAfter {
+		reclaimed += layersBefore - layersAfter
+	}
+	fmt.Printf("Removed %d image(s), %d cache entries, %d history record(s) and %d file(s), reclaiming %s\n",
+		len(removed), len(plan.CacheEntries), plan.Records, len(plan.Files), formatBytes(reclaimed))
+	return nil
+}
+
+// loadProject finds, parses and validates the project config
+func loadProject(projectRoot string) (*types.Project, error) {
+	configPath, err := config.FindConfigFile(projectRoot)
+	if err != nil {
+		return nil, err
+	}
+	project, err := config.Parse(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if err := config.Validate(project); err != nil {
+		return nil, fmt.Errorf("config validation failed: %w", err)
+	}
+	return project, nil
+}
+
+// cmdDoctor checks the integrity of the store and the Docker daemon, and with --fix
+// repairs what it can. It runs without the project config when the config does not load,
+// since a broken project is what it is for.
+func cmdDoctor(ctx context.Context, args []string, projectRoot string) error {
+	doctorFlags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fix := doctorFlags.Bool("fix", false, "Repair the problems that can be repaired")
+
+	if err := doctorFlags.Parse(args); err != nil {
+		return err
+	}
+
+	projectStore := store.New(projectRoot)
+	if err := projectStore.Init(); err != nil {
+		return fmt.Errorf("failed to initialize project store: %w", err)
+	}
+	defer projectStore.Close()
+	reportLayoutUpgrades(projectStore)
+	recoverInterrupted(projectStore)
+	if *fix {
+		lock, err := projectStore.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	layout := projectStore.Layout()
+	fmt.Printf("Store: layout version %d, %s backend\n", layout.Version, layout.Backend)
+
+	// Without the config, no block is known to be deleted
+	var opts store.CheckOptions
+	remaining := 0
+	if project, err := loadProject(projectRoot); err != nil {
+		fmt.Printf("Config: %v\n", err)
+		fmt.Println("Skipped checking for deleted blocks, since the config does not load")
+		remaining++
+	} else {
+		opts.Blocks = gcOptions(project, 0).Blocks
+	}
+
+	var info *docker.DaemonInfo
+	dockerClient, err := docker.NewClient()
+	if err == nil {
+		defer dockerClient.Close()
+		info, err = dockerClient.DaemonInfo(ctx)
+	}
+	switch {
+	case err != nil:
+		fmt.Printf("Docker: %v\n", err)
+		fmt.Println("Skipped checking block images, since Docker is unreachable")
+		remaining++
+	case !info.Supported():
+		fmt.Printf("Docker: %s with API %s, older than the API %s dockstep needs\n", info.Version, info.APIVersion, docker.MinAPIVersion)
+		remaining++
+	default:
+		fmt.Printf("Docker: %s with API %s (using %s) on %s/%s\n", info.Version, info.APIVersion, info.ClientVersion, info.OS, info.Arch)
+		opts.ImageExists = dockerClient.ImageExists
+	}
+
+	problems, err := projectStore.CheckIntegrity(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to check the store: %w", err)
+	}
+	fixable := 0
+	for _, problem := range problems {
+		if problem.Fixable() {
+			fixable++
+			fmt.Printf("  %s\n", problem)
+		} else {
+			fmt.Printf("  %s (cannot be fixed)\n", problem)
+		}
+	}
+	remaining += len(problems)
+
+	if *fix && fixable > 0 {
+		fixed, err := projectStore.FixProblems(problems)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Fixed %d problem(s)\n", fixed)
+		remaining -= fixed
+	} else if fixable > 0 {
+		fmt.Printf("Run 'dockstep doctor --fix' to fix %d problem(s)\n", fixable)
+	}
+
+	if remaining > 0 {
+		return fmt.Errorf("%d problem(s) remain", remaining)
+	}
+	fmt.Println("No problems found")
+	return nil
+}
+
+// openSharedCache opens the machine-wide cache
+func openSharedCache() (*store.Cache, error) {
+	dir, err := store.SharedCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	return store.OpenSharedCache(dir)
+}
+
+// sharedImages returns the digests of the images in the machine-wide cache
+func sharedImages() (map[string]bool, error) {
+	cache, err := openSharedCache()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := cache.Entries()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shared cache: %w", err)
+	}
+	digests := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		digests[entry.Digest] = true
+	}
+	return digests, nil
+}
+
+// gcOptions returns the garbage collection options for the blocks of a project
+func gcOptions(project *types.Project, keep int) store.GCOptions {
+	opts := store.GCOptions{Keep: keep, Blocks: []string{}, Now: time.Now()}
+	for _, block := range project.Blocks {
+		opts.Blocks = append(opts.Blocks, block.ID)
+	}
+	return opts
+}
+
+// formatBytes formats a size in bytes with a binary unit, such as 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 // cmdExportImage tags and pushes an image
 func cmdExportImage(ctx context.Context, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
 	if len(args) == 0 {
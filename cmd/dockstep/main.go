@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"dockstep.dev/config"
 	"dockstep.dev/docker"
@@ -23,8 +25,25 @@ var (
 var (
 	projectPath = flag.String("project", ".", "Project root directory")
 	contextName = flag.String("context", "", "Docker context name")
+	setFlags    stringListFlag
 )
 
+// stringListFlag collects the values of a repeatable flag
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func init() {
+	flag.Var(&setFlags, "set", "Override a variable or build arg (key=value, repeatable)")
+}
+
 func main() {
 	// Check for help flags before parsing other flags
 	for _, arg := range os.Args[1:] {
@@ -59,6 +78,42 @@ func main() {
 			os.Exit(1)
 		}
 		return
+	case "import":
+		if err := cmdImport(args, projectRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "migrate":
+		if err := cmdMigrate(args, projectRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "store":
+		if err := cmdStore(args, projectRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "schema":
+		if err := cmdSchema(args); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "doctor":
+		if err := cmdDoctor(context.Background(), args, projectRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	case "validate":
+		if err := cmdValidate(args, projectRoot); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		return
 	case "version", "--version", "-v":
 		printVersion()
 		return
@@ -89,6 +144,21 @@ func main() {
 		os.Exit(2)
 	}
 
+	// Commands that only need the config
+	if command == "lint" {
+		if err := cmdLint(args, project); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	overrides, err := config.ParseOverrides(setFlags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
 	// Create Docker client
 	dockerClient, err := docker.NewClient()
 	if err != nil {
@@ -107,6 +177,8 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Error: failed to initialize project store: %v\n", err)
 		os.Exit(1)
 	}
+	reportLayoutUpgrades(store)
+	recoverInterrupted(store)
 
 	// Create engine with context path
 	var eng *engine.Engine
@@ -121,16 +193,29 @@ func main() {
 	} else {
 		eng = engine.NewEngine(dockerClient, store, project, projectRoot)
 	}
+	eng.SetVariables(overrides)
 
 	// Execute command
 	ctx := context.Background()
-	if err := executeCommand(ctx, command, args, eng, store, dockerClient); err != nil {
+	err = executeCommand(ctx, command, args, eng, store, dockerClient)
+	if closeErr := store.Close(); closeErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to close project store: %v\n", closeErr)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
 func executeCommand(ctx context.Context, command string, args []string, engine *engine.Engine, store *store.Store, dockerClient *docker.Client) error {
+	if changesStore(command, args) {
+		lock, err := store.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
 	switch command {
 	case "status":
 		return cmdStatus(ctx, args, engine, store)
@@ -146,11 +231,49 @@ func executeCommand(ctx context.Context, command string, args []string, engine *
 		return cmdUI(args, engine, store, dockerClient)
 	case "export":
 		return cmdExport(ctx, args, engine, store, dockerClient)
+	case "lock":
+		return cmdLock(ctx, args, engine, store, dockerClient)
+	case "gc":
+		return cmdGC(ctx, args, engine, store, dockerClient)
+	case "cache":
+		return cmdCache(ctx, args, engine, store, dockerClient)
 	default:
 		return fmt.Errorf("unknown command: %s", command)
 	}
 }
 
+// changesStore reports whether a command changes the project's store, and so must hold the
+// project lock while it runs
+func changesStore(command string, args []string) bool {
+	switch command {
+	case "up", "run", "gc":
+		return true
+	case "cache":
+		return len(args) > 0 && (args[0] == "verify" || args[0] == "import")
+	}
+	return false
+}
+
+// recoverInterrupted marks runs whose process died as interrupted and removes what they
+// left behind, unless another process holds the project lock and may still be running them
+func recoverInterrupted(s *store.Store) {
+	report, err := s.RecoverIdle(time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to recover interrupted runs: %v (run 'dockstep doctor' to check the store)\n", err)
+		return
+	}
+	for _, id := range report.Interrupted {
+		fmt.Fprintf(os.Stderr, "Warning: the last run of block %s was interrupted; marked it as failed\n", id)
+	}
+}
+
+// reportLayoutUpgrades tells the user about the migrations that upgraded an older .dockstep
+func reportLayoutUpgrades(s *store.Store) {
+	for _, upgrade := range s.LayoutUpgrades() {
+		fmt.Fprintf(os.Stderr, "Upgraded the .dockstep layout: %s\n", upgrade)
+	}
+}
+
 func printUsage() {
 	fmt.Fprintf(os.Stderr, `dockstep - interactive, incremental Docker image builder
 
@@ -159,19 +282,39 @@ Usage:
 
 Commands:
   init                    Create skeleton dockstep.yaml and .dockstep/
+                          (--from-dockerfile <path> to generate blocks from a Dockerfile)
+  import <Dockerfile>     Generate dockstep.yaml from an existing Dockerfile
+                          (--split-on stage|comment|every-run, --output, --force)
+  import image <ref>      Reconstruct blocks from a local image's layer history
   status                  Show ordered blocks with state
-  up                      Execute blocks in order
-  run <id>                Execute a single block
+  up                      Execute blocks in order (--only <ids> to select blocks,
+                          --resume to continue from the first block that did not finish)
+  run <id>                Execute a single block (or every variant of a matrix block)
   logs <id>               Print logs for a block
   diff <id>               Show filesystem changes for a block
   ui                      Launch local UI server
   export dockerfile <id>  Generate Dockerfile for a block and its ancestry
+                          (--multi-stage <id>... for one stage per block)
   export image <id>        Tag and push image
+  lock                    Pin base images to registry digests in dockstep.lock
+  gc                      Remove images, cache entries, snapshots and logs no longer referenced
+                          (--keep <n>, --older-than <age>, --dry-run)
+  cache verify            Check that cached images still exist and evict missing ones (--dry-run, --shared)
+  cache export <target>   Bundle cached images into a tarball (.tar, .tar.gz, - for stdout) or a registry repository
+  cache import <source>   Restore cached images from a tarball or registry repository
+  lint                    Check blocks against the lint rules (--json for machine output)
+  validate [file]         Check a config file without Docker (--json for editor integrations)
+  schema                  Print the JSON Schema for dockstep.yaml (--output <file>)
+  migrate                 Upgrade dockstep.yaml to the current schema version (--dry-run to print a diff)
+  doctor                  Check the store's integrity and the Docker daemon (--fix to repair)
+  store                   Show the backend the project's .dockstep/ store uses
+  store migrate --to <b>  Move the store to another backend (file or bolt)
   version                 Show version information
 
 Global flags:
   --project <path>         Project root directory (default: .)
   --context <docker-context> Docker context name
+  --set <key=value>        Override a variable or build arg (repeatable)
   --quiet                  Reduce output
   --no-color               Disable ANSI colors
   --debug                  Enable debug output
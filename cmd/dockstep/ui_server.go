@@ -16,13 +16,12 @@ import (
 	"sync"
 	"time"
 
-	yaml "gopkg.in/yaml.v3"
-
 	assets "dockstep.dev"
 	"dockstep.dev/config"
 	"dockstep.dev/docker"
 	"dockstep.dev/engine"
 	"dockstep.dev/export"
+	"dockstep.dev/lint"
 	"dockstep.dev/store"
 	"dockstep.dev/types"
 )
@@ -90,6 +89,7 @@ func (s *uiServer) routes() http.Handler {
 		mux.HandleFunc("/api/config", s.requireAuth(s.handleConfig))
 		mux.HandleFunc("/api/history", s.requireAuth(s.handleHistory))
 		mux.HandleFunc("/api/lineage", s.requireAuth(s.handleLineage))
+		mux.HandleFunc("/api/lint", s.requireAuth(s.handleLint))
 	} else {
 		// No authentication required
 		mux.HandleFunc("/api/project", s.handleProject)
@@ -105,6 +105,7 @@ func (s *uiServer) routes() http.Handler {
 		mux.HandleFunc("/api/config", s.handleConfig)
 		mux.HandleFunc("/api/history", s.handleHistory)
 		mux.HandleFunc("/api/lineage", s.handleLineage)
+		mux.HandleFunc("/api/lint", s.handleLint)
 	}
 
 	// Static UI: serve built SPA when present; fallback to placeholder
@@ -182,6 +183,7 @@ func (s *uiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
 		}
 		nb := types.Block{ID: body.ID, From: body.From, FromBlock: body.FromBlock, FromBlockVersion: body.FromBlockVersion, Context: body.Context, Instructions: []string{"RUN echo 'new block'"}}
 		proj.Blocks = append(proj.Blocks, nb)
+		config.ApplyDefaults(proj)
 		cfgPath := s.store.RootPath() + "/dockstep.yaml"
 		if err := config.Validate(proj); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
@@ -223,6 +225,14 @@ func (s *uiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
 		found := false
 		for i := range proj.Blocks {
 			if proj.Blocks[i].ID == idv {
+				if src := proj.Blocks[i].Source; src != "" {
+					http.Error(w, fmt.Sprintf("block %s is defined in included file %s", idv, src), http.StatusBadRequest)
+					return
+				}
+				if template := proj.Blocks[i].Template; template != nil {
+					http.Error(w, fmt.Sprintf("block %s is a variant of matrix block %s; edit the matrix block in dockstep.yaml", idv, template.ID), http.StatusBadRequest)
+					return
+				}
 				if v, ok := body["instructions"].([]any); ok {
 					var out []string
 					for _, e := range v {
@@ -231,6 +241,8 @@ func (s *uiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
 						}
 					}
 					proj.Blocks[i].Instructions = out
+					// Lines in the config file no longer match the edited instructions
+					proj.Blocks[i].InstructionPositions = nil
 				}
 				// Also handle 'cmd' field for backward compatibility
 				if v, ok := body["cmd"].(string); ok && v != "" {
@@ -258,18 +270,28 @@ func (s *uiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// Re-validate and persist
+		config.ApplyDefaults(proj)
 		// Find config file from store root
 		cfgPath := s.store.RootPath() + "/dockstep.yaml"
 		if err := config.Validate(proj); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		findings, err := lint.Lint(proj)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		if err := config.Write(proj, cfgPath); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Return lint findings for the block so the UI can show them inline
 		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(proj)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"project": proj,
+			"lint":    lint.ForBlock(proj, findings, idv),
+		})
 	case http.MethodDelete:
 		id := r.URL.Query().Get("id")
 		if id == "" {
@@ -281,6 +303,14 @@ func (s *uiServer) handleBlock(w http.ResponseWriter, r *http.Request) {
 		found := false
 		for i, b := range proj.Blocks {
 			if b.ID == id {
+				if b.Source != "" {
+					http.Error(w, fmt.Sprintf("block %s is defined in included file %s", id, b.Source), http.StatusBadRequest)
+					return
+				}
+				if b.Template != nil {
+					http.Error(w, fmt.Sprintf("block %s is a variant of matrix block %s; edit the matrix block in dockstep.yaml", id, b.Template.ID), http.StatusBadRequest)
+					return
+				}
 				proj.Blocks = append(proj.Blocks[:i], proj.Blocks[i+1:]...)
 				found = true
 				break
@@ -347,12 +377,33 @@ func (s *uiServer) handleExportDockerfile(w http.ResponseWriter, r *http.Request
 		return
 	}
 	var body struct {
-		EndBlockID   string `json:"endBlockId"`
-		CollapseRuns bool   `json:"collapseRuns"`
-		PinDigests   bool   `json:"pinDigests"`
+		EndBlockID   string   `json:"endBlockId"`
+		Targets      []string `json:"targets"`
+		CollapseRuns bool     `json:"collapseRuns"`
+		PinDigests   bool     `json:"pinDigests"`
+		MultiStage   bool     `json:"multiStage"`
 	}
 	_ = json.NewDecoder(r.Body).Decode(&body)
-	content, err := export.GenerateDockerfile(s.engine.GetProject(), body.EndBlockID, types.DockerfileOptions{CollapseRuns: body.CollapseRuns, PinDigests: body.PinDigests})
+	opts := types.DockerfileOptions{CollapseRuns: body.CollapseRuns, PinDigests: body.PinDigests, MultiStage: body.MultiStage, Variables: s.engine.Variables()}
+	if opts.PinDigests {
+		digests, err := baseDigests(s.store)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		opts.Digests = digests
+	}
+	var content string
+	var err error
+	if opts.MultiStage {
+		targets := body.Targets
+		if len(targets) == 0 && body.EndBlockID != "" {
+			targets = []string{body.EndBlockID}
+		}
+		content, err = export.GenerateMultiStageDockerfile(s.engine.GetProject(), targets, opts)
+	} else {
+		content, err = export.GenerateDockerfile(s.engine.GetProject(), body.EndBlockID, opts)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -381,9 +432,12 @@ func (s *uiServer) handleDockerfileByDigest(w http.ResponseWriter, r *http.Reque
 }
 
 func (s *uiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	// Runs whose process died would otherwise show as running forever
+	_, _ = s.store.RecoverIdle(time.Now())
 	states, _ := s.store.GetBlockStates()
 	type item struct {
 		ID         string            `json:"id"`
+		Template   string            `json:"template,omitempty"`
 		Status     types.BlockStatus `json:"status"`
 		Digest     string            `json:"digest,omitempty"`
 		Hash       string            `json:"hash,omitempty"`
@@ -395,6 +449,9 @@ func (s *uiServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	for _, b := range s.engine.GetProject().Blocks {
 		st, ok := states[b.ID]
 		it := item{ID: b.ID, Status: types.StatusPending}
+		if b.Template != nil {
+			it.Template = b.Template.ID
+		}
 		if ok {
 			it.Status = st.Status
 			it.Digest = st.Digest
@@ -423,11 +480,19 @@ func (s *uiServer) handleUp(w http.ResponseWriter, r *http.Request) {
 		Force           bool   `json:"force"`
 		From            string `json:"from"`
 		ContinueOnError bool   `json:"continueOnError"`
+		Resume          bool   `json:"resume"`
 	}
 	_ = json.NewDecoder(r.Body).Decode(&req)
+	lock, err := s.store.Lock()
+	if err != nil {
+		s.setBusy(false)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	go func() {
 		defer s.setBusy(false)
-		_ = s.engine.RunUp(r.Context(), types.UpOptions{Force: req.Force, FromBlock: req.From, ContinueOnError: req.ContinueOnError})
+		defer lock.Unlock()
+		_ = s.engine.RunUp(r.Context(), types.UpOptions{Force: req.Force, FromBlock: req.From, ContinueOnError: req.ContinueOnError, Resume: req.Resume})
 	}()
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -453,7 +518,13 @@ func (s *uiServer) handleRun(w http.ResponseWriter, r *http.Request) {
 	}
 	// Run synchronously; keep connection open and return final result
 	defer s.setBusy(false)
-	err := s.engine.RunBlock(r.Context(), req.ID, types.RunOptions{Force: req.Force, KeepContainer: req.KeepContainer})
+	lock, err := s.store.Lock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	defer lock.Unlock()
+	err = s.engine.RunBlock(r.Context(), req.ID, types.RunOptions{Force: req.Force, KeepContainer: req.KeepContainer})
 	st, _ := s.store.LoadBlockState(req.ID)
 	w.Header().Set("Content-Type", "application/json")
 	if err != nil || (st != nil && st.Status == types.StatusFailed) {
@@ -631,16 +702,21 @@ func (s *uiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// parse to ensure valid and to apply defaults
-		var p types.Project
-		if err := yaml.Unmarshal(body, &p); err != nil {
+		p, err := config.ParseData(body, cfgPath)
+		if err != nil {
 			http.Error(w, fmt.Sprintf("yaml error: %v", err), http.StatusBadRequest)
 			return
 		}
-		if err := config.Validate(&p); err != nil {
+		if err := config.Validate(p); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := os.WriteFile(cfgPath, body, 0644); err != nil {
+		findings, err := lint.Lint(p)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := config.WriteData(cfgPath, body); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -649,12 +725,37 @@ func (s *uiServer) handleConfig(w http.ResponseWriter, r *http.Request) {
 		if err == nil {
 			s.engine.SetProject(proj)
 		}
-		w.WriteHeader(http.StatusNoContent)
+		if findings == nil {
+			findings = []lint.Finding{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"lint": findings})
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// handleLint returns the lint findings for the project, or for one block with ?id=
+func (s *uiServer) handleLint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	proj := s.engine.GetProject()
+	findings, err := lint.Lint(proj)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if id := r.URL.Query().Get("id"); id != "" {
+		findings = lint.ForBlock(proj, findings, id)
+	} else if findings == nil {
+		findings = []lint.Finding{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(findings)
+}
+
 func (s *uiServer) handleHistory(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -6,30 +6,74 @@ import (
 	"path/filepath"
 
 	"dockstep.dev/types"
-	yaml "gopkg.in/yaml.v3"
 )
 
-// Parse loads and unmarshals a dockstep.yaml file
+// Parse loads and unmarshals a dockstep.yaml file, printing deprecation warnings to stderr
 func Parse(path string) (*types.Project, error) {
+	project, warnings, err := ParseWithWarnings(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s: %s (run 'dockstep migrate' to update the config)\n", path, warning)
+	}
+	return project, nil
+}
+
+// ParseWithWarnings loads and unmarshals a dockstep.yaml file, returning the deprecation
+// warnings for the legacy shapes found in it and its includes
+func ParseWithWarnings(path string) (*types.Project, []string, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+		return nil, nil, fmt.Errorf("failed to read config file %s: %w", path, err)
 	}
+	return parseData(data, path)
+}
+
+// ParseData unmarshals dockstep.yaml content, loads included blocks and expands
+// matrix blocks. The path is where the content lives; includes are resolved relative to it.
+// Legacy config shapes are upgraded in memory.
+func ParseData(data []byte, path string) (*types.Project, error) {
+	project, _, err := parseData(data, path)
+	return project, err
+}
 
+// parseData parses config content and returns the deprecation warnings for the legacy
+// shapes found in it and its includes
+func parseData(data []byte, path string) (*types.Project, []string, error) {
 	var project types.Project
-	if err := yaml.Unmarshal(data, &project); err != nil {
-		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	warnings, err := decodeConfig(data, &project)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Load included blocks ahead of the project's own blocks
+	if len(project.Include) > 0 {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve config path %s: %w", path, err)
+		}
+		loader := &includeLoader{root: filepath.Dir(abs), stack: []string{abs}}
+		included, vars, err := loader.load(project.Include, filepath.Dir(abs))
+		if err != nil {
+			return nil, nil, err
+		}
+		project.Blocks = append(included, project.Blocks...)
+		project.IncludedVariables = vars
+		warnings = append(warnings, loader.warnings...)
 	}
 
-	// Apply defaults
-	applyDefaults(&project)
+	// Expand matrix blocks into concrete variants
+	blocks, err := expandMatrix(project.Blocks)
+	if err != nil {
+		return nil, nil, err
+	}
+	project.Blocks = blocks
 
-	return &project, nil
-}
+	// Apply project settings to blocks
+	ApplyDefaults(&project)
 
-// applyDefaults sets default values for optional fields
-func applyDefaults(project *types.Project) {
-	// No defaults needed for simplified schema
+	return &project, warnings, nil
 }
 
 // FindConfigFile searches for dockstep.yaml in the given directory and parent directories
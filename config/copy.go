@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// CopyRefs returns the blocks a block copies files from, in declaration order without
+// duplicates: every copy_from entry, and every COPY --from flag that names a project block.
+// A --from naming anything else (e.g. an image) is left to Docker.
+func CopyRefs(project *types.Project, block types.Block) []string {
+	seen := make(map[string]bool)
+	var refs []string
+	add := func(ref string) {
+		if ref != "" && !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	for _, entry := range block.CopyFrom {
+		add(entry.Block)
+	}
+	for _, instruction := range block.Instructions {
+		if ref, ok := copyFromFlag(instruction); ok && isBlockRef(project, ref) {
+			add(ref)
+		}
+	}
+	return refs
+}
+
+// ResolveCopyRef returns the ID of the block a copy reference points to. A matrix block ID
+// resolves to the single variant whose matrix values agree with the copying block's own.
+func ResolveCopyRef(project *types.Project, block types.Block, ref string) (string, error) {
+	var variants []string
+	var matches []string
+	for _, b := range project.Blocks {
+		if b.ID == ref {
+			return ref, nil
+		}
+		if b.Template == nil || b.Template.ID != ref {
+			continue
+		}
+		variants = append(variants, b.ID)
+		if variantAgrees(b.Variant, block.Variant) {
+			matches = append(matches, b.ID)
+		}
+	}
+
+	if len(variants) == 0 {
+		return "", fmt.Errorf("copy_from block '%s' does not exist", ref)
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("'%s' is a matrix block, copy from one of its variants: %s", ref, strings.Join(variants, ", "))
+}
+
+// RewriteCopyFrom replaces the --from reference of a COPY instruction with rename(ref).
+// Other instructions are returned unchanged.
+func RewriteCopyFrom(instruction string, rename func(ref string) string) string {
+	ref, ok := copyFromFlag(instruction)
+	if !ok {
+		return instruction
+	}
+	replacement := rename(ref)
+	if replacement == ref {
+		return instruction
+	}
+	return strings.Replace(instruction, "--from="+ref, "--from="+replacement, 1)
+}
+
+// copyFromFlag returns the value of the --from flag of a COPY instruction
+func copyFromFlag(instruction string) (string, bool) {
+	fields := strings.Fields(instruction)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "COPY") {
+		return "", false
+	}
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			break
+		}
+		if ref, ok := strings.CutPrefix(field, "--from="); ok {
+			return ref, ref != ""
+		}
+	}
+	return "", false
+}
+
+// isBlockRef reports whether ref names a block or a matrix block of the project
+func isBlockRef(project *types.Project, ref string) bool {
+	for _, b := range project.Blocks {
+		if b.ID == ref || b.TemplateID() == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// variantAgrees reports whether two sets of matrix values agree on every key they share
+func variantAgrees(a, b map[string]string) bool {
+	for key, value := range a {
+		if other, ok := b[key]; ok && other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// validateCopyFrom checks a block's copy_from entries and the blocks it copies from
+func validateCopyFrom(project *types.Project, block types.Block) error {
+	for _, entry := range block.CopyFrom {
+		if entry.Block == "" || entry.Src == "" || entry.Dst == "" {
+			return fmt.Errorf("copy_from entries require block, src and dst")
+		}
+	}
+	for _, ref := range CopyRefs(project, block) {
+		id, err := ResolveCopyRef(project, block, ref)
+		if err != nil {
+			return err
+		}
+		if id == block.ID {
+			return fmt.Errorf("block cannot copy from itself")
+		}
+	}
+	return nil
+}
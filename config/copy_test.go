@@ -0,0 +1,156 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+const copyConfig = `version: "1.0"
+name: "copy"
+
+blocks:
+  - id: "builder"
+    from: "golang:${go}"
+    matrix:
+      go: ["1.21", "1.22"]
+    instructions:
+      - "RUN go build -o /out/app ./cmd/app"
+
+  - id: "assets"
+    from: "node:20"
+    instructions:
+      - "RUN npm run build"
+
+  - id: "runtime"
+    from: "alpine:3.19"
+    matrix:
+      go: ["1.21", "1.22"]
+    copy_from:
+      - block: "builder"
+        src: "/out/app"
+        dst: "/usr/bin/app"
+    instructions:
+      - "COPY --from=assets /app/dist /srv/www"
+      - "COPY --from=nginx:1.25 /etc/nginx/nginx.conf /etc/nginx/"
+`
+
+func TestCopyRefs(t *testing.T) {
+	project, err := ParseData([]byte(copyConfig), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := Validate(project); err != nil {
+		t.Fatalf("Expected valid project, got %v", err)
+	}
+
+	runtime := project.Blocks[4]
+	if runtime.ID != "runtime[go=1.22]" {
+		t.Fatalf("Expected runtime[go=1.22], got %s", runtime.ID)
+	}
+
+	// Image references in COPY --from are left to Docker
+	refs := CopyRefs(project, runtime)
+	if !reflect.DeepEqual(refs, []string{"builder", "assets"}) {
+		t.Errorf("CopyRefs() = %v, want [builder assets]", refs)
+	}
+
+	// A matrix block resolves to the variant with the same matrix values
+	id, err := ResolveCopyRef(project, runtime, "builder")
+	if err != nil {
+		t.Fatalf("Failed to resolve copy reference: %v", err)
+	}
+	if id != "builder[go=1.22]" {
+		t.Errorf("Expected builder[go=1.22], got %s", id)
+	}
+
+	// Without matching values the variant must be named
+	if _, err := ResolveCopyRef(project, project.Blocks[2], "builder"); err == nil {
+		t.Error("Expected error for ambiguous matrix reference")
+	}
+}
+
+func TestRewriteCopyFrom(t *testing.T) {
+	rename := func(ref string) string { return "stage-" + ref }
+
+	tests := map[string]string{
+		"COPY --from=builder /out/app /usr/bin/app":             "COPY --from=stage-builder /out/app /usr/bin/app",
+		"copy --chown=app --from=builder /out /opt":             "copy --chown=app --from=stage-builder /out /opt",
+		"COPY ./--from=builder /dst":                            "COPY ./--from=builder /dst",
+		"RUN echo --from=builder":                               "RUN echo --from=builder",
+		"COPY --link --from=builder /out/app /usr/bin/--from=x": "COPY --link --from=stage-builder /out/app /usr/bin/--from=x",
+	}
+	for input, want := range tests {
+		if got := RewriteCopyFrom(input, rename); got != want {
+			t.Errorf("RewriteCopyFrom(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+func TestValidateCopyFrom(t *testing.T) {
+	base := func() *types.Project {
+		return &types.Project{
+			Version: "1.0",
+			Name:    "test",
+			Blocks: []types.Block{
+				{ID: "builder", From: "golang:1.22", Instructions: []string{"RUN go build -o /out/app"}},
+				{ID: "runtime", From: "alpine:3.19", Instructions: []string{"RUN true"}},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		edit    func(p *types.Project)
+		wantErr string
+	}{
+		"valid": {
+			edit: func(p *types.Project) {
+				p.Blocks[1].CopyFrom = []types.CopyFrom{{Block: "builder", Src: "/out/app", Dst: "/app"}}
+			},
+		},
+		"missing block": {
+			edit: func(p *types.Project) {
+				p.Blocks[1].CopyFrom = []types.CopyFrom{{Block: "missing", Src: "/out/app", Dst: "/app"}}
+			},
+			wantErr: "does not exist",
+		},
+		"incomplete entry": {
+			edit: func(p *types.Project) {
+				p.Blocks[1].CopyFrom = []types.CopyFrom{{Block: "builder", Src: "/out/app"}}
+			},
+			wantErr: "require block, src and dst",
+		},
+		"itself": {
+			edit: func(p *types.Project) {
+				p.Blocks[1].Instructions = []string{"COPY --from=runtime /a /b"}
+			},
+			wantErr: "itself",
+		},
+		"cycle": {
+			edit: func(p *types.Project) {
+				p.Blocks[0].CopyFrom = []types.CopyFrom{{Block: "runtime", Src: "/a", Dst: "/b"}}
+				p.Blocks[1].Instructions = []string{"COPY --from=builder /out/app /app"}
+			},
+			wantErr: "circular dependency",
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			project := base()
+			tt.edit(project)
+			err := Validate(project)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected valid project, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// namespacePattern matches valid include namespaces
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// includeLoader loads included files while tracking the include chain
+type includeLoader struct {
+	root  string   // project directory, used to display file names
+	stack []string // absolute paths of the files being loaded, for cycle detection
+	// warnings are the deprecation warnings for legacy shapes in the included files
+	warnings []string
+}
+
+// load returns the blocks and variables of the given includes, resolved relative to baseDir.
+// Blocks keep the order in which they are included.
+func (l *includeLoader) load(includes []types.Include, baseDir string) ([]types.Block, map[string]string, error) {
+	var blocks []types.Block
+	vars := make(map[string]string)
+
+	for _, include := range includes {
+		if include.Path == "" {
+			return nil, nil, fmt.Errorf("%s: include path is required", l.current())
+		}
+		if include.Namespace != "" && !namespacePattern.MatchString(include.Namespace) {
+			return nil, nil, fmt.Errorf("%s: invalid include namespace: %s", l.current(), include.Namespace)
+		}
+
+		path := include.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		files, err := includeFiles(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", l.current(), err)
+		}
+
+		var included []types.Block
+		for _, file := range files {
+			fileBlocks, fileVars, err := l.loadFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			included = append(included, fileBlocks...)
+			for name, value := range fileVars {
+				vars[name] = value
+			}
+		}
+
+		blocks = append(blocks, qualifyBlocks(included, include)...)
+	}
+
+	return blocks, vars, nil
+}
+
+// loadFile loads the blocks of a single included file, including its own includes
+func (l *includeLoader) loadFile(path string) ([]types.Block, map[string]string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to resolve include %s: %w", path, err)
+	}
+	for i, seen := range l.stack {
+		if seen == abs {
+			var chain []string
+			for _, p := range l.stack[i:] {
+				chain = append(chain, l.display(p))
+			}
+			chain = append(chain, l.display(abs))
+			return nil, nil, fmt.Errorf("include cycle detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: failed to read include: %w", l.current(), err)
+	}
+	var included types.Project
+	warnings, err := decodeConfig(data, &included)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", l.display(abs), err)
+	}
+	for _, warning := range warnings {
+		l.warnings = append(l.warnings, l.display(abs)+": "+warning)
+	}
+
+	l.stack = append(l.stack, abs)
+	nested, vars, err := l.load(included.Include, filepath.Dir(abs))
+	l.stack = l.stack[:len(l.stack)-1]
+	if err != nil {
+		return nil, nil, err
+	}
+
+	source := l.display(abs)
+	for i := range included.Blocks {
+		included.Blocks[i].Source = source
+	}
+	for name, value := range included.Variables {
+		vars[name] = value
+	}
+
+	return append(nested, included.Blocks...), vars, nil
+}
+
+// current returns the display name of the file whose includes are being loaded
+func (l *includeLoader) current() string {
+	return l.display(l.stack[len(l.stack)-1])
+}
+
+// display returns a file path relative to the project directory when possible
+func (l *includeLoader) display(path string) string {
+	if rel, err := filepath.Rel(l.root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// includeFiles returns the YAML files an include path refers to
+func includeFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include: %w", err)
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read include directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yaml" || ext == ".yml") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// qualifyBlocks applies an include's prefix and namespace to block IDs and to the
+// references between the included blocks
+func qualifyBlocks(blocks []types.Block, include types.Include) []types.Block {
+	if include.Namespace == "" && include.Prefix == "" {
+		return blocks
+	}
+
+	renamed := make(map[string]string, len(blocks))
+	for i := range blocks {
+		id := include.Prefix + blocks[i].ID
+		if include.Namespace != "" {
+			id = include.Namespace + "." + id
+		}
+		renamed[blocks[i].ID] = id
+		blocks[i].ID = id
+	}
+	rename := func(ref string) string { return renameReference(ref, renamed) }
+	for i := range blocks {
+		blocks[i].FromBlock = rename(blocks[i].FromBlock)
+		for j := range blocks[i].CopyFrom {
+			blocks[i].CopyFrom[j].Block = rename(blocks[i].CopyFrom[j].Block)
+		}
+		for j, instruction := range blocks[i].Instructions {
+			blocks[i].Instructions[j] = RewriteCopyFrom(instruction, rename)
+		}
+	}
+	return blocks
+}
+
+// renameReference renames a block reference, including references to a single matrix variant
+func renameReference(ref string, renamed map[string]string) string {
+	if id, ok := renamed[ref]; ok {
+		return id
+	}
+	if base, variant, ok := strings.Cut(ref, "["); ok {
+		if id, ok := renamed[base]; ok {
+			return id + "[" + variant
+		}
+	}
+	return ref
+}
+
+// sourceName returns the display name of the file a block was declared in
+func sourceName(block types.Block) string {
+	if block.Source == "" {
+		return "dockstep.yaml"
+	}
+	return block.Source
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes test files relative to dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeFiles(t, tmpDir, map[string]string{
+		"dockstep.yaml": `version: "1.0"
+name: "app"
+include:
+  - path: "shared/platform.yaml"
+    namespace: "platform"
+  - path: "shared/tools"
+    prefix: "tools-"
+blocks:
+  - id: "app"
+    from_block: "platform.base"
+    instructions:
+      - "RUN echo ${distro}"
+`,
+		"shared/platform.yaml": `version: "1.0"
+name: "platform"
+variables:
+  distro: "alpine"
+blocks:
+  - id: "os"
+    from: "alpine:3.19"
+    instructions: ["RUN apk update"]
+  - id: "base"
+    from_block: "os"
+    copy_from:
+      - {block: "os", src: "/etc/os-release", dst: "/etc/os-release.orig"}
+    instructions: ["RUN apk add curl"]
+`,
+		"shared/tools/b.yml": `version: "1.0"
+name: "tools"
+blocks:
+  - id: "lint"
+    from: "golang:1.22"
+    instructions: ["RUN go vet"]
+`,
+		"shared/tools/a.yaml": `version: "1.0"
+name: "tools"
+blocks:
+  - id: "fmt"
+    from: "golang:1.22"
+    instructions: ["RUN gofmt -l ."]
+`,
+		"shared/tools/notes.txt": "not a config file",
+	})
+
+	project, err := Parse(filepath.Join(tmpDir, "dockstep.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := Validate(project); err != nil {
+		t.Fatalf("Expected valid project, got %v", err)
+	}
+
+	var ids []string
+	for _, block := range project.Blocks {
+		ids = append(ids, block.ID)
+	}
+	want := []string{"platform.os", "platform.base", "tools-fmt", "tools-lint", "app"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("Block IDs = %v, want %v", ids, want)
+	}
+
+	// References between included blocks follow the namespace
+	if project.Blocks[1].FromBlock != "platform.os" {
+		t.Errorf("Expected from_block platform.os, got %s", project.Blocks[1].FromBlock)
+	}
+	if project.Blocks[1].CopyFrom[0].Block != "platform.os" {
+		t.Errorf("Expected copy_from platform.os, got %s", project.Blocks[1].CopyFrom[0].Block)
+	}
+	if project.Blocks[0].Source != "shared/platform.yaml" {
+		t.Errorf("Expected source shared/platform.yaml, got %s", project.Blocks[0].Source)
+	}
+	if project.Blocks[4].Source != "" {
+		t.Errorf("Expected project block to have no source, got %s", project.Blocks[4].Source)
+	}
+
+	// Included variables are available to project blocks
+	resolved := ResolveBlock(project, project.Blocks[4], nil)
+	if resolved.Instructions[0] != "RUN echo alpine" {
+		t.Errorf("Expected included variable, got %s", resolved.Instructions[0])
+	}
+
+	// Writing keeps included blocks out of the project file
+	out := filepath.Join(tmpDir, "written.yaml")
+	if err := Write(project, out); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if strings.Contains(string(data), "apk add curl") {
+		t.Errorf("Included blocks should not be written:\n%s", data)
+	}
+	written, err := ParseData(data, out)
+	if err != nil {
+		t.Fatalf("Failed to parse written config: %v", err)
+	}
+	if len(written.Blocks) != len(project.Blocks) {
+		t.Errorf("Expected %d blocks after round trip, got %d", len(project.Blocks), len(written.Blocks))
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	t.Run("cycle", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		writeFiles(t, tmpDir, map[string]string{
+			"dockstep.yaml": "version: \"1.0\"\nname: \"app\"\ninclude: [\"a.yaml\"]\nblocks: []\n",
+			"a.yaml":        "version: \"1.0\"\nname: \"a\"\ninclude: [\"b.yaml\"]\nblocks: []\n",
+			"b.yaml":        "version: \"1.0\"\nname: \"b\"\ninclude: [\"a.yaml\"]\nblocks: []\n",
+		})
+
+		_, err := Parse(filepath.Join(tmpDir, "dockstep.yaml"))
+		if err == nil {
+			t.Fatal("Expected include cycle error")
+		}
+		if !strings.Contains(err.Error(), "include cycle detected: a.yaml -> b.yaml -> a.yaml") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("duplicate ID", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		writeFiles(t, tmpDir, map[string]string{
+			"dockstep.yaml": `version: "1.0"
+name: "app"
+include: ["lib.yaml"]
+blocks:
+  - id: "base"
+    from: "alpine"
+    instructions: ["RUN true"]
+`,
+			"lib.yaml": `version: "1.0"
+name: "lib"
+blocks:
+  - id: "base"
+    from: "alpine"
+    instructions: ["RUN true"]
+`,
+		})
+
+		project, err := Parse(filepath.Join(tmpDir, "dockstep.yaml"))
+		if err != nil {
+			t.Fatalf("Failed to parse config: %v", err)
+		}
+		err = Validate(project)
+		if err == nil {
+			t.Fatal("Expected duplicate ID error")
+		}
+		if !strings.Contains(err.Error(), "lib.yaml") || !strings.Contains(err.Error(), "dockstep.yaml") {
+			t.Errorf("Expected error to name both files, got %v", err)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		writeFiles(t, tmpDir, map[string]string{
+			"dockstep.yaml": "version: \"1.0\"\nname: \"app\"\ninclude: [\"missing.yaml\"]\nblocks: []\n",
+		})
+		if _, err := Parse(filepath.Join(tmpDir, "dockstep.yaml")); err == nil {
+			t.Error("Expected error for missing include")
+		}
+	})
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"dockstep.dev/types"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// instructionKeywords are the Dockerfile instructions allowed in a block
+var instructionKeywords = map[string]bool{
+	"ADD": true, "ARG": true, "CMD": true, "COPY": true, "ENTRYPOINT": true, "ENV": true,
+	"EXPOSE": true, "HEALTHCHECK": true, "LABEL": true, "MAINTAINER": true, "ONBUILD": true,
+	"RUN": true, "SHELL": true, "STOPSIGNAL": true, "USER": true, "VOLUME": true, "WORKDIR": true,
+}
+
+// ValidationError is an invalid instruction, located in the file that declares it
+type ValidationError struct {
+	Block    string
+	Index    int    // position of the instruction in the block's instructions
+	Source   string // included file declaring the block, empty for the project's config
+	Position types.Position
+	Err      error
+}
+
+func (e *ValidationError) Error() string {
+	location := fmt.Sprintf("instructions[%d]", e.Index)
+	switch {
+	case e.Position.Line > 0 && e.Source != "":
+		location += fmt.Sprintf(" (%s:%d:%d)", e.Source, e.Position.Line, e.Position.Column)
+	case e.Position.Line > 0:
+		location += fmt.Sprintf(" (line %d, column %d)", e.Position.Line, e.Position.Column)
+	}
+	return fmt.Sprintf("block %s: %s: %v", e.Block, location, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// IsInstruction reports whether keyword names a Dockerfile instruction allowed in a block
+func IsInstruction(keyword string) bool {
+	return instructionKeywords[strings.ToUpper(keyword)]
+}
+
+// validateInstructions parses each instruction of a block against the Dockerfile grammar
+func validateInstructions(block types.Block) error {
+	for i, instruction := range block.Instructions {
+		if err := validateInstruction(instruction); err != nil {
+			verr := &ValidationError{Block: block.ID, Index: i, Source: block.Source, Err: err}
+			if i < len(block.InstructionPositions) {
+				verr.Position = block.InstructionPositions[i]
+			}
+			return verr
+		}
+	}
+	return nil
+}
+
+// validateInstruction checks that an instruction is a single, complete Dockerfile
+// instruction other than FROM, or a comment
+func validateInstruction(instruction string) error {
+	if strings.TrimSpace(instruction) == "" {
+		return fmt.Errorf("instruction is empty")
+	}
+	if isComment(instruction) {
+		return nil
+	}
+
+	parsed, err := parser.Parse(strings.NewReader(instruction))
+	if err != nil {
+		return fmt.Errorf("invalid instruction: %w", err)
+	}
+	if n := len(parsed.AST.Children); n > 1 {
+		return fmt.Errorf("entry holds %d instructions; put each in its own entry or check for a missing line continuation", n)
+	}
+
+	node := parsed.AST.Children[0]
+	keyword := strings.ToUpper(node.Value)
+	switch {
+	case keyword == "FROM":
+		return fmt.Errorf("FROM is not allowed in instructions; use 'from' or 'from_block' on the block")
+	case !instructionKeywords[keyword]:
+		if suggestion := suggestKeyword(keyword); suggestion != "" {
+			return fmt.Errorf("unknown instruction %s (did you mean %s?)", node.Value, suggestion)
+		}
+		return fmt.Errorf("unknown instruction %s", node.Value)
+	case node.Next == nil:
+		return fmt.Errorf("%s requires at least one argument", keyword)
+	}
+
+	// A trailing continuation would join this instruction with the next one
+	lines := strings.Split(strings.TrimRight(instruction, " \t\n"), "\n")
+	if len(node.Heredocs) == 0 && strings.HasSuffix(lines[len(lines)-1], "\\") {
+		return fmt.Errorf("instruction ends with a line continuation")
+	}
+	return nil
+}
+
+// isComment reports whether an instruction only holds comments
+func isComment(instruction string) bool {
+	for _, line := range strings.Split(instruction, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// suggestKeyword returns the instruction closest to an unknown keyword, if any is close
+func suggestKeyword(keyword string) string {
+	best, bestDistance := "", 3
+	for candidate := range instructionKeywords {
+		if d := editDistance(keyword, candidate); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+func TestValidateInstruction(t *testing.T) {
+	valid := []string{
+		"RUN apt-get update",
+		"run echo lowercase",
+		"RUN apt-get update && \\\n    apt-get install -y curl",
+		"RUN <<EOF\napk add curl\nEOF",
+		"COPY --from=builder /out/app /usr/bin/app",
+		"# Add your Dockerfile instructions here",
+		"ENV PATH=${HOME}/bin:$PATH",
+	}
+	for _, instruction := range valid {
+		if err := validateInstruction(instruction); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", instruction, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"RUNN echo hi":                        "unknown instruction RUNN (did you mean RUN?)",
+		"FROM alpine":                         "FROM is not allowed",
+		"RUN apt-get update \\":               "ends with a line continuation",
+		"RUN apt-get install \\\n curl\nwget": "holds 2 instructions",
+		"RUN <<EOF\napk add curl":             "unterminated heredoc",
+		"WORKDIR":                             "WORKDIR requires at least one argument",
+		"   ":                                 "instruction is empty",
+		"BUILD something":                     "unknown instruction BUILD",
+	}
+	for instruction, want := range invalid {
+		err := validateInstruction(instruction)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("validateInstruction(%q) = %v, want error containing %q", instruction, err, want)
+		}
+	}
+}
+
+func TestValidateInstructionPositions(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeFiles(t, tmpDir, map[string]string{
+		"dockstep.yaml": `version: "1.0"
+name: "app"
+include: ["lib.yaml"]
+blocks:
+  - id: "app"
+    from_block: "base"
+    instructions:
+      - "RUN echo ok"
+      - "RUNN echo typo"
+`,
+		"lib.yaml": `version: "1.0"
+name: "lib"
+blocks:
+  - id: "base"
+    from: "alpine"
+    instructions: ["RUN true"]
+`,
+	})
+
+	project, err := Parse(filepath.Join(tmpDir, "dockstep.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	err = Validate(project)
+
+	var verr *ValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	if verr.Block != "app" || verr.Index != 1 || verr.Position != (types.Position{Line: 9, Column: 9}) {
+		t.Errorf("Unexpected error location: %+v", verr)
+	}
+	if want := "block app: instructions[1] (line 9, column 9): unknown instruction RUNN (did you mean RUN?)"; err.Error() != want {
+		t.Errorf("Error = %q, want %q", err.Error(), want)
+	}
+
+	// Errors in included blocks name the file declaring them
+	writeFiles(t, tmpDir, map[string]string{
+		"lib.yaml": `version: "1.0"
+name: "lib"
+blocks:
+  - id: "base"
+    from: "alpine"
+    instructions: ["FROM debian"]
+`,
+	})
+	project, err = Parse(filepath.Join(tmpDir, "dockstep.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	err = Validate(project)
+	if err == nil || !strings.Contains(err.Error(), "block base: instructions[0] (lib.yaml:6:20): FROM is not allowed") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"dockstep.dev/types"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// LockFileName is the file, next to dockstep.yaml, that pins base images to digests
+const LockFileName = "dockstep.lock"
+
+// lockHeader is written at the top of lock files
+const lockHeader = "# Generated by dockstep lock. Pins base images for exports with --pin-digests.\n"
+
+// ReadLock reads a lock file. A missing lock file yields an empty lock.
+func ReadLock(path string) (*types.Lock, error) {
+	lock := &types.Lock{Images: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lock, nil
+		}
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+	if err := yaml.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock file: %w", err)
+	}
+	if lock.Images == nil {
+		lock.Images = make(map[string]string)
+	}
+	return lock, nil
+}
+
+// WriteLock writes a lock file to the given path
+func WriteLock(lock *types.Lock, path string) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock file: %w", err)
+	}
+	if err := writeFileAtomic(path, append([]byte(lockHeader), data...), 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+func TestLockRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), LockFileName)
+
+	// A missing lock file pins nothing
+	lock, err := ReadLock(path)
+	if err != nil {
+		t.Fatalf("Failed to read missing lock file: %v", err)
+	}
+	if len(lock.Images) != 0 {
+		t.Errorf("Expected empty lock, got %v", lock.Images)
+	}
+
+	lock = &types.Lock{Images: map[string]string{"alpine:3.19": "sha256:abc"}}
+	if err := WriteLock(lock, path); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	read, err := ReadLock(path)
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	if read.Images["alpine:3.19"] != "sha256:abc" {
+		t.Errorf("Expected pinned digest, got %v", read.Images)
+	}
+}
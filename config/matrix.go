@@ -0,0 +1,248 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// VariantID returns the ID of a matrix variant, e.g. deps[python=3.11]
+func VariantID(templateID string, values map[string]string) string {
+	if len(values) == 0 {
+		return templateID
+	}
+	pairs := make([]string, 0, len(values))
+	for _, key := range SortedKeys(values) {
+		pairs = append(pairs, key+"="+values[key])
+	}
+	return fmt.Sprintf("%s[%s]", templateID, strings.Join(pairs, ","))
+}
+
+// MatchBlocks returns the IDs of the blocks an ID refers to: the block itself,
+// or every variant when the ID names a matrix block
+func MatchBlocks(project *types.Project, id string) []string {
+	var ids []string
+	for _, block := range project.Blocks {
+		if block.ID == id || (block.Template != nil && block.Template.ID == id) {
+			ids = append(ids, block.ID)
+		}
+	}
+	return ids
+}
+
+// expandMatrix replaces matrix blocks with one concrete block per combination of values.
+// Blocks whose from_block names a matrix block fan out across its variants, while a
+// from_block naming a single variant ID pins that variant. Parents are expanded before
+// their children, wherever they are declared, and blocks keep their declared order.
+func expandMatrix(blocks []types.Block) ([]types.Block, error) {
+	variants := make(map[string][]types.Block) // matrix block ID -> expanded variants
+	expanded := make([][]types.Block, len(blocks))
+
+	for _, i := range parentsFirst(blocks) {
+		block := blocks[i]
+		combos, err := matrixCombinations(block)
+		if err != nil {
+			return nil, fmt.Errorf("block %s: %w", block.ID, err)
+		}
+
+		parents, fanOut := variants[block.FromBlock]
+		if !fanOut && len(block.Matrix) == 0 {
+			expanded[i] = []types.Block{block}
+			continue
+		}
+		if !fanOut {
+			parents = []types.Block{{}}
+		}
+
+		template := block
+		for _, parent := range parents {
+			for _, combo := range combos {
+				values := make(map[string]string, len(parent.Variant)+len(combo))
+				for key, value := range parent.Variant {
+					values[key] = value
+				}
+				for key, value := range combo {
+					if _, exists := values[key]; exists {
+						return nil, fmt.Errorf("block %s: matrix key '%s' is already set by from_block '%s'", block.ID, key, block.FromBlock)
+					}
+					values[key] = value
+				}
+
+				variant := block
+				variant.ID = VariantID(block.ID, values)
+				variant.Matrix = nil
+				variant.Template = &template
+				variant.Variant = values
+				if fanOut {
+					variant.FromBlock = parent.ID
+				}
+				expanded[i] = append(expanded[i], variant)
+			}
+		}
+		variants[block.ID] = expanded[i]
+	}
+
+	var out []types.Block
+	for _, blocks := range expanded {
+		out = append(out, blocks...)
+	}
+	return out, nil
+}
+
+// parentsFirst returns the indexes of blocks ordered so that a block's from_block parent
+// comes before it, keeping the declared order otherwise. Cycles are left for Validate to
+// report.
+func parentsFirst(blocks []types.Block) []int {
+	index := make(map[string]int, len(blocks))
+	for i, block := range blocks {
+		index[block.ID] = i
+	}
+	order := make([]int, 0, len(blocks))
+	state := make([]int, len(blocks)) // 0 unvisited, 1 visiting, 2 done
+	var visit func(i int)
+	visit = func(i int) {
+		if state[i] != 0 {
+			return
+		}
+		state[i] = 1
+		if parent, ok := index[blocks[i].FromBlock]; ok {
+			visit(parent)
+		}
+		state[i] = 2
+		order = append(order, i)
+	}
+	for i := range blocks {
+		visit(i)
+	}
+	return order
+}
+
+// matrixCombinations returns every combination of a block's matrix values in a stable order
+func matrixCombinations(block types.Block) ([]map[string]string, error) {
+	keys := make([]string, 0, len(block.Matrix))
+	for key, values := range block.Matrix {
+		if !variableNamePattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid matrix key: %s", key)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("matrix key '%s' has no values", key)
+		}
+		for _, value := range values {
+			if value == "" || strings.ContainsAny(value, "[],=") {
+				return nil, fmt.Errorf("invalid value %q for matrix key '%s'", value, key)
+			}
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	combos := []map[string]string{{}}
+	for _, key := range keys {
+		var next []map[string]string
+		for _, combo := range combos {
+			for _, value := range block.Matrix[key] {
+				extended := make(map[string]string, len(combo)+1)
+				for k, v := range combo {
+					extended[k] = v
+				}
+				extended[key] = value
+				next = append(next, extended)
+			}
+		}
+		combos = next
+	}
+	return combos, nil
+}
+
+// collapseMatrix turns expanded variants back into the matrix blocks they were declared as.
+// Edits made to every variant (e.g. through the UI) are carried over to the template; an
+// edit made to only some variants cannot be, and is an error.
+func collapseMatrix(blocks []types.Block) ([]types.Block, error) {
+	var out []types.Block
+	index := make(map[string]int)         // template ID -> position in out
+	first := make(map[string]types.Block) // template ID -> its first variant
+
+	for _, block := range blocks {
+		if block.Template == nil {
+			out = append(out, block)
+			continue
+		}
+
+		i, seen := index[block.Template.ID]
+		if !seen {
+			template := *block.Template
+			out = append(out, template)
+			i = len(out) - 1
+			index[template.ID] = i
+			first[template.ID] = block
+		} else if field := variantDifference(first[block.Template.ID], block); field != "" {
+			return nil, fmt.Errorf("block %s: %s differs from the other variants of matrix block %s; edit the matrix block instead", block.ID, field, block.Template.ID)
+		}
+
+		declared := block.Template
+		template := &out[i]
+		if block.From != declared.From {
+			template.From = block.From
+		}
+		if block.FromBlockVersion != declared.FromBlockVersion {
+			template.FromBlockVersion = block.FromBlockVersion
+		}
+		if block.Context != declared.Context {
+			template.Context = block.Context
+		}
+		if block.Platform != declared.Platform {
+			template.Platform = block.Platform
+		}
+		if !reflect.DeepEqual(block.Env, declared.Env) {
+			template.Env = block.Env
+		}
+		if !reflect.DeepEqual(block.Labels, declared.Labels) {
+			template.Labels = block.Labels
+		}
+		if !reflect.DeepEqual(block.Args, declared.Args) {
+			template.Args = block.Args
+		}
+		if !reflect.DeepEqual(block.CopyFrom, declared.CopyFrom) {
+			template.CopyFrom = block.CopyFrom
+		}
+		if !reflect.DeepEqual(block.Instructions, declared.Instructions) {
+			template.Instructions = block.Instructions
+		}
+		if !reflect.DeepEqual(block.Export, declared.Export) {
+			template.Export = block.Export
+		}
+	}
+
+	return out, nil
+}
+
+// variantDifference names the first field a template carries over in which two variants of
+// it differ, or returns "" when they agree
+func variantDifference(a, b types.Block) string {
+	switch {
+	case a.From != b.From:
+		return "from"
+	case a.FromBlockVersion != b.FromBlockVersion:
+		return "from_block_version"
+	case a.Context != b.Context:
+		return "context"
+	case a.Platform != b.Platform:
+		return "platform"
+	case !reflect.DeepEqual(a.Env, b.Env):
+		return "env"
+	case !reflect.DeepEqual(a.Labels, b.Labels):
+		return "labels"
+	case !reflect.DeepEqual(a.Args, b.Args):
+		return "args"
+	case !reflect.DeepEqual(a.CopyFrom, b.CopyFrom):
+		return "copy_from"
+	case !reflect.DeepEqual(a.Instructions, b.Instructions):
+		return "instructions"
+	case !reflect.DeepEqual(a.Export, b.Export):
+		return "export"
+	}
+	return ""
+}
@@ -0,0 +1,203 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const matrixConfig = `version: "1.0"
+name: "matrix"
+
+blocks:
+  - id: "deps"
+    from: "python:${python}-slim"
+    matrix:
+      python: ["3.10", "3.11"]
+    instructions:
+      - "RUN pip install -r requirements.txt"
+
+  - id: "test"
+    from_block: "deps"
+    matrix:
+      suite: ["unit", "integration"]
+    instructions:
+      - "RUN pytest tests/${suite}"
+
+  - id: "release"
+    from_block: "deps[python=3.11]"
+    instructions:
+      - "RUN echo release"
+`
+
+func TestExpandMatrix(t *testing.T) {
+	project, err := ParseData([]byte(matrixConfig), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	var ids []string
+	for _, block := range project.Blocks {
+		ids = append(ids, block.ID)
+	}
+	want := []string{
+		"deps[python=3.10]",
+		"deps[python=3.11]",
+		"test[python=3.10,suite=unit]",
+		"test[python=3.10,suite=integration]",
+		"test[python=3.11,suite=unit]",
+		"test[python=3.11,suite=integration]",
+		"release",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("Expanded IDs = %v, want %v", ids, want)
+	}
+
+	if err := Validate(project); err != nil {
+		t.Fatalf("Expanded project should be valid: %v", err)
+	}
+
+	// Descendants fan out onto the matching parent variant
+	fanned := project.Blocks[4]
+	if fanned.FromBlock != "deps[python=3.11]" {
+		t.Errorf("Expected fanned out block to extend deps[python=3.11], got %s", fanned.FromBlock)
+	}
+	if fanned.TemplateID() != "test" {
+		t.Errorf("Expected template ID test, got %s", fanned.TemplateID())
+	}
+
+	// Matrix values are usable as variables
+	resolved := ResolveBlock(project, fanned, nil)
+	if resolved.Instructions[0] != "RUN pytest tests/unit" {
+		t.Errorf("Expected matrix value interpolation, got %s", resolved.Instructions[0])
+	}
+	if ResolveBlock(project, project.Blocks[0], nil).From != "python:3.10-slim" {
+		t.Errorf("Expected matrix value in from, got %s", ResolveBlock(project, project.Blocks[0], nil).From)
+	}
+
+	// Pinned descendants are not expanded
+	if project.Blocks[6].Template != nil || project.Blocks[6].FromBlock != "deps[python=3.11]" {
+		t.Errorf("Expected release to pin deps[python=3.11]")
+	}
+
+	// Matrix IDs select every variant
+	if got := MatchBlocks(project, "deps"); len(got) != 2 {
+		t.Errorf("Expected 2 variants for deps, got %v", got)
+	}
+	if got := MatchBlocks(project, "release"); !reflect.DeepEqual(got, []string{"release"}) {
+		t.Errorf("Expected release to match itself, got %v", got)
+	}
+}
+
+func TestExpandMatrixErrors(t *testing.T) {
+	configs := map[string]string{
+		"empty values": `version: "1.0"
+name: "m"
+blocks:
+  - id: "a"
+    from: "alpine"
+    matrix:
+      v: []
+    instructions: ["RUN true"]
+`,
+		"duplicate key": `version: "1.0"
+name: "m"
+blocks:
+  - id: "a"
+    from: "alpine"
+    matrix:
+      v: ["1"]
+    instructions: ["RUN true"]
+  - id: "b"
+    from_block: "a"
+    matrix:
+      v: ["2"]
+    instructions: ["RUN true"]
+`,
+	}
+
+	for name, content := range configs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseData([]byte(content), "dockstep.yaml"); err == nil {
+				t.Error("Expected matrix expansion error")
+			}
+		})
+	}
+}
+
+func TestExpandMatrixChildBeforeParent(t *testing.T) {
+	project, err := ParseData([]byte(`version: "1.0"
+name: "matrix"
+blocks:
+  - id: "test"
+    from_block: "deps"
+    instructions:
+      - "RUN pytest"
+  - id: "deps"
+    from: "python:${python}-slim"
+    matrix:
+      python: ["3.10", "3.11"]
+    instructions:
+      - "RUN pip install -r requirements.txt"
+`), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	// The child fans out across its parent's variants, and keeps its declared position
+	var ids []string
+	for _, block := range project.Blocks {
+		ids = append(ids, block.ID+"<"+block.FromBlock)
+	}
+	want := []string{
+		"test[python=3.10]<deps[python=3.10]",
+		"test[python=3.11]<deps[python=3.11]",
+		"deps[python=3.10]<",
+		"deps[python=3.11]<",
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("Expanded blocks = %v, want %v", ids, want)
+	}
+	if err := Validate(project); err != nil {
+		t.Errorf("Expanded project should be valid: %v", err)
+	}
+}
+
+func TestWriteCollapsesMatrix(t *testing.T) {
+	project, err := ParseData([]byte(matrixConfig), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+
+	// An edit to one variant cannot be written back to the shared matrix block
+	project.Blocks[1].Instructions = []string{"RUN pip install -r requirements-dev.txt"}
+	if err := Write(project, path); err == nil {
+		t.Fatal("Expected an edit to a single variant to be rejected")
+	}
+
+	// The same edit made to every variant is
+	project.Blocks[0].Instructions = project.Blocks[1].Instructions
+	if err := Write(project, path); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	written, err := ParseData(data, path)
+	if err != nil {
+		t.Fatalf("Failed to parse written config: %v", err)
+	}
+
+	if len(written.Blocks) != len(project.Blocks) {
+		t.Fatalf("Expected %d blocks after round trip, got %d", len(project.Blocks), len(written.Blocks))
+	}
+	for _, block := range written.Blocks[:2] {
+		if block.Instructions[0] != "RUN pip install -r requirements-dev.txt" {
+			t.Errorf("Expected variant edit to apply to %s, got %s", block.ID, block.Instructions[0])
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is the newest config schema version this build of dockstep understands
+const SchemaVersion = "1.0"
+
+// migration upgrades one legacy shape of a config document in place
+type migration func(p *patcher, root *yaml.Node) []change
+
+// change is an edit made by a migration, either to a block item or to a top-level key
+type change struct {
+	block   *yaml.Node // the block item mapping that was rewritten
+	key     string     // the top-level key whose value was rewritten
+	message string
+}
+
+// migrations are applied in order to every config that is loaded
+var migrations = []migration{
+	migrateBlockCmd,
+	migrateSchemaVersion,
+}
+
+// schemaVersion parses a major.minor schema version; the minor part is optional
+func schemaVersion(version string) (int, int, error) {
+	majorText, minorText, hasMinor := strings.Cut(strings.TrimSpace(version), ".")
+	major, err := strconv.Atoi(majorText)
+	if err != nil || major < 0 {
+		return 0, 0, fmt.Errorf("invalid schema version %q (expected major.minor, such as %s)", version, SchemaVersion)
+	}
+	minor := 0
+	if hasMinor {
+		if minor, err = strconv.Atoi(minorText); err != nil || minor < 0 {
+			return 0, 0, fmt.Errorf("invalid schema version %q (expected major.minor, such as %s)", version, SchemaVersion)
+		}
+	}
+	return major, minor, nil
+}
+
+// compareVersions returns -1, 0 or 1 as schema version a is older than, the same as or newer than b
+func compareVersions(a, b string) (int, error) {
+	aMajor, aMinor, err := schemaVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bMajor, bMinor, err := schemaVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case aMajor != bMajor:
+		return sign(aMajor - bMajor), nil
+	default:
+		return sign(aMinor - bMinor), nil
+	}
+}
+
+// sign returns -1, 0 or 1 for the sign of n
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// checkVersion rejects configs written for a newer schema than this build understands
+func checkVersion(root *yaml.Node) error {
+	i := mappingIndex(root, "version")
+	if i < 0 || root.Content[i+1].Value == "" {
+		return nil
+	}
+	version := root.Content[i+1].Value
+	cmp, err := compareVersions(version, SchemaVersion)
+	if err != nil {
+		return err
+	}
+	if cmp > 0 {
+		return fmt.Errorf("config schema version %s is newer than this dockstep supports (%s); upgrade dockstep", version, SchemaVersion)
+	}
+	return nil
+}
+
+// decodeConfig decodes config content into out, upgrading legacy shapes in memory. It
+// returns a deprecation warning for every legacy shape it found.
+func decodeConfig(data []byte, out any) ([]string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if err := checkVersion(root); err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	if root.Kind == yaml.MappingNode {
+		for _, change := range applyMigrations(&patcher{indent: defaultIndent}, root) {
+			warnings = append(warnings, change.message)
+		}
+	}
+	if err := doc.Decode(out); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	return warnings, nil
+}
+
+// applyMigrations runs every migration over a config document
+func applyMigrations(p *patcher, root *yaml.Node) []change {
+	var changes []change
+	for _, migrate := range migrations {
+		changes = append(changes, migrate(p, root)...)
+	}
+	return changes
+}
+
+// Migrate upgrades config content to the current schema. It returns the upgraded content
+// and a description of every change; content without legacy shapes is returned as is.
+// Only the blocks and keys that change are rewritten, the rest of the file is kept byte for byte.
+func Migrate(data []byte) ([]byte, []string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("config is not a YAML mapping")
+	}
+	root := doc.Content[0]
+	if err := checkVersion(root); err != nil {
+		return nil, nil, err
+	}
+
+	p := &patcher{quoted: quotesStrings(root), indent: detectIndent(root)}
+	changes := applyMigrations(p, root)
+	if len(changes) == 0 {
+		return data, nil, nil
+	}
+	var messages []string
+	for _, change := range changes {
+		messages = append(messages, change.message)
+	}
+
+	if out, ok := p.spliceChanges(data, root, changes); ok {
+		return out, messages, nil
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(p.indent)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	return buf.Bytes(), messages, nil
+}
+
+// spliceChanges replaces the text of the changed blocks and top-level keys in the original
+// content. It reports false when a change cannot be located in the text.
+func (p *patcher) spliceChanges(data []byte, root *yaml.Node, changes []change) ([]byte, bool) {
+	lines, newline := splitLines(data)
+
+	type edit struct {
+		start, end int
+		lines      []string
+	}
+	edits := make(map[int]edit)
+
+	var spans []span
+	var seq *yaml.Node
+	if i := mappingIndex(root, "blocks"); i >= 0 && root.Content[i+1].Kind == yaml.SequenceNode {
+		seq = root.Content[i+1]
+	}
+
+	for _, change := range changes {
+		if change.block != nil {
+			if seq == nil {
+				return nil, false
+			}
+			if spans == nil {
+				var ok bool
+				if spans, ok = blockSpans(lines, seq); !ok {
+					return nil, false
+				}
+			}
+			n := -1
+			for j, item := range seq.Content {
+				if item == change.block {
+					n = j
+				}
+			}
+			if n < 0 {
+				return nil, false
+			}
+			clearOuterComments(change.block)
+			rendered, err := p.render(change.block, spans[n].dash, spans[n].content, newline)
+			if err != nil {
+				return nil, false
+			}
+			edits[spans[n].start] = edit{start: spans[n].start, end: spans[n].end, lines: rendered}
+			continue
+		}
+
+		// Top-level keys are only rewritten when they hold a single-line scalar
+		i := mappingIndex(root, change.key)
+		if i < 0 {
+			return nil, false
+		}
+		key, value := root.Content[i], root.Content[i+1]
+		if key.Line < 1 || key.Line != value.Line || value.Kind != yaml.ScalarNode || key.Column != 1 {
+			return nil, false
+		}
+		var buf bytes.Buffer
+		encoder := yaml.NewEncoder(&buf)
+		bare := *key
+		bare.HeadComment, bare.FootComment = "", ""
+		if err := encoder.Encode(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{&bare, value}}); err != nil {
+			return nil, false
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, false
+		}
+		text := strings.TrimSuffix(buf.String(), "\n")
+		if strings.Contains(text, "\n") {
+			return nil, false
+		}
+		edits[key.Line-1] = edit{start: key.Line - 1, end: key.Line, lines: []string{text + newline}}
+	}
+
+	for start := len(lines) - 1; start >= 0; start-- {
+		e, ok := edits[start]
+		if !ok {
+			continue
+		}
+		tail := append([]string(nil), lines[e.end:]...)
+		lines = append(append(lines[:e.start], e.lines...), tail...)
+	}
+	return []byte(strings.Join(lines, "")), true
+}
+
+// migrateBlockCmd moves the legacy single cmd field of a block into its instructions.
+// A cmd that is not a Dockerfile instruction is a shell command and becomes a RUN.
+func migrateBlockCmd(p *patcher, root *yaml.Node) []change {
+	i := mappingIndex(root, "blocks")
+	if i < 0 || root.Content[i+1].Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	var changes []change
+	for _, item := range root.Content[i+1].Content {
+		j := mappingIndex(item, "cmd")
+		if j < 0 || item.Content[j+1].Kind != yaml.ScalarNode {
+			continue
+		}
+		cmd := strings.TrimSpace(item.Content[j+1].Value)
+		instruction := cmd
+		if fields := strings.Fields(cmd); len(fields) > 0 && !IsInstruction(fields[0]) {
+			instruction = "RUN " + cmd
+		}
+		item.Content = append(item.Content[:j], item.Content[j+2:]...)
+
+		id := ""
+		if k := mappingIndex(item, "id"); k >= 0 {
+			id = item.Content[k+1].Value
+		}
+		message := fmt.Sprintf("block %s: cmd is deprecated and was moved to instructions", id)
+		if cmd != "" {
+			node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: instruction}
+			p.style(node, false)
+			if k := mappingIndex(item, "instructions"); k >= 0 && item.Content[k+1].Kind == yaml.SequenceNode {
+				item.Content[k+1].Content = append(item.Content[k+1].Content, node)
+				item.Content[k+1].Style &^= yaml.FlowStyle
+			} else {
+				if k >= 0 {
+					item.Content = append(item.Content[:k], item.Content[k+2:]...)
+					if k < j {
+						j -= 2
+					}
+				}
+				key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "instructions"}
+				value := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{node}}
+				tail := append([]*yaml.Node(nil), item.Content[j:]...)
+				item.Content = append(append(item.Content[:j], key, value), tail...)
+			}
+			message = fmt.Sprintf("block %s: cmd is deprecated and was moved to instructions as %q", id, instruction)
+		}
+		changes = append(changes, change{block: item, message: message})
+	}
+	return changes
+}
+
+// migrateSchemaVersion upgrades the version of configs written for an older schema
+func migrateSchemaVersion(p *patcher, root *yaml.Node) []change {
+	i := mappingIndex(root, "version")
+	if i < 0 || root.Content[i+1].Kind != yaml.ScalarNode || root.Content[i+1].Value == "" {
+		return nil
+	}
+	value := root.Content[i+1]
+	if cmp, err := compareVersions(value.Value, SchemaVersion); err != nil || cmp >= 0 {
+		return nil
+	}
+	old := value.Value
+	value.Value, value.Tag = SchemaVersion, "!!str"
+	return []change{{key: "version", message: fmt.Sprintf("schema version %s is deprecated and was upgraded to %s", old, SchemaVersion)}}
+}
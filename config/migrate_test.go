@@ -0,0 +1,104 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+const legacyConfig = `# Legacy project
+version: "0.9"   # first release
+name: "legacy"
+
+blocks:
+  # Base image
+  - id: "base"
+    from: "alpine:3.19"
+    cmd: "apk add --no-cache curl"
+
+  - id: "app"
+    from_block: "base"
+    cmd: "COPY . /app"
+    instructions:
+      - "RUN echo app"
+`
+
+func TestMigrate(t *testing.T) {
+	migrated, changes, err := Migrate([]byte(legacyConfig))
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	want := `# Legacy project
+version: "1.0" # first release
+name: "legacy"
+
+blocks:
+  # Base image
+  - id: "base"
+    from: "alpine:3.19"
+    instructions:
+      - "RUN apk add --no-cache curl"
+
+  - id: "app"
+    from_block: "base"
+    instructions:
+      - "RUN echo app"
+      - "COPY . /app"
+`
+	if string(migrated) != want {
+		t.Errorf("Migrated config:\n%s\nwant:\n%s", migrated, want)
+	}
+	if len(changes) != 3 {
+		t.Errorf("Expected 3 changes, got %v", changes)
+	}
+
+	// Migrating again changes nothing
+	again, changes, err := Migrate(migrated)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(changes) != 0 || string(again) != string(migrated) {
+		t.Errorf("Expected a migrated config to be up to date, got changes %v", changes)
+	}
+}
+
+func TestParseLegacyConfig(t *testing.T) {
+	project, warnings, err := parseData([]byte(legacyConfig), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if len(warnings) != 3 || !strings.Contains(warnings[0], "block base: cmd is deprecated") {
+		t.Errorf("Unexpected deprecation warnings: %v", warnings)
+	}
+	if project.Version != SchemaVersion {
+		t.Errorf("Expected version %s, got %s", SchemaVersion, project.Version)
+	}
+	if got := project.Blocks[0].Instructions; len(got) != 1 || got[0] != "RUN apk add --no-cache curl" {
+		t.Errorf("Expected cmd to become a RUN instruction, got %v", got)
+	}
+	if got := project.Blocks[1].Instructions; len(got) != 2 || got[1] != "COPY . /app" {
+		t.Errorf("Expected cmd to be appended to instructions, got %v", got)
+	}
+	if err := Validate(project); err != nil {
+		t.Errorf("Expected migrated config to be valid: %v", err)
+	}
+}
+
+func TestParseSchemaVersion(t *testing.T) {
+	tests := map[string]string{
+		`"1.0"`: "",
+		`1`:     "",
+		`"2.0"`: "config schema version 2.0 is newer than this dockstep supports",
+		`"1.7"`: "config schema version 1.7 is newer than this dockstep supports",
+		`"one"`: `invalid schema version "one"`,
+	}
+	for version, want := range tests {
+		_, err := ParseData([]byte("version: "+version+"\nname: test\nblocks: []\n"), "dockstep.yaml")
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("Version %s: unexpected error: %v", version, err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("Version %s: got %v, want error containing %q", version, err, want)
+		}
+	}
+}
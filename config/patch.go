@@ -0,0 +1,654 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// defaultIndent is the indentation used when a file gives no hint of its own
+const defaultIndent = 2
+
+// patchConfig returns existing config file content changed to declare project. When only
+// blocks changed, the changed blocks are replaced as text and everything else is kept byte
+// for byte. Other changes are applied to the YAML node tree, which keeps comments, key
+// order, quoting and anchors but not necessarily the original layout.
+func patchConfig(data []byte, project *types.Project) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse existing config: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("existing config is not a YAML mapping")
+	}
+	var old types.Project
+	if err := doc.Decode(&old); err != nil {
+		return nil, fmt.Errorf("failed to decode existing config: %w", err)
+	}
+
+	p := &patcher{
+		quoted: quotesStrings(doc.Content[0]),
+		indent: detectIndent(doc.Content[0]),
+	}
+	if sameTopLevel(&old, project) {
+		if out, ok := p.patchBlocksText(data, doc.Content[0], old.Blocks, project.Blocks); ok {
+			return out, nil
+		}
+	}
+	return p.patchDocument(&doc, &old, project)
+}
+
+// patcher applies changes in the style of the file being patched
+type patcher struct {
+	quoted bool // whether the file double-quotes its string values
+	indent int
+}
+
+// patchDocument patches the node tree of the whole document and re-encodes it
+func (p *patcher) patchDocument(doc *yaml.Node, old, project *types.Project) ([]byte, error) {
+	root := doc.Content[0]
+	updated, err := p.encode(project)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blocks are matched by ID so unchanged blocks keep their nodes
+	blocksIndex := mappingIndex(updated, "blocks")
+	if blocksIndex >= 0 {
+		if i := mappingIndex(root, "blocks"); i >= 0 && root.Content[i+1].Kind == yaml.SequenceNode {
+			seq := root.Content[i+1]
+			if err := p.patchBlocks(seq, old.Blocks, project.Blocks); err != nil {
+				return nil, err
+			}
+			updated.Content[blocksIndex+1] = seq
+		}
+	}
+	resolved, err := p.encode(old)
+	if err != nil {
+		return nil, err
+	}
+	p.patchMapping(root, resolved, updated)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(p.indent)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// patchBlocks rebuilds a blocks sequence for the new blocks, reusing and patching the
+// nodes of blocks that already exist
+func (p *patcher) patchBlocks(seq *yaml.Node, oldBlocks, newBlocks []types.Block) error {
+	items := make(map[string]int, len(oldBlocks))
+	for i, block := range oldBlocks {
+		if i < len(seq.Content) {
+			items[block.ID] = i
+		}
+	}
+
+	var content []*yaml.Node
+	for _, block := range newBlocks {
+		updated, err := p.encode(block)
+		if err != nil {
+			return err
+		}
+		i, exists := items[block.ID]
+		if !exists {
+			content = append(content, updated)
+			continue
+		}
+		resolved, err := p.encode(oldBlocks[i])
+		if err != nil {
+			return err
+		}
+		p.patchMapping(seq.Content[i], resolved, updated)
+		content = append(content, seq.Content[i])
+	}
+	seq.Content = content
+	if len(content) > 0 {
+		seq.Style &^= yaml.FlowStyle
+	}
+	return nil
+}
+
+// patchBlocksText replaces, removes and inserts the text of changed blocks, leaving every
+// other byte of the file as it was. It reports false when the layout of the blocks cannot
+// be patched as text, such as a flow-style sequence or reordered blocks.
+func (p *patcher) patchBlocksText(data []byte, root *yaml.Node, oldBlocks, newBlocks []types.Block) ([]byte, bool) {
+	i := mappingIndex(root, "blocks")
+	if i < 0 {
+		return nil, false
+	}
+	seq := root.Content[i+1]
+	if seq.Kind != yaml.SequenceNode || seq.Style&yaml.FlowStyle != 0 || len(seq.Content) == 0 || len(seq.Content) != len(oldBlocks) {
+		return nil, false
+	}
+
+	lines, newline := splitLines(data)
+	spans, ok := blockSpans(lines, seq)
+	if !ok {
+		return nil, false
+	}
+
+	// Blocks that are kept must stay in order, and at least one must remain to anchor the rest
+	oldIndex := make(map[string]int, len(oldBlocks))
+	for n, block := range oldBlocks {
+		oldIndex[block.ID] = n
+	}
+	first, last := -1, -1
+	for _, block := range newBlocks {
+		if n, ok := oldIndex[block.ID]; ok {
+			if n < last {
+				return nil, false
+			}
+			if first < 0 {
+				first = n
+			}
+			last = n
+		}
+	}
+	if first < 0 {
+		return nil, false
+	}
+
+	// Separate inserted blocks the way existing blocks are separated
+	separated := false
+	if len(spans) > 1 {
+		head := spans[1].start
+		for head > 0 && isCommentLine(lines[head-1]) {
+			head--
+		}
+		separated = head > 0 && strings.TrimSpace(lines[head-1]) == ""
+	}
+
+	type edit struct {
+		start, end int
+		lines      []string
+	}
+	var edits []edit
+	kept := make(map[string]bool)
+
+	// Blocks inserted before the first kept block go above its head comment
+	insertAt, prev := spans[first].start, -1
+	for insertAt > 0 && isCommentLine(lines[insertAt-1]) {
+		insertAt--
+	}
+	var pending []string
+	flush := func() {
+		if len(pending) > 0 {
+			edits = append(edits, edit{start: insertAt, end: insertAt, lines: pending})
+			pending = nil
+		}
+	}
+	for _, block := range newBlocks {
+		n, exists := oldIndex[block.ID]
+		if !exists {
+			updated, err := p.encode(block)
+			if err != nil {
+				return nil, false
+			}
+			rendered, err := p.render(updated, spans[0].dash, spans[0].content, newline)
+			if err != nil {
+				return nil, false
+			}
+			if prev >= 0 && separated {
+				pending = append(pending, newline)
+			}
+			pending = append(pending, rendered...)
+			if prev < 0 && separated {
+				pending = append(pending, newline)
+			}
+			continue
+		}
+
+		flush()
+		kept[block.ID] = true
+		prev, insertAt = n, spans[n].end
+		if sameYAML(oldBlocks[n], block) {
+			continue
+		}
+		item := seq.Content[n]
+		updated, err := p.encode(block)
+		if err != nil {
+			return nil, false
+		}
+		resolved, err := p.encode(oldBlocks[n])
+		if err != nil {
+			return nil, false
+		}
+		p.patchMapping(item, resolved, updated)
+		clearOuterComments(item)
+		rendered, err := p.render(item, spans[n].dash, spans[n].content, newline)
+		if err != nil {
+			return nil, false
+		}
+		edits = append(edits, edit{start: spans[n].start, end: spans[n].end, lines: rendered})
+	}
+	flush()
+
+	// Removed blocks take their head comment and one separating blank line with them
+	for n, block := range oldBlocks {
+		if kept[block.ID] {
+			continue
+		}
+		start, end := spans[n].start, spans[n].end
+		for start > 0 && isCommentLine(lines[start-1]) {
+			start--
+		}
+		if start > 0 && strings.TrimSpace(lines[start-1]) == "" && (end >= len(lines) || strings.TrimSpace(lines[end]) == "") {
+			start--
+		}
+		edits = append(edits, edit{start: start, end: end})
+	}
+
+	// Apply edits from the bottom up so earlier line numbers stay valid; a removal goes
+	// before an insertion at the same line
+	sort.SliceStable(edits, func(a, b int) bool {
+		if edits[a].start != edits[b].start {
+			return edits[a].start > edits[b].start
+		}
+		return edits[a].end > edits[b].end
+	})
+	for _, e := range edits {
+		tail := append([]string(nil), lines[e.end:]...)
+		lines = append(append(lines[:e.start], e.lines...), tail...)
+	}
+	return []byte(strings.Join(lines, "")), true
+}
+
+// splitLines splits file content into lines that keep their line endings, and returns
+// the line ending the file uses
+func splitLines(data []byte) ([]string, string) {
+	newline := "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, newline
+}
+
+// span is the text of a block sequence item: lines start to end, with the dash and the
+// item's content at the given columns
+type span struct{ start, end, dash, content int }
+
+// blockSpans locates the text of each item of a block-style sequence, from its dash to its
+// last line of content. It reports false for items it cannot locate, such as flow mappings.
+func blockSpans(lines []string, seq *yaml.Node) ([]span, bool) {
+	spans := make([]span, len(seq.Content))
+	for n, item := range seq.Content {
+		if item.Kind != yaml.MappingNode || item.Style&yaml.FlowStyle != 0 || item.Line < 1 || item.Line > len(lines) {
+			return nil, false
+		}
+		line := lines[item.Line-1]
+		content := item.Column - 1
+		prefix := strings.TrimRight(line[:min(content, len(line))], " ")
+		if !strings.HasSuffix(prefix, "-") || strings.TrimSpace(prefix) != "-" {
+			return nil, false
+		}
+		spans[n] = span{start: item.Line - 1, dash: len(prefix) - 1, content: content}
+	}
+	for n := range spans {
+		end := len(lines)
+		if n+1 < len(spans) {
+			end = spans[n+1].start
+		} else {
+			for j := spans[n].start + 1; j < len(lines); j++ {
+				if !isBlankOrComment(lines[j]) && indentation(lines[j]) <= spans[n].dash {
+					end = j
+					break
+				}
+			}
+		}
+		for end > spans[n].start+1 && isBlankOrComment(lines[end-1]) {
+			end--
+		}
+		spans[n].end = end
+	}
+	return spans, true
+}
+
+// render encodes a block node as a sequence item whose dash and content start at the
+// given columns
+func (p *patcher) render(node *yaml.Node, dash, content int, newline string) ([]string, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(p.indent)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimSuffix(buf.String(), "\n")
+	var lines []string
+	for n, line := range strings.Split(text, "\n") {
+		switch {
+		case n == 0:
+			line = strings.Repeat(" ", dash) + "-" + strings.Repeat(" ", content-dash-1) + line
+		case line != "":
+			line = strings.Repeat(" ", content) + line
+		}
+		lines = append(lines, line+newline)
+	}
+	return lines, nil
+}
+
+// encode converts a value to a node tree styled like the file being patched
+func (p *patcher) encode(value any) (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return nil, fmt.Errorf("failed to marshal YAML: %w", err)
+	}
+	p.style(&node, false)
+	return &node, nil
+}
+
+// style applies the file's quoting to string values, and the literal style to multi-line ones
+func (p *patcher) style(node *yaml.Node, isKey bool) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if isKey || node.Tag != "!!str" {
+			return
+		}
+		switch {
+		case strings.Contains(node.Value, "\n"):
+			node.Style = yaml.LiteralStyle
+		case p.quoted:
+			node.Style = yaml.DoubleQuotedStyle
+		}
+	case yaml.MappingNode:
+		for i, child := range node.Content {
+			p.style(child, i%2 == 0)
+		}
+	default:
+		for _, child := range node.Content {
+			p.style(child, false)
+		}
+	}
+}
+
+// patchMapping updates the mapping node old in place to hold the keys and values of updated.
+// Unchanged values keep their nodes, so their comments, quoting and anchors survive. Keys
+// only present through a merge key (<<) are compared against resolved, the decoded old
+// value, and merge keys themselves are left alone.
+func (p *patcher) patchMapping(old, resolved, updated *yaml.Node) {
+	for i := 0; i+1 < len(updated.Content); i += 2 {
+		key, value := updated.Content[i], updated.Content[i+1]
+
+		if j := mappingIndex(old, key.Value); j >= 0 {
+			current := old.Content[j+1]
+			if sameValue(current, value) {
+				continue
+			}
+			if current.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+				child := &yaml.Node{Kind: yaml.MappingNode}
+				if k := mappingIndex(resolved, key.Value); k >= 0 {
+					child = resolved.Content[k+1]
+				}
+				p.patchMapping(current, child, value)
+				continue
+			}
+			if current.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode {
+				patchSequence(current, value)
+				continue
+			}
+			value.HeadComment, value.LineComment, value.FootComment = current.HeadComment, current.LineComment, current.FootComment
+			old.Content[j+1] = value
+			continue
+		}
+		if resolved != nil {
+			if j := mappingIndex(resolved, key.Value); j >= 0 && sameValue(resolved.Content[j+1], value) {
+				continue
+			}
+		}
+
+		// Insert after the nearest preceding key that old already has
+		at := len(old.Content)
+		for k := i - 2; k >= 0; k -= 2 {
+			if j := mappingIndex(old, updated.Content[k].Value); j >= 0 {
+				at = j + 2
+				break
+			}
+		}
+		tail := append([]*yaml.Node(nil), old.Content[at:]...)
+		old.Content = append(append(old.Content[:at], key, value), tail...)
+	}
+
+	// Remove keys that are gone, keeping merge keys, keys the project type does not model
+	// and empty values the encoder omits
+	for i := 0; i+1 < len(old.Content); {
+		key := old.Content[i].Value
+		known := resolved == nil || mappingIndex(resolved, key) >= 0
+		if key != "<<" && known && mappingIndex(updated, key) < 0 && !isEmptyValue(old.Content[i+1]) {
+			old.Content = append(old.Content[:i], old.Content[i+2:]...)
+			continue
+		}
+		i += 2
+	}
+}
+
+// patchSequence updates the sequence node old in place to hold the items of updated,
+// keeping the nodes of items that are unchanged at the same position
+func patchSequence(old, updated *yaml.Node) {
+	// A comment below the last item stays below the last item
+	var foot string
+	if len(old.Content) > 0 {
+		last := old.Content[len(old.Content)-1]
+		foot, last.FootComment = last.FootComment, ""
+	}
+
+	content := make([]*yaml.Node, len(updated.Content))
+	for i, item := range updated.Content {
+		content[i] = item
+		if i < len(old.Content) && sameValue(old.Content[i], item) {
+			content[i] = old.Content[i]
+		}
+	}
+	if len(content) > 0 {
+		content[len(content)-1].FootComment = foot
+	}
+	old.Content = content
+	if len(content) == 0 {
+		old.Style |= yaml.FlowStyle
+	}
+}
+
+// mappingIndex returns the index of key in a mapping node's content, or -1
+func mappingIndex(node *yaml.Node, key string) int {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return -1
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// sameValue reports whether two nodes decode to the same value
+func sameValue(a, b *yaml.Node) bool {
+	var av, bv any
+	if err := a.Decode(&av); err != nil {
+		return false
+	}
+	if err := b.Decode(&bv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// isEmptyValue reports whether a node holds null or an empty collection or string
+func isEmptyValue(node *yaml.Node) bool {
+	var value any
+	if err := node.Decode(&value); err != nil {
+		return false
+	}
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// sameYAML reports whether two values marshal to the same YAML
+func sameYAML(a, b any) bool {
+	ad, err := yaml.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bd, err := yaml.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ad, bd)
+}
+
+// sameTopLevel reports whether two projects declare the same settings apart from blocks
+func sameTopLevel(a, b *types.Project) bool {
+	ac, bc := *a, *b
+	ac.Blocks, bc.Blocks = nil, nil
+	return sameYAML(&ac, &bc)
+}
+
+// clearOuterComments drops the comments above and below a block item, which stay in the
+// file outside the text that is replaced
+func clearOuterComments(item *yaml.Node) {
+	item.HeadComment = ""
+	if len(item.Content) > 0 {
+		item.Content[0].HeadComment = ""
+	}
+	for node := item; node != nil; {
+		node.FootComment = ""
+		if len(node.Content) == 0 {
+			break
+		}
+		node = node.Content[len(node.Content)-1]
+	}
+}
+
+// quotesStrings reports whether most string values in a document are double-quoted
+func quotesStrings(node *yaml.Node) bool {
+	quoted, plain := 0, 0
+	var walk func(node *yaml.Node, isKey bool)
+	walk = func(node *yaml.Node, isKey bool) {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			if isKey || node.Tag != "!!str" {
+				return
+			}
+			switch node.Style {
+			case yaml.DoubleQuotedStyle:
+				quoted++
+			case 0:
+				plain++
+			}
+		case yaml.MappingNode:
+			for i, child := range node.Content {
+				walk(child, i%2 == 0)
+			}
+		default:
+			for _, child := range node.Content {
+				walk(child, false)
+			}
+		}
+	}
+	walk(node, false)
+	return quoted > plain
+}
+
+// detectIndent returns the indentation of the first nested block collection in a document
+func detectIndent(node *yaml.Node) int {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if value.Style&yaml.FlowStyle == 0 && len(value.Content) > 0 && value.Line > key.Line {
+				column := value.Column
+				if value.Kind == yaml.SequenceNode {
+					column = value.Content[0].Column - 2
+				}
+				if indent := column - key.Column; indent > 0 {
+					return indent
+				}
+			}
+			if indent := detectIndent(value); indent > 0 {
+				return indent
+			}
+		}
+	}
+	for _, child := range node.Content {
+		if node.Kind != yaml.MappingNode {
+			if indent := detectIndent(child); indent > 0 {
+				return indent
+			}
+		}
+	}
+	if node.Kind == yaml.DocumentNode || node.Line == 1 {
+		return defaultIndent
+	}
+	return 0
+}
+
+// indentation returns the number of leading spaces of a line
+func indentation(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// isCommentLine reports whether a line only holds a comment
+func isCommentLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "#")
+}
+
+// isBlankOrComment reports whether a line holds no YAML content
+func isBlankOrComment(line string) bool {
+	return strings.TrimSpace(line) == "" || isCommentLine(line)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it into place,
+// so readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
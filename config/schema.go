@@ -0,0 +1,171 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// schemaID is the URL the published schema is served from
+const schemaID = "https://raw.githubusercontent.com/leonardmq/dockstep/main/schema/dockstep.schema.json"
+
+// schemaDescriptions documents the config fields, keyed by type and YAML field name
+var schemaDescriptions = map[string]string{
+	"Project.version":          "Config schema version",
+	"Project.name":             "Project name",
+	"Project.settings":         "Default settings for the project",
+	"Project.include":          "YAML files or directories of YAML files to load blocks from",
+	"Project.variables":        "Variables available as ${NAME} in blocks; overridable with --set",
+	"Project.secrets":          "Build secrets, mounted with RUN --mount=type=secret,id=<name>",
+	"Project.lint":             "Lint rule severities and suppressions",
+	"Project.blocks":           "Build steps, in order",
+	"Block.id":                 "Unique block ID",
+	"Block.description":        "What the block does; exported as a comment",
+	"Block.from":               "Base image; mutually exclusive with from_block",
+	"Block.from_block":         "Block whose image this block builds on",
+	"Block.from_block_version": "Image digest or short hash of from_block to pin",
+	"Block.args":               "Build args declared with ARG in the block",
+	"Block.copy_from":          "Paths copied out of other blocks' images",
+	"Block.instructions":       "Dockerfile instructions, one per entry",
+	"Block.context":            "Build context directory, relative to the project root",
+	"Block.platform":           "Target platform, such as linux/amd64",
+	"Block.env":                "Environment variables set with ENV before the instructions",
+	"Block.labels":             "Labels added to the block's image",
+	"Block.export":             "Image settings applied when the block is exported",
+	"Block.matrix":             "Values expanded into one variant of the block per combination",
+	"Settings.context":         "Build context for blocks that do not set one",
+	"Settings.platform":        "Target platform for every block, such as linux/amd64",
+	"Settings.pull_policy":     "When base images are pulled (default always)",
+	"Settings.env":             "Environment variables set at the root of every block chain",
+	"Settings.labels":          "Labels added to every built image",
+	"Settings.tag_prefix":      "Prefix of block image tags (default dockstep)",
+	"Settings.retention":       "How many timestamp tags of each block are kept",
+	"Settings.shared_cache":    "Share block images with other projects through the machine-wide cache",
+	"Retention.keep":           "Timestamp tags kept per block (default 5); 0 keeps all",
+	"Retention.max_age":        "Age after which older timestamp tags are removed, such as 72h or 7d",
+	"CopyFrom.block":           "Block to copy from",
+	"CopyFrom.src":             "Path in the source block's image",
+	"CopyFrom.dst":             "Path in this block's image",
+	"Include.path":             "File or directory to include, relative to the including file",
+	"Include.namespace":        "Namespace added to included block IDs as <namespace>.<id>",
+	"Include.prefix":           "Prefix added to included block IDs",
+	"Secret.file":              "File the secret is read from",
+	"Secret.env":               "Environment variable the secret is read from",
+	"LintConfig.rules":         "Severity by rule ID",
+	"LintConfig.ignore":        "Rule IDs to ignore, by block ID",
+}
+
+// schemaRequired lists the required fields of each type
+var schemaRequired = map[string][]string{
+	"Project":  {"version", "name"},
+	"Block":    {"id"},
+	"CopyFrom": {"block", "src", "dst"},
+	"Include":  {"path"},
+}
+
+// JSONSchema returns a JSON Schema for dockstep.yaml, generated from types.Project
+func JSONSchema() ([]byte, error) {
+	g := &schemaGenerator{definitions: make(map[string]any)}
+	root := g.object(reflect.TypeOf(types.Project{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["$id"] = schemaID
+	root["title"] = "dockstep.yaml"
+	root["definitions"] = g.definitions
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode schema: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// schemaGenerator builds schemas for Go types, collecting nested structs as definitions
+type schemaGenerator struct {
+	definitions map[string]any
+}
+
+// object returns the schema of a struct type from its YAML field tags
+func (g *schemaGenerator) object(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" || name == "" || !field.IsExported() {
+			continue
+		}
+		property := g.schema(t.Name(), name, field.Type)
+		if description, ok := schemaDescriptions[t.Name()+"."+name]; ok {
+			property["description"] = description
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if required := schemaRequired[t.Name()]; len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schema returns the schema of a field's type
+func (g *schemaGenerator) schema(owner, name string, t reflect.Type) map[string]any {
+	// Fields whose YAML form differs from their Go type
+	switch {
+	case owner == "Project" && name == "version":
+		return map[string]any{"type": []string{"string", "number"}, "examples": []string{SchemaVersion}}
+	case owner == "LintConfig" && name == "rules":
+		return map[string]any{
+			"type":                 "object",
+			"additionalProperties": map[string]any{"enum": []string{"error", "warning", "off"}},
+		}
+	case t == reflect.TypeOf(types.PullPolicy("")):
+		return map[string]any{"enum": []types.PullPolicy{types.PullAlways, types.PullMissing, types.PullNever}}
+	case t == reflect.TypeOf(types.Include{}):
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			g.ref(t),
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(owner, name, t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(owner, name, t.Elem())}
+	case reflect.Map:
+		values := g.schema(owner, name, t.Elem())
+		if t.Elem().Kind() == reflect.String {
+			// Unquoted numbers and booleans are read as strings
+			values = map[string]any{"type": []string{"string", "number", "boolean"}}
+		}
+		return map[string]any{"type": "object", "additionalProperties": values}
+	case reflect.Struct:
+		return g.ref(t)
+	}
+	return map[string]any{}
+}
+
+// ref returns a reference to the definition of a struct type, adding it on first use
+func (g *schemaGenerator) ref(t reflect.Type) map[string]any {
+	if _, ok := g.definitions[t.Name()]; !ok {
+		g.definitions[t.Name()] = nil // placeholder for recursive types
+		g.definitions[t.Name()] = g.object(t)
+	}
+	return map[string]any{"$ref": "#/definitions/" + t.Name()}
+}
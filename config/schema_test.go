@@ -0,0 +1,136 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "update the published schema")
+
+// publishedSchema is the schema file editors are pointed at
+const publishedSchema = "../schema/dockstep.schema.json"
+
+func TestJSONSchemaPublished(t *testing.T) {
+	got, err := JSONSchema()
+	if err != nil {
+		t.Fatalf("Failed to generate schema: %v", err)
+	}
+	if *update {
+		if err := os.WriteFile(publishedSchema, got, 0644); err != nil {
+			t.Fatalf("Failed to update schema: %v", err)
+		}
+	}
+	want, err := os.ReadFile(publishedSchema)
+	if err != nil {
+		t.Fatalf("Failed to read schema (run with -update to create it): %v", err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("%s is out of date; run go test ./config -update", publishedSchema)
+	}
+}
+
+func TestJSONSchemaAcceptsConfigs(t *testing.T) {
+	data, err := JSONSchema()
+	if err != nil {
+		t.Fatalf("Failed to generate schema: %v", err)
+	}
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Schema is not valid JSON: %v", err)
+	}
+
+	files, err := filepath.Glob("../examples/*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, "../export/testdata/dockstep.yaml")
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var doc any
+		if err := yaml.Unmarshal(content, &doc); err != nil {
+			t.Fatalf("Failed to parse %s: %v", file, err)
+		}
+		for _, problem := range checkSchema(schema, schema, doc, "") {
+			t.Errorf("%s: %s", file, problem)
+		}
+	}
+
+	var doc any
+	if err := yaml.Unmarshal([]byte("version: \"1.0\"\nname: x\nblocks:\n  - id: a\n    form: alpine\n"), &doc); err != nil {
+		t.Fatal(err)
+	}
+	problems := checkSchema(schema, schema, doc, "")
+	if len(problems) != 1 || !strings.Contains(problems[0], "blocks[0].form") {
+		t.Errorf("Expected the misspelled key to be rejected, got %v", problems)
+	}
+}
+
+// checkSchema reports keys of value that its schema does not allow, and values of the
+// wrong kind. It covers the parts of JSON Schema the generated schema uses.
+func checkSchema(root, schema map[string]any, value any, path string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		return checkSchema(root, root["definitions"].(map[string]any)[name].(map[string]any), value, path)
+	}
+	if options, ok := schema["oneOf"].([]any); ok {
+		for _, option := range options {
+			if len(checkSchema(root, option.(map[string]any), value, path)) == 0 {
+				return nil
+			}
+		}
+		return []string{path + ": matches none of the allowed forms"}
+	}
+
+	var problems []string
+	switch v := value.(type) {
+	case map[string]any:
+		if !allowsType(schema, "object") {
+			return []string{path + ": unexpected mapping"}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for key, child := range v {
+			childPath := strings.TrimPrefix(path+"."+key, ".")
+			if property, ok := properties[key].(map[string]any); ok {
+				problems = append(problems, checkSchema(root, property, child, childPath)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+				problems = append(problems, checkSchema(root, additional, child, childPath)...)
+			} else if schema["additionalProperties"] == false {
+				problems = append(problems, childPath+": unknown key")
+			}
+		}
+	case []any:
+		if !allowsType(schema, "array") {
+			return []string{path + ": unexpected sequence"}
+		}
+		for i, item := range v {
+			problems = append(problems, checkSchema(root, schema["items"].(map[string]any), item, path+"["+strconv.Itoa(i)+"]")...)
+		}
+	}
+	return problems
+}
+
+// allowsType reports whether a schema allows values of a JSON type
+func allowsType(schema map[string]any, name string) bool {
+	switch t := schema["type"].(type) {
+	case string:
+		return t == name
+	case []any:
+		for _, option := range t {
+			if option == name {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
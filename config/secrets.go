@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// secretIDPattern matches valid secret IDs
+var secretIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// SecretIDs returns the IDs of the secrets mounted by a block's RUN instructions
+func SecretIDs(block types.Block) []string {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, instruction := range block.Instructions {
+		for _, mount := range runMounts(instruction) {
+			if mount["type"] != "secret" {
+				continue
+			}
+			id := mount["id"]
+			if id == "" && mount["target"] != "" {
+				// Docker defaults the ID to the basename of the target path
+				id = path.Base(mount["target"])
+			}
+			if id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// LoadSecrets reads the values of the given secrets from their files or environment variables.
+// Relative file paths are resolved against projectRoot.
+func LoadSecrets(project *types.Project, projectRoot string, ids []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(ids))
+	for _, id := range ids {
+		secret, ok := project.Secrets[id]
+		if !ok {
+			return nil, fmt.Errorf("secret %s is not defined in secrets", id)
+		}
+		value, err := loadSecret(secret, projectRoot)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", id, err)
+		}
+		values[id] = value
+	}
+	return values, nil
+}
+
+// loadSecret reads a single secret value
+func loadSecret(secret types.Secret, projectRoot string) ([]byte, error) {
+	if secret.Env != "" {
+		value, ok := os.LookupEnv(secret.Env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", secret.Env)
+		}
+		return []byte(value), nil
+	}
+
+	file := secret.File
+	if strings.HasPrefix(file, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve home directory: %w", err)
+		}
+		file = filepath.Join(home, file[2:])
+	} else if !filepath.IsAbs(file) {
+		file = filepath.Join(projectRoot, file)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret file: %w", err)
+	}
+	return data, nil
+}
+
+// validateSecrets checks that every secret has a valid ID and exactly one source
+func validateSecrets(secrets map[string]types.Secret) error {
+	for id, secret := range secrets {
+		if !secretIDPattern.MatchString(id) {
+			return fmt.Errorf("invalid secret ID: %s", id)
+		}
+		if (secret.File == "") == (secret.Env == "") {
+			return fmt.Errorf("secret %s: exactly one of 'file' or 'env' must be specified", id)
+		}
+	}
+	return nil
+}
+
+// runMounts parses the --mount flags of a RUN instruction into key/value options
+func runMounts(instruction string) []map[string]string {
+	fields := strings.Fields(instruction)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "RUN") {
+		return nil
+	}
+
+	var mounts []map[string]string
+	for _, field := range fields[1:] {
+		if !strings.HasPrefix(field, "--") {
+			break // flags end at the command
+		}
+		value, ok := strings.CutPrefix(field, "--mount=")
+		if !ok {
+			continue
+		}
+		mount := make(map[string]string)
+		for _, option := range strings.Split(strings.Trim(value, `"'`), ",") {
+			key, val, _ := strings.Cut(option, "=")
+			mount[strings.ToLower(key)] = val
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+func TestSecretIDs(t *testing.T) {
+	block := types.Block{
+		ID: "deps",
+		Instructions: []string{
+			"RUN --mount=type=secret,id=pip_token pip install -r requirements.txt",
+			"RUN --mount=type=cache,target=/root/.cache --mount=type=secret,target=/run/secrets/npmrc npm ci",
+			"RUN docker run --mount=type=secret,id=not_a_flag alpine",
+			"COPY --mount=type=secret,id=ignored . .",
+			"RUN --mount=type=secret,id=pip_token pip install extra",
+		},
+	}
+
+	got := SecretIDs(block)
+	want := []string{"npmrc", "pip_token"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SecretIDs() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "token.txt"), []byte("file-secret"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	t.Setenv("DOCKSTEP_TEST_TOKEN", "env-secret")
+
+	project := &types.Project{
+		Secrets: map[string]types.Secret{
+			"from_file": {File: "token.txt"},
+			"from_env":  {Env: "DOCKSTEP_TEST_TOKEN"},
+			"missing":   {Env: "DOCKSTEP_TEST_UNSET_TOKEN"},
+		},
+	}
+
+	values, err := LoadSecrets(project, tmpDir, []string{"from_file", "from_env"})
+	if err != nil {
+		t.Fatalf("Failed to load secrets: %v", err)
+	}
+	if string(values["from_file"]) != "file-secret" {
+		t.Errorf("Expected file secret, got %q", values["from_file"])
+	}
+	if string(values["from_env"]) != "env-secret" {
+		t.Errorf("Expected env secret, got %q", values["from_env"])
+	}
+
+	if _, err := LoadSecrets(project, tmpDir, []string{"missing"}); err == nil {
+		t.Error("Expected error for unset environment variable")
+	}
+	if _, err := LoadSecrets(project, tmpDir, []string{"undeclared"}); err == nil {
+		t.Error("Expected error for undeclared secret")
+	}
+}
+
+func TestValidateSecrets(t *testing.T) {
+	base := func() *types.Project {
+		return &types.Project{
+			Version: "1.0",
+			Name:    "test",
+			Blocks: []types.Block{
+				{
+					ID:           "base",
+					From:         "alpine:3.19",
+					Instructions: []string{"RUN --mount=type=secret,id=token cat /run/secrets/token"},
+				},
+			},
+		}
+	}
+
+	project := base()
+	project.Secrets = map[string]types.Secret{"token": {Env: "TOKEN"}}
+	if err := Validate(project); err != nil {
+		t.Errorf("Expected valid project, got %v", err)
+	}
+
+	project = base()
+	if err := Validate(project); err == nil {
+		t.Error("Expected error for undeclared secret")
+	}
+
+	project = base()
+	project.Secrets = map[string]types.Secret{"token": {Env: "TOKEN", File: "token.txt"}}
+	if err := Validate(project); err == nil {
+		t.Error("Expected error for secret with both file and env")
+	}
+}
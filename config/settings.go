@@ -0,0 +1,187 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+var (
+	// platformPattern matches os/arch[/variant] platforms such as linux/arm64/v8
+	platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+	// tagPrefixPattern matches prefixes that keep image tags valid repository names
+	tagPrefixPattern = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+)
+
+// ApplyDefaults fills in block values from the project settings, so the engine, cache
+// hashes and exports see the effective values. Inherited values are recorded on each block
+// and left out when the config is written. It can be called again after blocks are edited.
+func ApplyDefaults(project *types.Project) {
+	for i := range project.Blocks {
+		block := &project.Blocks[i]
+		stripDefaults(project.Settings, block)
+		applyBlockDefaults(project.Settings, block)
+	}
+}
+
+// applyBlockDefaults fills in the values a block does not set itself
+func applyBlockDefaults(settings types.Settings, block *types.Block) {
+	if block.Context == "" && settings.Context != "" {
+		block.Context = settings.Context
+		block.Inherited.Context = true
+	}
+	if block.Platform == "" && settings.Platform != "" {
+		block.Platform = settings.Platform
+		block.Inherited.Platform = true
+	}
+	// Env and labels carry over to images built on top, so only chain roots need them
+	if block.From != "" {
+		block.Env, block.Inherited.Env = mergeDefaults(block.Env, settings.Env)
+		block.Labels, block.Inherited.Labels = mergeDefaults(block.Labels, settings.Labels)
+	}
+}
+
+// stripDefaults removes the values a block inherited from the settings, keeping any that
+// were changed since
+func stripDefaults(settings types.Settings, block *types.Block) {
+	if block.Inherited.Context && block.Context == settings.Context {
+		block.Context = ""
+	}
+	if block.Inherited.Platform && block.Platform == settings.Platform {
+		block.Platform = ""
+	}
+	block.Env = withoutDefaults(block.Env, settings.Env, block.Inherited.Env)
+	block.Labels = withoutDefaults(block.Labels, settings.Labels, block.Inherited.Labels)
+	block.Inherited = types.Inherited{}
+}
+
+// mergeDefaults returns values with the defaults it does not set added, and the added keys.
+// The maps passed in are not modified.
+func mergeDefaults(values, defaults map[string]string) (map[string]string, []string) {
+	var added []string
+	for key := range defaults {
+		if _, ok := values[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	if len(added) == 0 {
+		return values, nil
+	}
+	sort.Strings(added)
+
+	merged := make(map[string]string, len(values)+len(added))
+	for key, value := range values {
+		merged[key] = value
+	}
+	for _, key := range added {
+		merged[key] = defaults[key]
+	}
+	return merged, added
+}
+
+// withoutDefaults returns values without the inherited keys that still hold their default
+func withoutDefaults(values, defaults map[string]string, inherited []string) map[string]string {
+	if len(inherited) == 0 {
+		return values
+	}
+	out := make(map[string]string, len(values))
+	for key, value := range values {
+		out[key] = value
+	}
+	for _, key := range inherited {
+		if value, ok := out[key]; ok && value == defaults[key] {
+			delete(out, key)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// validateSettings checks the project settings
+func validateSettings(settings types.Settings) error {
+	switch settings.PullPolicy {
+	case "", types.PullAlways, types.PullMissing, types.PullNever:
+	default:
+		return fmt.Errorf("settings: invalid pull_policy %q (expected always, missing or never)", settings.PullPolicy)
+	}
+	if err := validatePlatform(settings.Platform); err != nil {
+		return fmt.Errorf("settings: %w", err)
+	}
+	if err := validateEnv(settings.Env); err != nil {
+		return fmt.Errorf("settings: %w", err)
+	}
+	if err := validateLabels(settings.Labels); err != nil {
+		return fmt.Errorf("settings: %w", err)
+	}
+	if settings.TagPrefix != "" && !tagPrefixPattern.MatchString(settings.TagPrefix) {
+		return fmt.Errorf("settings: invalid tag_prefix %q (use lowercase letters, digits, '.', '_', '-' and '/')", settings.TagPrefix)
+	}
+	if settings.Retention.Keep != nil && *settings.Retention.Keep < 0 {
+		return fmt.Errorf("settings: retention.keep must not be negative")
+	}
+	if settings.Retention.MaxAge != "" {
+		if _, err := ParseAge(settings.Retention.MaxAge); err != nil {
+			return fmt.Errorf("settings: retention.max_age: %w", err)
+		}
+	}
+	return nil
+}
+
+// validatePlatform checks an os/arch[/variant] platform; empty means the daemon's platform
+func validatePlatform(platform string) error {
+	if platform != "" && !strings.Contains(platform, "${") && !platformPattern.MatchString(platform) {
+		return fmt.Errorf("invalid platform %q (expected os/arch[/variant], such as linux/amd64)", platform)
+	}
+	return nil
+}
+
+// validateEnv checks that ENV names are valid variable names and values fit on one line
+func validateEnv(env map[string]string) error {
+	for name, value := range env {
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid env name: %s", name)
+		}
+		if strings.Contains(value, "\n") {
+			return fmt.Errorf("env %s: values cannot contain newlines", name)
+		}
+	}
+	return nil
+}
+
+// validateLabels checks that label keys are not empty and values fit on one line
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if strings.TrimSpace(key) == "" {
+			return fmt.Errorf("label keys cannot be empty")
+		}
+		if strings.ContainsAny(key+value, "\n") {
+			return fmt.Errorf("label %q: keys and values cannot contain newlines", key)
+		}
+	}
+	return nil
+}
+
+// ParseAge parses a duration such as 90m, 72h, 7d or 2w
+func ParseAge(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number, ok := strings.CutSuffix(value, suffix); ok {
+			n, err := strconv.ParseFloat(number, 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q (use units such as m, h, d or w)", value)
+	}
+	return d, nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const settingsConfig = `version: "1.0"
+name: "settings"
+
+settings:
+  context: "./src"
+  platform: "linux/arm64"
+  pull_policy: "missing"
+  env:
+    TZ: "UTC"
+  labels:
+    team: "platform"
+
+blocks:
+  - id: "base"
+    from: "alpine:3.19"
+    env:
+      TZ: "Europe/Paris"
+    instructions:
+      - "RUN apk add --no-cache tzdata"
+
+  - id: "app"
+    from_block: "base"
+    context: "./app"
+    instructions:
+      - "COPY . /app"
+`
+
+func TestApplyDefaults(t *testing.T) {
+	project, err := ParseData([]byte(settingsConfig), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := Validate(project); err != nil {
+		t.Fatalf("Expected config to be valid: %v", err)
+	}
+
+	base, app := project.Blocks[0], project.Blocks[1]
+	if base.Context != "./src" || app.Context != "./app" {
+		t.Errorf("Expected the settings context only where a block sets none, got %q and %q", base.Context, app.Context)
+	}
+	if base.Platform != "linux/arm64" || app.Platform != "linux/arm64" {
+		t.Errorf("Expected every block to inherit the platform, got %q and %q", base.Platform, app.Platform)
+	}
+	if base.Env["TZ"] != "Europe/Paris" {
+		t.Errorf("Expected the block env to override the settings, got %v", base.Env)
+	}
+	if base.Labels["team"] != "platform" {
+		t.Errorf("Expected the root block to inherit labels, got %v", base.Labels)
+	}
+	if len(app.Env) != 0 || len(app.Labels) != 0 {
+		t.Errorf("Expected env and labels to be set on the chain root only, got %v and %v", app.Env, app.Labels)
+	}
+
+	// Applying the defaults again changes nothing
+	ApplyDefaults(project)
+	if project.Blocks[0].Labels["team"] != "platform" || len(project.Blocks[0].Inherited.Labels) != 1 {
+		t.Errorf("Expected ApplyDefaults to be repeatable, got %+v", project.Blocks[0])
+	}
+}
+
+func TestWriteKeepsDefaultsInSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+	if err := os.WriteFile(path, []byte(settingsConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project, err := Parse(path)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	// Unchanged blocks are written back as they were declared
+	if err := Write(project, path); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != settingsConfig {
+		t.Errorf("Expected an unchanged config to be written back byte for byte, got:\n%s", data)
+	}
+
+	// Edited values are kept even when they started out inherited
+	project.Blocks[1].Platform = "linux/amd64"
+	project.Blocks[0].Labels["team"] = "web"
+	if err := Write(project, path); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	written, err := Parse(path)
+	if err != nil {
+		t.Fatalf("Failed to parse written config: %v", err)
+	}
+	if written.Blocks[1].Platform != "linux/amd64" || written.Blocks[1].Inherited.Platform {
+		t.Errorf("Expected the edited platform to be declared on the block, got %+v", written.Blocks[1])
+	}
+	if written.Blocks[0].Labels["team"] != "web" {
+		t.Errorf("Expected the edited label to be declared on the block, got %v", written.Blocks[0].Labels)
+	}
+	if written.Blocks[0].Inherited.Context != true {
+		t.Errorf("Expected the context to stay inherited, got %+v", written.Blocks[0])
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tests := map[string]string{
+		"pull_policy: sometimes":        "invalid pull_policy",
+		"platform: arm64":               "invalid platform",
+		"tag_prefix: Dockstep":          "invalid tag_prefix",
+		"env:\n    \"1X\": a":           "invalid env name",
+		"env:\n    MOTD: \"a\\nb\"":     "env MOTD: values cannot contain newlines",
+		"labels:\n    note: \"a\\nb\"":  "label \"note\": keys and values cannot contain newlines",
+		"retention:\n    keep: -1":      "retention.keep must not be negative",
+		"retention:\n    max_age: soon": "retention.max_age: invalid duration",
+	}
+	for settings, want := range tests {
+		config := "version: \"1.0\"\nname: test\nsettings:\n  " + settings + "\nblocks:\n  - id: a\n    from: alpine\n"
+		project, err := ParseData([]byte(config), "dockstep.yaml")
+		if err == nil {
+			err = Validate(project)
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Settings %q: got %v, want error containing %q", settings, err, want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"72h": 72 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"90m": 90 * time.Minute,
+	}
+	for value, want := range tests {
+		got, err := ParseAge(value)
+		if err != nil || got != want {
+			t.Errorf("ParseAge(%q) = %v, %v; want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "d", "-1d", "soon"} {
+		if _, err := ParseAge(value); err == nil {
+			t.Errorf("ParseAge(%q): expected an error", value)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 
 	"dockstep.dev/types"
 )
@@ -16,29 +17,70 @@ func Validate(project *types.Project) error {
 		return fmt.Errorf("name is required")
 	}
 
+	for name := range project.Variables {
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid variable name: %s", name)
+		}
+	}
+
+	if err := validateSecrets(project.Secrets); err != nil {
+		return err
+	}
+
+	if err := validateSettings(project.Settings); err != nil {
+		return err
+	}
+
 	// Allow empty projects - users can start with no blocks
 
 	// Check for duplicate block IDs (only if there are blocks)
 	if len(project.Blocks) > 0 {
+		// A from_block may name a block declared after it
+		allBlockIDs := make(map[string]bool, len(project.Blocks))
+		for _, block := range project.Blocks {
+			allBlockIDs[block.ID] = true
+		}
+
 		blockIDs := make(map[string]bool)
+		blockSources := make(map[string]types.Block)
 		for _, block := range project.Blocks {
 			if block.ID == "" {
-				return fmt.Errorf("block ID cannot be empty")
+				return fmt.Errorf("%s: block ID cannot be empty", sourceName(block))
 			}
 
 			if blockIDs[block.ID] {
+				first := blockSources[block.ID]
+				if first.Source != "" || block.Source != "" {
+					return fmt.Errorf("duplicate block ID: %s (defined in %s and %s)", block.ID, sourceName(first), sourceName(block))
+				}
 				return fmt.Errorf("duplicate block ID: %s", block.ID)
 			}
 			blockIDs[block.ID] = true
+			blockSources[block.ID] = block
 
 			// Validate block
-			if err := validateBlock(block, blockIDs); err != nil {
+			if err := validateBlock(block, allBlockIDs); err != nil {
+				return fmt.Errorf("block %s: %w", block.ID, err)
+			}
+
+			if err := validateInstructions(block); err != nil {
+				return err
+			}
+
+			if err := validateCopyFrom(project, block); err != nil {
 				return fmt.Errorf("block %s: %w", block.ID, err)
 			}
+
+			// Secrets mounted by RUN instructions must be declared
+			for _, id := range SecretIDs(block) {
+				if _, ok := project.Secrets[id]; !ok {
+					return fmt.Errorf("block %s: secret '%s' is not defined in secrets", block.ID, id)
+				}
+			}
 		}
 
 		// Check for circular dependencies
-		if err := checkCircularDependencies(project.Blocks); err != nil {
+		if err := checkCircularDependencies(project); err != nil {
 			return err
 		}
 	}
@@ -64,6 +106,30 @@ func validateBlock(block types.Block, allBlockIDs map[string]bool) error {
 		}
 	}
 
+	for name, value := range block.Args {
+		if !variableNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid arg name: %s", name)
+		}
+		if strings.Contains(value, "\n") {
+			return fmt.Errorf("arg %s: values cannot contain newlines", name)
+		}
+	}
+
+	if err := validatePlatform(block.Platform); err != nil {
+		return err
+	}
+	if err := validateEnv(block.Env); err != nil {
+		return err
+	}
+	if err := validateLabels(block.Labels); err != nil {
+		return err
+	}
+	if block.Export != nil {
+		if err := validateLabels(block.Export.Labels); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	}
+
 	// Validate instructions array is not empty
 	if len(block.Instructions) == 0 {
 		return fmt.Errorf("instructions array cannot be empty")
@@ -72,13 +138,18 @@ func validateBlock(block types.Block, allBlockIDs map[string]bool) error {
 	return nil
 }
 
-// checkCircularDependencies checks for circular dependencies in block references
-func checkCircularDependencies(blocks []types.Block) error {
+// checkCircularDependencies checks for circular dependencies across from_block and copy_from references
+func checkCircularDependencies(project *types.Project) error {
 	// Build dependency graph
-	deps := make(map[string]string) // blockID -> parentBlockID
-	for _, block := range blocks {
+	deps := make(map[string][]string) // blockID -> blocks it depends on
+	for _, block := range project.Blocks {
 		if block.FromBlock != "" {
-			deps[block.ID] = block.FromBlock
+			deps[block.ID] = append(deps[block.ID], block.FromBlock)
+		}
+		for _, ref := range CopyRefs(project, block) {
+			if id, err := ResolveCopyRef(project, block, ref); err == nil {
+				deps[block.ID] = append(deps[block.ID], id)
+			}
 		}
 	}
 
@@ -86,9 +157,9 @@ func checkCircularDependencies(blocks []types.Block) error {
 	visited := make(map[string]bool)
 	recStack := make(map[string]bool)
 
-	for blockID := range deps {
-		if !visited[blockID] {
-			if hasCycle(blockID, deps, visited, recStack) {
+	for _, block := range project.Blocks {
+		if !visited[block.ID] {
+			if hasCycle(block.ID, deps, visited, recStack) {
 				return fmt.Errorf("circular dependency detected in block references")
 			}
 		}
@@ -98,16 +169,16 @@ func checkCircularDependencies(blocks []types.Block) error {
 }
 
 // hasCycle performs DFS to detect cycles
-func hasCycle(blockID string, deps map[string]string, visited, recStack map[string]bool) bool {
+func hasCycle(blockID string, deps map[string][]string, visited, recStack map[string]bool) bool {
 	visited[blockID] = true
 	recStack[blockID] = true
 
-	if parent, exists := deps[blockID]; exists {
-		if !visited[parent] {
-			if hasCycle(parent, deps, visited, recStack) {
+	for _, dep := range deps[blockID] {
+		if !visited[dep] {
+			if hasCycle(dep, deps, visited, recStack) {
 				return true
 			}
-		} else if recStack[parent] {
+		} else if recStack[dep] {
 			return true
 		}
 	}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// Environment variables overriding declared values. Only prefixed names are read, so a
+// variable such as HOME or PATH never picks up the value of the machine it is built on.
+const (
+	VariableEnvPrefix = "DOCKSTEP_VAR_" // DOCKSTEP_VAR_<NAME> overrides variable NAME
+	ArgEnvPrefix      = "DOCKSTEP_ARG_" // DOCKSTEP_ARG_<NAME> overrides block arg NAME
+)
+
+// variableNamePattern matches valid variable and build arg names
+var variableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// referencePattern matches ${NAME} references, and $${NAME} escapes
+var referencePattern = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ParseOverrides parses key=value pairs as given to --set
+func ParseOverrides(pairs []string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid override %q: expected key=value", pair)
+		}
+		if !variableNamePattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid variable name %q", key)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// Interpolate replaces ${NAME} references with values from vars.
+// References to unknown names are left untouched so Docker can expand them
+// (e.g. ENV or ARG values), and $${NAME} yields a literal ${NAME}.
+func Interpolate(s string, vars map[string]string) string {
+	return referencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+		name := ref[2 : len(ref)-1]
+		if value, ok := vars[name]; ok {
+			return value
+		}
+		return ref
+	})
+}
+
+// BlockVariables returns the variables visible to a block: project variables
+// and the block's args, with environment values and overrides applied on top.
+// Environment values, read from VariableEnvPrefix and ArgEnvPrefix names, only
+// apply to names declared in the config, while
+// overrides may also introduce new names. Matrix values of a variant always
+// apply, so overrides cannot collapse variants into one another.
+func BlockVariables(project *types.Project, block types.Block, overrides map[string]string) map[string]string {
+	vars := make(map[string]string)
+	for name, value := range project.IncludedVariables {
+		vars[name] = value
+	}
+	for name, value := range project.Variables {
+		vars[name] = value
+	}
+	applyOverrides(vars, overrides)
+	for name, value := range block.Variant {
+		vars[name] = value
+	}
+
+	for name, value := range resolveArgs(block, vars, overrides) {
+		vars[name] = value
+	}
+	return vars
+}
+
+// ResolveBlock returns a copy of block with variables interpolated into its
+// from, context and instructions, and its args resolved to final values
+func ResolveBlock(project *types.Project, block types.Block, overrides map[string]string) types.Block {
+	vars := BlockVariables(project, block, overrides)
+
+	resolved := block
+	resolved.From = Interpolate(block.From, vars)
+	resolved.Context = Interpolate(block.Context, vars)
+	resolved.Platform = Interpolate(block.Platform, vars)
+	resolved.Env = interpolateValues(block.Env, vars)
+	resolved.Labels = interpolateValues(block.Labels, vars)
+	if len(block.Args) > 0 {
+		resolved.Args = make(map[string]string, len(block.Args))
+		for name := range block.Args {
+			resolved.Args[name] = vars[name]
+		}
+	}
+	if block.Instructions != nil {
+		resolved.Instructions = make([]string, len(block.Instructions))
+		for i, instruction := range block.Instructions {
+			resolved.Instructions[i] = Interpolate(instruction, vars)
+		}
+	}
+	if block.CopyFrom != nil {
+		resolved.CopyFrom = make([]types.CopyFrom, len(block.CopyFrom))
+		for i, entry := range block.CopyFrom {
+			entry.Src = Interpolate(entry.Src, vars)
+			entry.Dst = Interpolate(entry.Dst, vars)
+			resolved.CopyFrom[i] = entry
+		}
+	}
+	return resolved
+}
+
+// interpolateValues interpolates the values of a map into a new map
+func interpolateValues(values, vars map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	out := make(map[string]string, len(values))
+	for key, value := range values {
+		out[key] = Interpolate(value, vars)
+	}
+	return out
+}
+
+// SortedKeys returns the keys of a string map in sorted order
+func SortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resolveArgs interpolates block args with vars and applies environment values and overrides
+func resolveArgs(block types.Block, vars, overrides map[string]string) map[string]string {
+	args := make(map[string]string, len(block.Args))
+	for name, value := range block.Args {
+		args[name] = Interpolate(value, vars)
+		if env, ok := os.LookupEnv(ArgEnvPrefix + name); ok {
+			args[name] = env
+		}
+		if override, ok := overrides[name]; ok {
+			args[name] = override
+		}
+	}
+	return args
+}
+
+// applyOverrides applies environment values for declared names, then explicit overrides
+func applyOverrides(vars, overrides map[string]string) {
+	for name := range vars {
+		if env, ok := os.LookupEnv(VariableEnvPrefix + name); ok {
+			vars[name] = env
+		}
+	}
+	for name, value := range overrides {
+		vars[name] = value
+	}
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"VERSION": "3.11", "NAME": "app"}
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"python:${VERSION}-slim", "python:3.11-slim"},
+		{"RUN echo ${NAME} ${VERSION}", "RUN echo app 3.11"},
+		{"ENV PATH=${PATH}:/app", "ENV PATH=${PATH}:/app"},
+		{"RUN echo $${NAME}", "RUN echo ${NAME}"},
+		{"RUN echo $NAME", "RUN echo $NAME"},
+		{"RUN echo ${NAME", "RUN echo ${NAME"},
+	}
+
+	for _, tt := range tests {
+		if got := Interpolate(tt.input, vars); got != tt.want {
+			t.Errorf("Interpolate(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestResolveBlock(t *testing.T) {
+	project := &types.Project{
+		Version:   "1.0",
+		Name:      "test",
+		Variables: map[string]string{"PY": "3.10", "DOCKSTEP_TEST_REGISTRY": "docker.io"},
+	}
+	block := types.Block{
+		ID:           "base",
+		From:         "${DOCKSTEP_TEST_REGISTRY}/python:${PY}",
+		Context:      "./services/${APP}",
+		Args:         map[string]string{"APP": "api", "PIP_VERSION": "pip-for-${PY}"},
+		Instructions: []string{"RUN pip install ${APP}"},
+	}
+
+	t.Setenv(VariableEnvPrefix+"DOCKSTEP_TEST_REGISTRY", "registry.local")
+
+	resolved := ResolveBlock(project, block, map[string]string{"PY": "3.12"})
+
+	if resolved.From != "registry.local/python:3.12" {
+		t.Errorf("Expected from registry.local/python:3.12, got %s", resolved.From)
+	}
+	if resolved.Context != "./services/api" {
+		t.Errorf("Expected context ./services/api, got %s", resolved.Context)
+	}
+	if resolved.Instructions[0] != "RUN pip install api" {
+		t.Errorf("Expected interpolated instruction, got %s", resolved.Instructions[0])
+	}
+	if resolved.Args["PIP_VERSION"] != "pip-for-3.12" {
+		t.Errorf("Expected arg to be interpolated with override, got %s", resolved.Args["PIP_VERSION"])
+	}
+
+	// The original block must not be modified
+	if block.Instructions[0] != "RUN pip install ${APP}" {
+		t.Errorf("ResolveBlock modified the original block: %s", block.Instructions[0])
+	}
+}
+
+func TestResolveBlockIgnoresHostEnvironment(t *testing.T) {
+	project := &types.Project{
+		Version:   "1.0",
+		Name:      "test",
+		Variables: map[string]string{"HOME": "/srv/app"},
+	}
+	block := types.Block{
+		ID:           "base",
+		From:         "alpine",
+		Args:         map[string]string{"PATH": "/opt/bin", "PORT": "8080"},
+		Instructions: []string{"RUN echo ${HOME} ${PATH} ${PORT}"},
+	}
+
+	// Unprefixed names are the host's own, and never replace declared values
+	t.Setenv("HOME", "/root")
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv(ArgEnvPrefix+"PORT", "9090")
+
+	resolved := ResolveBlock(project, block, nil)
+	if want := "RUN echo /srv/app /opt/bin 9090"; resolved.Instructions[0] != want {
+		t.Errorf("Instruction = %q, want %q", resolved.Instructions[0], want)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	overrides, err := ParseOverrides([]string{"A=1", "B=x=y", "C="})
+	if err != nil {
+		t.Fatalf("Failed to parse overrides: %v", err)
+	}
+	if overrides["A"] != "1" || overrides["B"] != "x=y" || overrides["C"] != "" {
+		t.Errorf("Unexpected overrides: %v", overrides)
+	}
+
+	if _, err := ParseOverrides([]string{"missing-equals"}); err == nil {
+		t.Error("Expected error for override without '='")
+	}
+	if _, err := ParseOverrides([]string{"1BAD=x"}); err == nil {
+		t.Error("Expected error for invalid variable name")
+	}
+}
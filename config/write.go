@@ -9,12 +9,60 @@ import (
 )
 
 // Write persists the project configuration back to a YAML file at the given path.
+// Matrix variants are written back as the matrix block they were expanded from,
+// and blocks loaded from included files are left to those files. An existing file is
+// patched rather than rewritten, so comments and formatting outside the changed
+// blocks are kept, and the file is replaced atomically. When the existing file cannot
+// be patched it is left as it is and an error is returned.
 func Write(project *types.Project, path string) error {
-	data, err := yaml.Marshal(project)
+	declared, err := declaredProject(project)
 	if err != nil {
-		return fmt.Errorf("failed to marshal YAML: %w", err)
+		return err
 	}
-	if err := os.WriteFile(path, data, 0644); err != nil {
+	var data []byte
+	existing, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		data, err = patchConfig(existing, declared)
+		if err != nil {
+			return fmt.Errorf("cannot update %s without losing its formatting: %w", path, err)
+		}
+	case os.IsNotExist(err):
+		data, err = yaml.Marshal(declared)
+		if err != nil {
+			return fmt.Errorf("failed to marshal YAML: %w", err)
+		}
+	default:
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	return nil
+}
+
+// declaredProject returns the project as it is declared in its own config file, without
+// the values blocks inherit from the settings
+func declaredProject(project *types.Project) (*types.Project, error) {
+	declared := *project
+	declared.Blocks = nil
+	for _, block := range project.Blocks {
+		if block.Source == "" {
+			stripDefaults(project.Settings, &block)
+			declared.Blocks = append(declared.Blocks, block)
+		}
+	}
+	blocks, err := collapseMatrix(declared.Blocks)
+	if err != nil {
+		return nil, err
+	}
+	declared.Blocks = blocks
+	return &declared, nil
+}
+
+// WriteData writes raw config content to path, replacing the file atomically
+func WriteData(path string, data []byte) error {
+	if err := writeFileAtomic(path, data, 0644); err != nil {
 		return fmt.Errorf("failed to write config file: %w", err)
 	}
 	return nil
@@ -0,0 +1,220 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+const commentedConfig = `# Project comment
+version: "1.0"
+name: "commented"
+
+variables:
+  base_image: &image "alpine:3.19"   # pinned
+
+settings:
+  shell: "/bin/sh"
+
+blocks:
+  # The base block
+  - id: "base"
+    from: *image
+    instructions:
+      - "RUN apk add --no-cache curl"   # tools
+      # trailing note
+
+  # Python variants
+  - id: "test"
+    from: "python:${version}"
+    matrix:
+      version: ["3.11", "3.12"]
+    instructions:
+      - 'RUN python --version'
+
+  - id: "app"
+    from_block: "base"
+    instructions:
+      - "COPY . /app"
+
+# Footer comment
+`
+
+// writeConfig writes content to a temporary config file and parses it
+func writeConfig(t *testing.T, content string) (*types.Project, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	project, err := Parse(path)
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	return project, path
+}
+
+// writeAndRead writes a project and returns the resulting file content
+func writeAndRead(t *testing.T, project *types.Project, path string) string {
+	t.Helper()
+	if err := Write(project, path); err != nil {
+		t.Fatalf("Failed to write project: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if _, err := Parse(path); err != nil {
+		t.Fatalf("Written config does not parse: %v\n%s", err, data)
+	}
+	return string(data)
+}
+
+// findBlock returns a pointer to the block with the given ID
+func findBlock(t *testing.T, project *types.Project, id string) *types.Block {
+	t.Helper()
+	for i := range project.Blocks {
+		if project.Blocks[i].ID == id {
+			return &project.Blocks[i]
+		}
+	}
+	t.Fatalf("Block %s not found", id)
+	return nil
+}
+
+func TestWriteUnchanged(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	if got := writeAndRead(t, project, path); got != commentedConfig {
+		t.Errorf("Unchanged write modified the file:\n%s", got)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the config file to remain, got %d entries", len(entries))
+	}
+}
+
+func TestWriteEditBlock(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	app := findBlock(t, project, "app")
+	app.Instructions = append(app.Instructions, "RUN make")
+
+	got := writeAndRead(t, project, path)
+	want := strings.Replace(commentedConfig, `      - "COPY . /app"
+`, `      - "COPY . /app"
+      - "RUN make"
+`, 1)
+	if got != want {
+		t.Errorf("Edit changed more than the block:\n%s", got)
+	}
+}
+
+func TestWriteEditKeepsComments(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	base := findBlock(t, project, "base")
+	base.Description = "Base tools"
+
+	got := writeAndRead(t, project, path)
+	for _, kept := range []string{"# The base block", "from: *image", "# tools", "# trailing note", "# Python variants", "# Footer comment"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("Expected %q to be kept:\n%s", kept, got)
+		}
+	}
+	if !strings.Contains(got, `    description: "Base tools"`) {
+		t.Errorf("Expected the description in the file's quoting style:\n%s", got)
+	}
+	if strings.Count(got, "# The base block") != 1 || strings.Count(got, "# trailing note") != 1 {
+		t.Errorf("Expected comments not to be duplicated:\n%s", got)
+	}
+}
+
+func TestWriteRemoveBlock(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	var blocks []types.Block
+	for _, block := range project.Blocks {
+		if block.TemplateID() != "test" {
+			blocks = append(blocks, block)
+		}
+	}
+	project.Blocks = blocks
+
+	got := writeAndRead(t, project, path)
+	want := strings.Replace(commentedConfig, `  # Python variants
+  - id: "test"
+    from: "python:${version}"
+    matrix:
+      version: ["3.11", "3.12"]
+    instructions:
+      - 'RUN python --version'
+
+`, "", 1)
+	if got != want {
+		t.Errorf("Removal changed more than the block:\n%s", got)
+	}
+}
+
+func TestWriteAddBlock(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	project.Blocks = append(project.Blocks, types.Block{
+		ID:           "worker",
+		FromBlock:    "base",
+		Instructions: []string{"RUN echo worker"},
+	})
+
+	got := writeAndRead(t, project, path)
+	want := strings.Replace(commentedConfig, `      - "COPY . /app"
+`, `      - "COPY . /app"
+
+  - id: "worker"
+    from_block: "base"
+    instructions:
+      - "RUN echo worker"
+`, 1)
+	if got != want {
+		t.Errorf("Added block does not match the file's style:\n%s", got)
+	}
+}
+
+func TestWriteTopLevelChange(t *testing.T) {
+	project, path := writeConfig(t, commentedConfig)
+	project.Name = "renamed"
+
+	got := writeAndRead(t, project, path)
+	for _, kept := range []string{"# Project comment", "&image", "*image", "# pinned", "# The base block", "# Footer comment", `name: "renamed"`} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("Expected %q in the written file:\n%s", kept, got)
+		}
+	}
+}
+
+func TestWriteUnpatchableFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+	original := "# not a project\n- alpine\n- debian\n"
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project := &types.Project{Version: "1.0", Name: "new", Blocks: []types.Block{{ID: "base", From: "alpine:3.19"}}}
+
+	// The file is never replaced with a plain rendering that drops its content
+	if err := Write(project, path); err == nil || !strings.Contains(err.Error(), "without losing its formatting") {
+		t.Errorf("Expected an error for a file that cannot be patched, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Errorf("Expected the file to be left as it was, got:\n%s", data)
+	}
+}
+
+func TestWriteNewFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+	project := &types.Project{Version: "1.0", Name: "new", Blocks: []types.Block{{ID: "base", From: "alpine:3.19"}}}
+	got := writeAndRead(t, project, path)
+	if !strings.Contains(got, "id: base") {
+		t.Errorf("Unexpected new file content:\n%s", got)
+	}
+}
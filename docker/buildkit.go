@@ -0,0 +1,76 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	controlapi "github.com/moby/buildkit/api/services/control"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// buildkitTraceID is the aux message ID BuildKit uses for progress updates
+const buildkitTraceID = "moby.buildkit.trace"
+
+// startSecretsSession starts a BuildKit session that serves the given secrets to the daemon.
+// The caller must close the returned session once the build has finished.
+func (c *Client) startSecretsSession(ctx context.Context, secrets map[string][]byte) (*session.Session, error) {
+	sess, err := session.NewSession(ctx, "dockstep", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build session: %w", err)
+	}
+	sess.Allow(secretsprovider.FromMap(secrets))
+
+	dialSession := func(ctx context.Context, proto string, meta map[string][]string) (net.Conn, error) {
+		return c.client.DialHijack(ctx, "/session", proto, meta)
+	}
+	go func() {
+		// Run blocks until the session is closed or the connection fails; build errors surface separately
+		_ = sess.Run(ctx, dialSession)
+	}()
+
+	return sess, nil
+}
+
+// buildkitProgress turns BuildKit trace messages into plain log output
+type buildkitProgress struct {
+	started map[digest.Digest]bool
+}
+
+func newBuildkitProgress() *buildkitProgress {
+	return &buildkitProgress{started: make(map[digest.Digest]bool)}
+}
+
+// decode renders one trace message as log lines
+func (p *buildkitProgress) decode(aux json.RawMessage) ([]byte, error) {
+	var data []byte
+	if err := json.Unmarshal(aux, &data); err != nil {
+		return nil, err
+	}
+	var status controlapi.StatusResponse
+	if err := status.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, vertex := range status.Vertexes {
+		if vertex.Started != nil && !p.started[vertex.Digest] {
+			p.started[vertex.Digest] = true
+			line := vertex.Name
+			if vertex.Cached {
+				line += " (cached)"
+			}
+			out = append(out, []byte(line+"\n")...)
+		}
+		if vertex.Error != "" {
+			out = append(out, []byte(fmt.Sprintf("Error: %s\n", vertex.Error))...)
+		}
+	}
+	for _, log := range status.Logs {
+		out = append(out, log.Msg...)
+	}
+	return out, nil
+}
@@ -10,9 +10,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"dockstep.dev/types"
 	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/versions"
 	"github.com/docker/docker/client"
 )
 
@@ -28,6 +31,18 @@ type JSONMessage struct {
 	ErrorDetail struct {
 		Message string `json:"message"`
 	} `json:"errorDetail"`
+	ID  string          `json:"id"`
+	Aux json.RawMessage `json:"aux"`
+}
+
+// BuildOptions holds the per-build settings passed to the Docker daemon
+type BuildOptions struct {
+	Tag       string
+	BuildArgs map[string]string
+	// Secrets are served to RUN --mount=type=secret through a BuildKit session
+	Secrets  map[string][]byte
+	Labels   map[string]string
+	Platform string // os/arch[/variant]; empty for the daemon's platform
 }
 
 // NewClient creates a new Docker client
@@ -42,16 +57,20 @@ func NewClient() (*Client, error) {
 
 // PullImage pulls an image from registry
 func (c *Client) PullImage(ctx context.Context, ref string) error {
-	reader, err := c.client.ImagePull(ctx, ref, dockerTypes.ImagePullOptions{})
+	return c.PullImageForPlatform(ctx, ref, "")
+}
+
+// PullImageForPlatform pulls an image for a platform, or the daemon's platform when empty
+func (c *Client) PullImageForPlatform(ctx context.Context, ref, platform string) error {
+	reader, err := c.client.ImagePull(ctx, ref, dockerTypes.ImagePullOptions{Platform: platform})
 	if err != nil {
 		return fmt.Errorf("failed to pull image %s: %w", ref, err)
 	}
 	defer reader.Close()
 
 	// Read the response to completion
-	_, err = io.Copy(io.Discard, reader)
-	if err != nil {
-		return fmt.Errorf("failed to read pull response: %w", err)
+	if err := readProgress(reader); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", ref, err)
 	}
 
 	return nil
@@ -64,6 +83,13 @@ func (c *Client) BuildImage(ctx context.Context, contextDir, dockerfileContent s
 
 // BuildImageWithLogs builds a Docker image from a Dockerfile and streams logs via callback
 func (c *Client) BuildImageWithLogs(ctx context.Context, contextDir, dockerfileContent string, tag string, logCallback func([]byte)) (string, error) {
+	return c.BuildImageWithOptions(ctx, contextDir, dockerfileContent, BuildOptions{Tag: tag}, logCallback)
+}
+
+// BuildImageWithOptions builds a Docker image with build args and streams logs via callback
+func (c *Client) BuildImageWithOptions(ctx context.Context, contextDir, dockerfileContent string, opts BuildOptions, logCallback func([]byte)) (string, error) {
+	tag := opts.Tag
+
 	// Create a tar archive of the build context
 	tarReader, err := c.createContextTar(contextDir)
 	if err != nil {
@@ -71,13 +97,34 @@ func (c *Client) BuildImageWithLogs(ctx context.Context, contextDir, dockerfileC
 	}
 	defer tarReader.Close()
 
+	buildArgs := make(map[string]*string, len(opts.BuildArgs))
+	for name, value := range opts.BuildArgs {
+		value := value
+		buildArgs[name] = &value
+	}
+
 	// Build the image
 	buildOptions := dockerTypes.ImageBuildOptions{
 		Tags:       []string{tag},
 		Dockerfile: "Dockerfile",
 		Remove:     true,
 		NoCache:    false, // Allow caching for now
+		BuildArgs:  buildArgs,
+		Labels:     opts.Labels,
+		Platform:   opts.Platform,
+	}
+
+	// Secret mounts are only available with BuildKit, which needs a session to fetch them from
+	if len(opts.Secrets) > 0 {
+		sess, err := c.startSecretsSession(ctx, opts.Secrets)
+		if err != nil {
+			return "", err
+		}
+		defer sess.Close()
+		buildOptions.Version = dockerTypes.BuilderBuildKit
+		buildOptions.SessionID = sess.ID()
 	}
+	progress := newBuildkitProgress()
 
 	buildResponse, err := c.client.ImageBuild(ctx, tarReader, buildOptions)
 	if err != nil {
@@ -110,6 +157,13 @@ func (c *Client) BuildImageWithLogs(ctx context.Context, contextDir, dockerfileC
 			logCallback([]byte(message.Stream))
 		}
 
+		// BuildKit reports progress as encoded trace messages
+		if message.ID == buildkitTraceID && len(message.Aux) > 0 {
+			if out, err := progress.decode(message.Aux); err == nil && len(out) > 0 && logCallback != nil {
+				logCallback(out)
+			}
+		}
+
 		// Handle errors
 		if message.Error != "" {
 			if logCallback != nil {
@@ -230,6 +284,18 @@ func (c *Client) createContextTar(contextDir string) (io.ReadCloser, error) {
 	return pipeReader, nil
 }
 
+// ImageExists reports whether an image is available locally
+func (c *Client) ImageExists(ctx context.Context, ref string) (bool, error) {
+	_, _, err := c.client.ImageInspectWithRaw(ctx, ref)
+	if err == nil {
+		return true, nil
+	}
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+}
+
 // InspectImage inspects an image and returns its digest
 func (c *Client) InspectImage(ctx context.Context, ref string) (string, error) {
 	img, _, err := c.client.ImageInspectWithRaw(ctx, ref)
@@ -250,6 +316,94 @@ func (c *Client) InspectImage(ctx context.Context, ref string) (string, error) {
 	return img.ID, nil
 }
 
+// RepoDigest returns the registry digest (sha256:...) of a local image, or an empty
+// string when the image was never pulled from or pushed to a registry
+func (c *Client) RepoDigest(ctx context.Context, ref string) (string, error) {
+	img, _, err := c.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+	for _, repoDigest := range img.RepoDigests {
+		if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+			return digest, nil
+		}
+	}
+	return "", nil
+}
+
+// ImageHistory returns the build history of an image, oldest layer first
+func (c *Client) ImageHistory(ctx context.Context, ref string) ([]types.HistoryEntry, error) {
+	items, err := c.client.ImageHistory(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history of image %s: %w", ref, err)
+	}
+
+	// Docker returns the newest layer first
+	history := make([]types.HistoryEntry, 0, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		item := items[i]
+		history = append(history, types.HistoryEntry{
+			ID:        item.ID,
+			CreatedBy: item.CreatedBy,
+			Created:   time.Unix(item.Created, 0).UTC(),
+			Tags:      item.Tags,
+			Size:      item.Size,
+			Comment:   item.Comment,
+		})
+	}
+	return history, nil
+}
+
+// ImageRefs returns a reference for every tagged local image, preferring repo digests
+func (c *Client) ImageRefs(ctx context.Context) ([]string, error) {
+	images, err := c.client.ImageList(ctx, dockerTypes.ImageListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	var refs []string
+	for _, img := range images {
+		switch {
+		case len(img.RepoDigests) > 0 && !strings.HasPrefix(img.RepoDigests[0], "<none>"):
+			refs = append(refs, img.RepoDigests[0])
+		case len(img.RepoTags) > 0 && !strings.HasPrefix(img.RepoTags[0], "<none>"):
+			refs = append(refs, img.RepoTags[0])
+		}
+	}
+	return refs, nil
+}
+
+// ImageTags returns the tags of local images whose reference matches a pattern such as
+// dockstep-app-*
+func (c *Client) ImageTags(ctx context.Context, pattern string) ([]string, error) {
+	images, err := c.client.ImageList(ctx, dockerTypes.ImageListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", pattern)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	var tags []string
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if !strings.HasPrefix(tag, "<none>") {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// UntagImage removes a tag, deleting the image once no tag or child image refers to it.
+// Tags that no longer exist are ignored.
+func (c *Client) UntagImage(ctx context.Context, tag string) error {
+	_, err := c.client.ImageRemove(ctx, tag, dockerTypes.ImageRemoveOptions{PruneChildren: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return fmt.Errorf("failed to remove tag %s: %w", tag, err)
+	}
+	return nil
+}
+
 // TagImage tags an image with a new name
 func (c *Client) TagImage(ctx context.Context, source, target string) error {
 	err := c.client.ImageTag(ctx, source, target)
@@ -268,9 +422,8 @@ func (c *Client) PushImage(ctx context.Context, ref string) error {
 	defer reader.Close()
 
 	// Read the response to completion
-	_, err = io.Copy(io.Discard, reader)
-	if err != nil {
-		return fmt.Errorf("failed to read push response: %w", err)
+	if err := readProgress(reader); err != nil {
+		return fmt.Errorf("failed to push image %s: %w", ref, err)
 	}
 
 	return nil
@@ -302,6 +455,39 @@ func (c *Client) DeleteImage(ctx context.Context, imageRef string) error {
 	return nil
 }
 
+// MinAPIVersion is the oldest Docker API dockstep supports; BuildKit builds need 1.39
+const MinAPIVersion = "1.39"
+
+// DaemonInfo describes the Docker daemon the client talks to
+type DaemonInfo struct {
+	Version       string // Docker version of the daemon
+	APIVersion    string // newest API version the daemon supports
+	ClientVersion string // API version negotiated with the daemon
+	OS            string
+	Arch          string
+}
+
+// DaemonInfo checks that the daemon is reachable and returns its versions
+func (c *Client) DaemonInfo(ctx context.Context) (*DaemonInfo, error) {
+	version, err := c.client.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the Docker daemon: %w", err)
+	}
+	c.client.NegotiateAPIVersion(ctx)
+	return &DaemonInfo{
+		Version:       version.Version,
+		APIVersion:    version.APIVersion,
+		ClientVersion: c.client.ClientVersion(),
+		OS:            version.Os,
+		Arch:          version.Arch,
+	}, nil
+}
+
+// Supported reports whether the daemon's API is recent enough for dockstep
+func (i *DaemonInfo) Supported() bool {
+	return !versions.LessThan(i.APIVersion, MinAPIVersion)
+}
+
 // Close closes the Docker client
 func (c *Client) Close() error {
 	return c.client.Close()
@@ -0,0 +1,166 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+)
+
+// ProjectImages returns the local images labeled as built in a project's checkout, by the
+// project ID of its store, mapping each image ID to its registry digests
+func (c *Client) ProjectImages(ctx context.Context, projectID string) (map[string][]string, error) {
+	images, err := c.client.ImageList(ctx, dockerTypes.ImageListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", types.LabelProjectID+"="+projectID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	out := make(map[string][]string, len(images))
+	for _, img := range images {
+		var digests []string
+		for _, repoDigest := range img.RepoDigests {
+			if _, digest, ok := strings.Cut(repoDigest, "@"); ok {
+				digests = append(digests, digest)
+			}
+		}
+		out[img.ID] = digests
+	}
+	return out, nil
+}
+
+// ImageDiskUsage returns the space used by all image layers, and the space each image
+// uses on its own, by image ID
+func (c *Client) ImageDiskUsage(ctx context.Context) (int64, map[string]int64, error) {
+	usage, err := c.client.DiskUsage(ctx, dockerTypes.DiskUsageOptions{
+		Types: []dockerTypes.DiskUsageObject{dockerTypes.ImageObject},
+	})
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get disk usage: %w", err)
+	}
+	sizes := make(map[string]int64, len(usage.Images))
+	for _, img := range usage.Images {
+		size := img.Size
+		if img.SharedSize > 0 {
+			size -= img.SharedSize
+		}
+		sizes[img.ID] = size
+	}
+	return usage.LayersSize, sizes, nil
+}
+
+// RemoveImages removes images by ID or digest along with their tags, newest first so
+// child images go before their parents. Images that no longer exist are ignored; images
+// still used by a container or another image are left in place and returned as skipped.
+func (c *Client) RemoveImages(ctx context.Context, refs []string) (removed, skipped []string, err error) {
+	type image struct {
+		id      string
+		tags    []string
+		created string
+	}
+	var images []image
+	for _, ref := range refs {
+		img, _, err := c.client.ImageInspectWithRaw(ctx, ref)
+		if err != nil {
+			if client.IsErrNotFound(err) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+		}
+		images = append(images, image{id: img.ID, tags: img.RepoTags, created: img.Created})
+	}
+	// Created is an RFC 3339 timestamp, which sorts as a string
+	sort.SliceStable(images, func(i, j int) bool { return images[i].created > images[j].created })
+
+	for _, img := range images {
+		// Removing each tag deletes the image with the last one, without forcing the
+		// removal of an image that is still in use
+		inUse := false
+		for _, target := range append(img.tags, img.id) {
+			_, err := c.client.ImageRemove(ctx, target, dockerTypes.ImageRemoveOptions{PruneChildren: true})
+			switch {
+			case err == nil || client.IsErrNotFound(err):
+			case errdefs.IsConflict(err):
+				inUse = true
+			default:
+				return removed, skipped, fmt.Errorf("failed to remove image %s: %w", img.id, err)
+			}
+		}
+		if inUse {
+			skipped = append(skipped, img.id)
+			continue
+		}
+		removed = append(removed, img.id)
+	}
+	return removed, skipped, nil
+}
+
+// ImageInfo returns the ID and labels of a local image
+func (c *Client) ImageInfo(ctx context.Context, ref string) (string, map[string]string, error) {
+	img, _, err := c.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to inspect image %s: %w", ref, err)
+	}
+	var labels map[string]string
+	if img.Config != nil {
+		labels = img.Config.Labels
+	}
+	return img.ID, labels, nil
+}
+
+// SaveImages writes images and their tags to w as a tar archive, like docker save
+func (c *Client) SaveImages(ctx context.Context, refs []string, w io.Writer) error {
+	reader, err := c.client.ImageSave(ctx, refs)
+	if err != nil {
+		return fmt.Errorf("failed to save images: %w", err)
+	}
+	defer reader.Close()
+	if _, err := io.Copy(w, reader); err != nil {
+		return fmt.Errorf("failed to save images: %w", err)
+	}
+	return nil
+}
+
+// LoadImages loads images from a tar archive written by SaveImages, like docker load
+func (c *Client) LoadImages(ctx context.Context, r io.Reader) error {
+	response, err := c.client.ImageLoad(ctx, r, true)
+	if err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	defer response.Body.Close()
+	if err := readProgress(response.Body); err != nil {
+		return fmt.Errorf("failed to load images: %w", err)
+	}
+	return nil
+}
+
+// readProgress reads a stream of JSON progress messages to the end, returning the first
+// error it reports
+func readProgress(r io.Reader) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var message JSONMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read response: %w", err)
+		}
+		if message.ErrorDetail.Message != "" {
+			return errors.New(message.ErrorDetail.Message)
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+	}
+}
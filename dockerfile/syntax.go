@@ -0,0 +1,78 @@
+// Package dockerfile renders the Dockerfile syntax shared by the exporter and the engine
+package dockerfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExecForm renders arguments as the JSON array used by exec-form ENTRYPOINT, CMD and RUN
+func ExecForm(args []string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	// Keep characters such as & and < readable; Docker parses the array as plain JSON
+	encoder.SetEscapeHTML(false)
+	if args == nil {
+		args = []string{}
+	}
+	_ = encoder.Encode(args)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// EnvLines renders one ENV instruction per key, sorted by key. Values are quoted but $
+// is left alone, so references such as ${PATH} are expanded by Docker.
+func EnvLines(values map[string]string) []string {
+	return keyValueLines("ENV", values, quoteExpanded)
+}
+
+// LabelLines renders one LABEL instruction per key, sorted by key, with values kept literal
+func LabelLines(values map[string]string) []string {
+	return keyValueLines("LABEL", values, QuoteString)
+}
+
+// keyValueLines renders one instruction per key, sorted by key, quoting values with quote
+func keyValueLines(keyword string, values map[string]string, quote func(string) string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("%s %s=%s", keyword, quoteKey(key), quote(values[key])))
+	}
+	return lines
+}
+
+// quoteKey quotes a LABEL or ENV key when it contains characters that would end the key
+func quoteKey(key string) string {
+	if key != "" && !strings.ContainsAny(key, " \t\"'\\$=") {
+		return key
+	}
+	return QuoteString(key)
+}
+
+// QuoteArgValue quotes an ARG default when it contains whitespace or quotes
+func QuoteArgValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\"'\\$") {
+		return value
+	}
+	return QuoteString(value)
+}
+
+// QuoteString double-quotes a value, escaping characters Docker would otherwise interpret.
+// Dockerfile quoting has no escape for newlines, so validation rejects values with them.
+func QuoteString(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`)
+	return `"` + replacer.Replace(value) + `"`
+}
+
+// quoteExpanded double-quotes a value whose variable references Docker should expand
+func quoteExpanded(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + replacer.Replace(value) + `"`
+}
@@ -0,0 +1,37 @@
+package dockerfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExecForm(t *testing.T) {
+	tests := map[string][]string{
+		`["node","server.js"]`:      {"node", "server.js"},
+		`["sh","-c","a && b > /x"]`: {"sh", "-c", "a && b > /x"},
+		`["echo","say \"hi\""]`:     {"echo", `say "hi"`},
+		`[]`:                        nil,
+	}
+	for want, args := range tests {
+		if got := ExecForm(args); got != want {
+			t.Errorf("ExecForm(%q) = %s, want %s", args, got, want)
+		}
+	}
+}
+
+func TestLabelLines(t *testing.T) {
+	got := LabelLines(map[string]string{"team": "web", "a b": "x\"y", "price": "$5"})
+	want := []string{`LABEL "a b"="x\"y"`, `LABEL price="\$5"`, `LABEL team="web"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LabelLines = %q, want %q", got, want)
+	}
+}
+
+func TestEnvLines(t *testing.T) {
+	// Docker expands references in ENV values, so $ is kept
+	got := EnvLines(map[string]string{"PATH": "/opt/bin:${PATH}", "GREETING": `say "hi"`})
+	want := []string{`ENV GREETING="say \"hi\""`, `ENV PATH="/opt/bin:${PATH}"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("EnvLines = %q, want %q", got, want)
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"strings"
 	"time"
 
+	"dockstep.dev/config"
 	"dockstep.dev/docker"
+	"dockstep.dev/dockerfile"
 	"dockstep.dev/store"
 	"dockstep.dev/types"
 )
@@ -20,18 +22,24 @@ type Engine struct {
 	dockerClient *docker.Client
 	store        *store.Store
 	cache        *store.Cache
+	shared       *store.Cache // machine-wide cache, nil unless the project enables it
 	project      *types.Project
 	projectRoot  string
 	contextPath  string
+	variables    map[string]string
 }
 
 // NewEngine creates a new Engine instance
 func NewEngine(dockerClient *docker.Client, store *store.Store, project *types.Project, projectRoot string) *Engine {
 	cache := store.NewCache()
+	if dockerClient != nil {
+		cache.SetImageCheck(dockerClient.ImageExists, 0)
+	}
 	return &Engine{
 		dockerClient: dockerClient,
 		store:        store,
 		cache:        cache,
+		shared:       openSharedCache(dockerClient, project),
 		project:      project,
 		projectRoot:  projectRoot,
 		contextPath:  projectRoot, // Default to project root
@@ -41,16 +49,42 @@ func NewEngine(dockerClient *docker.Client, store *store.Store, project *types.P
 // NewEngineWithContext creates a new Engine instance with a custom context path
 func NewEngineWithContext(dockerClient *docker.Client, store *store.Store, project *types.Project, projectRoot, contextPath string) *Engine {
 	cache := store.NewCache()
+	if dockerClient != nil {
+		cache.SetImageCheck(dockerClient.ImageExists, 0)
+	}
 	return &Engine{
 		dockerClient: dockerClient,
 		store:        store,
 		cache:        cache,
+		shared:       openSharedCache(dockerClient, project),
 		project:      project,
 		projectRoot:  projectRoot,
 		contextPath:  contextPath,
 	}
 }
 
+// openSharedCache opens the machine-wide cache when the project's settings enable it. A
+// cache that cannot be opened only disables sharing.
+func openSharedCache(dockerClient *docker.Client, project *types.Project) *store.Cache {
+	if project == nil || !project.Settings.SharedCache {
+		return nil
+	}
+	dir, err := store.SharedCacheDir()
+	if err != nil {
+		fmt.Printf("Warning: shared cache disabled: %v\n", err)
+		return nil
+	}
+	cache, err := store.OpenSharedCache(dir)
+	if err != nil {
+		fmt.Printf("Warning: shared cache disabled: %v\n", err)
+		return nil
+	}
+	if dockerClient != nil {
+		cache.SetImageCheck(dockerClient.ImageExists, 0)
+	}
+	return cache
+}
+
 // GetProject returns the project configuration
 func (e *Engine) GetProject() *types.Project {
 	return e.project
@@ -61,18 +95,30 @@ func (e *Engine) SetProject(project *types.Project) {
 	e.project = project
 }
 
-// RunBlock executes a single block
-func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOptions) error {
-	// Find the block
-	var block types.Block
-	found := false
+// SetVariables sets variable overrides (e.g. from --set) applied on top of project variables and block args
+func (e *Engine) SetVariables(variables map[string]string) {
+	e.variables = variables
+}
+
+// Variables returns the variable overrides used when resolving blocks
+func (e *Engine) Variables() map[string]string {
+	return e.variables
+}
+
+// findBlock returns the block with the given ID with its variables resolved
+func (e *Engine) findBlock(blockID string) (types.Block, bool) {
 	for _, b := range e.project.Blocks {
 		if b.ID == blockID {
-			block = b
-			found = true
-			break
+			return config.ResolveBlock(e.project, b, e.variables), true
 		}
 	}
+	return types.Block{}, false
+}
+
+// RunBlock executes a single block
+func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOptions) error {
+	// Find the block
+	block, found := e.findBlock(blockID)
 	if !found {
 		return fmt.Errorf("block %s not found", blockID)
 	}
@@ -83,13 +129,46 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 		return fmt.Errorf("failed to resolve parent digest: %w", err)
 	}
 
+	// Resolve the digests of the blocks this block copies files from
+	copyDigests, err := e.resolveCopySources(ctx, block)
+	if err != nil {
+		return fmt.Errorf("failed to resolve copy sources: %w", err)
+	}
+
+	// Load secrets mounted by the block. Their values are redacted from stored logs
+	// and only contribute a fingerprint to the cache hash.
+	secrets, err := config.LoadSecrets(e.project, e.projectRoot, config.SecretIDs(block))
+	if err != nil {
+		return fmt.Errorf("failed to load secrets: %w", err)
+	}
+	for _, value := range secrets {
+		e.store.AddRedactions(value)
+	}
+
 	// Compute cache hash
-	hash := store.ComputeBlockHash(block, parentDigest)
+	inputs := store.BlockInputs{
+		ParentDigest: parentDigest,
+		CopyDigests:  copyDigests,
+		Secrets:      secrets,
+	}
+	if len(secrets) > 0 {
+		if inputs.SecretKey, err = e.store.SecretKey(); err != nil {
+			return err
+		}
+	}
+	hash := store.ComputeBlockHashWithInputs(block, inputs)
 
 	// Check cache if not forced
 	fmt.Printf("DEBUG: Force flag: %v, Hash: %s\n", opts.Force, hash)
 	if !opts.Force {
-		if cachedDigest, exists := e.cache.GetCachedDigest(hash); exists {
+		cachedDigest, exists, evicted := e.cache.GetVerifiedDigest(ctx, hash)
+		if evicted != "" {
+			fmt.Printf("Warning: cached image %s of block %s no longer exists; rebuilding\n", evicted, blockID)
+		}
+		if !exists {
+			cachedDigest, exists = e.sharedCacheHit(ctx, block, inputs, hash)
+		}
+		if exists {
 			fmt.Printf("DEBUG: Found cached digest: %s\n", cachedDigest)
 
 			// Load existing logs from previous successful run
@@ -121,6 +200,7 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 			if err := e.store.SaveBlockState(blockID, state); err != nil {
 				return fmt.Errorf("failed to save cached state: %w", err)
 			}
+			e.tagImage(ctx, block, cachedDigest, hash)
 			return nil
 		} else {
 			fmt.Printf("DEBUG: No cached digest found\n")
@@ -129,16 +209,17 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 		fmt.Printf("DEBUG: Force flag is true, skipping cache\n")
 	}
 
-	// Update state to running
+	// Update state to running, recording this process so an interrupted run can be detected
 	state := &types.BlockState{
 		ID:        blockID,
-		Status:    types.StatusRunning,
 		Hash:      hash,
 		Timestamp: time.Now(),
 	}
+	store.MarkRunning(state)
 	if err := e.store.SaveBlockState(blockID, state); err != nil {
 		return fmt.Errorf("failed to save running state: %w", err)
 	}
+	stopHeartbeat := e.store.StartHeartbeat(state)
 
 	// Clear logs before starting a fresh build (not cached)
 	if err := e.store.ClearLogs(blockID); err != nil {
@@ -147,8 +228,12 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 
 	// Build the block
 	startTime := time.Now()
-	digest, err := e.buildBlock(ctx, block, parentImageRef)
+	digest, err := e.buildBlock(ctx, block, hash, parentImageRef, copyDigests, secrets)
 	duration := time.Since(startTime)
+	stopHeartbeat()
+	if err := e.store.FlushLogs(blockID); err != nil {
+		fmt.Printf("Warning: failed to append build logs: %v\n", err)
+	}
 	exitCode := 0
 	if err != nil {
 		exitCode = 1
@@ -186,6 +271,9 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 		if err := e.cache.SetCachedDigest(hash, digest); err != nil {
 			return fmt.Errorf("failed to update cache: %w", err)
 		}
+		e.shareImage(block, inputs, digest)
+		e.tagImage(ctx, block, digest, hash)
+		e.pruneTags(ctx, blockID)
 	}
 
 	return nil
@@ -195,19 +283,52 @@ func (e *Engine) RunBlock(ctx context.Context, blockID string, opts types.RunOpt
 func (e *Engine) RunUp(ctx context.Context, opts types.UpOptions) error {
 	startIndex := 0
 
-	// Find starting block if specified
+	// Find starting block if specified (a matrix block ID starts at its first variant)
+	if opts.Resume && opts.FromBlock != "" {
+		return fmt.Errorf("resume and from cannot be combined")
+	}
+	if opts.Resume {
+		index, err := e.resumeIndex()
+		if err != nil {
+			return err
+		}
+		if index == len(e.project.Blocks) {
+			fmt.Println("Every block already finished; nothing to resume")
+			return nil
+		}
+		fmt.Printf("Resuming from block %s\n", e.project.Blocks[index].ID)
+		startIndex = index
+	}
 	if opts.FromBlock != "" {
 		for i, block := range e.project.Blocks {
-			if block.ID == opts.FromBlock {
+			if block.ID == opts.FromBlock || block.TemplateID() == opts.FromBlock {
 				startIndex = i
 				break
 			}
 		}
 	}
 
+	// Restrict to the selected blocks; their parents still run on demand
+	var only map[string]bool
+	if len(opts.Only) > 0 {
+		only = make(map[string]bool)
+		for _, id := range opts.Only {
+			ids := config.MatchBlocks(e.project, id)
+			if len(ids) == 0 {
+				return fmt.Errorf("block %s not found", id)
+			}
+			for _, match := range ids {
+				only[match] = true
+			}
+		}
+	}
+
 	// Execute blocks in order
 	for i := startIndex; i < len(e.project.Blocks); i++ {
 		block := e.project.Blocks[i]
+		if only != nil && !only[block.ID] {
+			continue
+		}
 
 		runOpts := types.RunOptions{
 			Force: opts.Force,
@@ -225,6 +346,41 @@ func (e *Engine) RunUp(ctx context.Context, opts types.UpOptions) error {
 	return nil
 }
 
+// resumeIndex returns the index of the first block whose last run did not finish, or the
+// number of blocks when every block finished
+func (e *Engine) resumeIndex() (int, error) {
+	states, err := e.store.GetBlockStates()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load block states: %w", err)
+	}
+	for i, block := range e.project.Blocks {
+		state, ok := states[block.ID]
+		if !ok || (state.Status != types.StatusSuccess && state.Status != types.StatusCached) {
+			return i, nil
+		}
+	}
+	return len(e.project.Blocks), nil
+}
+
+// ensureBaseImage makes a block's base image available according to the project pull policy
+// and returns its digest
+func (e *Engine) ensureBaseImage(ctx context.Context, block types.Block) (string, error) {
+	policy := e.project.Settings.Pull()
+	if policy != types.PullAlways {
+		digest, err := e.dockerClient.InspectImage(ctx, block.From)
+		if err == nil {
+			return digest, nil
+		}
+		if policy == types.PullNever {
+			return "", fmt.Errorf("image %s is not available locally and the pull policy is never: %w", block.From, err)
+		}
+	}
+	if err := e.dockerClient.PullImageForPlatform(ctx, block.From, block.Platform); err != nil {
+		return "", fmt.Errorf("failed to pull image %s: %w", block.From, err)
+	}
+	return e.dockerClient.InspectImage(ctx, block.From)
+}
+
 // resolveParent resolves the parent image reference for container creation and the digest for hashing
 func (e *Engine) resolveParent(ctx context.Context, block types.Block) (string, string, error) {
 	return e.resolveParentWithVisited(ctx, block, make(map[string]bool))
@@ -234,13 +390,16 @@ func (e *Engine) resolveParent(ctx context.Context, block types.Block) (string,
 func (e *Engine) resolveParentWithVisited(ctx context.Context, block types.Block, visited map[string]bool) (string, string, error) {
 	if block.From != "" {
 		// Ensure image is available locally; use the reference for container create
-		if err := e.dockerClient.PullImage(ctx, block.From); err != nil {
-			return "", "", fmt.Errorf("failed to pull image %s: %w", block.From, err)
-		}
-		digest, err := e.dockerClient.InspectImage(ctx, block.From)
+		digest, err := e.ensureBaseImage(ctx, block)
 		if err != nil {
 			return "", "", err
 		}
+		// Record the registry digest so exports can pin the base image
+		if repoDigest, err := e.dockerClient.RepoDigest(ctx, block.From); err == nil && repoDigest != "" {
+			if err := e.store.SaveBaseDigest(block.From, repoDigest); err != nil {
+				fmt.Printf("Warning: failed to save base image digest: %v\n", err)
+			}
+		}
 		// Return the original image reference for FROM directive, digest for hashing
 		return block.From, digest, nil
 	}
@@ -255,106 +414,109 @@ func (e *Engine) resolveParentWithVisited(ctx context.Context, block types.Block
 		visited[block.ID] = true
 		defer delete(visited, block.ID)
 
-		// If a specific version is requested, use that digest directly
+		// If a specific version is requested, build on that image directly
 		if block.FromBlockVersion != "" {
-			// Find the parent block to get its original 'from' reference
-			var parentBlock types.Block
-			found := false
-			for _, b := range e.project.Blocks {
-				if b.ID == block.FromBlock {
-					parentBlock = b
-					found = true
-					break
-				}
-			}
-			if !found {
+			if _, found := e.findBlock(block.FromBlock); !found {
 				return "", "", fmt.Errorf("parent block %s not found in project", block.FromBlock)
 			}
-
-			// If parent block has a 'from' field, use that as the image reference
-			if parentBlock.From != "" {
-				return parentBlock.From, block.FromBlockVersion, nil
-			}
-
-			// Otherwise use the digest directly
 			return block.FromBlockVersion, block.FromBlockVersion, nil
 		}
 
-		// Check if parent block has been executed and has a digest
-		state, err := e.store.LoadBlockState(block.FromBlock)
+		// Build on the parent block's image, executing the parent first if needed
+		digest, err := e.blockDigest(ctx, block.FromBlock, visited)
 		if err != nil {
-			// If state file doesn't exist, treat as not executed
-			if os.IsNotExist(err) {
-				state = &types.BlockState{ID: block.FromBlock, Digest: ""}
-			} else {
-				return "", "", fmt.Errorf("failed to load state for parent block %s: %w", block.FromBlock, err)
-			}
+			return "", "", err
 		}
+		return digest, digest, nil
+	}
 
-		// If parent block has no digest, it needs to be executed first
-		if state.Digest == "" {
-			// Find the parent block definition
-			var parentBlock types.Block
-			found := false
-			for _, b := range e.project.Blocks {
-				if b.ID == block.FromBlock {
-					parentBlock = b
-					found = true
-					break
-				}
-			}
-			if !found {
-				return "", "", fmt.Errorf("parent block %s not found in project", block.FromBlock)
-			}
+	return "", "", fmt.Errorf("block has no parent specified")
+}
 
-			// Recursively resolve parent dependencies first
-			_, _, err := e.resolveParentWithVisited(ctx, parentBlock, visited)
-			if err != nil {
-				return "", "", fmt.Errorf("failed to resolve parent dependencies for %s: %w", block.FromBlock, err)
-			}
+// resolveCopySources resolves the digests of the blocks a block copies files from, keyed by reference
+func (e *Engine) resolveCopySources(ctx context.Context, block types.Block) (map[string]string, error) {
+	return e.resolveCopySourcesWithVisited(ctx, block, make(map[string]bool))
+}
 
-			// Execute the parent block
-			runOpts := types.RunOptions{Force: false}
-			if err := e.RunBlock(ctx, block.FromBlock, runOpts); err != nil {
-				return "", "", fmt.Errorf("failed to execute parent block %s: %w", block.FromBlock, err)
-			}
+// resolveCopySourcesWithVisited resolves copy sources with cycle detection
+func (e *Engine) resolveCopySourcesWithVisited(ctx context.Context, block types.Block, visited map[string]bool) (map[string]string, error) {
+	refs := config.CopyRefs(e.project, block)
+	if len(refs) == 0 {
+		return nil, nil
+	}
 
-			// Reload the state after execution
-			state, err = e.store.LoadBlockState(block.FromBlock)
-			if err != nil {
-				return "", "", fmt.Errorf("failed to reload state for parent block %s: %w", block.FromBlock, err)
-			}
-			if state.Digest == "" {
-				return "", "", fmt.Errorf("parent block %s still has no digest after execution", block.FromBlock)
-			}
-		}
+	if visited[block.ID] {
+		return nil, fmt.Errorf("circular dependency detected: block %s depends on itself", block.ID)
+	}
+	visited[block.ID] = true
+	defer delete(visited, block.ID)
 
-		// For from_block, we need to get the original image reference from the parent block
-		// Find the parent block to get its original 'from' reference
-		var parentBlock types.Block
-		found := false
-		for _, b := range e.project.Blocks {
-			if b.ID == block.FromBlock {
-				parentBlock = b
-				found = true
-				break
-			}
+	digests := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		id, err := config.ResolveCopyRef(e.project, block, ref)
+		if err != nil {
+			return nil, err
 		}
-		if !found {
-			return "", "", fmt.Errorf("parent block %s not found in project", block.FromBlock)
+		digest, err := e.blockDigest(ctx, id, visited)
+		if err != nil {
+			return nil, err
 		}
+		digests[ref] = digest
+	}
+	return digests, nil
+}
 
-		// If parent block has a 'from' field, use that as the image reference
-		if parentBlock.From != "" {
-			return parentBlock.From, state.Digest, nil
+// blockDigest returns the image digest of a block, executing it (and its dependencies) if it has not run yet
+func (e *Engine) blockDigest(ctx context.Context, blockID string, visited map[string]bool) (string, error) {
+	// Check if the block has been executed and has a digest
+	state, err := e.store.LoadBlockState(blockID)
+	if err != nil {
+		// If state file doesn't exist, treat as not executed
+		if os.IsNotExist(err) {
+			state = &types.BlockState{ID: blockID, Digest: ""}
+		} else {
+			return "", fmt.Errorf("failed to load state for block %s: %w", blockID, err)
 		}
+	}
+	// Use the recorded image unless it was removed, for example by docker image prune
+	if state.Digest != "" && e.cache.ImageExists(ctx, state.Digest) {
+		return state.Digest, nil
+	}
 
-		// If parent block also uses from_block, we need to resolve it recursively
-		// For now, use the digest as fallback (this might need further refinement)
-		return state.Digest, state.Digest, nil
+	// Find the block definition
+	block, found := e.findBlock(blockID)
+	if !found {
+		return "", fmt.Errorf("block %s not found in project", blockID)
 	}
 
-	return "", "", fmt.Errorf("block has no parent specified")
+	// Recursively resolve its dependencies first
+	if _, _, err := e.resolveParentWithVisited(ctx, block, visited); err != nil {
+		return "", fmt.Errorf("failed to resolve dependencies for %s: %w", blockID, err)
+	}
+	if _, err := e.resolveCopySourcesWithVisited(ctx, block, visited); err != nil {
+		return "", fmt.Errorf("failed to resolve dependencies for %s: %w", blockID, err)
+	}
+
+	// Execute the block
+	runOpts := types.RunOptions{Force: false}
+	if err := e.RunBlock(ctx, blockID, runOpts); err != nil {
+		return "", fmt.Errorf("failed to execute block %s: %w", blockID, err)
+	}
+
+	// Reload the state after execution
+	state, err = e.store.LoadBlockState(blockID)
+	if err != nil {
+		return "", fmt.Errorf("failed to reload state for block %s: %w", blockID, err)
+	}
+	if state.Digest == "" {
+		return "", fmt.Errorf("block %s still has no digest after execution", blockID)
+	}
+	return state.Digest, nil
+}
+
+// copyStageName returns the name of the build stage holding a copied block's image
+func copyStageName(ref string) string {
+	return "dockstep-" + sanitizeForDockerTag(ref)
 }
 
 // sanitizeForDockerTag converts a block ID to a valid Docker image tag
@@ -383,9 +545,9 @@ func sanitizeForDockerTag(blockID string) string {
 }
 
 // buildBlock builds a single block and returns the resulting digest
-func (e *Engine) buildBlock(ctx context.Context, block types.Block, parentImageRef string) (string, error) {
+func (e *Engine) buildBlock(ctx context.Context, block types.Block, hash, parentImageRef string, copyDigests map[string]string, secrets map[string][]byte) (string, error) {
 	// Generate Dockerfile content
-	dockerfileContent := e.generateDockerfile(block, parentImageRef)
+	dockerfileContent := e.generateDockerfile(block, parentImageRef, copyDigests)
 
 	// Determine context directory
 	contextDir := e.contextPath
@@ -398,7 +560,7 @@ func (e *Engine) buildBlock(ctx context.Context, block types.Block, parentImageR
 	}
 
 	// Create temporary directory for build context
-	tempDir, err := os.MkdirTemp("", "dockstep-build-*")
+	tempDir, err := store.NewBuildDir()
 	if err != nil {
 		return "", fmt.Errorf("failed to create temp directory: %w", err)
 	}
@@ -416,13 +578,12 @@ func (e *Engine) buildBlock(ctx context.Context, block types.Block, parentImageR
 	}
 
 	// Generate tag for the image
-	sanitizedID := sanitizeForDockerTag(block.ID)
-	tag := fmt.Sprintf("dockstep-%s-%d", sanitizedID, time.Now().Unix())
+	tag := timestampTag(e.project.Settings.ImageTagPrefix(), block.ID, time.Now())
 
 	// Build the image using temp directory as context
 	fmt.Printf("DEBUG: Building image with tag: %s\n", tag)
 	fmt.Printf("DEBUG: Dockerfile content:\n%s\n", dockerfileContent)
-	digest, err := e.buildImageWithLogs(ctx, tempDir, dockerfileContent, tag, block.ID)
+	digest, err := e.buildImageWithLogs(ctx, tempDir, dockerfileContent, tag, hash, block, secrets)
 	if err != nil {
 		fmt.Printf("DEBUG: Build failed with error: %v\n", err)
 		return "", fmt.Errorf("failed to build image: %w", err)
@@ -446,30 +607,69 @@ func (e *Engine) buildBlock(ctx context.Context, block types.Block, parentImageR
 }
 
 // generateDockerfile generates Dockerfile content for a block
-func (e *Engine) generateDockerfile(block types.Block, parentImageRef string) string {
+func (e *Engine) generateDockerfile(block types.Block, parentImageRef string, copyDigests map[string]string) string {
 	var lines []string
 
+	// Name a stage for each block files are copied from
+	if len(copyDigests) > 0 {
+		for _, ref := range config.SortedKeys(copyDigests) {
+			lines = append(lines, fmt.Sprintf("FROM %s AS %s", copyDigests[ref], copyStageName(ref)))
+		}
+		lines = append(lines, "")
+	}
+
 	// Add FROM directive
 	lines = append(lines, fmt.Sprintf("FROM %s", parentImageRef))
 	lines = append(lines, "")
 
-	// Add block instructions
-	lines = append(lines, block.Instructions...)
+	// Declare build args so they are visible to the instructions
+	if len(block.Args) > 0 {
+		for _, name := range config.SortedKeys(block.Args) {
+			lines = append(lines, fmt.Sprintf("ARG %s", name))
+		}
+		lines = append(lines, "")
+	}
+
+	// Set environment variables before the instructions; labels are passed to the build
+	if len(block.Env) > 0 {
+		lines = append(lines, dockerfile.EnvLines(block.Env)...)
+		lines = append(lines, "")
+	}
+
+	// Copy files from other blocks, then add block instructions
+	for _, entry := range block.CopyFrom {
+		lines = append(lines, fmt.Sprintf("COPY --from=%s %s %s", copyStageName(entry.Block), entry.Src, entry.Dst))
+	}
+	for _, instruction := range block.Instructions {
+		lines = append(lines, config.RewriteCopyFrom(instruction, func(ref string) string {
+			if _, ok := copyDigests[ref]; ok {
+				return copyStageName(ref)
+			}
+			return ref
+		}))
+	}
 
 	return strings.Join(lines, "\n")
 }
 
 // buildImageWithLogs builds an image and captures the build logs
-func (e *Engine) buildImageWithLogs(ctx context.Context, contextDir, dockerfileContent, tag, blockID string) (string, error) {
+func (e *Engine) buildImageWithLogs(ctx context.Context, contextDir, dockerfileContent, tag, hash string, block types.Block, secrets map[string][]byte) (string, error) {
 	// Create log callback that appends to store
 	logCallback := func(logChunk []byte) {
-		if err := e.store.AppendLogs(blockID, logChunk); err != nil {
+		if err := e.store.AppendLogs(block.ID, logChunk); err != nil {
 			fmt.Printf("Warning: failed to append build logs: %v\n", err)
 		}
 	}
 
 	// Build with log streaming
-	digest, err := e.dockerClient.BuildImageWithLogs(ctx, contextDir, dockerfileContent, tag, logCallback)
+	buildOpts := docker.BuildOptions{
+		Tag:       tag,
+		BuildArgs: block.Args,
+		Secrets:   secrets,
+		Labels:    imageLabels(e.project.Name, e.store.ProjectID(), block, hash),
+		Platform:  block.Platform,
+	}
+	digest, err := e.dockerClient.BuildImageWithOptions(ctx, contextDir, dockerfileContent, buildOpts, logCallback)
 	if err != nil {
 		// Even if build fails, we want to keep the logs for debugging
 		return "", err
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"dockstep.dev/config"
+	"dockstep.dev/store"
+	"dockstep.dev/types"
+)
+
+func TestResumeIndex(t *testing.T) {
+	root := t.TempDir()
+	s := store.New(root)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	project := &types.Project{Name: "shop", Blocks: []types.Block{{ID: "base"}, {ID: "deps"}, {ID: "app"}}}
+	e := NewEngine(nil, s, project, root)
+
+	if index, err := e.resumeIndex(); err != nil || index != 0 {
+		t.Errorf("Expected to resume from the first block of a fresh project, got %d, %v", index, err)
+	}
+
+	s.SaveBlockState("base", &types.BlockState{ID: "base", Status: types.StatusSuccess})
+	s.SaveBlockState("deps", &types.BlockState{ID: "deps", Status: types.StatusFailed, Error: store.InterruptedError})
+	s.SaveBlockState("app", &types.BlockState{ID: "app", Status: types.StatusSuccess})
+	if index, err := e.resumeIndex(); err != nil || index != 1 {
+		t.Errorf("Expected to resume from the interrupted block, got %d, %v", index, err)
+	}
+
+	s.SaveBlockState("deps", &types.BlockState{ID: "deps", Status: types.StatusCached})
+	if index, _ := e.resumeIndex(); index != len(project.Blocks) {
+		t.Errorf("Expected nothing to resume once every block finished, got %d", index)
+	}
+	if err := e.RunUp(context.Background(), types.UpOptions{Resume: true}); err != nil {
+		t.Errorf("Expected resuming a finished project to do nothing, got %v", err)
+	}
+	if err := e.RunUp(context.Background(), types.UpOptions{Resume: true, FromBlock: "app"}); err == nil {
+		t.Error("Expected resume and from to be rejected together")
+	}
+}
+
+func TestResolveParentFromBlock(t *testing.T) {
+	root := t.TempDir()
+	s := store.New(root)
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	project := &types.Project{Name: "shop", Blocks: []types.Block{
+		{ID: "base", From: "alpine:3.19"},
+		{ID: "deps", FromBlock: "base"},
+		{ID: "pinned", FromBlock: "base", FromBlockVersion: "sha256:old"},
+		{ID: "app", FromBlock: "deps"},
+		{ID: "app-pinned", FromBlock: "deps", FromBlockVersion: "sha256:deps-old"},
+	}}
+	e := NewEngine(nil, s, project, root)
+	s.SaveBlockState("base", &types.BlockState{ID: "base", Status: types.StatusSuccess, Digest: "sha256:base"})
+	s.SaveBlockState("deps", &types.BlockState{ID: "deps", Status: types.StatusSuccess, Digest: "sha256:deps"})
+
+	// A child builds on its parent's image, so every instruction of the parent is kept,
+	// as in the multi-stage export's FROM <parent stage>
+	tests := []struct {
+		block      string
+		wantRef    string
+		wantDigest string
+	}{
+		{"deps", "sha256:base", "sha256:base"},
+		{"pinned", "sha256:old", "sha256:old"},
+		{"app", "sha256:deps", "sha256:deps"},
+		{"app-pinned", "sha256:deps-old", "sha256:deps-old"},
+	}
+	for _, tt := range tests {
+		block, _ := e.findBlock(tt.block)
+		ref, digest, err := e.resolveParent(context.Background(), block)
+		if err != nil || ref != tt.wantRef || digest != tt.wantDigest {
+			t.Errorf("resolveParent(%s) = %s, %s, %v, want %s, %s", tt.block, ref, digest, err, tt.wantRef, tt.wantDigest)
+		}
+	}
+}
+
+func TestGenerateDockerfileExtendsPath(t *testing.T) {
+	project, err := config.ParseData([]byte(`version: "1.0"
+name: "shop"
+settings:
+  env:
+    PATH: "/opt/bin:${PATH}"
+blocks:
+  - id: "base"
+    from: "alpine:3.19"
+    instructions:
+      - "RUN tool --version"
+`), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	root := t.TempDir()
+	e := NewEngine(nil, store.New(root), project, root)
+
+	// Docker expands ${PATH} in ENV, so it must not be escaped
+	got := e.generateDockerfile(project.Blocks[0], "alpine:3.19", nil)
+	if want := `ENV PATH="/opt/bin:${PATH}"`; !strings.Contains(got, want) {
+		t.Errorf("Expected %q in:\n%s", want, got)
+	}
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"dockstep.dev/store"
+	"dockstep.dev/types"
+)
+
+// sharedCacheHit looks a block up in the machine-wide cache after a miss in the project
+// cache. A hit is recorded in the project cache under the block's own hash.
+func (e *Engine) sharedCacheHit(ctx context.Context, block types.Block, inputs store.BlockInputs, hash string) (string, bool) {
+	if e.shared == nil {
+		return "", false
+	}
+	key, ok := store.SharedBlockHash(block, inputs)
+	if !ok {
+		return "", false
+	}
+	digest, hit, _ := e.shared.GetVerifiedDigest(ctx, key)
+	if !hit {
+		return "", false
+	}
+	fmt.Printf("Using image %s of block %s from the shared cache\n", digest, block.ID)
+	if err := e.cache.SetCachedDigest(hash, digest); err != nil {
+		fmt.Printf("Warning: failed to update cache: %v\n", err)
+	}
+	return digest, true
+}
+
+// shareImage records a built block image in the machine-wide cache
+func (e *Engine) shareImage(block types.Block, inputs store.BlockInputs, digest string) {
+	if e.shared == nil {
+		return
+	}
+	key, ok := store.SharedBlockHash(block, inputs)
+	if !ok {
+		return
+	}
+	if err := e.shared.SetCachedDigest(key, digest); err != nil {
+		fmt.Printf("Warning: failed to update shared cache: %v\n", err)
+	}
+}
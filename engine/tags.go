@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+// imageRepository returns the repository a block's images are tagged in, <project>/<block>
+func imageRepository(project, blockID string) string {
+	return sanitizeForDockerTag(project) + "/" + sanitizeForDockerTag(blockID)
+}
+
+// contentTag returns the tag derived from a block's cache hash
+func contentTag(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// timestampTag returns the tag of a single build of a block
+func timestampTag(prefix, blockID string, t time.Time) string {
+	return fmt.Sprintf("%s-%s-%d", prefix, sanitizeForDockerTag(blockID), t.Unix())
+}
+
+// imageLabels returns the labels of a block's image: its own labels plus the project, the
+// checkout it was built in, the block and the cache hash it was built from
+func imageLabels(project, projectID string, block types.Block, hash string) map[string]string {
+	labels := make(map[string]string, len(block.Labels)+4)
+	for key, value := range block.Labels {
+		labels[key] = value
+	}
+	labels[types.LabelProject] = project
+	labels[types.LabelProjectID] = projectID
+	labels[types.LabelBlock] = block.ID
+	labels[types.LabelHash] = hash
+	return labels
+}
+
+// expiredTags returns the timestamp tags of a block that the retention policy no longer
+// keeps, oldest first. Tags of other blocks are ignored and the newest tag is always kept.
+func expiredTags(tags []string, prefix, blockID string, retention types.Retention, now time.Time) []string {
+	type build struct {
+		tag  string
+		time time.Time
+	}
+	name := fmt.Sprintf("%s-%s-", prefix, sanitizeForDockerTag(blockID))
+	var builds []build
+	for _, tag := range tags {
+		ref := strings.TrimSuffix(tag, ":latest")
+		stamp, ok := strings.CutPrefix(ref, name)
+		if !ok {
+			continue
+		}
+		seconds, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			continue
+		}
+		builds = append(builds, build{tag: ref, time: time.Unix(seconds, 0)})
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].time.After(builds[j].time) })
+
+	maxAge, err := config.ParseAge(retention.MaxAge)
+	if retention.MaxAge == "" || err != nil {
+		maxAge = 0
+	}
+	keep := retention.KeepCount()
+
+	var expired []string
+	for i := len(builds) - 1; i > 0; i-- {
+		if (keep > 0 && i >= keep) || (maxAge > 0 && now.Sub(builds[i].time) > maxAge) {
+			expired = append(expired, builds[i].tag)
+		}
+	}
+	return expired
+}
+
+// tagImage tags a block's image as <project>/<block>:latest and with its content tag
+func (e *Engine) tagImage(ctx context.Context, block types.Block, digest, hash string) {
+	repository := imageRepository(e.project.Name, block.ID)
+	for _, tag := range []string{"latest", contentTag(hash)} {
+		if err := e.dockerClient.TagImage(ctx, digest, repository+":"+tag); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+}
+
+// pruneTags removes the timestamp tags of a block that the retention policy no longer keeps
+func (e *Engine) pruneTags(ctx context.Context, blockID string) {
+	prefix := e.project.Settings.ImageTagPrefix()
+	tags, err := e.dockerClient.ImageTags(ctx, fmt.Sprintf("%s-%s-*", prefix, sanitizeForDockerTag(blockID)))
+	if err != nil {
+		fmt.Printf("Warning: failed to list image tags: %v\n", err)
+		return
+	}
+	for _, tag := range expiredTags(tags, prefix, blockID, e.project.Settings.Retention, time.Now()) {
+		if err := e.dockerClient.UntagImage(ctx, tag); err != nil {
+			fmt.Printf("Warning: %v\n", err)
+		}
+	}
+}
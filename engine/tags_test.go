@@ -0,0 +1,61 @@
+package engine
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+func TestImageRepository(t *testing.T) {
+	if got := imageRepository("My App", "Build Step"); got != "my-app/build-step" {
+		t.Errorf("imageRepository = %s, want my-app/build-step", got)
+	}
+	if got := contentTag("0123456789abcdef0123"); got != "0123456789ab" {
+		t.Errorf("contentTag = %s, want 0123456789ab", got)
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	block := types.Block{ID: "app", Labels: map[string]string{"team": "web"}}
+	labels := imageLabels("shop", "0123abcd", block, "abc")
+	want := map[string]string{"team": "web", types.LabelProject: "shop", types.LabelProjectID: "0123abcd", types.LabelBlock: "app", types.LabelHash: "abc"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("imageLabels = %v, want %v", labels, want)
+	}
+	if len(block.Labels) != 1 {
+		t.Error("imageLabels should not modify the block's labels")
+	}
+}
+
+func TestExpiredTags(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var tags []string
+	for days := 0; days < 4; days++ {
+		tags = append(tags, timestampTag("dockstep", "app", now.Add(-time.Duration(days)*24*time.Hour))+":latest")
+	}
+	// Tags of other blocks and repositories are never removed
+	tags = append(tags, "dockstep-app-server-1600000000:latest", "shop/app:latest")
+
+	keep := func(n int) *int { return &n }
+	tests := []struct {
+		name      string
+		retention types.Retention
+		want      []string
+	}{
+		{name: "default", retention: types.Retention{}},
+		{name: "keep", retention: types.Retention{Keep: keep(2)}, want: []string{"dockstep-app-1699740800", "dockstep-app-1699827200"}},
+		{name: "keep all", retention: types.Retention{Keep: keep(0)}},
+		{name: "max age", retention: types.Retention{Keep: keep(0), MaxAge: "36h"}, want: []string{"dockstep-app-1699740800", "dockstep-app-1699827200"}},
+		{name: "newest kept", retention: types.Retention{Keep: keep(1), MaxAge: "1h"}, want: []string{"dockstep-app-1699740800", "dockstep-app-1699827200", "dockstep-app-1699913600"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := expiredTags(tags, "dockstep", "app", tt.retention, now)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expiredTags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package export
+
+import (
+	"strings"
+)
+
+// runCollapser writes Dockerfile lines, merging consecutive shell-form RUN instructions
+// into a single RUN joined with && when enabled. Comments between merged instructions stay
+// inside the line continuation, where Docker ignores them.
+type runCollapser struct {
+	enabled bool
+	lines   []string
+	pending []string // comments and blank lines not written yet
+	lastRun int      // index of the RUN that can be continued, or -1
+}
+
+// newRunCollapser creates a runCollapser; a disabled one writes lines unchanged
+func newRunCollapser(enabled bool) *runCollapser {
+	return &runCollapser{enabled: enabled, lastRun: -1}
+}
+
+// comment adds a comment or blank line
+func (c *runCollapser) comment(line string) {
+	c.pending = append(c.pending, line)
+}
+
+// instruction adds an instruction, continuing the previous RUN when both can be merged
+func (c *runCollapser) instruction(instruction string) {
+	command, mergeable := shellRunCommand(instruction)
+	mergeable = mergeable && c.enabled
+
+	if mergeable && c.lastRun >= 0 {
+		c.lines[c.lastRun] += " && \\"
+		for _, line := range c.pending {
+			// Blank lines inside a continuation are deprecated, comments are fine
+			if strings.TrimSpace(line) != "" {
+				c.lines = append(c.lines, line)
+			}
+		}
+		c.pending = nil
+		c.lines = append(c.lines, "    "+command)
+		c.lastRun = len(c.lines) - 1
+		return
+	}
+
+	c.flush()
+	c.lines = append(c.lines, instruction)
+	c.lastRun = -1
+	if mergeable {
+		c.lastRun = len(c.lines) - 1
+	}
+}
+
+// barrier adds lines that end any open RUN, such as ARG or LABEL lines
+func (c *runCollapser) barrier(lines ...string) {
+	if len(lines) == 0 {
+		return
+	}
+	c.flush()
+	c.lines = append(c.lines, lines...)
+	c.lastRun = -1
+}
+
+// result returns all lines written
+func (c *runCollapser) result() []string {
+	c.flush()
+	return c.lines
+}
+
+// flush writes pending comments and blank lines
+func (c *runCollapser) flush() {
+	c.lines = append(c.lines, c.pending...)
+	c.pending = nil
+}
+
+// shellRunCommand returns the command of a shell-form RUN instruction that can safely be
+// joined with another using &&. RUN instructions with flags (e.g. --mount), exec form,
+// heredocs, trailing shell comments or control operators are left alone.
+func shellRunCommand(instruction string) (string, bool) {
+	keyword, command, found := strings.Cut(strings.TrimSpace(instruction), " ")
+	if !found || !strings.EqualFold(keyword, "RUN") {
+		return "", false
+	}
+	command = strings.TrimSpace(command)
+	if command == "" || strings.HasPrefix(command, "--") || strings.HasPrefix(command, "[") {
+		return "", false
+	}
+	if strings.Contains(command, "<<") || strings.Contains(command, " #") || hasControlOperator(command) {
+		return "", false
+	}
+	return command, true
+}
+
+// hasControlOperator reports whether a command holds a shell operator that binds looser than
+// or as loose as &&, such as ; || | or &, or a line break: joined with && as in
+// "false && echo a; echo b", the failing command would no longer fail the RUN. Quotes are
+// not parsed, which only leaves more commands unmerged.
+func hasControlOperator(command string) bool {
+	rest := strings.ReplaceAll(command, "&&", "")
+	rest = strings.ReplaceAll(rest, ">&", "")
+	rest = strings.ReplaceAll(rest, "<&", "")
+	return strings.ContainsAny(rest, ";|&\n")
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 
+	"dockstep.dev/config"
+	"dockstep.dev/dockerfile"
 	"dockstep.dev/types"
 )
 
@@ -28,6 +30,9 @@ func GenerateDockerfile(project *types.Project, endBlockID string, opts types.Do
 			}
 		}
 		if endBlock == nil {
+			if variants := config.MatchBlocks(project, endBlockID); len(variants) > 0 {
+				return "", fmt.Errorf("block %s is a matrix block; export one of its variants: %s", endBlockID, strings.Join(variants, ", "))
+			}
 			return "", fmt.Errorf("block %s not found", endBlockID)
 		}
 	}
@@ -38,15 +43,30 @@ func GenerateDockerfile(project *types.Project, endBlockID string, opts types.Do
 		return "", fmt.Errorf("failed to build block chain: %w", err)
 	}
 
+	// Resolve variables and build args for every block in the chain
+	for i := range chain {
+		if refs := config.CopyRefs(project, chain[i]); len(refs) > 0 {
+			return "", fmt.Errorf("block %s copies files from %s; export it as a multi-stage Dockerfile (--multi-stage)", chain[i].ID, strings.Join(refs, ", "))
+		}
+		chain[i] = config.ResolveBlock(project, chain[i], opts.Variables)
+	}
+
 	// Generate Dockerfile
 	lines = append(lines, "# Generated by dockstep")
+	lines = append(lines, secretHints(project, chain)...)
 	lines = append(lines, "")
 
 	// Add FROM directive for the first block
 	if len(chain) > 0 {
 		firstBlock := chain[0]
 		if firstBlock.From != "" {
-			lines = append(lines, fmt.Sprintf("FROM %s", firstBlock.From))
+			from := firstBlock.From
+			if opts.PinDigests {
+				if from, err = pinImage(from, opts.Digests); err != nil {
+					return "", err
+				}
+			}
+			lines = append(lines, fmt.Sprintf("FROM %s%s", fromPlatform(firstBlock), from))
 		} else {
 			return "", fmt.Errorf("first block must have 'from' specified")
 		}
@@ -54,46 +74,121 @@ func GenerateDockerfile(project *types.Project, endBlockID string, opts types.Do
 	}
 
 	// Process each block in the chain
+	out := newRunCollapser(opts.CollapseRuns)
 	for i, block := range chain {
-		// Add block instructions directly
-		lines = append(lines, block.Instructions...)
+		// Mark where each block starts, since its RUN instructions may be merged with others
+		if opts.CollapseRuns {
+			out.comment(fmt.Sprintf("# Block: %s", block.ID))
+		}
+
+		// Declare build args with their resolved values as defaults, then env and labels
+		out.barrier(argLines(block)...)
+		out.barrier(envLabelLines(block)...)
+
+		// Add block instructions, with paths relative to the project root
+		for _, line := range descriptionLines(block) {
+			out.comment(line)
+		}
+		instructions, err := blockInstructions(block)
+		if err != nil {
+			return "", err
+		}
+		for _, instruction := range instructions {
+			out.instruction(instruction)
+		}
 		if len(block.Instructions) > 0 {
-			lines = append(lines, "")
+			out.comment("")
 		}
 
 		// Add export configuration if present
-		if block.Export != nil {
-			// Add labels
-			if len(block.Export.Labels) > 0 {
-				for key, value := range block.Export.Labels {
-					lines = append(lines, fmt.Sprintf("LABEL %s=%s", key, value))
-				}
-				lines = append(lines, "")
-			}
+		out.barrier(exportLines(block)...)
 
-			// Add entrypoint
-			if len(block.Export.Entrypoint) > 0 {
-				entrypoint := strings.Join(block.Export.Entrypoint, " ")
-				lines = append(lines, fmt.Sprintf("ENTRYPOINT [%s]", entrypoint))
-				lines = append(lines, "")
-			}
+		// Add stage name if this is not the last block
+		if i < len(chain)-1 && !opts.CollapseRuns {
+			out.comment(fmt.Sprintf("# Stage: %s", block.ID))
+			out.comment("")
+		}
+	}
+	lines = append(lines, out.result()...)
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// exportLines returns the LABEL, ENTRYPOINT and CMD lines of a block's export configuration
+func exportLines(block types.Block) []string {
+	if block.Export == nil {
+		return nil
+	}
+
+	var lines []string
 
-			// Add cmd
-			if len(block.Export.Cmd) > 0 {
-				cmd := strings.Join(block.Export.Cmd, " ")
-				lines = append(lines, fmt.Sprintf("CMD [%s]", cmd))
-				lines = append(lines, "")
+	// Add labels in a stable order with quoted values
+	if len(block.Export.Labels) > 0 {
+		lines = append(lines, dockerfile.LabelLines(block.Export.Labels)...)
+		lines = append(lines, "")
+	}
+
+	// Add entrypoint in exec form
+	if len(block.Export.Entrypoint) > 0 {
+		lines = append(lines, "ENTRYPOINT "+dockerfile.ExecForm(block.Export.Entrypoint))
+		lines = append(lines, "")
+	}
+
+	// Add cmd in exec form
+	if len(block.Export.Cmd) > 0 {
+		lines = append(lines, "CMD "+dockerfile.ExecForm(block.Export.Cmd))
+		lines = append(lines, "")
+	}
+
+	return lines
+}
+
+// secretHints documents the --secret flags needed to build the chain, without any secret values
+func secretHints(project *types.Project, chain []types.Block) []string {
+	seen := make(map[string]bool)
+	var hints []string
+	for _, block := range chain {
+		for _, id := range config.SecretIDs(block) {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			secret := project.Secrets[id]
+			source := "src=" + secret.File
+			if secret.Env != "" {
+				source = "env=" + secret.Env
 			}
+			hints = append(hints, fmt.Sprintf("#   --secret id=%s,%s", id, source))
 		}
+	}
+	if len(hints) == 0 {
+		return nil
+	}
+	return append([]string{"# Build with BuildKit secrets:"}, hints...)
+}
 
-		// Add stage name if this is not the last block
-		if i < len(chain)-1 {
-			lines = append(lines, fmt.Sprintf("# Stage: %s", block.ID))
-			lines = append(lines, "")
-		}
+// argLines declares a block's build args with their resolved values as defaults
+func argLines(block types.Block) []string {
+	if len(block.Args) == 0 {
+		return nil
 	}
+	var lines []string
+	for _, name := range config.SortedKeys(block.Args) {
+		lines = append(lines, fmt.Sprintf("ARG %s=%s", name, dockerfile.QuoteArgValue(block.Args[name])))
+	}
+	return append(lines, "")
+}
 
-	return strings.Join(lines, "\n"), nil
+// pinImage pins an image reference to the digest recorded for it
+func pinImage(image string, digests map[string]string) (string, error) {
+	if strings.Contains(image, "@") || image == "scratch" {
+		return image, nil
+	}
+	digest, ok := digests[image]
+	if !ok {
+		return "", fmt.Errorf("no digest recorded for base image %s; run a block that uses it or run 'dockstep lock'", image)
+	}
+	return image + "@" + digest, nil
 }
 
 // buildBlockChain builds the dependency chain for a block
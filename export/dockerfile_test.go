@@ -0,0 +1,181 @@
+package export
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func TestGenerateDockerfileGolden(t *testing.T) {
+	project, err := config.Parse(filepath.Join("testdata", "dockstep.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	if err := config.Validate(project); err != nil {
+		t.Fatalf("Invalid test config: %v", err)
+	}
+
+	digests := map[string]string{
+		"debian:12":   "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+		"golang:1.22": "sha256:2222222222222222222222222222222222222222222222222222222222222222",
+		"alpine:3.19": "sha256:3333333333333333333333333333333333333333333333333333333333333333",
+	}
+
+	tests := []struct {
+		name    string
+		targets []string
+		opts    types.DockerfileOptions
+	}{
+		{name: "flat", targets: []string{"app"}},
+		{name: "collapse_pinned", targets: []string{"app"}, opts: types.DockerfileOptions{CollapseRuns: true, PinDigests: true, Digests: digests}},
+		{name: "multistage", targets: []string{"app", "worker"}, opts: types.DockerfileOptions{MultiStage: true}},
+		{name: "multistage_collapse_pinned", targets: []string{"worker"}, opts: types.DockerfileOptions{MultiStage: true, CollapseRuns: true, PinDigests: true, Digests: digests}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			var err error
+			if tt.opts.MultiStage {
+				got, err = GenerateMultiStageDockerfile(project, tt.targets, tt.opts)
+			} else {
+				got, err = GenerateDockerfile(project, tt.targets[0], tt.opts)
+			}
+			if err != nil {
+				t.Fatalf("Failed to generate Dockerfile: %v", err)
+			}
+
+			golden := filepath.Join("testdata", tt.name+".Dockerfile")
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatalf("Failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("Failed to read golden file (run with -update to create it): %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("Dockerfile does not match %s:\n--- got ---\n%s\n--- want ---\n%s", golden, got, want)
+			}
+
+			// Output must be deterministic
+			for i := 0; i < 5; i++ {
+				var again string
+				if tt.opts.MultiStage {
+					again, _ = GenerateMultiStageDockerfile(project, tt.targets, tt.opts)
+				} else {
+					again, _ = GenerateDockerfile(project, tt.targets[0], tt.opts)
+				}
+				if again != got {
+					t.Fatal("Dockerfile output is not deterministic")
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateDockerfileSettings(t *testing.T) {
+	project, err := config.ParseData([]byte(`version: "1.0"
+name: "settings"
+settings:
+  platform: "linux/arm64"
+  env:
+    TZ: "UTC"
+    PATH: "/opt/bin:${PATH}"
+  labels:
+    team: "web"
+blocks:
+  - id: "base"
+    from: "alpine:3.19"
+    instructions:
+      - "RUN apk add --no-cache tzdata"
+  - id: "app"
+    from_block: "base"
+    env:
+      PORT: "8080"
+    instructions:
+      - "RUN echo $PORT"
+`), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	flat, err := GenerateDockerfile(project, "app", types.DockerfileOptions{})
+	if err != nil {
+		t.Fatalf("Failed to generate Dockerfile: %v", err)
+	}
+	multi, err := GenerateMultiStageDockerfile(project, []string{"app"}, types.DockerfileOptions{MultiStage: true})
+	if err != nil {
+		t.Fatalf("Failed to generate Dockerfile: %v", err)
+	}
+	for name, got := range map[string]string{"flat": flat, "multistage": multi} {
+		for _, want := range []string{"FROM --platform=linux/arm64 alpine:3.19", `ENV TZ="UTC"`, `ENV PATH="/opt/bin:${PATH}"`, `LABEL team="web"`, `ENV PORT="8080"`} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%s: expected %q in:\n%s", name, want, got)
+			}
+		}
+		if strings.Count(got, "LABEL team") != 1 {
+			t.Errorf("%s: expected the settings labels once, on the root block:\n%s", name, got)
+		}
+	}
+}
+
+func TestRewriteContextPaths(t *testing.T) {
+	tests := map[string]string{
+		"COPY . /app":                            "COPY services/api /app",
+		"COPY a.txt b.txt /app/":                 "COPY services/api/a.txt services/api/b.txt /app/",
+		"COPY --chown=app:app src /app/src":      "COPY --chown=app:app services/api/src /app/src",
+		"COPY /etc/conf /conf":                   "COPY services/api/etc/conf /conf",
+		`COPY ["my file", "/app/"]`:              `COPY ["services/api/my file","/app/"]`,
+		"COPY --from=builder /out/app /app":      "COPY --from=builder /out/app /app",
+		"ADD https://example.com/x.tgz /opt/":    "ADD https://example.com/x.tgz /opt/",
+		"RUN cp . /app":                          "RUN cp . /app",
+		"COPY <<EOF /app/config\nkey=value\nEOF": "COPY <<EOF /app/config\nkey=value\nEOF",
+	}
+	for input, want := range tests {
+		if got := rewriteContextPaths(input, "./services/api"); got != want {
+			t.Errorf("rewriteContextPaths(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	if got := rewriteContextPaths("COPY . /app", "."); got != "COPY . /app" {
+		t.Errorf("Expected default context to leave paths unchanged, got %q", got)
+	}
+}
+
+func TestCollapseRunsKeepsShellOperators(t *testing.T) {
+	project, err := config.ParseData([]byte(`version: "1.0"
+name: "operators"
+blocks:
+  - id: "app"
+    from: "alpine:3.19"
+    instructions:
+      - "RUN false"
+      - "RUN echo a; echo b"
+      - "RUN test -f x || echo missing"
+      - "RUN apk add curl 2>&1"
+      - "RUN echo done"
+`), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	got, err := GenerateDockerfile(project, "app", types.DockerfileOptions{CollapseRuns: true})
+	if err != nil {
+		t.Fatalf("Failed to generate Dockerfile: %v", err)
+	}
+	// Joined with &&, the failing RUN false would be masked by the later ; and ||
+	for _, want := range []string{"RUN false\n", "RUN echo a; echo b\n", "RUN test -f x || echo missing\n", "RUN apk add curl 2>&1 && \\\n    echo done\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q in:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package export
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+// invalidStageChars matches runs of characters that are not allowed in build stage names
+var invalidStageChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// GenerateMultiStageDockerfile generates a Dockerfile with one stage per block, mirroring
+// the block graph. The targets and every block they depend on are included, so each target
+// builds with docker build --target <stage>. A matrix block ID selects all of its variants.
+func GenerateMultiStageDockerfile(project *types.Project, targetIDs []string, opts types.DockerfileOptions) (string, error) {
+	if len(project.Blocks) == 0 {
+		return "", fmt.Errorf("no blocks found")
+	}
+
+	// Resolve the targets, defaulting to the last block
+	var targets []string
+	for _, id := range targetIDs {
+		ids := config.MatchBlocks(project, id)
+		if len(ids) == 0 {
+			return "", fmt.Errorf("block %s not found", id)
+		}
+		targets = append(targets, ids...)
+	}
+	if len(targets) == 0 {
+		targets = []string{project.Blocks[len(project.Blocks)-1].ID}
+	}
+
+	blocks, err := stageOrder(project, targets)
+	if err != nil {
+		return "", fmt.Errorf("failed to build block graph: %w", err)
+	}
+	names := stageNames(blocks)
+
+	// Generate Dockerfile
+	var lines []string
+	lines = append(lines, "# Generated by dockstep")
+	lines = append(lines, secretHints(project, blocks)...)
+	lines = append(lines, "# Targets:")
+	for _, id := range targets {
+		lines = append(lines, fmt.Sprintf("#   docker build --target %s .", names[id]))
+	}
+	lines = append(lines, "")
+
+	for _, block := range blocks {
+		resolved := config.ResolveBlock(project, block, opts.Variables)
+		stage := names[block.ID]
+
+		// Add FROM directive naming the stage
+		lines = append(lines, fmt.Sprintf("# Block: %s", block.ID))
+		lines = append(lines, descriptionLines(block)...)
+		switch {
+		case resolved.From != "":
+			from := resolved.From
+			if opts.PinDigests {
+				if from, err = pinImage(from, opts.Digests); err != nil {
+					return "", err
+				}
+			}
+			lines = append(lines, fmt.Sprintf("FROM %s%s AS %s", fromPlatform(resolved), from, stage))
+		case resolved.FromBlockVersion != "":
+			lines = append(lines, fmt.Sprintf("# Pinned version of %s", block.FromBlock))
+			lines = append(lines, fmt.Sprintf("FROM %s AS %s", resolved.FromBlockVersion, stage))
+		default:
+			lines = append(lines, fmt.Sprintf("FROM %s AS %s", names[block.FromBlock], stage))
+		}
+		lines = append(lines, "")
+
+		// Declare build args with their resolved values as defaults, then env and labels
+		out := newRunCollapser(opts.CollapseRuns)
+		out.barrier(argLines(resolved)...)
+		out.barrier(envLabelLines(resolved)...)
+
+		// Copy files from other block stages, then add block instructions
+		copyStages := make(map[string]string)
+		for _, ref := range config.CopyRefs(project, block) {
+			id, err := config.ResolveCopyRef(project, block, ref)
+			if err != nil {
+				return "", fmt.Errorf("block %s: %w", block.ID, err)
+			}
+			copyStages[ref] = names[id]
+		}
+		for _, entry := range resolved.CopyFrom {
+			out.instruction(fmt.Sprintf("COPY --from=%s %s %s", copyStages[entry.Block], entry.Src, entry.Dst))
+		}
+		instructions, err := blockInstructions(resolved)
+		if err != nil {
+			return "", err
+		}
+		for _, instruction := range instructions {
+			out.instruction(config.RewriteCopyFrom(instruction, func(ref string) string {
+				if stage, ok := copyStages[ref]; ok {
+					return stage
+				}
+				return ref
+			}))
+		}
+		if len(resolved.CopyFrom) > 0 || len(resolved.Instructions) > 0 {
+			out.comment("")
+		}
+
+		// Add export configuration if present
+		out.barrier(exportLines(resolved)...)
+		lines = append(lines, out.result()...)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// stageOrder returns the targets and every block they depend on, with dependencies before
+// the blocks that use them and otherwise in declaration order
+func stageOrder(project *types.Project, targets []string) ([]types.Block, error) {
+	blockMap := make(map[string]types.Block)
+	for _, block := range project.Blocks {
+		blockMap[block.ID] = block
+	}
+
+	// dependencies returns the blocks a stage is built from
+	dependencies := func(block types.Block) ([]string, error) {
+		var deps []string
+		if block.FromBlock != "" && block.FromBlockVersion == "" {
+			deps = append(deps, block.FromBlock)
+		}
+		for _, ref := range config.CopyRefs(project, block) {
+			id, err := config.ResolveCopyRef(project, block, ref)
+			if err != nil {
+				return nil, fmt.Errorf("block %s: %w", block.ID, err)
+			}
+			deps = append(deps, id)
+		}
+		return deps, nil
+	}
+
+	// Collect the blocks the targets need
+	needed := make(map[string]bool)
+	visiting := make(map[string]bool)
+	var collect func(blockID string) error
+	collect = func(blockID string) error {
+		if needed[blockID] {
+			return nil
+		}
+		if visiting[blockID] {
+			return fmt.Errorf("circular dependency detected at block %s", blockID)
+		}
+		block, exists := blockMap[blockID]
+		if !exists {
+			return fmt.Errorf("block %s not found", blockID)
+		}
+		visiting[blockID] = true
+		deps, err := dependencies(block)
+		if err != nil {
+			return err
+		}
+		for _, dep := range deps {
+			if err := collect(dep); err != nil {
+				return err
+			}
+		}
+		visiting[blockID] = false
+		needed[blockID] = true
+		return nil
+	}
+	for _, id := range targets {
+		if err := collect(id); err != nil {
+			return nil, err
+		}
+	}
+
+	// Emit them in declaration order, pulling dependencies forward when needed
+	var order []types.Block
+	emitted := make(map[string]bool)
+	var emit func(blockID string)
+	emit = func(blockID string) {
+		if emitted[blockID] {
+			return
+		}
+		emitted[blockID] = true
+		block := blockMap[blockID]
+		deps, _ := dependencies(block)
+		for _, dep := range deps {
+			emit(dep)
+		}
+		order = append(order, block)
+	}
+	for _, block := range project.Blocks {
+		if needed[block.ID] {
+			emit(block.ID)
+		}
+	}
+
+	return order, nil
+}
+
+// stageNames assigns each block a unique build stage name
+func stageNames(blocks []types.Block) map[string]string {
+	names := make(map[string]string, len(blocks))
+	used := make(map[string]bool, len(blocks))
+	for _, block := range blocks {
+		base := stageName(block.ID)
+		name := base
+		for i := 2; used[name]; i++ {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		used[name] = true
+		names[block.ID] = name
+	}
+	return names
+}
+
+// stageName converts a block ID to a valid build stage name
+func stageName(blockID string) string {
+	// Stage names must be lowercase, start with a letter and only contain [a-z0-9._-]
+	name := invalidStageChars.ReplaceAllString(strings.ToLower(blockID), "-")
+	name = strings.Trim(name, "-")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "stage-" + name
+	}
+	return strings.TrimSuffix(name, "-")
+}
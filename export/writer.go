@@ -0,0 +1,123 @@
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"dockstep.dev/dockerfile"
+	"dockstep.dev/types"
+)
+
+// descriptionLines renders a block's description as Dockerfile comments
+func descriptionLines(block types.Block) []string {
+	if block.Description == "" {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(block.Description, "\n") {
+		lines = append(lines, strings.TrimRight("# "+line, " "))
+	}
+	return lines
+}
+
+// envLabelLines returns the ENV and LABEL lines of a block
+func envLabelLines(block types.Block) []string {
+	if len(block.Env) == 0 && len(block.Labels) == 0 {
+		return nil
+	}
+	lines := append(dockerfile.EnvLines(block.Env), dockerfile.LabelLines(block.Labels)...)
+	return append(lines, "")
+}
+
+// fromPlatform returns the --platform flag for a block's FROM, if it sets a platform
+func fromPlatform(block types.Block) string {
+	if block.Platform == "" {
+		return ""
+	}
+	return "--platform=" + block.Platform + " "
+}
+
+// blockInstructions returns a block's instructions with COPY and ADD sources made relative
+// to the project root, which is the build context of exported Dockerfiles
+func blockInstructions(block types.Block) ([]string, error) {
+	if block.Context == "" {
+		return block.Instructions, nil
+	}
+	if filepath.IsAbs(block.Context) {
+		return nil, fmt.Errorf("block %s uses the absolute context %s, which cannot be exported relative to the project root", block.ID, block.Context)
+	}
+	instructions := make([]string, len(block.Instructions))
+	for i, instruction := range block.Instructions {
+		instructions[i] = rewriteContextPaths(instruction, filepath.ToSlash(block.Context))
+	}
+	return instructions, nil
+}
+
+// rewriteContextPaths rewrites the source paths of a COPY or ADD instruction so they are
+// relative to the project root instead of a block's own build context. Instructions that
+// copy from another stage or image, heredocs and remote ADD sources are left unchanged.
+func rewriteContextPaths(instruction, context string) string {
+	context = path.Clean(strings.TrimPrefix(context, "./"))
+	if context == "." || context == "" {
+		return instruction
+	}
+
+	fields := strings.Fields(instruction)
+	if len(fields) < 3 || (!strings.EqualFold(fields[0], "COPY") && !strings.EqualFold(fields[0], "ADD")) {
+		return instruction
+	}
+	if strings.Contains(instruction, "<<") {
+		return instruction
+	}
+
+	// Keep flags; a --from source is not in the build context
+	parts := []string{fields[0]}
+	rest := fields[1:]
+	for len(rest) > 0 && strings.HasPrefix(rest[0], "--") {
+		if strings.HasPrefix(rest[0], "--from=") {
+			return instruction
+		}
+		parts = append(parts, rest[0])
+		rest = rest[1:]
+	}
+
+	// JSON form: COPY ["src", "dst"]
+	if len(rest) > 0 && strings.HasPrefix(rest[0], "[") {
+		_, afterFlags, _ := strings.Cut(instruction, rest[0])
+		var args []string
+		if err := json.Unmarshal([]byte(rest[0]+afterFlags), &args); err != nil || len(args) < 2 {
+			return instruction
+		}
+		for i := range args[:len(args)-1] {
+			args[i] = contextSource(args[i], context)
+		}
+		return strings.Join(append(parts, dockerfile.ExecForm(args)), " ")
+	}
+
+	// Shell form: drop line continuations, then rewrite every argument but the destination
+	var args []string
+	for _, arg := range rest {
+		if arg != "\\" {
+			args = append(args, arg)
+		}
+	}
+	if len(args) < 2 {
+		return instruction
+	}
+	for i := range args[:len(args)-1] {
+		args[i] = contextSource(args[i], context)
+	}
+	return strings.Join(append(parts, args...), " ")
+}
+
+// contextSource joins a COPY or ADD source onto a build context directory
+func contextSource(src, context string) string {
+	if strings.Contains(src, "://") || strings.HasPrefix(src, "git@") {
+		return src
+	}
+	// Docker resolves absolute sources against the root of the build context
+	return path.Join(context, strings.TrimPrefix(src, "/"))
+}
@@ -0,0 +1,369 @@
+// Package importer converts existing Dockerfiles and images into dockstep projects
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// SplitMode controls how the instructions of a Dockerfile are grouped into blocks
+type SplitMode string
+
+const (
+	// SplitStage creates one block per build stage
+	SplitStage SplitMode = "stage"
+	// SplitComment starts a new block at every commented instruction
+	SplitComment SplitMode = "comment"
+	// SplitEveryRun starts a new block at every RUN instruction
+	SplitEveryRun SplitMode = "every-run"
+)
+
+var (
+	// bareVariablePattern matches $VAR references, which are rewritten to ${VAR}
+	bareVariablePattern = regexp.MustCompile(`\$([A-Za-z_][A-Za-z0-9_]*)`)
+	// directivePattern matches parser directives such as # syntax=docker/dockerfile:1
+	directivePattern = regexp.MustCompile(`(?i)^(syntax|escape|check)\s*=`)
+	// slugPattern matches runs of characters that are not used in generated block IDs
+	slugPattern = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// maxSlugLength limits the length of block IDs derived from comments
+const maxSlugLength = 32
+
+// Result is an imported project along with anything that could not be carried over
+type Result struct {
+	Project  *types.Project
+	Warnings []string
+}
+
+// stage tracks a build stage while its instructions are grouped into blocks
+type stage struct {
+	name     string // AS name, or the stage index
+	line     int    // line of the stage's FROM
+	skipped  bool   // the stage has no instructions, so it has no block
+	blocks   []*types.Block
+	args     map[string]string
+	comments []string
+}
+
+// ParseSplitMode validates a --split-on value
+func ParseSplitMode(value string) (SplitMode, error) {
+	switch mode := SplitMode(value); mode {
+	case SplitStage, SplitComment, SplitEveryRun:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid split mode %q (expected stage, comment or every-run)", value)
+	}
+}
+
+// ImportDockerfile converts a Dockerfile into a project named name. Multi-stage builds map
+// to blocks linked with from_block and COPY --from, global ARGs become project variables,
+// ARGs inside a stage become block args, and comments become block descriptions.
+func ImportDockerfile(r io.Reader, name string, mode SplitMode) (*Result, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %w", err)
+	}
+	parsed, err := parser.Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Dockerfile: %w", err)
+	}
+	source := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+
+	result := &Result{Project: &types.Project{
+		Version: "1.0",
+		Name:    name,
+	}}
+	variables := make(map[string]string)
+	var stages []*stage
+	stageBlocks := make(map[string]string) // stage name or index -> ID of its last block
+	usedIDs := make(map[string]bool)
+	var current *stage
+
+	for _, node := range parsed.AST.Children {
+		keyword := strings.ToUpper(node.Value)
+		comments := filterComments(node.PrevComment)
+
+		if keyword == "FROM" {
+			current, err = newStage(node, len(stages), stageBlocks, result)
+			if err != nil {
+				return nil, err
+			}
+			current.comments = comments
+			stages = append(stages, current)
+			continue
+		}
+
+		if current == nil {
+			// Instructions before the first FROM: only ARG is allowed there
+			if keyword == "ARG" {
+				for name, value := range argValues(node) {
+					variables[name] = value
+				}
+			} else {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("line %d: ignored %s before the first FROM", node.StartLine, keyword))
+			}
+			continue
+		}
+
+		// ARGs are declared as block args rather than instructions
+		if keyword == "ARG" {
+			for name, value := range argValues(node) {
+				if _, global := variables[name]; global && value == "" {
+					value = "${" + name + "}"
+				}
+				current.args[name] = value
+				current.lastBlock().Args = copyArgs(current.args)
+			}
+			current.comments = append(current.comments, comments...)
+			continue
+		}
+
+		// Start a new block where the split mode asks for one
+		block := current.lastBlock()
+		if len(block.Instructions) > 0 && startsBlock(mode, keyword, comments, block) {
+			block = current.addBlock()
+		}
+		if len(comments) > 0 || len(current.comments) > 0 {
+			block.Description = joinDescription(block.Description, append(current.comments, comments...))
+			current.comments = nil
+		}
+		block.Instructions = append(block.Instructions, instructionText(node, source, stageBlocks))
+	}
+
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("Dockerfile has no FROM instruction")
+	}
+
+	// Name the blocks and link each to the previous block of its stage. A stage with only
+	// FROM has nothing to build, so it is skipped and references to it use its base.
+	stageImages := make(map[string]string) // skipped stage name or index -> its base image
+	for i, st := range stages {
+		if len(st.blocks) == 1 && len(st.lastBlock().Instructions) == 0 {
+			st.skipped = true
+			image, target := st.lastBlock().From, ""
+			if ref, ok := strings.CutPrefix(st.lastBlock().FromBlock, stageRefPrefix); ok {
+				image, target = stageImages[ref], stageBlocks[ref]
+			}
+			if target != "" {
+				stageBlocks[st.name] = target
+				stageBlocks[strconv.Itoa(i)] = target
+			} else {
+				stageImages[st.name] = image
+				stageImages[strconv.Itoa(i)] = image
+			}
+			result.Warnings = append(result.Warnings, fmt.Sprintf("line %d: stage %s has no instructions and was not imported; references to it use %s", st.line, st.name, image+target))
+			continue
+		}
+		for j, block := range st.blocks {
+			block.ID = blockID(st, j, mode, usedIDs)
+			if j > 0 {
+				block.From = ""
+				block.FromBlock = st.blocks[j-1].ID
+			}
+		}
+		stageBlocks[st.name] = st.lastBlock().ID
+		stageBlocks[strconv.Itoa(i)] = st.lastBlock().ID
+	}
+
+	// Resolve references to stages now that block IDs are known
+	for _, st := range stages {
+		if st.skipped {
+			continue
+		}
+		for _, block := range st.blocks {
+			if ref, ok := strings.CutPrefix(block.FromBlock, stageRefPrefix); ok {
+				if image, ok := stageImages[ref]; ok {
+					block.From = image
+					block.FromBlock = ""
+				} else {
+					block.FromBlock = stageBlocks[ref]
+				}
+			}
+			for i, instruction := range block.Instructions {
+				block.Instructions[i] = config.RewriteCopyFrom(instruction, func(ref string) string {
+					if stageRef, ok := strings.CutPrefix(ref, stageRefPrefix); ok {
+						if image, ok := stageImages[stageRef]; ok {
+							return image
+						}
+						return stageBlocks[stageRef]
+					}
+					return ref
+				})
+			}
+			result.Project.Blocks = append(result.Project.Blocks, *block)
+		}
+	}
+
+	if len(variables) > 0 {
+		result.Project.Variables = variables
+	}
+	return result, nil
+}
+
+// stageRefPrefix marks references to stages that are resolved once block IDs are known
+const stageRefPrefix = "\x00stage:"
+
+// newStage starts a stage from a FROM instruction
+func newStage(node *parser.Node, index int, stageBlocks map[string]string, result *Result) (*stage, error) {
+	var args []string
+	for n := node.Next; n != nil; n = n.Next {
+		args = append(args, n.Value)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("line %d: FROM requires an image", node.StartLine)
+	}
+	if len(node.Flags) > 0 {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("line %d: ignored FROM flags %s", node.StartLine, strings.Join(node.Flags, " ")))
+	}
+
+	st := &stage{name: strconv.Itoa(index), line: node.StartLine, args: make(map[string]string)}
+	if len(args) == 3 && strings.EqualFold(args[1], "AS") {
+		st.name = strings.ToLower(args[2])
+	}
+	stageBlocks[st.name] = ""
+	stageBlocks[strconv.Itoa(index)] = ""
+
+	block := &types.Block{}
+	image := args[0]
+	if _, isStage := stageBlocks[strings.ToLower(image)]; isStage && strings.ToLower(image) != st.name {
+		block.FromBlock = stageRefPrefix + strings.ToLower(image)
+	} else {
+		block.From = bareVariablePattern.ReplaceAllString(image, "$${$1}")
+	}
+	st.blocks = []*types.Block{block}
+	return st, nil
+}
+
+// lastBlock returns the block instructions are currently added to
+func (s *stage) lastBlock() *types.Block {
+	return s.blocks[len(s.blocks)-1]
+}
+
+// addBlock starts a new block in the stage, inheriting the stage's args
+func (s *stage) addBlock() *types.Block {
+	block := &types.Block{Args: copyArgs(s.args)}
+	s.blocks = append(s.blocks, block)
+	return block
+}
+
+// startsBlock reports whether an instruction starts a new block in the given split mode
+func startsBlock(mode SplitMode, keyword string, comments []string, block *types.Block) bool {
+	switch mode {
+	case SplitComment:
+		return len(comments) > 0
+	case SplitEveryRun:
+		if keyword != "RUN" {
+			return false
+		}
+		for _, instruction := range block.Instructions {
+			if fields := strings.Fields(instruction); len(fields) > 0 && strings.EqualFold(fields[0], "RUN") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blockID names the i-th block of a stage. The last block takes the stage name so that
+// references to the stage keep working; earlier blocks are numbered or named after comments.
+func blockID(st *stage, i int, mode SplitMode, used map[string]bool) string {
+	base := st.name
+	if _, err := strconv.Atoi(base); err == nil {
+		base = "stage" + base
+	}
+
+	id := base
+	if i < len(st.blocks)-1 {
+		id = fmt.Sprintf("%s-%d", base, i+1)
+		if mode == SplitComment {
+			if slug := slugify(st.blocks[i].Description); slug != "" {
+				id = slug
+			}
+		}
+	}
+
+	unique := id
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s-%d", id, n)
+	}
+	used[unique] = true
+	return unique
+}
+
+// instructionText returns an instruction as written in the source, including line
+// continuations and heredoc bodies, with references to stages marked
+func instructionText(node *parser.Node, source []string, stageBlocks map[string]string) string {
+	text := strings.TrimSpace(node.Original)
+	if node.StartLine >= 1 && node.EndLine <= len(source) {
+		text = strings.TrimSpace(strings.Join(source[node.StartLine-1:node.EndLine], "\n"))
+	}
+
+	// COPY --from=<stage> refers to a block; the ID is filled in later
+	return config.RewriteCopyFrom(text, func(ref string) string {
+		if _, isStage := stageBlocks[strings.ToLower(ref)]; isStage {
+			return stageRefPrefix + strings.ToLower(ref)
+		}
+		return ref
+	})
+}
+
+// argValues returns the names and defaults declared by an ARG instruction
+func argValues(node *parser.Node) map[string]string {
+	values := make(map[string]string)
+	for n := node.Next; n != nil; n = n.Next {
+		name, value, _ := strings.Cut(n.Value, "=")
+		values[name] = strings.Trim(value, `"'`)
+	}
+	return values
+}
+
+// copyArgs copies a block's args, returning nil when there are none
+func copyArgs(args map[string]string) map[string]string {
+	if len(args) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(args))
+	for name, value := range args {
+		out[name] = value
+	}
+	return out
+}
+
+// filterComments drops parser directives from the comments preceding an instruction
+func filterComments(comments []string) []string {
+	var out []string
+	for _, comment := range comments {
+		if !directivePattern.MatchString(comment) {
+			out = append(out, comment)
+		}
+	}
+	return out
+}
+
+// joinDescription appends comment lines to a block description
+func joinDescription(description string, comments []string) string {
+	lines := comments
+	if description != "" {
+		lines = append([]string{description}, comments...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// slugify turns the first line of a description into a block ID
+func slugify(description string) string {
+	line, _, _ := strings.Cut(description, "\n")
+	slug := strings.Trim(slugPattern.ReplaceAllString(strings.ToLower(line), "-"), "-")
+	if len(slug) > maxSlugLength {
+		slug = strings.TrimRight(slug[:maxSlugLength], "-")
+	}
+	return slug
+}
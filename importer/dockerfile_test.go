@@ -0,0 +1,222 @@
+package importer
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dockstep.dev/config"
+	"dockstep.dev/export"
+	"dockstep.dev/types"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+const sampleDockerfile = `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.22
+
+# Build the binary
+FROM golang:${GO_VERSION} AS build
+ARG TARGETOS=linux
+WORKDIR /src
+COPY go.mod go.sum ./
+RUN go mod download
+# Compile
+RUN CGO_ENABLED=0 GOOS=$TARGETOS \
+    go build -o /out/app ./cmd/app
+
+FROM build AS test
+RUN go test ./...
+
+FROM alpine:3.19
+RUN <<EOF
+apk add --no-cache ca-certificates
+adduser -D app
+EOF
+COPY --from=build /out/app /usr/bin/app
+USER app
+ENTRYPOINT ["/usr/bin/app"]
+`
+
+func TestImportDockerfileStages(t *testing.T) {
+	result, err := ImportDockerfile(strings.NewReader(sampleDockerfile), "sample", SplitStage)
+	if err != nil {
+		t.Fatalf("Failed to import Dockerfile: %v", err)
+	}
+	project := result.Project
+	if err := config.Validate(project); err != nil {
+		t.Fatalf("Imported project is invalid: %v", err)
+	}
+
+	if got := blockIDs(project); !reflect.DeepEqual(got, []string{"build", "test", "stage2"}) {
+		t.Fatalf("Block IDs = %v", got)
+	}
+	if project.Variables["GO_VERSION"] != "1.22" {
+		t.Errorf("Expected global ARG as variable, got %v", project.Variables)
+	}
+
+	build := project.Blocks[0]
+	if build.From != "golang:${GO_VERSION}" {
+		t.Errorf("Expected from golang:${GO_VERSION}, got %s", build.From)
+	}
+	if build.Args["TARGETOS"] != "linux" {
+		t.Errorf("Expected stage ARG as block arg, got %v", build.Args)
+	}
+	if build.Description != "Build the binary\nCompile" {
+		t.Errorf("Expected comments as description, got %q", build.Description)
+	}
+	if !strings.Contains(build.Instructions[3], "\\\n    go build") {
+		t.Errorf("Expected line continuation to be kept, got %q", build.Instructions[3])
+	}
+
+	if project.Blocks[1].FromBlock != "build" {
+		t.Errorf("Expected test to extend build, got %q", project.Blocks[1].FromBlock)
+	}
+
+	final := project.Blocks[2]
+	if final.Instructions[0] != "RUN <<EOF\napk add --no-cache ca-certificates\nadduser -D app\nEOF" {
+		t.Errorf("Expected heredoc to be kept, got %q", final.Instructions[0])
+	}
+	if !reflect.DeepEqual(config.CopyRefs(project, final), []string{"build"}) {
+		t.Errorf("Expected COPY --from=build to reference the build block")
+	}
+}
+
+func TestImportDockerfileEmptyStage(t *testing.T) {
+	dockerfile := `FROM golang:1.22 AS toolchain
+FROM toolchain AS build
+RUN go build -o /app
+FROM build AS release
+FROM alpine:3.19
+COPY --from=toolchain /usr/local/go/VERSION /
+COPY --from=release /app /app
+`
+	result, err := ImportDockerfile(strings.NewReader(dockerfile), "sample", SplitStage)
+	if err != nil {
+		t.Fatalf("Failed to import Dockerfile: %v", err)
+	}
+	project := result.Project
+	if err := config.Validate(project); err != nil {
+		t.Fatalf("Imported project is invalid: %v", err)
+	}
+
+	// Stages without instructions are skipped, and references to them use their base
+	if got := blockIDs(project); !reflect.DeepEqual(got, []string{"build", "stage3"}) {
+		t.Fatalf("Block IDs = %v", got)
+	}
+	if build := project.Blocks[0]; build.From != "golang:1.22" || build.FromBlock != "" {
+		t.Errorf("Expected build from golang:1.22, got from %q, from_block %q", build.From, build.FromBlock)
+	}
+	want := []string{"COPY --from=golang:1.22 /usr/local/go/VERSION /", "COPY --from=build /app /app"}
+	if got := project.Blocks[1].Instructions; !reflect.DeepEqual(got, want) {
+		t.Errorf("Instructions = %q, want %q", got, want)
+	}
+	if len(result.Warnings) != 2 || !strings.Contains(result.Warnings[0], "line 1: stage toolchain has no instructions") {
+		t.Errorf("Expected a warning for each skipped stage, got %q", result.Warnings)
+	}
+}
+
+func TestImportDockerfileSplitModes(t *testing.T) {
+	tests := map[SplitMode][]string{
+		SplitComment:  {"build-the-binary", "build", "test", "stage2"},
+		SplitEveryRun: {"build-1", "build", "test", "stage2"},
+	}
+	for mode, want := range tests {
+		t.Run(string(mode), func(t *testing.T) {
+			result, err := ImportDockerfile(strings.NewReader(sampleDockerfile), "sample", mode)
+			if err != nil {
+				t.Fatalf("Failed to import Dockerfile: %v", err)
+			}
+			if err := config.Validate(result.Project); err != nil {
+				t.Fatalf("Imported project is invalid: %v", err)
+			}
+			if got := blockIDs(result.Project); !reflect.DeepEqual(got, want) {
+				t.Fatalf("Block IDs = %v, want %v", got, want)
+			}
+
+			// Later blocks of a stage extend the earlier ones and keep the stage's args
+			second := result.Project.Blocks[1]
+			if second.FromBlock != want[0] || second.Args["TARGETOS"] != "linux" {
+				t.Errorf("Expected %s to extend %s with args, got from_block %q args %v", second.ID, want[0], second.FromBlock, second.Args)
+			}
+		})
+	}
+}
+
+func TestImportExportRoundTrip(t *testing.T) {
+	result, err := ImportDockerfile(strings.NewReader(sampleDockerfile), "sample", SplitStage)
+	if err != nil {
+		t.Fatalf("Failed to import Dockerfile: %v", err)
+	}
+
+	// Write and re-read the config, as dockstep import does
+	path := filepath.Join(t.TempDir(), "dockstep.yaml")
+	if err := config.Write(result.Project, path); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+	project, err := config.Parse(path)
+	if err != nil {
+		t.Fatalf("Failed to parse written config: %v", err)
+	}
+
+	exported, err := export.GenerateMultiStageDockerfile(project, []string{"test", "stage2"}, types.DockerfileOptions{MultiStage: true})
+	if err != nil {
+		t.Fatalf("Failed to export Dockerfile: %v", err)
+	}
+
+	want := normalizedInstructions(t, sampleDockerfile)
+	got := normalizedInstructions(t, exported)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Round trip changed the Dockerfile:\ngot  %q\nwant %q\n\nexported:\n%s", got, want, exported)
+	}
+}
+
+func TestParseSplitMode(t *testing.T) {
+	if _, err := ParseSplitMode("every-run"); err != nil {
+		t.Errorf("Expected every-run to be valid: %v", err)
+	}
+	if _, err := ParseSplitMode("layer"); err == nil {
+		t.Error("Expected error for unknown split mode")
+	}
+}
+
+// blockIDs returns the IDs of a project's blocks in order
+func blockIDs(project *types.Project) []string {
+	var ids []string
+	for _, block := range project.Blocks {
+		ids = append(ids, block.ID)
+	}
+	return ids
+}
+
+// normalizedInstructions reduces a Dockerfile to what affects the build: the base image of
+// each stage, with global ARGs expanded, and every instruction other than ARG
+func normalizedInstructions(t *testing.T, dockerfile string) []string {
+	t.Helper()
+	parsed, err := parser.Parse(strings.NewReader(dockerfile))
+	if err != nil {
+		t.Fatalf("Failed to parse Dockerfile: %v\n%s", err, dockerfile)
+	}
+
+	globals := make(map[string]string)
+	var out []string
+	for _, node := range parsed.AST.Children {
+		switch strings.ToUpper(node.Value) {
+		case "ARG":
+			if len(out) == 0 {
+				for name, value := range argValues(node) {
+					globals[name] = value
+				}
+			}
+		case "FROM":
+			out = append(out, "FROM "+config.Interpolate(node.Next.Value, globals))
+		default:
+			text := strings.Join(strings.Fields(node.Original), " ")
+			for _, heredoc := range node.Heredocs {
+				text += "\n" + heredoc.Content
+			}
+			out = append(out, text)
+		}
+	}
+	return out
+}
@@ -0,0 +1,275 @@
+package importer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+// BaseImage is a local image that an imported image may have been built on
+type BaseImage struct {
+	Ref     string // reference used as the first block's from, preferably repo@digest
+	History []types.HistoryEntry
+}
+
+// buildGap is the pause between layers after which they are treated as separate builds
+const buildGap = 10 * time.Minute
+
+var (
+	// nopPattern matches the prefix the legacy builder records for metadata instructions
+	nopPattern = regexp.MustCompile(`^/bin/sh -c #\(nop\)\s*`)
+	// shellPattern matches the shell the builders record for shell-form RUN instructions
+	shellPattern = regexp.MustCompile(`^/bin/(ba)?sh -c `)
+	// buildArgsPattern matches the build args recorded before a RUN command, e.g. |2 A=1 B=2
+	buildArgsPattern = regexp.MustCompile(`^\|(\d+) `)
+	// exposePattern matches the port map the legacy builder records for EXPOSE
+	exposePattern = regexp.MustCompile(`^EXPOSE map\[(.*)\]$`)
+	// hashedSourcePattern matches COPY and ADD sources that only exist as a content hash
+	hashedSourcePattern = regexp.MustCompile(`^(COPY|ADD) (file|dir|multi):`)
+)
+
+// historyStep is a history entry converted back into an instruction
+type historyStep struct {
+	instruction string            // empty for entries that only declare build args
+	args        map[string]string // build args the entry was created with
+	warning     string
+}
+
+// ImportImage reconstructs a project named name from the history of the image ref, oldest
+// layer first. Layers shared with the closest of bases are replaced by a from of that base,
+// and the rest are grouped into blocks at tagged layers and at pauses between builds.
+func ImportImage(ref string, history []types.HistoryEntry, bases []BaseImage, name string) (*Result, error) {
+	if len(history) == 0 {
+		return nil, fmt.Errorf("image %s has no history", ref)
+	}
+
+	result := &Result{Project: &types.Project{
+		Version: "1.0",
+		Name:    name,
+	}}
+
+	from := "scratch"
+	base, shared := closestBase(history, bases)
+	if base != nil {
+		from = base.Ref
+	} else {
+		result.Warnings = append(result.Warnings, "no local image matches the base layers; the first block starts from scratch")
+	}
+
+	// Group the remaining layers into blocks
+	var groups [][]types.HistoryEntry
+	for i, entry := range history[shared:] {
+		if i == 0 || startsBuild(history[shared+i-1], entry) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], entry)
+	}
+	if len(groups) == 0 {
+		groups = [][]types.HistoryEntry{nil}
+	}
+
+	usedIDs := make(map[string]bool)
+	warned := make(map[string]bool)
+	for i, group := range groups {
+		block := types.Block{ID: imageBlockID(ref, group, i == len(groups)-1, i+1, usedIDs)}
+		if i == 0 {
+			block.From = from
+			block.Description = fmt.Sprintf("Imported from %s", ref)
+		} else {
+			block.FromBlock = result.Project.Blocks[i-1].ID
+		}
+
+		for _, entry := range group {
+			step := convertHistory(entry.CreatedBy)
+			for name, value := range step.args {
+				if block.Args == nil {
+					block.Args = make(map[string]string)
+				}
+				block.Args[name] = value
+			}
+			if step.instruction != "" {
+				block.Instructions = append(block.Instructions, step.instruction)
+			}
+			if step.warning != "" && !warned[step.warning] {
+				warned[step.warning] = true
+				result.Warnings = append(result.Warnings, step.warning)
+			}
+		}
+		if len(block.Instructions) == 0 {
+			// Validation requires at least one instruction
+			block.Instructions = []string{"# No instructions"}
+		}
+		result.Project.Blocks = append(result.Project.Blocks, block)
+	}
+
+	return result, nil
+}
+
+// closestBase returns the base image sharing the most layers with history, and the number
+// of shared layers. Images with the same history as the imported one are not bases.
+func closestBase(history []types.HistoryEntry, bases []BaseImage) (*BaseImage, int) {
+	var best *BaseImage
+	for i := range bases {
+		candidate := &bases[i]
+		if len(candidate.History) == 0 || len(candidate.History) >= len(history) {
+			continue
+		}
+		if best != nil && len(candidate.History) <= len(best.History) {
+			continue
+		}
+		if sameLayers(candidate.History, history[:len(candidate.History)]) {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	return best, len(best.History)
+}
+
+// sameLayers reports whether two histories record the same layers
+func sameLayers(a, b []types.HistoryEntry) bool {
+	for i := range a {
+		if a[i].CreatedBy != b[i].CreatedBy || !a[i].Created.Equal(b[i].Created) || a[i].Size != b[i].Size {
+			return false
+		}
+	}
+	return true
+}
+
+// startsBuild reports whether entry starts a new block after prev: layers after a tagged
+// image or after a long pause were produced by a separate build
+func startsBuild(prev, entry types.HistoryEntry) bool {
+	return len(prev.Tags) > 0 || entry.Created.Sub(prev.Created) > buildGap
+}
+
+// imageBlockID names a block of an imported image: the last block after the image itself,
+// blocks ending in a tagged layer after that tag, and the others by position
+func imageBlockID(ref string, group []types.HistoryEntry, last bool, n int, used map[string]bool) string {
+	id := ""
+	switch {
+	case last:
+		id = repositoryName(ref)
+	case len(group) > 0 && len(group[len(group)-1].Tags) > 0:
+		id = repositoryName(group[len(group)-1].Tags[0])
+	}
+	if id == "" || (!last && used[id]) {
+		id = fmt.Sprintf("layer-%d", n)
+	}
+
+	unique := id
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", id, i)
+	}
+	used[unique] = true
+	return unique
+}
+
+// repositoryName returns the last path element of an image reference as a block ID
+func repositoryName(ref string) string {
+	name, _, _ := strings.Cut(ref, "@")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	if name == "sha256" {
+		return ""
+	}
+	return slugify(name)
+}
+
+// convertHistory turns a history entry's created_by into a Dockerfile instruction. It
+// understands both the legacy builder's /bin/sh -c #(nop) form and BuildKit's form.
+func convertHistory(createdBy string) historyStep {
+	text := strings.TrimSpace(createdBy)
+	text = strings.TrimSpace(strings.TrimSuffix(text, "# buildkit"))
+	if text == "" {
+		return historyStep{}
+	}
+
+	// Metadata instructions recorded by the legacy builder
+	if loc := nopPattern.FindStringIndex(text); loc != nil {
+		return convertInstruction(strings.TrimSpace(text[loc[1]:]))
+	}
+
+	// RUN, optionally with the build args it was run with
+	var step historyStep
+	command, isRun := strings.CutPrefix(text, "RUN ")
+	if !isRun {
+		command = text
+	}
+	if match := buildArgsPattern.FindStringSubmatch(command); match != nil {
+		count, _ := strconv.Atoi(match[1])
+		fields := strings.SplitN(command[len(match[0]):], " ", count+1)
+		step.args = make(map[string]string)
+		for _, field := range fields[:min(count, len(fields))] {
+			name, value, _ := strings.Cut(field, "=")
+			step.args[name] = value
+		}
+		command = ""
+		if len(fields) > count {
+			command = fields[count]
+		}
+		isRun = true
+	}
+	if loc := shellPattern.FindStringIndex(command); loc != nil {
+		step.instruction = "RUN " + strings.TrimSpace(command[loc[1]:])
+		return step
+	}
+	if isRun {
+		step.instruction = "RUN " + command
+		return step
+	}
+
+	return convertInstruction(text)
+}
+
+// convertInstruction converts a history entry that names its instruction
+func convertInstruction(text string) historyStep {
+	keyword, rest, _ := strings.Cut(text, " ")
+	keyword = strings.ToUpper(keyword)
+
+	switch {
+	case strings.HasPrefix(text, "#"):
+		// Tools such as debuerreotype record a comment for the root filesystem
+		return historyStep{instruction: text}
+	case !config.IsInstruction(keyword):
+		return historyStep{
+			instruction: "# " + text,
+			warning:     fmt.Sprintf("kept %q as a comment: it was not created by a Dockerfile instruction", text),
+		}
+	case keyword == "ARG":
+		step := historyStep{args: make(map[string]string)}
+		for _, field := range strings.Fields(rest) {
+			name, value, _ := strings.Cut(field, "=")
+			step.args[name] = strings.Trim(value, `"'`)
+		}
+		return step
+	case hashedSourcePattern.MatchString(text):
+		return historyStep{
+			instruction: "# " + text,
+			warning:     "COPY and ADD layers whose sources were not recorded are kept as comments",
+		}
+	case keyword == "COPY" || keyword == "ADD":
+		return historyStep{
+			instruction: text,
+			warning:     "COPY and ADD sources must be provided in the build context",
+		}
+	}
+
+	if match := exposePattern.FindStringSubmatch(text); match != nil {
+		var ports []string
+		for _, port := range strings.Fields(match[1]) {
+			ports = append(ports, strings.TrimSuffix(port, ":{}"))
+		}
+		return historyStep{instruction: "EXPOSE " + strings.Join(ports, " ")}
+	}
+	return historyStep{instruction: strings.TrimSpace(keyword + " " + rest)}
+}
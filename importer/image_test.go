@@ -0,0 +1,110 @@
+package importer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+func TestImportImage(t *testing.T) {
+	start := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	debian := []types.HistoryEntry{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:4e6b5f2a in / ", Created: start, Size: 101},
+		{CreatedBy: `/bin/sh -c #(nop)  CMD ["bash"]`, Created: start.Add(time.Second)},
+	}
+	build := start.Add(24 * time.Hour)
+	history := append(append([]types.HistoryEntry(nil), debian...),
+		types.HistoryEntry{CreatedBy: "RUN |1 APP_VERSION=1.2 /bin/sh -c apt-get update && apt-get install -y curl # buildkit", Created: build, Size: 30},
+		types.HistoryEntry{CreatedBy: "WORKDIR /app", Created: build.Add(time.Minute), Tags: []string{"legacy-deps:latest"}},
+		types.HistoryEntry{CreatedBy: "COPY . /app # buildkit", Created: build.Add(2 * time.Minute), Size: 5},
+		types.HistoryEntry{CreatedBy: "/bin/sh -c #(nop)  EXPOSE map[8080/tcp:{}]", Created: build.Add(2 * time.Minute)},
+		types.HistoryEntry{CreatedBy: `/bin/sh -c #(nop)  CMD ["./server"]`, Created: build.Add(2 * time.Minute)},
+	)
+
+	bases := []BaseImage{
+		{Ref: "ubuntu@sha256:222", History: []types.HistoryEntry{{CreatedBy: "/bin/sh -c #(nop) ADD file:9c1 in / ", Created: start}}},
+		{Ref: "debian@sha256:111", History: debian},
+		{Ref: "registry.example.com/team/legacy:2019", History: history},
+	}
+	result, err := ImportImage("registry.example.com/team/legacy:2019", history, bases, "legacy")
+	if err != nil {
+		t.Fatalf("Failed to import image: %v", err)
+	}
+	if err := config.Validate(result.Project); err != nil {
+		t.Fatalf("Imported project is invalid: %v", err)
+	}
+
+	want := []types.Block{
+		{
+			ID:           "legacy-deps",
+			Description:  "Imported from registry.example.com/team/legacy:2019",
+			From:         "debian@sha256:111",
+			Args:         map[string]string{"APP_VERSION": "1.2"},
+			Instructions: []string{"RUN apt-get update && apt-get install -y curl", "WORKDIR /app"},
+		},
+		{
+			ID:           "legacy",
+			FromBlock:    "legacy-deps",
+			Instructions: []string{"COPY . /app", "EXPOSE 8080/tcp", `CMD ["./server"]`},
+		},
+	}
+	if !reflect.DeepEqual(result.Project.Blocks, want) {
+		t.Errorf("Blocks = %+v, want %+v", result.Project.Blocks, want)
+	}
+	if len(result.Warnings) != 1 {
+		t.Errorf("Expected a warning about COPY sources, got %v", result.Warnings)
+	}
+}
+
+func TestImportImageWithoutBase(t *testing.T) {
+	start := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	history := []types.HistoryEntry{
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:4e6b5f2a in / ", Created: start},
+		{CreatedBy: "/bin/sh -c apk add --no-cache curl", Created: start.Add(time.Hour)},
+	}
+	result, err := ImportImage("sha256:0123abcd", history, nil, "legacy")
+	if err != nil {
+		t.Fatalf("Failed to import image: %v", err)
+	}
+
+	// The pause between the layers starts a second block
+	if got := blockIDs(result.Project); !reflect.DeepEqual(got, []string{"layer-1", "layer-2"}) {
+		t.Fatalf("Block IDs = %v", got)
+	}
+	first := result.Project.Blocks[0]
+	if first.From != "scratch" || first.Instructions[0] != "# ADD file:4e6b5f2a in /" {
+		t.Errorf("Expected the root filesystem as a comment on scratch, got %+v", first)
+	}
+	if len(result.Warnings) != 2 {
+		t.Errorf("Expected warnings about the base and the ADD layer, got %v", result.Warnings)
+	}
+}
+
+func TestConvertHistory(t *testing.T) {
+	tests := []struct {
+		createdBy   string
+		instruction string
+		args        map[string]string
+	}{
+		{"/bin/sh -c apt-get update", "RUN apt-get update", nil},
+		{"RUN /bin/sh -c make install # buildkit", "RUN make install", nil},
+		{"|2 A=1 B=two /bin/sh -c ./build.sh $A", "RUN ./build.sh $A", map[string]string{"A": "1", "B": "two"}},
+		{`/bin/sh -c #(nop)  ENTRYPOINT ["/entrypoint.sh"]`, `ENTRYPOINT ["/entrypoint.sh"]`, nil},
+		{"/bin/sh -c #(nop)  EXPOSE map[80/tcp:{} 443/tcp:{}]", "EXPOSE 80/tcp 443/tcp", nil},
+		{"ENV PATH=/usr/local/bin:/usr/bin", "ENV PATH=/usr/local/bin:/usr/bin", nil},
+		{"ARG TARGETARCH=amd64", "", map[string]string{"TARGETARCH": "amd64"}},
+		{"/bin/sh -c #(nop) COPY dir:5f1 in /app ", "# COPY dir:5f1 in /app", nil},
+		{"# debian.sh --arch 'amd64' out/ 'bookworm'", "# debian.sh --arch 'amd64' out/ 'bookworm'", nil},
+		{"bazel build //app:image", "# bazel build //app:image", nil},
+		{"", "", nil},
+	}
+	for _, tt := range tests {
+		step := convertHistory(tt.createdBy)
+		if step.instruction != tt.instruction || !reflect.DeepEqual(step.args, tt.args) {
+			t.Errorf("convertHistory(%q) = %q %v, want %q %v", tt.createdBy, step.instruction, step.args, tt.instruction, tt.args)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Package lint checks blocks against policy rules such as pinned base images
+package lint
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"dockstep.dev/config"
+	"dockstep.dev/types"
+)
+
+// Severity is how a finding is reported
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	SeverityOff     Severity = "off"
+)
+
+// Finding is a rule violation in a block
+type Finding struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Block    string   `json:"block"`
+	Index    int      `json:"index"`            // instruction index, -1 when the finding is about the block
+	Source   string   `json:"source,omitempty"` // included file declaring the block
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Message  string   `json:"message"`
+}
+
+// String formats a finding like a compiler diagnostic
+func (f Finding) String() string {
+	location := "block " + f.Block
+	if f.Index >= 0 {
+		location += fmt.Sprintf(" instructions[%d]", f.Index)
+	}
+	switch {
+	case f.Line > 0 && f.Source != "":
+		location += fmt.Sprintf(" (%s:%d:%d)", f.Source, f.Line, f.Column)
+	case f.Line > 0:
+		location += fmt.Sprintf(" (line %d, column %d)", f.Line, f.Column)
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", f.Severity, location, f.Message, f.Rule)
+}
+
+// Lint checks every block of a project against the rules, with the severities and
+// suppressions from the project's lint section
+func Lint(project *types.Project) ([]Finding, error) {
+	severities, ignored, err := settings(project)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []Finding
+	for _, block := range project.Blocks {
+		resolved := config.ResolveBlock(project, block, nil)
+		for _, rule := range rules {
+			severity := severities[rule.ID]
+			if severity == SeverityOff || ignored[block.ID][rule.ID] || ignored[block.TemplateID()][rule.ID] {
+				continue
+			}
+			for _, issue := range rule.check(project, resolved) {
+				finding := Finding{
+					Rule:     rule.ID,
+					Severity: severity,
+					Block:    block.ID,
+					Index:    issue.index,
+					Source:   block.Source,
+					Message:  issue.message,
+				}
+				position := block.Position
+				if issue.index >= 0 && issue.index < len(block.InstructionPositions) {
+					position = block.InstructionPositions[issue.index]
+				}
+				finding.Line, finding.Column = position.Line, position.Column
+				findings = append(findings, finding)
+			}
+		}
+	}
+	return findings, nil
+}
+
+// ForBlock returns the findings for a block, including every variant of a matrix block
+func ForBlock(project *types.Project, findings []Finding, id string) []Finding {
+	ids := make(map[string]bool)
+	for _, match := range config.MatchBlocks(project, id) {
+		ids[match] = true
+	}
+	out := []Finding{}
+	for _, finding := range findings {
+		if ids[finding.Block] {
+			out = append(out, finding)
+		}
+	}
+	return out
+}
+
+// Count returns the number of findings with the given severity
+func Count(findings []Finding, severity Severity) int {
+	n := 0
+	for _, finding := range findings {
+		if finding.Severity == severity {
+			n++
+		}
+	}
+	return n
+}
+
+// settings returns the severity of every rule and the rules ignored per block
+func settings(project *types.Project) (map[string]Severity, map[string]map[string]bool, error) {
+	severities := make(map[string]Severity, len(rules))
+	for _, rule := range rules {
+		severities[rule.ID] = rule.Severity
+	}
+	ignored := make(map[string]map[string]bool)
+	if project.Lint == nil {
+		return severities, ignored, nil
+	}
+
+	for id, value := range project.Lint.Rules {
+		if _, ok := severities[id]; !ok {
+			return nil, nil, fmt.Errorf("lint: unknown rule %s (available: %s)", id, ruleIDs())
+		}
+		switch severity := Severity(value); severity {
+		case SeverityError, SeverityWarning, SeverityOff:
+			severities[id] = severity
+		default:
+			return nil, nil, fmt.Errorf("lint: invalid severity %q for rule %s (expected error, warning or off)", value, id)
+		}
+	}
+
+	for blockID, ruleIDs := range project.Lint.Ignore {
+		if len(config.MatchBlocks(project, blockID)) == 0 {
+			return nil, nil, fmt.Errorf("lint: ignore refers to unknown block %s", blockID)
+		}
+		ignored[blockID] = make(map[string]bool)
+		for _, id := range ruleIDs {
+			if _, ok := severities[id]; !ok {
+				return nil, nil, fmt.Errorf("lint: unknown rule %s ignored for block %s", id, blockID)
+			}
+			ignored[blockID][id] = true
+		}
+	}
+	return severities, ignored, nil
+}
+
+// ruleIDs lists the IDs of all rules
+func ruleIDs() string {
+	ids := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		ids = append(ids, rule.ID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ", ")
+}
@@ -0,0 +1,130 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+
+	"dockstep.dev/config"
+)
+
+const lintConfig = `version: "1.0"
+name: "lint"
+variables:
+  node_version: "latest"
+blocks:
+  - id: "base"
+    from: "node:${node_version}"
+    instructions:
+      - "RUN apt-get update"
+      - "RUN apt-get update && apt-get install -y curl"
+      - "RUN curl -fsSL https://example.com/install.sh | sudo bash"
+      - "ADD https://example.com/tool.tar.gz /opt/"
+      - "ADD --checksum=sha256:24454f830c /opt/ https://example.com/other.tar.gz"
+
+  - id: "app"
+    from_block: "base"
+    instructions:
+      - "USER node"
+    export:
+      cmd: ["node", "server.js"]
+
+  - id: "admin"
+    from: "registry.example.com:5000/tools"
+    instructions:
+      - "USER root"
+    export:
+      cmd: ["sh"]
+`
+
+// parse parses a config for the tests
+func parse(t *testing.T, data string) []Finding {
+	t.Helper()
+	project, err := config.ParseData([]byte(data), "dockstep.yaml")
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+	findings, err := Lint(project)
+	if err != nil {
+		t.Fatalf("Failed to lint: %v", err)
+	}
+	return findings
+}
+
+func TestLint(t *testing.T) {
+	findings := parse(t, lintConfig)
+
+	var got []string
+	for _, finding := range findings {
+		got = append(got, finding.String())
+	}
+	want := []string{
+		"warning: block base (line 6, column 5): base image node:latest is not pinned; use a version tag or digest [latest-tag]",
+		"error: block base instructions[2] (line 11, column 9): pipes a download into a shell; download it, verify a checksum, then run it [curl-pipe-shell]",
+		"warning: block base instructions[0] (line 9, column 9): apt-get update without apt-get install in the same RUN caches a stale package index [apt-get-update-alone]",
+		"warning: block base instructions[3] (line 12, column 9): ADD downloads https://example.com/tool.tar.gz without verifying it; add --checksum or download it with RUN [add-url]",
+		"warning: block admin (line 22, column 5): base image registry.example.com:5000/tools has no tag and defaults to latest; pin a version or digest [latest-tag]",
+		"warning: block admin (line 22, column 5): exported image runs as root; switch to a non-root USER [missing-user]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Findings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	data := lintConfig + `lint:
+  rules:
+    latest-tag: error
+    add-url: off
+  ignore:
+    base: ["curl-pipe-shell", "apt-get-update-alone"]
+`
+	findings := parse(t, data)
+	if Count(findings, SeverityError) != 2 || Count(findings, SeverityWarning) != 1 {
+		for _, finding := range findings {
+			t.Log(finding)
+		}
+		t.Fatalf("Expected 2 errors and 1 warning, got %d findings", len(findings))
+	}
+	for _, finding := range findings {
+		if finding.Rule == "add-url" || finding.Block == "base" && finding.Rule != "latest-tag" {
+			t.Errorf("Expected %s to be suppressed", finding)
+		}
+	}
+}
+
+func TestLintConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"lint:\n  rules:\n    no-such-rule: error\n":    "unknown rule no-such-rule",
+		"lint:\n  rules:\n    latest-tag: fatal\n":      `invalid severity "fatal"`,
+		"lint:\n  ignore:\n    missing: [latest-tag]\n": "unknown block missing",
+		"lint:\n  ignore:\n    base: [typo]\n":          "unknown rule typo ignored for block base",
+	}
+	for section, want := range tests {
+		project, err := config.ParseData([]byte(lintConfig+section), "dockstep.yaml")
+		if err != nil {
+			t.Fatalf("Failed to parse config: %v", err)
+		}
+		if _, err := Lint(project); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Lint with %q = %v, want error containing %q", section, err, want)
+		}
+	}
+}
+
+func TestLintMatrixSuppression(t *testing.T) {
+	findings := parse(t, `version: "1.0"
+name: "matrix"
+blocks:
+  - id: "test"
+    from: "python:${version}"
+    matrix:
+      version: ["3.12", "latest"]
+    instructions:
+      - "RUN apt-get update"
+lint:
+  ignore:
+    test: ["apt-get-update-alone"]
+`)
+	if len(findings) != 1 || findings[0].Block != "test[version=latest]" || findings[0].Rule != "latest-tag" {
+		t.Errorf("Expected only the latest variant to be flagged, got %v", findings)
+	}
+}
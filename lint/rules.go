@@ -0,0 +1,167 @@
+package lint
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// Rule is a check run against every block
+type Rule struct {
+	ID          string
+	Description string
+	Severity    Severity // default severity, overridable in the lint section
+	check       func(project *types.Project, block types.Block) []issue
+}
+
+// issue is a rule violation found in a block; index is -1 for the block itself
+type issue struct {
+	index   int
+	message string
+}
+
+var (
+	// pipeToShellPattern matches a download piped straight into a shell
+	pipeToShellPattern = regexp.MustCompile(`\b(curl|wget)\b[^|;&]*\|\s*(sudo\s+)?(\S*/)?(sh|bash|zsh|dash|ash)\b`)
+	// aptUpdatePattern and aptInstallPattern match apt-get update and install commands
+	aptUpdatePattern  = regexp.MustCompile(`\bapt(-get)?\s+(-\S+\s+)*update\b`)
+	aptInstallPattern = regexp.MustCompile(`\bapt(-get)?\s+(-\S+\s+)*install\b`)
+)
+
+// rules are the built-in rules, in the order they are run
+var rules = []Rule{
+	{
+		ID:          "latest-tag",
+		Description: "Base images must be pinned to a tag other than latest, or a digest",
+		Severity:    SeverityWarning,
+		check:       checkLatestTag,
+	},
+	{
+		ID:          "curl-pipe-shell",
+		Description: "Downloads must not be piped straight into a shell",
+		Severity:    SeverityError,
+		check:       checkCurlPipeShell,
+	},
+	{
+		ID:          "apt-get-update-alone",
+		Description: "apt-get update must be followed by apt-get install in the same RUN",
+		Severity:    SeverityWarning,
+		check:       checkAptGetUpdate,
+	},
+	{
+		ID:          "missing-user",
+		Description: "Blocks with an export section must switch to a non-root USER",
+		Severity:    SeverityWarning,
+		check:       checkMissingUser,
+	},
+	{
+		ID:          "add-url",
+		Description: "ADD must not download URLs without a --checksum",
+		Severity:    SeverityWarning,
+		check:       checkAddURL,
+	},
+}
+
+// Rules returns the built-in rules
+func Rules() []Rule {
+	return append([]Rule(nil), rules...)
+}
+
+// checkLatestTag flags base images without a tag or tagged latest
+func checkLatestTag(_ *types.Project, block types.Block) []issue {
+	image := block.From
+	if image == "" || image == "scratch" || strings.Contains(image, "@") {
+		return nil
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	_, tag, tagged := strings.Cut(name, ":")
+	switch {
+	case !tagged:
+		return []issue{{-1, fmt.Sprintf("base image %s has no tag and defaults to latest; pin a version or digest", image)}}
+	case tag == "latest":
+		return []issue{{-1, fmt.Sprintf("base image %s is not pinned; use a version tag or digest", image)}}
+	}
+	return nil
+}
+
+// checkCurlPipeShell flags RUN instructions that pipe curl or wget into a shell
+func checkCurlPipeShell(_ *types.Project, block types.Block) []issue {
+	var issues []issue
+	for i, instruction := range block.Instructions {
+		if keyword(instruction) == "RUN" && pipeToShellPattern.MatchString(instruction) {
+			issues = append(issues, issue{i, "pipes a download into a shell; download it, verify a checksum, then run it"})
+		}
+	}
+	return issues
+}
+
+// checkAptGetUpdate flags apt-get update in a RUN that installs nothing, which caches a
+// package index that later installs may not refresh
+func checkAptGetUpdate(_ *types.Project, block types.Block) []issue {
+	var issues []issue
+	for i, instruction := range block.Instructions {
+		if keyword(instruction) == "RUN" && aptUpdatePattern.MatchString(instruction) && !aptInstallPattern.MatchString(instruction) {
+			issues = append(issues, issue{i, "apt-get update without apt-get install in the same RUN caches a stale package index"})
+		}
+	}
+	return issues
+}
+
+// checkMissingUser flags exported blocks that run as root: the last USER in the block and
+// its from_block ancestry is missing or root
+func checkMissingUser(project *types.Project, block types.Block) []issue {
+	if block.Export == nil {
+		return nil
+	}
+
+	blocks := make(map[string]types.Block, len(project.Blocks))
+	for _, b := range project.Blocks {
+		blocks[b.ID] = b
+	}
+	seen := make(map[string]bool)
+	for current, ok := block, true; ok && !seen[current.ID]; current, ok = blocks[current.FromBlock] {
+		seen[current.ID] = true
+		for i := len(current.Instructions) - 1; i >= 0; i-- {
+			if keyword(current.Instructions[i]) != "USER" {
+				continue
+			}
+			fields := strings.Fields(current.Instructions[i])
+			if len(fields) > 1 {
+				user, _, _ := strings.Cut(fields[1], ":")
+				if user == "root" || user == "0" {
+					return []issue{{-1, "exported image runs as root; switch to a non-root USER"}}
+				}
+			}
+			return nil
+		}
+	}
+	return []issue{{-1, "exported image runs as root; add a USER instruction"}}
+}
+
+// checkAddURL flags ADD instructions that download URLs without verifying them
+func checkAddURL(_ *types.Project, block types.Block) []issue {
+	var issues []issue
+	for i, instruction := range block.Instructions {
+		if keyword(instruction) != "ADD" || strings.Contains(instruction, "--checksum") {
+			continue
+		}
+		for _, field := range strings.Fields(instruction)[1:] {
+			if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+				issues = append(issues, issue{i, fmt.Sprintf("ADD downloads %s without verifying it; add --checksum or download it with RUN", field)})
+				break
+			}
+		}
+	}
+	return issues
+}
+
+// keyword returns the upper-cased keyword of an instruction
+func keyword(instruction string) string {
+	fields := strings.Fields(instruction)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
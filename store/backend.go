@@ -0,0 +1,303 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+const (
+	// FileBackendName keeps each value in its own file under .dockstep/
+	FileBackendName = "file"
+	// BoltBackendName keeps the whole store in the single database file .dockstep/store.db
+	BoltBackendName = "bolt"
+	// updateLockFile serializes the transactions of the file backend
+	updateLockFile = "update.lock"
+)
+
+// SnapshotsBucket holds the Dockerfile snapshots of built images, by digest
+const SnapshotsBucket = HistoryDir + "/" + DockerfilesSubDir
+
+// buckets lists the buckets of a store. History is kept apart, since backends index it.
+var buckets = []string{StateDir, LogsDir, ImagesDir, SnapshotsBucket, CacheDir}
+
+// Backend persists the data of a store. Values live in buckets named after the directories
+// of the file layout (state, logs, images, history/dockerfiles and cache), keyed by the
+// names of their files there, so data moves between backends unchanged.
+type Backend interface {
+	// Name identifies the backend in .dockstep/layout.json
+	Name() string
+
+	// Get returns a value, or an error satisfying os.IsNotExist when there is none
+	Get(bucket, key string) ([]byte, error)
+	// Put replaces a value atomically
+	Put(bucket, key string, value []byte) error
+	// Append adds to the end of a value, creating it if needed
+	Append(bucket, key string, value []byte) error
+	// Delete removes a value; removing a missing value is not an error
+	Delete(bucket, key string) error
+	// List returns the size of every value in a bucket, by key
+	List(bucket string) (map[string]int64, error)
+
+	// AppendHistory adds a record to the image history of a block
+	AppendHistory(id string, record types.ImageRecord) error
+	// History returns the image records matching a query, oldest first
+	History(query HistoryQuery) ([]HistoryRecord, error)
+	// ReplaceHistory replaces the image history of a block; no records removes it
+	ReplaceHistory(id string, records []types.ImageRecord) error
+
+	// View runs fn with a consistent view of the store
+	View(fn func(tx Backend) error) error
+	// Update runs fn as a transaction: no other update runs at the same time, and backends
+	// that support it make either all of fn's changes or, when fn fails, none of them
+	Update(fn func(tx Backend) error) error
+}
+
+// HistoryQuery selects image records
+type HistoryQuery struct {
+	Block  string    // block whose history is read; empty reads every block's
+	Digest string    // only records of this image
+	Since  time.Time // only records made at or after Since
+	Limit  int       // only the newest Limit records; 0 returns all
+}
+
+// HistoryRecord is an image record with the block it was built for
+type HistoryRecord struct {
+	Block string `json:"block"`
+	types.ImageRecord
+}
+
+// matches reports whether a record of a block matches the query
+func (q HistoryQuery) matches(record types.ImageRecord) bool {
+	return (q.Digest == "" || record.Digest == q.Digest) && !record.Timestamp.Before(q.Since)
+}
+
+// finish orders matching records oldest first and applies the limit
+func (q HistoryQuery) finish(records []HistoryRecord) []HistoryRecord {
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp.Before(records[j].Timestamp) })
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+	return records
+}
+
+// getJSON decodes a JSON value of a backend
+func getJSON(b Backend, bucket, key string, value interface{}) error {
+	data, err := b.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
+
+// putJSON stores a value as indented JSON
+func putJSON(b Backend, bucket, key string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.Put(bucket, key, append(data, '\n'))
+}
+
+// fileBackend keeps each value in its own file, at <root>/<bucket>/<key>
+type fileBackend struct {
+	root string
+}
+
+// newFileBackend returns a backend keeping its files under root
+func newFileBackend(root string) *fileBackend {
+	return &fileBackend{root: root}
+}
+
+// fileTx is a file backend within a transaction, whose nested transactions join it
+type fileTx struct {
+	*fileBackend
+}
+
+func (b *fileBackend) Name() string {
+	return FileBackendName
+}
+
+// path returns the file of a value
+func (b *fileBackend) path(bucket, key string) string {
+	return filepath.Join(b.root, bucket, key)
+}
+
+func (b *fileBackend) Get(bucket, key string) ([]byte, error) {
+	return os.ReadFile(b.path(bucket, key))
+}
+
+func (b *fileBackend) Put(bucket, key string, value []byte) error {
+	path := b.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, value, 0644)
+}
+
+// Append writes value in a single append, so concurrent readers never see part of it
+func (b *fileBackend) Append(bucket, key string, value []byte) error {
+	path := b.path(bucket, key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(value)
+	return err
+}
+
+func (b *fileBackend) Delete(bucket, key string) error {
+	if err := os.Remove(b.path(bucket, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List skips subdirectories, and the hidden temporary files of atomic writes
+func (b *fileBackend) List(bucket string) (map[string]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(b.root, bucket))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]int64{}, nil
+		}
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		sizes[entry.Name()] = info.Size()
+	}
+	return sizes, nil
+}
+
+// AppendHistory appends the record to history/<block-id>.jsonl, as a line of JSON
+func (b *fileBackend) AppendHistory(id string, record types.ImageRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Append(HistoryDir, blockFileName(id)+".jsonl", append(line, '\n'))
+}
+
+// History reads the history files of the queried blocks, which it scans in full
+func (b *fileBackend) History(query HistoryQuery) ([]HistoryRecord, error) {
+	var keys []string
+	if query.Block != "" {
+		keys = []string{blockFileName(query.Block) + ".jsonl"}
+	} else {
+		files, err := b.List(HistoryDir)
+		if err != nil {
+			return nil, err
+		}
+		for key := range files {
+			if strings.HasSuffix(key, ".jsonl") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	}
+
+	var out []HistoryRecord
+	for _, key := range keys {
+		f, err := os.Open(b.path(HistoryDir, key))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		id := blockIDFromFileName(strings.TrimSuffix(key, ".jsonl"))
+		dec := json.NewDecoder(f)
+		for {
+			var record types.ImageRecord
+			// The end of the file, or a partly written last line, ends the history
+			if err := dec.Decode(&record); err != nil {
+				break
+			}
+			if query.matches(record) {
+				out = append(out, HistoryRecord{Block: id, ImageRecord: record})
+			}
+		}
+		f.Close()
+	}
+	return query.finish(out), nil
+}
+
+func (b *fileBackend) ReplaceHistory(id string, records []types.ImageRecord) error {
+	key := blockFileName(id) + ".jsonl"
+	if len(records) == 0 {
+		return b.Delete(HistoryDir, key)
+	}
+	var data []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	return b.Put(HistoryDir, key, data)
+}
+
+// View reads files as they are; atomic writes keep each one whole
+func (b *fileBackend) View(fn func(tx Backend) error) error {
+	return fn(b)
+}
+
+// Update holds a file lock while fn runs, which keeps other processes' updates out. Files
+// are written as fn goes, so a failing fn keeps the changes it made.
+func (b *fileBackend) Update(fn func(tx Backend) error) error {
+	return withFileLock(filepath.Join(b.root, updateLockFile), func() error {
+		return fn(fileTx{b})
+	})
+}
+
+func (tx fileTx) View(fn func(tx Backend) error) error {
+	return fn(tx)
+}
+
+func (tx fileTx) Update(fn func(tx Backend) error) error {
+	return fn(tx)
+}
+
+// closeBackend closes a backend that holds resources open, such as a bolt database
+func closeBackend(b Backend) error {
+	if closer, ok := b.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// openBackend returns the backend with a name, keeping its data in a .dockstep directory
+func openBackend(name, dir string) (Backend, error) {
+	switch name {
+	case FileBackendName:
+		return newFileBackend(dir), nil
+	case BoltBackendName:
+		b := newBoltBackend(filepath.Join(dir, BoltFile))
+		if err := b.init(); err != nil {
+			b.Close()
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q (use %s or %s)", name, FileBackendName, BoltBackendName)
+	}
+}
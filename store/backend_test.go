@@ -0,0 +1,315 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+// testBackends returns an empty backend of each kind
+func testBackends(t *testing.T) map[string]Backend {
+	t.Helper()
+	backends := make(map[string]Backend)
+	for _, name := range []string{FileBackendName, BoltBackendName} {
+		backend, err := openBackend(name, t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to open %s backend: %v", name, err)
+		}
+		t.Cleanup(func() { closeBackend(backend) })
+		backends[name] = backend
+	}
+	return backends
+}
+
+func TestBackendValues(t *testing.T) {
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, err := backend.Get(StateDir, "app.json"); !os.IsNotExist(err) {
+				t.Errorf("Expected a missing value to not exist, got %v", err)
+			}
+			if err := backend.Put(StateDir, "app.json", []byte(`{"id":"app"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := backend.Get(StateDir, "app.json"); err != nil || string(value) != `{"id":"app"}` {
+				t.Errorf("Get = %q, %v", value, err)
+			}
+
+			// An empty value exists
+			if err := backend.Put(LogsDir, "app.log", nil); err != nil {
+				t.Fatal(err)
+			}
+			if value, err := backend.Get(LogsDir, "app.log"); err != nil || len(value) != 0 {
+				t.Errorf("Expected an empty value, got %q, %v", value, err)
+			}
+			for _, chunk := range []string{"step 1\n", "step 2\n"} {
+				if err := backend.Append(LogsDir, "app.log", []byte(chunk)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if value, _ := backend.Get(LogsDir, "app.log"); string(value) != "step 1\nstep 2\n" {
+				t.Errorf("Appended value = %q", value)
+			}
+			// Putting a value replaces what was appended, and appending to it keeps it
+			if err := backend.Put(LogsDir, "web.log", []byte("step 1\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Append(LogsDir, "web.log", []byte("step 2\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Put(LogsDir, "app.log", []byte("done\n")); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Append(LogsDir, "app.log", []byte("step 1\n")); err != nil {
+				t.Fatal(err)
+			}
+			if value, _ := backend.Get(LogsDir, "web.log"); string(value) != "step 1\nstep 2\n" {
+				t.Errorf("Value appended to a put value = %q", value)
+			}
+			if value, _ := backend.Get(LogsDir, "app.log"); string(value) != "done\nstep 1\n" {
+				t.Errorf("Value put over an appended value = %q", value)
+			}
+
+			if err := backend.Put(SnapshotsBucket, "sha256:a.Dockerfile", []byte("FROM alpine\n")); err != nil {
+				t.Fatal(err)
+			}
+			files, err := backend.List(HistoryDir)
+			if err != nil || len(files) != 0 {
+				t.Errorf("Expected snapshots to stay out of the history bucket, got %v, %v", files, err)
+			}
+			files, err = backend.List(LogsDir)
+			if want := map[string]int64{"app.log": 12, "web.log": 14}; err != nil || !reflect.DeepEqual(files, want) {
+				t.Errorf("List = %v, %v, want %v", files, err, want)
+			}
+
+			if err := backend.Delete(LogsDir, "app.log"); err != nil {
+				t.Fatal(err)
+			}
+			if err := backend.Delete(LogsDir, "app.log"); err != nil {
+				t.Errorf("Expected deleting a missing value to succeed, got %v", err)
+			}
+			if _, err := backend.Get(LogsDir, "app.log"); !os.IsNotExist(err) {
+				t.Errorf("Expected the value to be deleted, got %v", err)
+			}
+		})
+	}
+}
+
+func TestBackendHistory(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, backend := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			// Records are appended out of order, and two share a timestamp
+			appends := []struct {
+				block  string
+				digest string
+				hours  int
+			}{
+				{"app", "sha256:a1", 0}, {"api", "sha256:b1", 1}, {"app", "sha256:a2", 3},
+				{"app", "sha256:a3", 2}, {"api", "sha256:a2", 3}, {"web/amd64", "sha256:w1", 4},
+			}
+			for _, a := range appends {
+				record := types.ImageRecord{Digest: a.digest, Timestamp: start.Add(time.Duration(a.hours) * time.Hour)}
+				if err := backend.AppendHistory(a.block, record); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			digests := func(query HistoryQuery) []string {
+				t.Helper()
+				records, err := backend.History(query)
+				if err != nil {
+					t.Fatalf("History(%+v) failed: %v", query, err)
+				}
+				var out []string
+				for _, record := range records {
+					out = append(out, record.Block+"="+record.Digest)
+				}
+				return out
+			}
+			tests := []struct {
+				query    HistoryQuery
+				want     []string
+				anyOrder bool // records made at the same time may come in any order
+			}{
+				{HistoryQuery{Block: "app"}, []string{"app=sha256:a1", "app=sha256:a3", "app=sha256:a2"}, false},
+				{HistoryQuery{Block: "app", Limit: 2}, []string{"app=sha256:a3", "app=sha256:a2"}, false},
+				{HistoryQuery{Since: start.Add(3 * time.Hour)}, []string{"app=sha256:a2", "api=sha256:a2", "web/amd64=sha256:w1"}, true},
+				{HistoryQuery{Digest: "sha256:a2"}, []string{"app=sha256:a2", "api=sha256:a2"}, true},
+				{HistoryQuery{Digest: "sha256:a2", Block: "api"}, []string{"api=sha256:a2"}, false},
+				{HistoryQuery{Block: "web/amd64"}, []string{"web/amd64=sha256:w1"}, false},
+				{HistoryQuery{Block: "missing"}, nil, false},
+			}
+			for _, tt := range tests {
+				got := digests(tt.query)
+				if tt.anyOrder && !sameElements(got, tt.want) || !tt.anyOrder && !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("History(%+v) = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+
+			// Replacing a history also updates what digest queries find
+			kept := []types.ImageRecord{{Digest: "sha256:a1", Timestamp: start}}
+			if err := backend.ReplaceHistory("app", kept); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := digests(HistoryQuery{Digest: "sha256:a2"}), []string{"api=sha256:a2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("After replacing, History = %v, want %v", got, want)
+			}
+			if err := backend.ReplaceHistory("app", nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := digests(HistoryQuery{Block: "app"}); got != nil {
+				t.Errorf("Expected the history to be removed, got %v", got)
+			}
+		})
+	}
+}
+
+// sameElements reports whether two lists hold the same values in any order
+func sameElements(a, b []string) bool {
+	count := make(map[string]int)
+	for _, v := range a {
+		count[v]++
+	}
+	for _, v := range b {
+		count[v]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
+func TestBoltUpdateRollsBack(t *testing.T) {
+	backend, err := openBackend(BoltBackendName, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeBackend(backend)
+	failure := errors.New("build failed")
+	err = backend.Update(func(tx Backend) error {
+		if err := tx.Put(StateDir, "app.json", []byte("{}")); err != nil {
+			return err
+		}
+		if err := tx.AppendHistory("app", types.ImageRecord{Digest: "sha256:a1"}); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Expected the update to fail, got %v", err)
+	}
+	if _, err := backend.Get(StateDir, "app.json"); !os.IsNotExist(err) {
+		t.Errorf("Expected the value of a failed update to be rolled back, got %v", err)
+	}
+	if records, _ := backend.History(HistoryQuery{}); len(records) != 0 {
+		t.Errorf("Expected the history of a failed update to be rolled back, got %v", records)
+	}
+}
+
+func TestMigrateBackend(t *testing.T) {
+	now := time.Now()
+	store := gcStore(t, now)
+	dir := filepath.Join(store.RootPath(), ".dockstep")
+	if err := store.SaveBaseDigest("alpine:3.19", "sha256:base"); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotStore(t, store)
+
+	migration, err := store.MigrateBackend(BoltBackendName)
+	if err != nil {
+		t.Fatalf("Failed to migrate to bolt: %v", err)
+	}
+	if migration.Records != 5 || migration.Values == 0 {
+		t.Errorf("Unexpected migration %+v", migration)
+	}
+	if _, err := os.Stat(filepath.Join(dir, StateDir)); !os.IsNotExist(err) {
+		t.Errorf("Expected the files of the old backend to be removed, got %v", err)
+	}
+
+	// A store opened afterwards uses the new backend and finds the same data, once the
+	// first store closes the database
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := New(store.RootPath())
+	if err := reopened.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if name := reopened.Backend().Name(); name != BoltBackendName {
+		t.Fatalf("Expected the bolt backend after migrating, got %s", name)
+	}
+	if after := snapshotStore(t, reopened); !reflect.DeepEqual(after, before) {
+		t.Errorf("Migrated store differs:\n got %+v\nwant %+v", after, before)
+	}
+	if _, err := reopened.MigrateBackend(BoltBackendName); err == nil {
+		t.Error("Expected migrating to the current backend to fail")
+	}
+
+	// And back again
+	if _, err := reopened.MigrateBackend(FileBackendName); err != nil {
+		t.Fatalf("Failed to migrate back to files: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, BoltFile)); !os.IsNotExist(err) {
+		t.Errorf("Expected the database to be removed, got %v", err)
+	}
+	if after := snapshotStore(t, reopened); !reflect.DeepEqual(after, before) {
+		t.Errorf("Store migrated back differs:\n got %+v\nwant %+v", after, before)
+	}
+	if _, err := os.Stat(filepath.Join(dir, HistoryDir, "app.jsonl")); err != nil {
+		t.Errorf("Expected the history file to be written back: %v", err)
+	}
+}
+
+// storeSnapshot is what a store holds, as read through its methods
+type storeSnapshot struct {
+	States  map[string]*types.BlockState
+	Logs    string
+	Digest  string
+	Bases   map[string]string
+	History []types.ImageRecord
+	Cache   []CacheEntry
+	Plan    []string
+}
+
+// snapshotStore reads a store set up by gcStore
+func snapshotStore(t *testing.T, store *Store) storeSnapshot {
+	t.Helper()
+	var snapshot storeSnapshot
+	var err error
+	if snapshot.States, err = store.GetBlockStates(); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := store.LoadLogs("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Logs = string(logs)
+	if snapshot.Digest, err = store.LoadImageDigest("old"); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.Bases, err = store.LoadBaseDigests(); err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.History, err = store.LoadImageHistory("app"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range snapshot.History {
+		snapshot.History[i].Timestamp = snapshot.History[i].Timestamp.UTC()
+	}
+	if snapshot.Cache, err = store.NewCache().Entries(); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := store.PlanGC(GCOptions{Keep: 2, Blocks: []string{"app"}, Now: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Plan = append(plan.Images, plan.CacheEntries...)
+	return snapshot
+}
@@ -0,0 +1,454 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"dockstep.dev/types"
+)
+
+const (
+	// BoltFile is the database of the bolt backend, in .dockstep/
+	BoltFile = "store.db"
+	// boltTimeout bounds how long an operation waits for another process's update
+	boltTimeout = 10 * time.Second
+	// historyBucket holds a nested bucket of image records per block, keyed by time
+	historyBucket = "history"
+	// digestIndexBucket holds a nested bucket per digest, listing the history keys of its records
+	digestIndexBucket = "history-digests"
+)
+
+// boltBackend keeps a store in a single bbolt database, which it opens on first use and
+// keeps open until Close. bbolt locks the database file while it is open, so another
+// dockstep process waits up to boltTimeout for it to be closed.
+type boltBackend struct {
+	path string
+
+	mu sync.Mutex
+	db *bolt.DB
+}
+
+// boltTx is a bolt backend within a transaction
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// newBoltBackend returns a backend keeping its data in the database at path
+func newBoltBackend(path string) *boltBackend {
+	return &boltBackend{path: path}
+}
+
+// init creates the database and its buckets
+func (b *boltBackend) init() error {
+	return b.Update(func(tx Backend) error {
+		for _, name := range append(buckets, historyBucket, digestIndexBucket) {
+			if _, err := tx.(*boltTx).tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// database returns the open database, opening it if needed
+func (b *boltBackend) database() (*bolt.DB, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.db == nil {
+		db, err := bolt.Open(b.path, 0644, &bolt.Options{Timeout: boltTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %w", b.path, err)
+		}
+		b.db = db
+	}
+	return b.db, nil
+}
+
+// Close closes the database, so other processes can open it
+func (b *boltBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.db == nil {
+		return nil
+	}
+	err := b.db.Close()
+	b.db = nil
+	return err
+}
+
+func (b *boltBackend) Name() string {
+	return BoltBackendName
+}
+
+func (b *boltBackend) View(fn func(tx Backend) error) error {
+	db, err := b.database()
+	if err != nil {
+		return err
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+// Update commits fn's changes together, or rolls them back when fn fails
+func (b *boltBackend) Update(fn func(tx Backend) error) error {
+	db, err := b.database()
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx: tx})
+	})
+}
+
+func (b *boltBackend) Get(bucket, key string) (value []byte, err error) {
+	err = b.View(func(tx Backend) error {
+		value, err = tx.Get(bucket, key)
+		return err
+	})
+	return value, err
+}
+
+func (b *boltBackend) Put(bucket, key string, value []byte) error {
+	return b.Update(func(tx Backend) error { return tx.Put(bucket, key, value) })
+}
+
+// Append batches the chunks appended at the same time, such as the logs of blocks built in
+// parallel, into one transaction
+func (b *boltBackend) Append(bucket, key string, value []byte) error {
+	db, err := b.database()
+	if err != nil {
+		return err
+	}
+	return db.Batch(func(tx *bolt.Tx) error {
+		return (&boltTx{tx: tx}).Append(bucket, key, value)
+	})
+}
+
+func (b *boltBackend) Delete(bucket, key string) error {
+	return b.Update(func(tx Backend) error { return tx.Delete(bucket, key) })
+}
+
+func (b *boltBackend) List(bucket string) (sizes map[string]int64, err error) {
+	err = b.View(func(tx Backend) error {
+		sizes, err = tx.List(bucket)
+		return err
+	})
+	return sizes, err
+}
+
+func (b *boltBackend) AppendHistory(id string, record types.ImageRecord) error {
+	return b.Update(func(tx Backend) error { return tx.AppendHistory(id, record) })
+}
+
+func (b *boltBackend) History(query HistoryQuery) (records []HistoryRecord, err error) {
+	err = b.View(func(tx Backend) error {
+		records, err = tx.History(query)
+		return err
+	})
+	return records, err
+}
+
+func (b *boltBackend) ReplaceHistory(id string, records []types.ImageRecord) error {
+	return b.Update(func(tx Backend) error { return tx.ReplaceHistory(id, records) })
+}
+
+func (t *boltTx) Name() string {
+	return BoltBackendName
+}
+
+// Get tells an empty value from a missing one, which bbolt's Get does not, and joins the
+// chunks of an appended value
+func (t *boltTx) Get(bucket, key string) ([]byte, error) {
+	if bkt := t.tx.Bucket([]byte(bucket)); bkt != nil {
+		k, v := bkt.Cursor().Seek([]byte(key))
+		if k != nil && string(k) == key {
+			chunks := bkt.Bucket(k)
+			if chunks == nil {
+				return append([]byte{}, v...), nil
+			}
+			value := []byte{}
+			err := chunks.ForEach(func(_, chunk []byte) error {
+				value = append(value, chunk...)
+				return nil
+			})
+			return value, err
+		}
+	}
+	return nil, &fs.PathError{Op: "get", Path: bucket + "/" + key, Err: fs.ErrNotExist}
+}
+
+func (t *boltTx) Put(bucket, key string, value []byte) error {
+	bkt, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	if bkt.Bucket([]byte(key)) != nil {
+		if err := bkt.DeleteBucket([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return bkt.Put([]byte(key), append([]byte{}, value...))
+}
+
+// Append keeps an appended value as a nested bucket of chunks keyed by sequence, so an
+// append writes only its own chunk. A value that was Put becomes the first chunk.
+func (t *boltTx) Append(bucket, key string, value []byte) error {
+	bkt, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	chunks := bkt.Bucket([]byte(key))
+	if chunks == nil {
+		current := bkt.Get([]byte(key))
+		if current != nil {
+			current = append([]byte{}, current...)
+			if err := bkt.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if chunks, err = bkt.CreateBucket([]byte(key)); err != nil {
+			return err
+		}
+		if len(current) > 0 {
+			if err := appendChunk(chunks, current); err != nil {
+				return err
+			}
+		}
+	}
+	return appendChunk(chunks, value)
+}
+
+// appendChunk adds a chunk after the others of an appended value
+func appendChunk(chunks *bolt.Bucket, value []byte) error {
+	seq, err := chunks.NextSequence()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return chunks.Put(key, append([]byte{}, value...))
+}
+
+func (t *boltTx) Delete(bucket, key string) error {
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return nil
+	}
+	if bkt.Bucket([]byte(key)) != nil {
+		return bkt.DeleteBucket([]byte(key))
+	}
+	return bkt.Delete([]byte(key))
+}
+
+// List counts an appended value as the size of its chunks
+func (t *boltTx) List(bucket string) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	bkt := t.tx.Bucket([]byte(bucket))
+	if bkt == nil {
+		return sizes, nil
+	}
+	err := bkt.ForEach(func(k, v []byte) error {
+		chunks := bkt.Bucket(k)
+		if chunks == nil {
+			sizes[string(k)] = int64(len(v))
+			return nil
+		}
+		var size int64
+		err := chunks.ForEach(func(_, chunk []byte) error {
+			size += int64(len(chunk))
+			return nil
+		})
+		sizes[string(k)] = size
+		return err
+	})
+	return sizes, err
+}
+
+// historyKey orders image records by time; seq keeps records made at the same time apart
+func historyKey(timestamp time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, timeKey(timestamp))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// timeKey encodes a time so that keys sort in time order; times before 1970 sort first
+func timeKey(t time.Time) uint64 {
+	if nanos := t.UnixNano(); nanos > 0 {
+		return uint64(nanos)
+	}
+	return 0
+}
+
+// indexKey is the entry of a record in the digest index
+func indexKey(id string, key []byte) []byte {
+	return append([]byte(id+"\x00"), key...)
+}
+
+// AppendHistory stores the record under its time and adds it to the digest index
+func (t *boltTx) AppendHistory(id string, record types.ImageRecord) error {
+	history, err := t.tx.CreateBucketIfNotExists([]byte(historyBucket))
+	if err != nil {
+		return err
+	}
+	block, err := history.CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	seq, err := block.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	key := historyKey(record.Timestamp, seq)
+	if err := block.Put(key, value); err != nil {
+		return err
+	}
+
+	if record.Digest == "" {
+		return nil
+	}
+	index, err := t.tx.CreateBucketIfNotExists([]byte(digestIndexBucket))
+	if err != nil {
+		return err
+	}
+	digest, err := index.CreateBucketIfNotExists([]byte(record.Digest))
+	if err != nil {
+		return err
+	}
+	return digest.Put(indexKey(id, key), []byte{})
+}
+
+// History reads records by digest through the digest index, and otherwise seeks each
+// block's records from Since on
+func (t *boltTx) History(query HistoryQuery) ([]HistoryRecord, error) {
+	history := t.tx.Bucket([]byte(historyBucket))
+	if history == nil {
+		return nil, nil
+	}
+	var out []HistoryRecord
+	add := func(id string, value []byte) error {
+		var record types.ImageRecord
+		if err := json.Unmarshal(value, &record); err != nil {
+			return fmt.Errorf("failed to decode history of block %s: %w", id, err)
+		}
+		if query.matches(record) {
+			out = append(out, HistoryRecord{Block: id, ImageRecord: record})
+		}
+		return nil
+	}
+
+	if query.Digest != "" {
+		var digest *bolt.Bucket
+		if index := t.tx.Bucket([]byte(digestIndexBucket)); index != nil {
+			digest = index.Bucket([]byte(query.Digest))
+		}
+		if digest == nil {
+			return nil, nil
+		}
+		err := digest.ForEach(func(k, _ []byte) error {
+			id, key, found := bytes.Cut(k, []byte{0})
+			if !found || (query.Block != "" && string(id) != query.Block) {
+				return nil
+			}
+			block := history.Bucket(id)
+			if block == nil {
+				return nil
+			}
+			if value := block.Get(key); value != nil {
+				return add(string(id), value)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return query.finish(out), nil
+	}
+
+	read := func(id []byte, block *bolt.Bucket) error {
+		c := block.Cursor()
+		for k, v := c.Seek(historyKey(query.Since, 0)); k != nil; k, v = c.Next() {
+			if err := add(string(id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if query.Block != "" {
+		if block := history.Bucket([]byte(query.Block)); block != nil {
+			if err := read([]byte(query.Block), block); err != nil {
+				return nil, err
+			}
+		}
+		return query.finish(out), nil
+	}
+	err := history.ForEach(func(id, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return read(id, history.Bucket(id))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return query.finish(out), nil
+}
+
+// ReplaceHistory drops the block's records and their index entries, then adds records
+func (t *boltTx) ReplaceHistory(id string, records []types.ImageRecord) error {
+	if history := t.tx.Bucket([]byte(historyBucket)); history != nil && history.Bucket([]byte(id)) != nil {
+		index := t.tx.Bucket([]byte(digestIndexBucket))
+		err := history.Bucket([]byte(id)).ForEach(func(k, v []byte) error {
+			var record types.ImageRecord
+			if json.Unmarshal(v, &record) != nil || record.Digest == "" || index == nil {
+				return nil
+			}
+			digest := index.Bucket([]byte(record.Digest))
+			if digest == nil {
+				return nil
+			}
+			if err := digest.Delete(indexKey(id, k)); err != nil {
+				return err
+			}
+			if k, _ := digest.Cursor().First(); k == nil {
+				return index.DeleteBucket([]byte(record.Digest))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := history.DeleteBucket([]byte(id)); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if err := t.AppendHistory(id, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltTx) View(fn func(tx Backend) error) error {
+	return fn(t)
+}
+
+func (t *boltTx) Update(fn func(tx Backend) error) error {
+	if !t.tx.Writable() {
+		return fmt.Errorf("cannot update the store while viewing it")
+	}
+	return fn(t)
+}
@@ -1,10 +1,14 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
 // CacheEntry represents a cache entry mapping hash to digest
@@ -13,19 +17,67 @@ type CacheEntry struct {
 	Digest string `json:"digest"`
 }
 
+// DefaultVerifyTTL is how long an image found to exist is trusted before it is checked again
+const DefaultVerifyTTL = time.Minute
+
+// ImageCheck reports whether the image with a digest still exists
+type ImageCheck func(ctx context.Context, digest string) (bool, error)
+
+// SharedCacheEnv names the environment variable that overrides the shared cache directory
+const SharedCacheEnv = "DOCKSTEP_CACHE_DIR"
+
+// cacheIndexKey holds the cache entries in their bucket
+const cacheIndexKey = "index.json"
+
 // Cache manages the cache index
 type Cache struct {
-	store *Store
+	// the index is kept at bucket/index.json in backend
+	backend Backend
+	bucket  string
+
+	// check verifies cache hits; verified records when each digest was last found to exist
+	check    ImageCheck
+	ttl      time.Duration
+	mu       sync.Mutex
+	verified map[string]time.Time
+}
+
+// VerifyReport is the result of checking every cache entry
+type VerifyReport struct {
+	Checked int
+	Missing []CacheEntry // entries whose image no longer exists
 }
 
 // NewCache creates a new Cache instance
 func NewCache(store *Store) *Cache {
-	return &Cache{store: store}
+	return &Cache{backend: store.backend, bucket: CacheDir}
+}
+
+// SharedCacheDir returns the machine-wide cache directory: $DOCKSTEP_CACHE_DIR, or
+// dockstep in the user cache directory ($XDG_CACHE_HOME or ~/.cache on Linux)
+func SharedCacheDir() (string, error) {
+	if dir := os.Getenv(SharedCacheEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the user cache directory (set %s): %w", SharedCacheEnv, err)
+	}
+	return filepath.Join(dir, "dockstep"), nil
+}
+
+// OpenSharedCache returns the cache shared by every project in dir. Its entries are keyed
+// by SharedBlockHash, so identical blocks of different projects share an image.
+func OpenSharedCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create shared cache directory: %w", err)
+	}
+	return &Cache{backend: newFileBackend(dir)}, nil
 }
 
 // GetCachedDigest looks up a cached digest by hash
 func (c *Cache) GetCachedDigest(hash string) (string, bool) {
-	entries, err := c.loadCache()
+	entries, err := loadCacheEntries(c.backend, c.bucket)
 	if err != nil {
 		return "", false
 	}
@@ -37,73 +89,209 @@ func (c *Cache) GetCachedDigest(hash string) (string, bool) {
 	return "", false
 }
 
-// SetCachedDigest stores a digest for a given hash
-func (c *Cache) SetCachedDigest(hash, digest string) error {
-	entries, err := c.loadCache()
+// SetImageCheck makes cache hits verify that their image still exists. An image found to
+// exist is trusted for ttl, so repeated lookups stay cheap; zero uses DefaultVerifyTTL.
+func (c *Cache) SetImageCheck(check ImageCheck, ttl time.Duration) {
+	if ttl == 0 {
+		ttl = DefaultVerifyTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.check = check
+	c.ttl = ttl
+	c.verified = make(map[string]time.Time)
+}
+
+// GetVerifiedDigest looks up a cached digest by hash and checks that its image still
+// exists. Entries whose image is gone are evicted and reported as a miss; the evicted
+// digest is returned so callers can say why.
+func (c *Cache) GetVerifiedDigest(ctx context.Context, hash string) (digest string, hit bool, evicted string) {
+	digest, hit = c.GetCachedDigest(hash)
+	if !hit || c.ImageExists(ctx, digest) {
+		return digest, hit, ""
+	}
+	// An entry that fails to be evicted is checked and evicted again on the next lookup
+	_, _ = c.Evict(digest)
+	return "", false, digest
+}
+
+// ImageExists reports whether the image with a digest still exists. Without an image
+// check, or when the check fails, the image is assumed to exist.
+func (c *Cache) ImageExists(ctx context.Context, digest string) bool {
+	c.mu.Lock()
+	check, ttl := c.check, c.ttl
+	checkedAt, ok := c.verified[digest]
+	c.mu.Unlock()
+	if check == nil || (ok && time.Since(checkedAt) < ttl) {
+		return true
+	}
+
+	exists, err := check(ctx, digest)
 	if err != nil {
-		entries = make(map[string]CacheEntry)
+		return true
+	}
+	c.mu.Lock()
+	if exists {
+		c.verified[digest] = time.Now()
+	} else {
+		delete(c.verified, digest)
+	}
+	c.mu.Unlock()
+	return exists
+}
+
+// Evict removes every cache entry pointing at a digest and returns how many were removed
+func (c *Cache) Evict(digest string) (int, error) {
+	removed := 0
+	err := c.update(func(entries map[string]CacheEntry) {
+		for hash, entry := range entries {
+			if entry.Digest == digest {
+				delete(entries, hash)
+				removed++
+			}
+		}
+	})
+	return removed, err
+}
+
+// Remove deletes the cache entries of the given hashes
+func (c *Cache) Remove(hashes []string) error {
+	return c.update(func(entries map[string]CacheEntry) {
+		for _, hash := range hashes {
+			delete(entries, hash)
+		}
+	})
+}
+
+// Verify checks the image of every cache entry, ignoring the TTL, and evicts the entries
+// whose image no longer exists unless dryRun is set
+func (c *Cache) Verify(ctx context.Context, dryRun bool) (*VerifyReport, error) {
+	c.mu.Lock()
+	check := c.check
+	c.mu.Unlock()
+	if check == nil {
+		return nil, fmt.Errorf("no image check configured")
 	}
 
-	entries[hash] = CacheEntry{
-		Hash:   hash,
-		Digest: digest,
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	// Images are checked outside the transaction, which only covers the final update
+	report := &VerifyReport{}
+	exists := make(map[string]bool)
+	for _, entry := range entries {
+		found, checked := exists[entry.Digest]
+		if !checked {
+			if found, err = check(ctx, entry.Digest); err != nil {
+				return nil, fmt.Errorf("failed to check image %s: %w", entry.Digest, err)
+			}
+			exists[entry.Digest] = found
+		}
+		report.Checked++
+		if !found {
+			report.Missing = append(report.Missing, entry)
+		}
+	}
+	if dryRun || len(report.Missing) == 0 {
+		return report, nil
 	}
+	// Entries changed by another process since they were checked are left alone
+	return report, c.update(func(current map[string]CacheEntry) {
+		for _, entry := range report.Missing {
+			if current[entry.Hash].Digest == entry.Digest {
+				delete(current, entry.Hash)
+			}
+		}
+	})
+}
 
-	return c.saveCache(entries)
+// Entries returns all cache entries, sorted by hash
+func (c *Cache) Entries() ([]CacheEntry, error) {
+	entries, err := loadCacheEntries(c.backend, c.bucket)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]CacheEntry, 0, len(entries))
+	for _, entry := range entries {
+		out = append(out, entry)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Hash < out[j].Hash })
+	return out, nil
 }
 
-// loadCache loads the cache index from disk
-func (c *Cache) loadCache() (map[string]CacheEntry, error) {
-	path := filepath.Join(c.store.rootPath, ".dockstep", CacheFile)
+// SetCachedDigest stores a digest for a given hash
+func (c *Cache) SetCachedDigest(hash, digest string) error {
+	return c.backend.Update(func(tx Backend) error {
+		entries, err := loadCacheEntries(tx, c.bucket)
+		if err != nil {
+			entries = make(map[string]CacheEntry)
+		}
 
-	file, err := os.Open(path)
+		entries[hash] = CacheEntry{
+			Hash:   hash,
+			Digest: digest,
+		}
+
+		return saveCacheEntries(tx, c.bucket, entries)
+	})
+}
+
+// update changes the cache index in a transaction, saving it only if fn changed it
+func (c *Cache) update(fn func(entries map[string]CacheEntry)) error {
+	return c.backend.Update(func(tx Backend) error {
+		entries, err := loadCacheEntries(tx, c.bucket)
+		if err != nil {
+			return err
+		}
+		before := len(entries)
+		fn(entries)
+		if len(entries) == before {
+			return nil
+		}
+		return saveCacheEntries(tx, c.bucket, entries)
+	})
+}
+
+// loadCacheEntries loads the cache index kept in a bucket
+func loadCacheEntries(b Backend, bucket string) (map[string]CacheEntry, error) {
+	data, err := b.Get(bucket, cacheIndexKey)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return make(map[string]CacheEntry), nil
 		}
 		return nil, err
 	}
-	defer file.Close()
 
 	var entries map[string]CacheEntry
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&entries); err != nil {
+	if err := json.Unmarshal(data, &entries); err != nil {
 		return nil, fmt.Errorf("failed to decode cache: %w", err)
 	}
-
+	if entries == nil {
+		entries = make(map[string]CacheEntry)
+	}
 	return entries, nil
 }
 
-// saveCache saves the cache index to disk
-func (c *Cache) saveCache(entries map[string]CacheEntry) error {
-	path := filepath.Join(c.store.rootPath, ".dockstep", CacheFile)
-
-	// Ensure directory exists
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create cache directory: %w", err)
-	}
-
-	file, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("failed to create cache file: %w", err)
+// saveCacheEntries saves the cache index kept in a bucket
+func saveCacheEntries(b Backend, bucket string, entries map[string]CacheEntry) error {
+	if err := putJSON(b, bucket, cacheIndexKey, entries); err != nil {
+		return fmt.Errorf("failed to write cache file: %w", err)
 	}
-	defer file.Close()
-
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(entries)
+	return nil
 }
 
 // ClearCache removes all cache entries
 func (c *Cache) ClearCache() error {
-	path := filepath.Join(c.store.rootPath, ".dockstep", CacheFile)
-	return os.Remove(path)
+	return c.backend.Update(func(tx Backend) error {
+		return tx.Delete(c.bucket, cacheIndexKey)
+	})
 }
 
 // GetCacheStats returns cache statistics
 func (c *Cache) GetCacheStats() (int, error) {
-	entries, err := c.loadCache()
+	entries, err := c.Entries()
 	if err != nil {
 		return 0, err
 	}
@@ -1,7 +1,11 @@
 package store
 
 import (
+	"context"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCache(t *testing.T) {
@@ -90,3 +94,150 @@ func TestClearCache(t *testing.T) {
 		t.Errorf("Expected 0 cache entries after clear, got %d", count)
 	}
 }
+
+// fakeImages is an image check backed by a set of existing digests that counts its calls
+type fakeImages struct {
+	exists map[string]bool
+	calls  int
+}
+
+func (f *fakeImages) check(ctx context.Context, digest string) (bool, error) {
+	f.calls++
+	return f.exists[digest], nil
+}
+
+func TestCacheVerifiedDigest(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	cache := NewCache(store)
+	images := &fakeImages{exists: map[string]bool{"digest1": true}}
+	cache.SetImageCheck(images.check, time.Hour)
+
+	cache.SetCachedDigest("hash1", "digest1")
+	cache.SetCachedDigest("hash2", "digest2")
+	cache.SetCachedDigest("hash3", "digest2")
+
+	// Hits are checked once, then trusted until the TTL expires
+	for i := 0; i < 3; i++ {
+		digest, hit, evicted := cache.GetVerifiedDigest(context.Background(), "hash1")
+		if !hit || digest != "digest1" || evicted != "" {
+			t.Fatalf("Expected a verified hit, got %q %v %q", digest, hit, evicted)
+		}
+	}
+	if images.calls != 1 {
+		t.Errorf("Expected 1 image check within the TTL, got %d", images.calls)
+	}
+
+	// A removed image is a miss, and every entry pointing at it is evicted
+	_, hit, evicted := cache.GetVerifiedDigest(context.Background(), "hash2")
+	if hit || evicted != "digest2" {
+		t.Errorf("Expected a miss evicting digest2, got %v %q", hit, evicted)
+	}
+	if _, ok := cache.GetCachedDigest("hash3"); ok {
+		t.Error("Expected all entries of the missing image to be evicted")
+	}
+
+	// With a TTL shorter than the time between lookups, every hit is checked again
+	cache.SetImageCheck(images.check, time.Nanosecond)
+	images.calls = 0
+	cache.GetVerifiedDigest(context.Background(), "hash1")
+	time.Sleep(time.Millisecond)
+	cache.GetVerifiedDigest(context.Background(), "hash1")
+	if images.calls != 2 {
+		t.Errorf("Expected an image check per lookup once the TTL expired, got %d", images.calls)
+	}
+}
+
+func TestCacheVerify(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	cache := NewCache(store)
+	images := &fakeImages{exists: map[string]bool{"digest1": true}}
+	cache.SetImageCheck(images.check, time.Hour)
+
+	cache.SetCachedDigest("hash1", "digest1")
+	cache.SetCachedDigest("hash2", "digest2")
+
+	report, err := cache.Verify(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+	if report.Checked != 2 || len(report.Missing) != 1 || report.Missing[0].Hash != "hash2" {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	if count, _ := cache.GetCacheStats(); count != 2 {
+		t.Errorf("Expected a dry run to keep all entries, got %d", count)
+	}
+
+	if _, err := cache.Verify(context.Background(), false); err != nil {
+		t.Fatalf("Failed to verify: %v", err)
+	}
+	if count, _ := cache.GetCacheStats(); count != 1 {
+		t.Errorf("Expected the missing entry to be evicted, got %d entries", count)
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(SharedCacheEnv, dir)
+	got, err := SharedCacheDir()
+	if err != nil || got != dir {
+		t.Fatalf("Expected %s from %s, got %q, %v", dir, SharedCacheEnv, got, err)
+	}
+
+	// Two projects open the same shared cache; what one records, the other finds
+	first, err := OpenSharedCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to open shared cache: %v", err)
+	}
+	second, err := OpenSharedCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to open shared cache: %v", err)
+	}
+	if err := first.SetCachedDigest("shared-hash", "sha256:base"); err != nil {
+		t.Fatalf("Failed to set cached digest: %v", err)
+	}
+	if digest, ok := second.GetCachedDigest("shared-hash"); !ok || digest != "sha256:base" {
+		t.Errorf("Expected the other project to hit sha256:base, got %q %v", digest, ok)
+	}
+}
+
+func TestCacheConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+
+	// Each writer has its own Cache, as separate processes would, and only the file lock
+	// keeps their read-modify-write cycles from losing each other's entries
+	const writers, perWriter = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			cache, err := OpenSharedCache(dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < perWriter; i++ {
+				if err := cache.SetCachedDigest(fmt.Sprintf("hash-%d-%d", w, i), "sha256:image"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to write concurrently: %v", err)
+	}
+
+	cache, err := OpenSharedCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := cache.GetCacheStats(); err != nil || count != writers*perWriter {
+		t.Errorf("Expected %d entries, got %d, %v", writers*perWriter, count, err)
+	}
+}
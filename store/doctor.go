@@ -0,0 +1,301 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"dockstep.dev/types"
+)
+
+// ProblemKind classifies what is wrong with the store
+type ProblemKind string
+
+const (
+	// ProblemOrphanState is the state of a block that is no longer in the config
+	ProblemOrphanState ProblemKind = "orphan-state"
+	// ProblemMissingImage is an image digest whose image no longer exists
+	ProblemMissingImage ProblemKind = "missing-image"
+	// ProblemMissingSnapshot is a built image without its Dockerfile snapshot
+	ProblemMissingSnapshot ProblemKind = "missing-snapshot"
+	// ProblemCorrupt is a value that does not decode
+	ProblemCorrupt ProblemKind = "corrupt"
+)
+
+// Problem is an integrity problem found in the store
+type Problem struct {
+	Kind   ProblemKind
+	Block  string // block the problem concerns, if any
+	File   string // value the problem concerns, as <bucket>/<key>
+	Digest string // image the problem concerns, if any
+	Detail string
+}
+
+// Fixable reports whether FixProblems can repair the problem. A missing snapshot cannot be
+// recreated, since the config may have changed since the image was built.
+func (p Problem) Fixable() bool {
+	return p.Kind != ProblemMissingSnapshot
+}
+
+func (p Problem) String() string {
+	switch p.Kind {
+	case ProblemOrphanState:
+		return fmt.Sprintf("%s: state of block %s, which is no longer in the config", p.File, p.Block)
+	case ProblemMissingImage:
+		return fmt.Sprintf("%s: image %s of block %s no longer exists", p.File, p.Digest, p.Block)
+	case ProblemMissingSnapshot:
+		return fmt.Sprintf("image %s of block %s has no Dockerfile snapshot", p.Digest, p.Block)
+	default:
+		return fmt.Sprintf("%s: %s", p.File, p.Detail)
+	}
+}
+
+// CheckOptions selects what CheckIntegrity compares the store against
+type CheckOptions struct {
+	Blocks      []string   // IDs of the blocks in the config; nil when it cannot be loaded
+	ImageExists ImageCheck // checks image digests; nil skips the check
+}
+
+// CheckIntegrity looks for state of deleted blocks, digests whose image is gone, built
+// images without a Dockerfile snapshot and values that do not decode. Without the blocks
+// of the config, every block in the store is checked and none is reported as deleted.
+func (s *Store) CheckIntegrity(ctx context.Context, opts CheckOptions) ([]Problem, error) {
+	blocks := make(map[string]bool, len(opts.Blocks))
+	for _, id := range opts.Blocks {
+		blocks[id] = true
+	}
+	known := func(id string) bool { return opts.Blocks == nil || blocks[id] }
+
+	var problems []Problem
+	var digests map[string]string // image digest files of blocks in the config, by block
+	err := s.backend.View(func(tx Backend) error {
+		states, err := tx.List(StateDir)
+		if err != nil {
+			return err
+		}
+		for key := range states {
+			if !strings.HasSuffix(key, ".json") {
+				continue
+			}
+			id := blockIDFromFileName(strings.TrimSuffix(key, ".json"))
+			file := StateDir + "/" + key
+			var state types.BlockState
+			if err := getJSON(tx, StateDir, key, &state); err != nil {
+				problems = append(problems, Problem{Kind: ProblemCorrupt, Block: id, File: file, Detail: err.Error()})
+				continue
+			}
+			if !known(id) {
+				problems = append(problems, Problem{Kind: ProblemOrphanState, Block: id, File: file})
+			}
+		}
+
+		for _, value := range [][2]string{{ImagesDir, baseDigestsKey}, {CacheDir, cacheIndexKey}} {
+			data, err := tx.Get(value[0], value[1])
+			if err != nil {
+				continue
+			}
+			if !json.Valid(data) {
+				problems = append(problems, Problem{Kind: ProblemCorrupt, File: value[0] + "/" + value[1], Detail: "invalid JSON"})
+			}
+		}
+
+		if digests, err = imageDigests(tx, known); err != nil {
+			return err
+		}
+		problems = append(problems, corruptHistory(tx)...)
+
+		records, err := tx.History(HistoryQuery{})
+		if err != nil {
+			return err
+		}
+		snapshots, err := tx.List(SnapshotsBucket)
+		if err != nil {
+			return err
+		}
+		reported := make(map[string]bool)
+		for _, record := range records {
+			if _, ok := snapshots[record.Digest+".Dockerfile"]; ok || record.Digest == "" || reported[record.Digest] || !known(record.Block) {
+				continue
+			}
+			reported[record.Digest] = true
+			problems = append(problems, Problem{Kind: ProblemMissingSnapshot, Block: record.Block, Digest: record.Digest,
+				File: SnapshotsBucket + "/" + record.Digest + ".Dockerfile"})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Images are checked outside the view, since it may take a while
+	if opts.ImageExists != nil {
+		for id, digest := range digests {
+			exists, err := opts.ImageExists(ctx, digest)
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				problems = append(problems, Problem{Kind: ProblemMissingImage, Block: id, Digest: digest,
+					File: ImagesDir + "/" + blockFileName(id) + ".digest"})
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].File < problems[j].File })
+	return problems, nil
+}
+
+// imageDigests returns the image digests recorded for the known blocks
+func imageDigests(tx Backend, known func(id string) bool) (map[string]string, error) {
+	files, err := tx.List(ImagesDir)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]string)
+	for key := range files {
+		id := blockIDFromFileName(strings.TrimSuffix(key, ".digest"))
+		if !strings.HasSuffix(key, ".digest") || !known(id) {
+			continue
+		}
+		if digest, err := tx.Get(ImagesDir, key); err == nil && len(digest) > 0 {
+			digests[id] = string(digest)
+		}
+	}
+	return digests, nil
+}
+
+// corruptHistory finds history files with lines that do not decode. Backends that keep
+// history records apart never have any.
+func corruptHistory(tx Backend) []Problem {
+	files, err := tx.List(HistoryDir)
+	if err != nil {
+		return nil
+	}
+	var problems []Problem
+	for key := range files {
+		if !strings.HasSuffix(key, ".jsonl") {
+			continue
+		}
+		data, err := tx.Get(HistoryDir, key)
+		if err != nil {
+			continue
+		}
+		if _, bad := decodeHistory(data); bad > 0 {
+			problems = append(problems, Problem{Kind: ProblemCorrupt, Block: blockIDFromFileName(strings.TrimSuffix(key, ".jsonl")),
+				File: HistoryDir + "/" + key, Detail: fmt.Sprintf("%d history line(s) do not decode", bad)})
+		}
+	}
+	return problems
+}
+
+// decodeHistory decodes the lines of a history file, counting those that do not decode
+func decodeHistory(data []byte) (records []types.ImageRecord, bad int) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record types.ImageRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			bad++
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, bad
+}
+
+// FixProblems repairs the fixable problems in a single update and returns how many it
+// fixed. Deleted blocks lose their state, digest and logs; blocks whose image is gone lose
+// their state and digest, so they are built again, and the cache entries of the image are
+// evicted. Corrupt values are removed, and history lines that do not decode are dropped.
+func (s *Store) FixProblems(problems []Problem) (int, error) {
+	fixed := 0
+	err := s.backend.Update(func(tx Backend) error {
+		for _, problem := range problems {
+			if !problem.Fixable() {
+				continue
+			}
+			var err error
+			switch problem.Kind {
+			case ProblemOrphanState:
+				err = deleteValues(tx, blockValues(problem.Block))
+			case ProblemMissingImage:
+				err = deleteValues(tx, blockValues(problem.Block)[:2])
+				if err == nil {
+					err = evictDigest(tx, problem.Digest)
+				}
+			case ProblemCorrupt:
+				err = fixCorrupt(tx, problem.File)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to fix %s: %w", problem.File, err)
+			}
+			fixed++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return fixed, nil
+}
+
+// fixCorrupt drops the lines of a history file that do not decode, and removes any other
+// corrupt value
+func fixCorrupt(tx Backend, file string) error {
+	i := strings.LastIndex(file, "/")
+	bucket, key := file[:i], file[i+1:]
+	if bucket != HistoryDir {
+		return tx.Delete(bucket, key)
+	}
+	data, err := tx.Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	records, _ := decodeHistory(data)
+	return tx.ReplaceHistory(blockIDFromFileName(strings.TrimSuffix(key, ".jsonl")), records)
+}
+
+// blockValues lists the values kept for a block: its state and digest first, then its logs
+func blockValues(id string) [][2]string {
+	name := blockFileName(id)
+	return [][2]string{
+		{StateDir, name + ".json"},
+		{ImagesDir, name + ".digest"},
+		{LogsDir, name + ".log"},
+		{LogsDir, name + ".success.log"},
+	}
+}
+
+// deleteValues deletes values given as bucket and key
+func deleteValues(tx Backend, values [][2]string) error {
+	for _, value := range values {
+		if err := tx.Delete(value[0], value[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictDigest removes the project cache entries pointing at a digest
+func evictDigest(tx Backend, digest string) error {
+	entries, err := loadCacheEntries(tx, CacheDir)
+	if err != nil {
+		// A corrupt cache index is fixed on its own
+		return nil
+	}
+	before := len(entries)
+	for hash, entry := range entries {
+		if entry.Digest == digest {
+			delete(entries, hash)
+		}
+	}
+	if len(entries) == before {
+		return nil
+	}
+	return saveCacheEntries(tx, CacheDir, entries)
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	now := time.Now()
+	store := gcStore(t, now)
+	dir := filepath.Join(store.RootPath(), ".dockstep")
+
+	// app's image was removed from Docker, and a3's snapshot was lost
+	if err := store.SaveImageDigest("app", "sha256:a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, SnapshotsBucket, "sha256:a3.Dockerfile")); err != nil {
+		t.Fatal(err)
+	}
+	// A crash left a corrupt state and a torn history line behind
+	if err := store.backend.Put(StateDir, "web.json", []byte(`{"id": "we`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.backend.Append(HistoryDir, "app.jsonl", []byte("{\"digest\":\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveImageHistory("app", types.ImageRecord{Digest: "sha256:a5", Timestamp: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveDockerfileSnapshot("sha256:a5", "FROM alpine\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(ctx context.Context, digest string) (bool, error) { return digest != "sha256:a1", nil }
+	opts := CheckOptions{Blocks: []string{"app", "web"}, ImageExists: exists}
+	problems, err := store.CheckIntegrity(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	var got []string
+	for _, problem := range problems {
+		got = append(got, string(problem.Kind)+" "+problem.File)
+	}
+	want := []string{
+		"corrupt history/app.jsonl",
+		"missing-snapshot history/dockerfiles/sha256:a3.Dockerfile",
+		"missing-image images/app.digest",
+		"orphan-state state/old.json",
+		"corrupt state/web.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Problems = %v, want %v", got, want)
+	}
+
+	fixed, err := store.FixProblems(problems)
+	if err != nil {
+		t.Fatalf("Failed to fix: %v", err)
+	}
+	if fixed != 4 {
+		t.Errorf("Expected 4 problems fixed, got %d", fixed)
+	}
+	problems, err = store.CheckIntegrity(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemMissingSnapshot {
+		t.Errorf("Expected only the missing snapshot to remain, got %v", problems)
+	}
+
+	// The records after the torn line are kept, and app is built again
+	history, err := store.LoadImageHistory("app")
+	if err != nil || len(history) != 5 || history[4].Digest != "sha256:a5" {
+		t.Errorf("Expected the whole history to be kept, got %v, %v", history, err)
+	}
+	if _, err := store.LoadBlockState("app"); !os.IsNotExist(err) {
+		t.Errorf("Expected the state of a block whose image is gone to be removed, got %v", err)
+	}
+	if _, ok := store.NewCache().GetCachedDigest("hash-sha256:a1"); ok {
+		t.Error("Expected the cache entry of the missing image to be evicted")
+	}
+	if _, err := store.LoadLogs("old"); !os.IsNotExist(err) {
+		t.Errorf("Expected the logs of a deleted block to be removed, got %v", err)
+	}
+}
+
+func TestCheckIntegrityWithoutConfig(t *testing.T) {
+	store := gcStore(t, time.Now())
+
+	// Without the config's blocks, no state is reported as belonging to a deleted block
+	problems, err := store.CheckIntegrity(context.Background(), CheckOptions{})
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	for _, problem := range problems {
+		if problem.Kind == ProblemOrphanState {
+			t.Errorf("Unexpected problem without the config: %s", problem)
+		}
+	}
+}
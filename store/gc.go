@@ -0,0 +1,247 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+// GCOptions selects what garbage collection keeps
+type GCOptions struct {
+	Keep      int           // image records kept per block, newest first; 0 keeps all
+	OlderThan time.Duration // image records older than this are removed; 0 keeps all ages
+	Blocks    []string      // IDs of the blocks in the config; data of other blocks is removed
+	Now       time.Time
+}
+
+// GCPlan lists what garbage collection removes. Digests of current block images and of
+// kept history are never removed.
+type GCPlan struct {
+	Kept         map[string]bool // digests still referenced
+	Images       []string        // digests of images no longer referenced
+	CacheEntries []string        // cache hashes whose image is no longer referenced
+	Files        []string        // snapshots, logs and state files to delete, as <bucket>/<key>
+	FileSize     int64           // total size of Files
+	Records      int             // image records dropped from history
+
+	history map[string][]types.ImageRecord // kept history to write back, by block ID
+}
+
+// PlanGC works out what garbage collection removes without changing anything
+func (s *Store) PlanGC(opts GCOptions) (*GCPlan, error) {
+	var plan *GCPlan
+	err := s.backend.View(func(tx Backend) (err error) {
+		plan, err = planGC(tx, opts)
+		return err
+	})
+	return plan, err
+}
+
+// planGC plans garbage collection from a consistent view of the store
+func planGC(tx Backend, opts GCOptions) (*GCPlan, error) {
+	plan := &GCPlan{Kept: make(map[string]bool), history: make(map[string][]types.ImageRecord)}
+	blocks := make(map[string]bool, len(opts.Blocks))
+	for _, id := range opts.Blocks {
+		blocks[id] = true
+	}
+	known := func(id string) bool { return opts.Blocks == nil || blocks[id] }
+	list := func(bucket string) (map[string]int64, error) {
+		files, err := tx.List(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", bucket, err)
+		}
+		return files, nil
+	}
+
+	// Current images of blocks still in the config are always kept
+	states, err := list(StateDir)
+	if err != nil {
+		return nil, err
+	}
+	for key, size := range states {
+		id := blockIDFromFileName(strings.TrimSuffix(key, ".json"))
+		if !known(id) {
+			plan.addFile(StateDir, key, size)
+			continue
+		}
+		var state types.BlockState
+		if err := getJSON(tx, StateDir, key, &state); err != nil {
+			return nil, fmt.Errorf("failed to load state for block %s: %w", id, err)
+		}
+		if state.Digest != "" {
+			plan.Kept[state.Digest] = true
+		}
+	}
+	images, err := list(ImagesDir)
+	if err != nil {
+		return nil, err
+	}
+	for key, size := range images {
+		if !strings.HasSuffix(key, ".digest") {
+			continue
+		}
+		id := blockIDFromFileName(strings.TrimSuffix(key, ".digest"))
+		if !known(id) {
+			plan.addFile(ImagesDir, key, size)
+			continue
+		}
+		if digest, err := tx.Get(ImagesDir, key); err == nil && len(digest) > 0 {
+			plan.Kept[string(digest)] = true
+		}
+	}
+
+	// Keep the newest history records, and drop the rest
+	all, err := tx.History(HistoryQuery{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %w", err)
+	}
+	history := make(map[string][]types.ImageRecord)
+	for _, record := range all {
+		history[record.Block] = append(history[record.Block], record.ImageRecord)
+	}
+	historyFiles, err := list(HistoryDir)
+	if err != nil {
+		return nil, err
+	}
+	var dropped []string
+	for id, records := range history {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Timestamp.After(records[j].Timestamp) })
+
+		var kept []types.ImageRecord
+		for i, record := range records {
+			expired := !known(id) ||
+				(opts.Keep > 0 && i >= opts.Keep) ||
+				(opts.OlderThan > 0 && opts.Now.Sub(record.Timestamp) > opts.OlderThan)
+			if expired && !plan.Kept[record.Digest] {
+				dropped = append(dropped, record.Digest)
+				continue
+			}
+			kept = append(kept, record)
+		}
+		if len(kept) == len(records) {
+			continue
+		}
+		plan.Records += len(records) - len(kept)
+		if len(kept) == 0 {
+			key := blockFileName(id) + ".jsonl"
+			plan.addFile(HistoryDir, key, historyFiles[key])
+		}
+		// Written back oldest first, the order records are appended in
+		sort.SliceStable(kept, func(i, j int) bool { return kept[i].Timestamp.Before(kept[j].Timestamp) })
+		plan.history[id] = kept
+	}
+	for id, records := range history {
+		if kept, ok := plan.history[id]; ok {
+			records = kept
+		} else if !known(id) {
+			continue
+		}
+		for _, record := range records {
+			plan.Kept[record.Digest] = true
+		}
+	}
+	for _, digest := range dropped {
+		if digest != "" && !plan.Kept[digest] && !contains(plan.Images, digest) {
+			plan.Images = append(plan.Images, digest)
+		}
+	}
+	sort.Strings(plan.Images)
+
+	// Cache entries pointing at images that are no longer referenced
+	entries, err := loadCacheEntries(tx, CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	for hash, entry := range entries {
+		if !plan.Kept[entry.Digest] {
+			plan.CacheEntries = append(plan.CacheEntries, hash)
+		}
+	}
+	sort.Strings(plan.CacheEntries)
+
+	// Dockerfile snapshots of images that are no longer referenced
+	snapshots, err := list(SnapshotsBucket)
+	if err != nil {
+		return nil, err
+	}
+	for key, size := range snapshots {
+		if strings.HasSuffix(key, ".Dockerfile") && !plan.Kept[strings.TrimSuffix(key, ".Dockerfile")] {
+			plan.addFile(SnapshotsBucket, key, size)
+		}
+	}
+
+	// Logs of blocks that are no longer in the config
+	logs, err := list(LogsDir)
+	if err != nil {
+		return nil, err
+	}
+	for key, size := range logs {
+		if !strings.HasSuffix(key, ".log") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimSuffix(key, ".log"), ".success")
+		if !known(blockIDFromFileName(name)) {
+			plan.addFile(LogsDir, key, size)
+		}
+	}
+
+	sort.Strings(plan.Files)
+	return plan, nil
+}
+
+// contains reports whether a list holds a value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// addFile adds a value to delete to the plan
+func (p *GCPlan) addFile(bucket, key string, size int64) {
+	p.Files = append(p.Files, bucket+"/"+key)
+	p.FileSize += size
+}
+
+// ApplyGC removes the cache entries, files and history records of a plan in a single
+// update. Images are removed by the caller, which talks to Docker.
+func (s *Store) ApplyGC(plan *GCPlan) error {
+	return s.backend.Update(func(tx Backend) error {
+		if len(plan.CacheEntries) > 0 {
+			entries, err := loadCacheEntries(tx, CacheDir)
+			if err != nil {
+				return err
+			}
+			for _, hash := range plan.CacheEntries {
+				delete(entries, hash)
+			}
+			if err := saveCacheEntries(tx, CacheDir, entries); err != nil {
+				return err
+			}
+		}
+
+		for id, records := range plan.history {
+			if err := tx.ReplaceHistory(id, records); err != nil {
+				return fmt.Errorf("failed to write history for block %s: %w", id, err)
+			}
+		}
+
+		for _, file := range plan.Files {
+			i := strings.LastIndex(file, "/")
+			bucket, key := file[:i], file[i+1:]
+			// Histories were replaced above
+			if bucket == HistoryDir {
+				continue
+			}
+			if err := tx.Delete(bucket, key); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", file, err)
+			}
+		}
+		return nil
+	})
+}
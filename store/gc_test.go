@@ -0,0 +1,145 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+// gcStore sets up a store where block app was built four times, a day apart, and block
+// old has since been removed from the config
+func gcStore(t *testing.T, now time.Time) *Store {
+	t.Helper()
+	store := New(t.TempDir())
+	if err := store.Init(); err != nil {
+		t.Fatalf("Failed to initialize store: %v", err)
+	}
+	cache := store.NewCache()
+	for i, digest := range []string{"sha256:a1", "sha256:a2", "sha256:a3", "sha256:a4"} {
+		record := types.ImageRecord{Tag: "dockstep-app", Digest: digest, Timestamp: now.Add(time.Duration(i-3) * 24 * time.Hour)}
+		if err := store.SaveImageHistory("app", record); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SaveDockerfileSnapshot(digest, "FROM alpine\n"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.SetCachedDigest("hash-"+digest, digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The current image of app is an older build that was restored from the cache
+	if err := store.SaveBlockState("app", &types.BlockState{ID: "app", Status: types.StatusCached, Digest: "sha256:a1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.SaveBlockState("old", &types.BlockState{ID: "old", Status: types.StatusSuccess, Digest: "sha256:o1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveImageDigest("old", "sha256:o1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveImageHistory("old", types.ImageRecord{Digest: "sha256:o1", Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveLogs("old", []byte("build output")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveSuccessfulLogs("app", []byte("build output")); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestPlanGC(t *testing.T) {
+	now := time.Now()
+	store := gcStore(t, now)
+
+	plan, err := store.PlanGC(GCOptions{Keep: 2, Blocks: []string{"app"}, Now: now})
+	if err != nil {
+		t.Fatalf("Failed to plan: %v", err)
+	}
+	// a4 and a3 are the newest builds; a1 is kept because it is current
+	if want := []string{"sha256:a2", "sha256:o1"}; !reflect.DeepEqual(plan.Images, want) {
+		t.Errorf("Images = %v, want %v", plan.Images, want)
+	}
+	if want := []string{"hash-sha256:a2"}; !reflect.DeepEqual(plan.CacheEntries, want) {
+		t.Errorf("CacheEntries = %v, want %v", plan.CacheEntries, want)
+	}
+	if plan.Records != 2 {
+		t.Errorf("Records = %d, want 2", plan.Records)
+	}
+	wantFiles := []string{
+		HistoryDir + "/" + DockerfilesSubDir + "/sha256:a2.Dockerfile",
+		HistoryDir + "/old.jsonl",
+		ImagesDir + "/old.digest",
+		LogsDir + "/old.log",
+		StateDir + "/old.json",
+	}
+	if !reflect.DeepEqual(plan.Files, wantFiles) {
+		t.Errorf("Files = %v, want %v", plan.Files, wantFiles)
+	}
+	if plan.FileSize == 0 {
+		t.Error("Expected the size of the files to be counted")
+	}
+
+	// Planning changes nothing
+	dir := filepath.Join(store.RootPath(), ".dockstep")
+	if _, err := os.Stat(filepath.Join(dir, wantFiles[0])); err != nil {
+		t.Errorf("PlanGC removed a file: %v", err)
+	}
+
+	if err := store.ApplyGC(plan); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+	for _, file := range wantFiles {
+		if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", file)
+		}
+	}
+	history, err := store.LoadImageHistory("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var digests []string
+	for _, record := range history {
+		digests = append(digests, record.Digest)
+	}
+	if want := []string{"sha256:a1", "sha256:a3", "sha256:a4"}; !reflect.DeepEqual(digests, want) {
+		t.Errorf("History = %v, want %v", digests, want)
+	}
+	if _, ok := store.NewCache().GetCachedDigest("hash-sha256:a2"); ok {
+		t.Error("Expected the cache entry of a removed image to be removed")
+	}
+	if _, ok := store.NewCache().GetCachedDigest("hash-sha256:a1"); !ok {
+		t.Error("Expected the cache entry of the current image to be kept")
+	}
+
+	// A second run finds nothing to do
+	plan, err = store.PlanGC(GCOptions{Keep: 2, Blocks: []string{"app"}, Now: now})
+	if err != nil {
+		t.Fatalf("Failed to plan: %v", err)
+	}
+	if len(plan.Images)+len(plan.CacheEntries)+len(plan.Files)+plan.Records != 0 {
+		t.Errorf("Expected nothing left to collect, got %+v", plan)
+	}
+}
+
+func TestPlanGCOlderThan(t *testing.T) {
+	now := time.Now()
+	store := gcStore(t, now)
+
+	plan, err := store.PlanGC(GCOptions{OlderThan: 36 * time.Hour, Blocks: []string{"app", "old"}, Now: now})
+	if err != nil {
+		t.Fatalf("Failed to plan: %v", err)
+	}
+	if want := []string{"sha256:a2"}; !reflect.DeepEqual(plan.Images, want) {
+		t.Errorf("Images = %v, want %v", plan.Images, want)
+	}
+	if len(plan.Files) != 1 {
+		t.Errorf("Expected only the snapshot of a2 to be removed, got %v", plan.Files)
+	}
+}
@@ -0,0 +1,194 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// LayoutFile records the version of the .dockstep layout and the backend it uses
+	LayoutFile = "layout.json"
+	// LayoutVersion is the layout this dockstep reads and writes
+	LayoutVersion = 1
+)
+
+// Layout is the content of .dockstep/layout.json
+type Layout struct {
+	Version int    `json:"version"`
+	Backend string `json:"backend"`
+}
+
+// layoutMigration upgrades a .dockstep directory to layout version To. Migrate changes the
+// layout in place; Cleanup removes what the old layout needed once the new one is recorded,
+// so an interrupted upgrade runs again from the start.
+type layoutMigration struct {
+	To          int
+	Description string
+	Migrate     func(dir string, layout *Layout) error
+	Cleanup     func(dir string) error
+}
+
+// layoutMigrations upgrade older layouts, in order. A .dockstep directory without
+// layout.json has version 0.
+var layoutMigrations = []layoutMigration{
+	{
+		To:          1,
+		Description: "record the layout in layout.json and escape block IDs in file names",
+		Migrate:     migrateLayoutV1,
+	},
+}
+
+// migrateLayoutV1 upgrades a .dockstep directory from before layout versions, whose store
+// was always kept in files, by renaming the files of blocks whose IDs need escaping
+func migrateLayoutV1(dir string, layout *Layout) error {
+	layout.Backend = FileBackendName
+	return escapeBlockFileNames(dir)
+}
+
+// blockFileSuffixes lists the suffixes of the files named after a block, by bucket
+var blockFileSuffixes = map[string][]string{
+	StateDir:   {".json"},
+	LogsDir:    {".success.log", ".log"},
+	ImagesDir:  {".digest"},
+	HistoryDir: {".jsonl"},
+}
+
+// escapeBlockFileNames renames the files of blocks whose IDs blockFileName escapes. Files
+// used to be named after block IDs as they are, so a "/" in an ID made subdirectories,
+// which are removed once empty. Files of other IDs keep their names.
+func escapeBlockFileNames(dir string) error {
+	for bucket, suffixes := range blockFileSuffixes {
+		root := filepath.Join(dir, bucket)
+		var renames [][2]string
+		var subdirs []string
+		err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if entry.IsDir() {
+				if path == filepath.Join(dir, SnapshotsBucket) {
+					return filepath.SkipDir
+				}
+				if path != root {
+					subdirs = append(subdirs, path)
+				}
+				return nil
+			}
+			if strings.HasPrefix(entry.Name(), ".") {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			for _, suffix := range suffixes {
+				if !strings.HasSuffix(rel, suffix) {
+					continue
+				}
+				// Names an interrupted upgrade already escaped decode to the same name
+				name := strings.TrimSuffix(rel, suffix)
+				if blockFileName(blockIDFromFileName(name)) != name {
+					renames = append(renames, [2]string{path, filepath.Join(root, blockFileName(name)+suffix)})
+				}
+				break
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, rename := range renames {
+			if err := os.Rename(rename[0], rename[1]); err != nil {
+				return err
+			}
+		}
+		// Deepest first, so parents are empty by the time they are removed
+		for i := len(subdirs) - 1; i >= 0; i-- {
+			if entries, err := os.ReadDir(subdirs[i]); err == nil && len(entries) == 0 {
+				os.Remove(subdirs[i])
+			}
+		}
+	}
+	return nil
+}
+
+// readLayout reads the layout of a .dockstep directory; without layout.json it is version 0
+func readLayout(dir string) (*Layout, error) {
+	layout := &Layout{}
+	data, err := os.ReadFile(filepath.Join(dir, LayoutFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return layout, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, layout); err != nil {
+		return nil, fmt.Errorf("corrupt %s: %w", LayoutFile, err)
+	}
+	return layout, nil
+}
+
+// writeLayout records the layout of a .dockstep directory
+func writeLayout(dir string, layout *Layout) error {
+	data, err := json.MarshalIndent(layout, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, LayoutFile), append(data, '\n'), 0644)
+}
+
+// upgradeLayout brings a .dockstep directory to LayoutVersion, recording the layout after
+// each migration. It returns the layout and the descriptions of the migrations it ran.
+// Upgrading changes the store, so it holds the project lock, and fails with a *BusyError
+// while another process holds it.
+func (s *Store) upgradeLayout(dir string) (*Layout, []string, error) {
+	layout, err := readLayout(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if layout.Version > LayoutVersion {
+		return nil, nil, fmt.Errorf(".dockstep was written by a newer dockstep (layout version %d, this dockstep supports up to %d)", layout.Version, LayoutVersion)
+	}
+	if layout.Version == LayoutVersion {
+		return layout, nil, nil
+	}
+
+	lock, err := s.Lock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to upgrade .dockstep: %w", err)
+	}
+	defer lock.Unlock()
+	// Another process may have upgraded it in the meantime
+	if layout, err = readLayout(dir); err != nil {
+		return nil, nil, err
+	}
+
+	var applied []string
+	for _, migration := range layoutMigrations {
+		if migration.To <= layout.Version {
+			continue
+		}
+		if err := migration.Migrate(dir, layout); err != nil {
+			return nil, nil, fmt.Errorf("failed to upgrade .dockstep to layout version %d: %w", migration.To, err)
+		}
+		layout.Version = migration.To
+		if err := writeLayout(dir, layout); err != nil {
+			return nil, nil, fmt.Errorf("failed to record layout version %d: %w", migration.To, err)
+		}
+		if migration.Cleanup != nil {
+			if err := migration.Cleanup(dir); err != nil {
+				return nil, nil, fmt.Errorf("failed to clean up after layout version %d: %w", migration.To, err)
+			}
+		}
+		applied = append(applied, migration.Description)
+	}
+	return layout, applied, nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+func TestLayoutUpgrade(t *testing.T) {
+	root := t.TempDir()
+	store := New(root)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if layout := store.Layout(); layout.Version != LayoutVersion || layout.Backend != FileBackendName {
+		t.Errorf("Expected a new store at the current layout, got %+v", layout)
+	}
+	if upgrades := store.LayoutUpgrades(); len(upgrades) != 0 {
+		t.Errorf("Expected a new store to need no upgrades, got %v", upgrades)
+	}
+	if err := store.SaveBlockState("app", &types.BlockState{ID: "app", Status: types.StatusSuccess}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Before layout versions, .dockstep had no layout.json
+	dir := filepath.Join(root, ".dockstep")
+	if err := os.Remove(filepath.Join(dir, LayoutFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upgrading waits for the project to be idle
+	lock, err := store.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var busy *BusyError
+	if err := New(root).Init(); !errors.As(err, &busy) {
+		t.Errorf("Expected the upgrade of a locked project to fail as busy, got %v", err)
+	}
+	lock.Unlock()
+
+	upgraded := New(root)
+	if err := upgraded.Init(); err != nil {
+		t.Fatalf("Failed to upgrade the layout: %v", err)
+	}
+	if layout := upgraded.Layout(); layout.Version != LayoutVersion || layout.Backend != FileBackendName {
+		t.Errorf("Expected the upgraded layout to use files, got %+v", layout)
+	}
+	if upgrades := upgraded.LayoutUpgrades(); len(upgrades) != 1 {
+		t.Errorf("Expected one upgrade, got %v", upgrades)
+	}
+	if state, err := upgraded.LoadBlockState("app"); err != nil || state.Status != types.StatusSuccess {
+		t.Errorf("Expected the state to survive the upgrade, got %+v, %v", state, err)
+	}
+
+	// Upgrading is done once
+	again := New(root)
+	if err := again.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if upgrades := again.LayoutUpgrades(); len(upgrades) != 0 {
+		t.Errorf("Expected no further upgrades, got %v", upgrades)
+	}
+}
+
+func TestLayoutEscapesBlockFileNames(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, ".dockstep")
+
+	// Before layout versions, files were named after block IDs as they are
+	files := map[string]string{
+		"state/app.json":                           `{"id": "app", "status": "success"}`,
+		"state/web/amd64.json":                     `{"id": "web/amd64", "status": "success"}`,
+		"state/50%.json":                           `{"id": "50%", "status": "failed"}`,
+		"logs/web/amd64.log":                       "building",
+		"logs/web/amd64.success.log":               "built",
+		"images/web/amd64.digest":                  "sha256:w1",
+		"history/web/amd64.jsonl":                  `{"digest": "sha256:w1"}` + "\n",
+		"history/dockerfiles/sha256:w1.Dockerfile": "FROM alpine\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := New(root)
+	if err := store.Init(); err != nil {
+		t.Fatalf("Failed to upgrade the layout: %v", err)
+	}
+	for _, id := range []string{"app", "web/amd64", "50%"} {
+		if state, err := store.LoadBlockState(id); err != nil || state.ID != id {
+			t.Errorf("Expected the state of %s to be found, got %+v, %v", id, state, err)
+		}
+	}
+	if logs, err := store.LoadLogs("web/amd64"); err != nil || string(logs) != "building" {
+		t.Errorf("Expected the logs to be found, got %q, %v", logs, err)
+	}
+	if logs, err := store.LoadSuccessfulLogs("web/amd64"); err != nil || string(logs) != "built" {
+		t.Errorf("Expected the successful logs to be found, got %q, %v", logs, err)
+	}
+	if digest, err := store.LoadImageDigest("web/amd64"); err != nil || digest != "sha256:w1" {
+		t.Errorf("Expected the digest to be found, got %q, %v", digest, err)
+	}
+	if history, err := store.LoadImageHistory("web/amd64"); err != nil || len(history) != 1 {
+		t.Errorf("Expected the history to be found, got %v, %v", history, err)
+	}
+	if _, err := store.LoadDockerfileSnapshot("sha256:w1"); err != nil {
+		t.Errorf("Expected the snapshot to be kept, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, StateDir, "app.json")); err != nil {
+		t.Errorf("Expected IDs that need no escaping to keep their file names, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, StateDir, "web")); !os.IsNotExist(err) {
+		t.Errorf("Expected the emptied subdirectory to be removed, got %v", err)
+	}
+}
+
+func TestLayoutFromNewerVersion(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, ".dockstep")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLayout(dir, &Layout{Version: LayoutVersion + 1, Backend: FileBackendName}); err != nil {
+		t.Fatal(err)
+	}
+	err := New(root).Init()
+	if err == nil || !strings.Contains(err.Error(), "newer dockstep") {
+		t.Errorf("Expected a newer layout to be refused, got %v", err)
+	}
+}
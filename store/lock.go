@@ -0,0 +1,115 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// withFileLock runs fn while holding an exclusive lock on the file at path, so separate
+// dockstep processes take turns changing the files it guards
+func withFileLock(path string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer file.Close()
+
+	if err := lockFile(file, true); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	defer unlockFile(file)
+	return fn()
+}
+
+// BusyError reports that another process holds the project lock
+type BusyError struct {
+	PID int // 0 when the holder has not recorded its pid yet
+}
+
+func (e *BusyError) Error() string {
+	if e.PID == 0 {
+		return "project is busy"
+	}
+	return fmt.Sprintf("project is busy (pid %d)", e.PID)
+}
+
+// ProjectLock is the lock a process holds while it changes the store
+type ProjectLock struct {
+	file *os.File
+}
+
+// Lock takes the project lock without waiting, so two processes never change the store at
+// once. When another process holds it, Lock fails with a *BusyError naming that process.
+// The lock is released by Unlock, or by the operating system when the process exits.
+func (s *Store) Lock() (*ProjectLock, error) {
+	path := filepath.Join(s.rootPath, ".dockstep", LockFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open project lock: %w", err)
+	}
+
+	locked, err := tryLockFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock project: %w", err)
+	}
+	if !locked {
+		data, _ := io.ReadAll(file)
+		file.Close()
+		pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+		return nil, &BusyError{PID: pid}
+	}
+
+	// Record the holder for the error other processes report
+	if err := file.Truncate(0); err == nil {
+		_, _ = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &ProjectLock{file: file}, nil
+}
+
+// Unlock releases the project lock
+func (l *ProjectLock) Unlock() error {
+	_ = l.file.Truncate(0)
+	if err := unlockFile(l.file); err != nil {
+		l.file.Close()
+		return fmt.Errorf("failed to unlock project: %w", err)
+	}
+	return l.file.Close()
+}
+
+// writeFileAtomic writes data to a temporary file beside path and renames it into place, so
+// neither readers nor a crash ever leave a partly written file behind
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+TempSuffix+"*")
+	if err != nil {
+		return err
+	}
+	// Fails harmlessly once the file has been renamed
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
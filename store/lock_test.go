@@ -0,0 +1,188 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"dockstep.dev/types"
+)
+
+// lockHolderEnv makes TestLockHolderProcess hold the lock of the project it names
+const lockHolderEnv = "DOCKSTEP_TEST_LOCK_HOLDER"
+
+// TestLockHolderProcess is run by TestProjectLockAcrossProcesses as another dockstep process
+// holding the project lock until its stdin closes
+func TestLockHolderProcess(t *testing.T) {
+	root := os.Getenv(lockHolderEnv)
+	if root == "" {
+		t.Skip("only runs as a helper process")
+	}
+	lock, err := New(root).Lock()
+	if err != nil {
+		t.Fatalf("Failed to lock project: %v", err)
+	}
+	defer lock.Unlock()
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+func TestProjectLock(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+
+	lock, err := store.Lock()
+	if err != nil {
+		t.Fatalf("Failed to lock project: %v", err)
+	}
+	_, err = store.Lock()
+	var busy *BusyError
+	if !errors.As(err, &busy) || busy.PID != os.Getpid() {
+		t.Fatalf("Expected the project to be busy with pid %d, got %v", os.Getpid(), err)
+	}
+	if want := fmt.Sprintf("project is busy (pid %d)", os.Getpid()); err.Error() != want {
+		t.Errorf("Expected %q, got %q", want, err.Error())
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatalf("Failed to unlock project: %v", err)
+	}
+	lock, err = store.Lock()
+	if err != nil {
+		t.Fatalf("Expected the project to be free after unlocking, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestProjectLockAcrossProcesses(t *testing.T) {
+	root := t.TempDir()
+	store := New(root)
+	store.Init()
+
+	holder := exec.Command(os.Args[0], "-test.run=^TestLockHolderProcess$")
+	holder.Env = append(os.Environ(), lockHolderEnv+"="+root)
+	stdin, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatalf("Failed to start lock holder: %v", err)
+	}
+	defer holder.Wait()
+	defer stdin.Close()
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || strings.TrimSpace(line) != "locked" {
+		t.Fatalf("Lock holder did not take the lock: %q, %v", line, err)
+	}
+
+	_, err = store.Lock()
+	if want := fmt.Sprintf("project is busy (pid %d)", holder.Process.Pid); err == nil || err.Error() != want {
+		t.Fatalf("Expected %q, got %v", want, err)
+	}
+
+	// The lock is free again once the holder is gone
+	stdin.Close()
+	holder.Wait()
+	lock, err := store.Lock()
+	if err != nil {
+		t.Fatalf("Expected the project to be free after the holder exited, got %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestConcurrentStateWriters(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	if err := store.SaveBlockState("base", &types.BlockState{ID: "base", Status: types.StatusRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers racing the writers must always see a whole state file, however large
+	output := strings.Repeat("x", 256<<10)
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				state := &types.BlockState{ID: "base", Status: types.StatusFailed, Digest: fmt.Sprintf("sha256:%d-%d", w, i), Error: output}
+				if err := store.SaveBlockState("base", state); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if _, err := store.LoadBlockState("base"); err != nil {
+					errs <- fmt.Errorf("read a partial state: %w", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// No temporary files are left behind
+	files, err := filepath.Glob(filepath.Join(store.RootPath(), ".dockstep", StateDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only the state file, got %v", files)
+	}
+}
+
+func TestConcurrentCacheAndDigestWriters(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+
+	// Each writer uses its own Cache, as separate processes would
+	const writers, perWriter = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			cache := store.NewCache()
+			for i := 0; i < perWriter; i++ {
+				if err := cache.SetCachedDigest(fmt.Sprintf("hash-%d-%d", w, i), "sha256:image"); err != nil {
+					errs <- err
+					return
+				}
+				if err := store.SaveBaseDigest(fmt.Sprintf("image-%d-%d", w, i), "sha256:base"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to write concurrently: %v", err)
+	}
+
+	if count, err := store.NewCache().GetCacheStats(); err != nil || count != writers*perWriter {
+		t.Errorf("Expected %d cache entries, got %d, %v", writers*perWriter, count, err)
+	}
+	if digests, err := store.LoadBaseDigests(); err != nil || len(digests) != writers*perWriter {
+		t.Errorf("Expected %d base digests, got %d, %v", writers*perWriter, len(digests), err)
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// BackendMigration is the result of moving a store to another backend
+type BackendMigration struct {
+	From    string
+	To      string
+	Values  int // values copied
+	Records int // image records copied
+}
+
+// MigrateBackend moves the store to the backend named to: it copies every value and image
+// record in a single update of the new backend, records the backend in .dockstep/layout.json
+// and removes the old backend's data. An interrupted migration leaves the project on the
+// old backend. The caller holds the project lock.
+func (s *Store) MigrateBackend(to string) (*BackendMigration, error) {
+	from := s.backend.Name()
+	if to == from {
+		return nil, fmt.Errorf("store already uses the %s backend", to)
+	}
+	dir := filepath.Join(s.rootPath, ".dockstep")
+
+	// Data left by an earlier migration that did not finish is replaced, not merged
+	if err := dropBackend(to, dir); err != nil {
+		return nil, fmt.Errorf("failed to clear the %s backend: %w", to, err)
+	}
+	target, err := openBackend(to, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migration := &BackendMigration{From: from, To: to}
+	err = s.backend.View(func(src Backend) error {
+		return target.Update(func(dst Backend) error {
+			for _, bucket := range buckets {
+				keys, err := src.List(bucket)
+				if err != nil {
+					return fmt.Errorf("failed to list %s: %w", bucket, err)
+				}
+				for key := range keys {
+					value, err := src.Get(bucket, key)
+					if err != nil {
+						return fmt.Errorf("failed to read %s/%s: %w", bucket, key, err)
+					}
+					if err := dst.Put(bucket, key, value); err != nil {
+						return fmt.Errorf("failed to write %s/%s: %w", bucket, key, err)
+					}
+					migration.Values++
+				}
+			}
+
+			records, err := src.History(HistoryQuery{})
+			if err != nil {
+				return fmt.Errorf("failed to read history: %w", err)
+			}
+			for _, record := range records {
+				if err := dst.AppendHistory(record.Block, record.ImageRecord); err != nil {
+					return fmt.Errorf("failed to write history of block %s: %w", record.Block, err)
+				}
+				migration.Records++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		closeBackend(target)
+		dropBackend(to, dir)
+		return nil, err
+	}
+
+	layout := s.layout
+	layout.Backend = to
+	if err := writeLayout(dir, &layout); err != nil {
+		closeBackend(target)
+		dropBackend(to, dir)
+		return nil, fmt.Errorf("failed to record the store backend: %w", err)
+	}
+	closeBackend(s.backend)
+	s.backend = target
+	s.layout = layout
+	if err := dropBackend(from, dir); err != nil {
+		return migration, fmt.Errorf("migrated to %s, but failed to remove the %s data: %w", to, from, err)
+	}
+	return migration, nil
+}
+
+// dropBackend removes the data a backend keeps in a .dockstep directory
+func dropBackend(name, dir string) error {
+	var paths []string
+	switch name {
+	case FileBackendName:
+		paths = []string{filepath.Join(dir, updateLockFile)}
+		for _, bucket := range append(buckets, HistoryDir) {
+			paths = append(paths, filepath.Join(dir, bucket))
+		}
+	case BoltBackendName:
+		paths = []string{filepath.Join(dir, BoltFile)}
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
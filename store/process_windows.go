@@ -0,0 +1,17 @@
+//go:build windows
+
+package store
+
+import "golang.org/x/sys/windows"
+
+// processAlive reports whether a process with the pid exists on this host
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.SYNCHRONIZE|windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// A process that exists but cannot be opened is still alive
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+	event, err := windows.WaitForSingleObject(handle, 0)
+	return err == nil && event == uint32(windows.WAIT_TIMEOUT)
+}
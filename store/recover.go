@@ -0,0 +1,205 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+const (
+	// HeartbeatInterval is how often a running block's state records that its process is alive
+	HeartbeatInterval = 10 * time.Second
+	// StaleAfter is how long a running state may go without a heartbeat before it is
+	// considered interrupted, when its process cannot be checked directly
+	StaleAfter = 6 * HeartbeatInterval
+	// InterruptedError is the error of blocks whose run was interrupted
+	InterruptedError = "interrupted"
+	// buildDirPrefix starts the name of temporary build directories, followed by the pid
+	// of the process that created them
+	buildDirPrefix = "dockstep-build-"
+)
+
+// RecoveryReport lists what Recover cleaned up
+type RecoveryReport struct {
+	Interrupted []string // blocks marked as failed
+	Removed     []string // leftover temporary files and build directories
+}
+
+// NewBuildDir creates a temporary build directory named after the current process, so
+// Recover can remove it if the process dies before it does
+func NewBuildDir() (string, error) {
+	return os.MkdirTemp("", buildDirPrefix+strconv.Itoa(os.Getpid())+"-*")
+}
+
+// MarkRunning records the current process as running a block's state
+func MarkRunning(state *types.BlockState) {
+	state.Status = types.StatusRunning
+	state.PID = os.Getpid()
+	state.Host, _ = os.Hostname()
+	state.Heartbeat = time.Now()
+}
+
+// StartHeartbeat saves a running state every HeartbeatInterval with a fresh heartbeat. A
+// beat is only saved while the stored state is still this run's, so a run that was marked
+// interrupted, or replaced by another, is never set back to running. The returned function
+// stops the heartbeat, and returns once no more saves can happen.
+func (s *Store) StartHeartbeat(state *types.BlockState) (stop func()) {
+	beat := *state
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				beat.Heartbeat = now
+				if err := s.saveHeartbeat(&beat); err != nil {
+					fmt.Printf("Warning: failed to record heartbeat of block %s: %v\n", beat.ID, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// saveHeartbeat saves a running state if the stored state is still the same run
+func (s *Store) saveHeartbeat(beat *types.BlockState) error {
+	key := blockFileName(beat.ID) + ".json"
+	return s.backend.Update(func(tx Backend) error {
+		var current types.BlockState
+		if err := getJSON(tx, StateDir, key, &current); err != nil {
+			return err
+		}
+		if current.Status != types.StatusRunning || current.PID != beat.PID || current.Host != beat.Host || !current.Timestamp.Equal(beat.Timestamp) {
+			return nil
+		}
+		return putJSON(tx, StateDir, key, beat)
+	})
+}
+
+// IsStale reports whether a running state belongs to a run that is no longer in progress.
+// A run on this host is stale once its process is gone; while the process is alive it is
+// not, however long it went without a heartbeat, for example while the machine slept. A
+// run elsewhere is stale once it has missed its heartbeats for StaleAfter.
+func IsStale(state *types.BlockState, now time.Time) bool {
+	if state.Status != types.StatusRunning {
+		return false
+	}
+	if host, _ := os.Hostname(); state.PID != 0 && state.Host == host {
+		return !processAlive(state.PID)
+	}
+	lastSeen := state.Heartbeat
+	if lastSeen.IsZero() {
+		lastSeen = state.Timestamp
+	}
+	return now.Sub(lastSeen) > StaleAfter
+}
+
+// RecoverStates marks the stale running states as failed with InterruptedError, keeping
+// the partial logs of their runs for debugging. It returns the interrupted blocks. The
+// caller holds the project lock.
+func (s *Store) RecoverStates(now time.Time) (*RecoveryReport, error) {
+	states, err := s.GetBlockStates()
+	if err != nil {
+		return nil, err
+	}
+	report := &RecoveryReport{}
+	for id, state := range states {
+		if !IsStale(state, now) {
+			continue
+		}
+		lastSeen := state.Heartbeat
+		if lastSeen.IsZero() {
+			lastSeen = state.Timestamp
+		}
+		state.Status = types.StatusFailed
+		state.Error = InterruptedError
+		state.Duration = lastSeen.Sub(state.Timestamp)
+		if err := s.SaveBlockState(id, state); err != nil {
+			return nil, fmt.Errorf("failed to mark block %s as interrupted: %w", id, err)
+		}
+		report.Interrupted = append(report.Interrupted, id)
+	}
+	sort.Strings(report.Interrupted)
+	return report, nil
+}
+
+// RecoverIdle runs Recover while holding the project lock. When another process holds the
+// lock it may be running blocks, so nothing is recovered and the report is empty.
+func (s *Store) RecoverIdle(now time.Time) (*RecoveryReport, error) {
+	lock, err := s.Lock()
+	if err != nil {
+		var busy *BusyError
+		if errors.As(err, &busy) {
+			return &RecoveryReport{}, nil
+		}
+		return nil, err
+	}
+	defer lock.Unlock()
+	return s.Recover(now)
+}
+
+// Recover cleans up after processes that died mid-run: it recovers their states, removes
+// temporary files left by interrupted atomic writes, and removes the build directories of
+// processes that no longer exist. The caller holds the project lock.
+func (s *Store) Recover(now time.Time) (*RecoveryReport, error) {
+	report, err := s.RecoverStates(now)
+	if err != nil {
+		return nil, err
+	}
+
+	// A temporary file may still be renamed by a live writer, so only old ones are removed
+	root := filepath.Join(s.rootPath, ".dockstep")
+	err = filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), ".") || !strings.Contains(entry.Name(), TempSuffix) {
+			return nil
+		}
+		if info, err := entry.Info(); err != nil || now.Sub(info.ModTime()) <= StaleAfter {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.Removed = append(report.Removed, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove temporary files: %w", err)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), buildDirPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		owner, _, _ := strings.Cut(strings.TrimPrefix(filepath.Base(dir), buildDirPrefix), "-")
+		pid, err := strconv.Atoi(owner)
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to remove build directory %s: %w", dir, err)
+		}
+		report.Removed = append(report.Removed, dir)
+	}
+	return report, nil
+}
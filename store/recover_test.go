@@ -0,0 +1,169 @@
+package store
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"dockstep.dev/types"
+)
+
+// deadPID returns the pid of a process that has exited
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run helper process: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestRecover(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	store := New(t.TempDir())
+	store.Init()
+	host, _ := os.Hostname()
+	now := time.Now()
+	dead := deadPID(t)
+
+	states := map[string]*types.BlockState{
+		"crashed": {Status: types.StatusRunning, Timestamp: now.Add(-time.Minute), PID: dead, Host: host, Heartbeat: now},
+		"silent":  {Status: types.StatusRunning, Timestamp: now.Add(-time.Hour), PID: os.Getpid(), Host: "elsewhere", Heartbeat: now.Add(-2 * StaleAfter)},
+		"legacy":  {Status: types.StatusRunning, Timestamp: now.Add(-time.Hour)},
+		"running": {Status: types.StatusRunning, Timestamp: now, PID: os.Getpid(), Host: host, Heartbeat: now},
+		"paused":  {Status: types.StatusRunning, Timestamp: now.Add(-time.Hour), PID: os.Getpid(), Host: host, Heartbeat: now.Add(-2 * StaleAfter)},
+		"built":   {Status: types.StatusSuccess, Timestamp: now.Add(-time.Hour), Digest: "sha256:built"},
+	}
+	for id, state := range states {
+		state.ID = id
+		if err := store.SaveBlockState(id, state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.SaveLogs("crashed", []byte("Step 1/3 : RUN make"))
+	store.SaveSuccessfulLogs("crashed", []byte("the last successful build"))
+
+	// Leftovers of an atomic write that died, and of one still in progress
+	stateDir := filepath.Join(store.RootPath(), ".dockstep", StateDir)
+	stale := filepath.Join(stateDir, ".built.json"+TempSuffix+"1")
+	fresh := filepath.Join(stateDir, ".running.json"+TempSuffix+"2")
+	for _, path := range []string{stale, fresh} {
+		if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chtimes(stale, now.Add(-time.Hour), now.Add(-time.Hour))
+
+	// Build directories of a dead process and of this one
+	deadDir := filepath.Join(tmp, buildDirPrefix+strconv.Itoa(dead)+"-1")
+	liveDir, err := NewBuildDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(deadDir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Recover(now)
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	want := []string{"crashed", "legacy", "silent"}
+	if len(report.Interrupted) != len(want) {
+		t.Fatalf("Expected %v to be interrupted, got %v", want, report.Interrupted)
+	}
+	for i, id := range want {
+		if report.Interrupted[i] != id {
+			t.Errorf("Expected %v to be interrupted, got %v", want, report.Interrupted)
+		}
+		state, _ := store.LoadBlockState(id)
+		if state.Status != types.StatusFailed || state.Error != InterruptedError {
+			t.Errorf("Expected %s to be failed as interrupted, got %s %q", id, state.Status, state.Error)
+		}
+	}
+	// A live process on this host is still running its block, even after missing heartbeats
+	for id, status := range map[string]types.BlockStatus{"running": types.StatusRunning, "paused": types.StatusRunning, "built": types.StatusSuccess} {
+		if state, _ := store.LoadBlockState(id); state.Status != status {
+			t.Errorf("Expected %s to stay %s, got %s", id, status, state.Status)
+		}
+	}
+
+	if logs, _ := store.LoadLogs("crashed"); string(logs) != "Step 1/3 : RUN make" {
+		t.Errorf("Expected the partial logs to be kept, got %q", logs)
+	}
+	if logs, _ := store.LoadSuccessfulLogs("crashed"); string(logs) != "the last successful build" {
+		t.Errorf("Expected the successful logs to be kept, got %q", logs)
+	}
+	for path, exists := range map[string]bool{stale: false, fresh: true, deadDir: false, liveDir: true} {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Errorf("Expected %s to exist: %v, got %v", path, exists, err)
+		}
+	}
+}
+
+func TestRecoverIdle(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	host, _ := os.Hostname()
+	state := &types.BlockState{ID: "crashed", Status: types.StatusRunning, Timestamp: time.Now(), PID: deadPID(t), Host: host}
+	if err := store.SaveBlockState("crashed", state); err != nil {
+		t.Fatal(err)
+	}
+
+	// While another process holds the project lock, its runs are left alone
+	lock, err := store.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := New(store.RootPath()).RecoverIdle(time.Now())
+	if err != nil || len(report.Interrupted) != 0 {
+		t.Errorf("Expected nothing to be recovered while the project is locked, got %+v, %v", report, err)
+	}
+	if state, _ := store.LoadBlockState("crashed"); state.Status != types.StatusRunning {
+		t.Errorf("Expected the state to stay running, got %s", state.Status)
+	}
+
+	lock.Unlock()
+	report, err = store.RecoverIdle(time.Now())
+	if err != nil || len(report.Interrupted) != 1 {
+		t.Errorf("Expected the run to be recovered once the project is idle, got %+v, %v", report, err)
+	}
+}
+
+func TestHeartbeatKeepsRecoveredState(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	state := &types.BlockState{ID: "app", Timestamp: time.Now()}
+	MarkRunning(state)
+	if err := store.SaveBlockState("app", state); err != nil {
+		t.Fatal(err)
+	}
+
+	beat := *state
+	beat.Heartbeat = state.Heartbeat.Add(HeartbeatInterval)
+	if err := store.saveHeartbeat(&beat); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.LoadBlockState("app"); !saved.Heartbeat.Equal(beat.Heartbeat) {
+		t.Errorf("Expected the heartbeat to be saved, got %v", saved.Heartbeat)
+	}
+
+	// Once the run is marked interrupted, a late heartbeat does not set it back to running
+	interrupted := beat
+	interrupted.Status = types.StatusFailed
+	interrupted.Error = InterruptedError
+	if err := store.SaveBlockState("app", &interrupted); err != nil {
+		t.Fatal(err)
+	}
+	beat.Heartbeat = beat.Heartbeat.Add(HeartbeatInterval)
+	if err := store.saveHeartbeat(&beat); err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := store.LoadBlockState("app"); saved.Status != types.StatusFailed {
+		t.Errorf("Expected the interrupted state to be kept, got %s", saved.Status)
+	}
+}
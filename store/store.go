@@ -1,13 +1,20 @@
 package store
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
-	"io"
+	"io/fs"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"dockstep.dev/config"
 	"dockstep.dev/types"
 )
 
@@ -15,20 +22,49 @@ const (
 	StateDir          = "state"
 	LogsDir           = "logs"
 	ImagesDir         = "images"
-	CacheFile         = "cache/index.json"
+	CacheDir          = "cache"
 	ArtifactsDir      = "artifacts"
 	HistoryDir        = "history"
 	DockerfilesSubDir = "dockerfiles"
+	LockFile          = "lock"
+	// SecretKeyFile holds the project's key for secret fingerprints
+	SecretKeyFile = "secret.key"
+	// TempSuffix marks the temporary files atomic writes rename into place
+	TempSuffix = ".tmp-"
+	// baseDigestsKey holds the base image digests in ImagesDir
+	baseDigestsKey = "bases.json"
 )
 
-// Store manages the .dockstep/ directory structure and state persistence
+const (
+	// redactedPlaceholder replaces secret values in stored logs
+	redactedPlaceholder = "[REDACTED]"
+	// minRedactionLength avoids redacting trivially short values such as single characters
+	minRedactionLength = 4
+)
+
+// Store manages the .dockstep/ directory and persists state through a Backend. Processes
+// that change the store hold the project lock (see Lock).
 type Store struct {
 	rootPath string
+	backend  Backend
+	layout   Layout
+	upgrades []string
+
+	redactMu   sync.RWMutex
+	redactions [][]byte
+
+	heldMu sync.Mutex
+	held   map[string][]byte // log tails held back by AppendLogs, by block
 }
 
-// New creates a new Store instance
+// New creates a new Store instance, using the file backend until Init opens the
+// project's own
 func New(rootPath string) *Store {
-	return &Store{rootPath: rootPath}
+	return &Store{
+		rootPath: rootPath,
+		backend:  newFileBackend(filepath.Join(rootPath, ".dockstep")),
+		layout:   Layout{Version: LayoutVersion, Backend: FileBackendName},
+	}
 }
 
 // RootPath returns the project root path associated with the store
@@ -36,39 +72,94 @@ func (s *Store) RootPath() string {
 	return s.rootPath
 }
 
+// ProjectID identifies the project by its absolute root path, so checkouts sharing a
+// project name label their images apart
+func (s *Store) ProjectID() string {
+	root, err := filepath.Abs(s.rootPath)
+	if err != nil {
+		root = s.rootPath
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(root)))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// Backend returns the backend the store persists its data with
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
 // NewCache creates a new Cache instance
 func (s *Store) NewCache() *Cache {
 	return NewCache(s)
 }
 
-// Init creates the .dockstep/ directory structure
+// Init creates the .dockstep/ directory structure, upgrades an older layout and opens the
+// backend recorded in .dockstep/layout.json
 func (s *Store) Init() error {
-	dirs := []string{
-		filepath.Join(s.rootPath, ".dockstep"),
-		filepath.Join(s.rootPath, ".dockstep", StateDir),
-		filepath.Join(s.rootPath, ".dockstep", LogsDir),
-		filepath.Join(s.rootPath, ".dockstep", ImagesDir),
-		filepath.Join(s.rootPath, ".dockstep", ArtifactsDir),
-		filepath.Join(s.rootPath, ".dockstep", HistoryDir),
-		filepath.Join(s.rootPath, ".dockstep", HistoryDir, DockerfilesSubDir),
+	dir := filepath.Join(s.rootPath, ".dockstep")
+	layout := &Layout{Version: LayoutVersion, Backend: FileBackendName}
+	_, err := os.Stat(dir)
+	fresh := os.IsNotExist(err)
+	if err != nil && !fresh {
+		return err
+	}
+	if !fresh {
+		if layout, s.upgrades, err = s.upgradeLayout(dir); err != nil {
+			return err
+		}
 	}
 
+	dirs := []string{dir, filepath.Join(dir, ArtifactsDir)}
+	if layout.Backend == FileBackendName {
+		for _, bucket := range buckets {
+			dirs = append(dirs, filepath.Join(dir, bucket))
+		}
+	}
 	for _, dir := range dirs {
 		if err := os.MkdirAll(dir, 0755); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 	}
 
+	// A new .dockstep directory starts at the current layout
+	if fresh {
+		if err := writeLayout(dir, layout); err != nil {
+			return fmt.Errorf("failed to record the store layout: %w", err)
+		}
+	}
+
+	backend, err := openBackend(layout.Backend, dir)
+	if err != nil {
+		return err
+	}
+	s.backend = backend
+	s.layout = *layout
 	return nil
 }
 
+// Close releases the backend. A bolt database stays open, and other dockstep processes
+// wait for it, until the store is closed.
+func (s *Store) Close() error {
+	return closeBackend(s.backend)
+}
+
+// Layout returns the layout of the .dockstep directory
+func (s *Store) Layout() Layout {
+	return s.layout
+}
+
+// LayoutUpgrades describes the migrations Init ran to bring an older .dockstep directory
+// to the current layout
+func (s *Store) LayoutUpgrades() []string {
+	return s.upgrades
+}
+
 // SaveDockerfileSnapshot saves the Dockerfile content for a built image digest under history/dockerfiles/<digest>.Dockerfile
 func (s *Store) SaveDockerfileSnapshot(digest string, content string) error {
 	if digest == "" {
 		return fmt.Errorf("empty digest for dockerfile snapshot")
 	}
-	path := filepath.Join(s.rootPath, ".dockstep", HistoryDir, DockerfilesSubDir, digest+".Dockerfile")
-	return os.WriteFile(path, []byte(content), 0644)
+	return s.backend.Put(SnapshotsBucket, digest+".Dockerfile", []byte(content))
 }
 
 // LoadDockerfileSnapshot loads the Dockerfile content for a built image digest
@@ -76,8 +167,7 @@ func (s *Store) LoadDockerfileSnapshot(digest string) (string, error) {
 	if digest == "" {
 		return "", fmt.Errorf("empty digest")
 	}
-	path := filepath.Join(s.rootPath, ".dockstep", HistoryDir, DockerfilesSubDir, digest+".Dockerfile")
-	data, err := os.ReadFile(path)
+	data, err := s.backend.Get(SnapshotsBucket, digest+".Dockerfile")
 	if err != nil {
 		return "", err
 	}
@@ -86,211 +176,457 @@ func (s *Store) LoadDockerfileSnapshot(digest string) (string, error) {
 
 // SaveBlockState saves block state to state/<block-id>.json
 func (s *Store) SaveBlockState(id string, state *types.BlockState) error {
-	path := filepath.Join(s.rootPath, ".dockstep", StateDir, id+".json")
-	return s.writeJSON(path, state)
+	return putJSON(s.backend, StateDir, blockFileName(id)+".json", state)
 }
 
 // LoadBlockState loads block state from state/<block-id>.json
 func (s *Store) LoadBlockState(id string) (*types.BlockState, error) {
-	path := filepath.Join(s.rootPath, ".dockstep", StateDir, id+".json")
 	var state types.BlockState
-	if err := s.readJSON(path, &state); err != nil {
+	if err := getJSON(s.backend, StateDir, blockFileName(id)+".json", &state); err != nil {
 		return nil, err
 	}
 	return &state, nil
 }
 
+// AddRedactions registers secret values that must never be written to stored logs.
+// Each line of a multi-line value is redacted on its own as well.
+func (s *Store) AddRedactions(values ...[]byte) {
+	s.redactMu.Lock()
+	defer s.redactMu.Unlock()
+	for _, value := range values {
+		candidates := append([][]byte{bytes.TrimSpace(value)}, bytes.Split(value, []byte("\n"))...)
+		for _, candidate := range candidates {
+			candidate = bytes.TrimSpace(candidate)
+			if len(candidate) < minRedactionLength {
+				continue
+			}
+			s.redactions = append(s.redactions, append([]byte(nil), candidate...))
+		}
+	}
+	// Replace longer values first so a line never leaves part of the full value behind
+	sort.Slice(s.redactions, func(i, j int) bool {
+		return len(s.redactions[i]) > len(s.redactions[j])
+	})
+}
+
+// redact replaces registered secret values in log output
+func (s *Store) redact(logs []byte) []byte {
+	s.redactMu.RLock()
+	defer s.redactMu.RUnlock()
+	for _, secret := range s.redactions {
+		logs = bytes.ReplaceAll(logs, secret, []byte(redactedPlaceholder))
+	}
+	return logs
+}
+
+// secretPrefixLength returns the length of the longest end of logs that starts a secret
+// value, and so may be completed by the next chunk
+func (s *Store) secretPrefixLength(logs []byte) int {
+	s.redactMu.RLock()
+	defer s.redactMu.RUnlock()
+	longest := 0
+	for _, secret := range s.redactions {
+		for n := min(len(secret)-1, len(logs)); n > longest; n-- {
+			if bytes.HasPrefix(secret, logs[len(logs)-n:]) {
+				longest = n
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// takeHeldLogs removes and returns the log tail held back for a block
+func (s *Store) takeHeldLogs(id string) []byte {
+	s.heldMu.Lock()
+	defer s.heldMu.Unlock()
+	held := s.held[id]
+	delete(s.held, id)
+	return held
+}
+
 // SaveLogs saves logs to logs/<block-id>.log
 func (s *Store) SaveLogs(id string, logs []byte) error {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".log")
-	return os.WriteFile(path, logs, 0644)
+	s.takeHeldLogs(id)
+	return s.backend.Put(LogsDir, blockFileName(id)+".log", s.redact(logs))
 }
 
-// AppendLogs appends logs to logs/<block-id>.log creating the file if needed
+// AppendLogs appends logs to logs/<block-id>.log creating it if needed. Each chunk is
+// written at once, so concurrent readers never see part of one. A chunk ending in the
+// start of a secret value keeps that end back until the next chunk, or FlushLogs, shows
+// whether the value is complete, so secrets split across chunks are redacted too.
 func (s *Store) AppendLogs(id string, logs []byte) error {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".log")
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+	s.heldMu.Lock()
+	logs = s.redact(append(s.held[id], logs...))
+	n := len(logs) - s.secretPrefixLength(logs)
+	if s.held == nil {
+		s.held = make(map[string][]byte)
 	}
-	defer f.Close()
-	_, err = f.Write(logs)
-	return err
+	s.held[id] = append([]byte(nil), logs[n:]...)
+	s.heldMu.Unlock()
+
+	if n == 0 {
+		return nil
+	}
+	return s.backend.Append(LogsDir, blockFileName(id)+".log", logs[:n])
 }
 
-// ClearLogs truncates logs/<block-id>.log to zero length
-func (s *Store) ClearLogs(id string) error {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".log")
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	if err != nil {
-		return err
+// FlushLogs writes the log tail AppendLogs held back for a block, once its build is over
+func (s *Store) FlushLogs(id string) error {
+	held := s.takeHeldLogs(id)
+	if len(held) == 0 {
+		return nil
 	}
-	return f.Close()
+	return s.backend.Append(LogsDir, blockFileName(id)+".log", held)
+}
+
+// ClearLogs empties logs/<block-id>.log
+func (s *Store) ClearLogs(id string) error {
+	s.takeHeldLogs(id)
+	return s.backend.Put(LogsDir, blockFileName(id)+".log", nil)
 }
 
 // LoadLogs loads logs from logs/<block-id>.log
 func (s *Store) LoadLogs(id string) ([]byte, error) {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".log")
-	return os.ReadFile(path)
+	return s.backend.Get(LogsDir, blockFileName(id)+".log")
 }
 
 // SaveSuccessfulLogs saves successful build logs to logs/<block-id>.success.log
 func (s *Store) SaveSuccessfulLogs(id string, logs []byte) error {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".success.log")
-	return os.WriteFile(path, logs, 0644)
+	return s.backend.Put(LogsDir, blockFileName(id)+".success.log", s.redact(logs))
 }
 
 // LoadSuccessfulLogs loads successful build logs from logs/<block-id>.success.log
 func (s *Store) LoadSuccessfulLogs(id string) ([]byte, error) {
-	path := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".success.log")
-	return os.ReadFile(path)
+	return s.backend.Get(LogsDir, blockFileName(id)+".success.log")
 }
 
 // SaveImageDigest saves image digest to images/<block-id>.digest
 func (s *Store) SaveImageDigest(id, digest string) error {
-	path := filepath.Join(s.rootPath, ".dockstep", ImagesDir, id+".digest")
-	return os.WriteFile(path, []byte(digest), 0644)
+	return s.backend.Put(ImagesDir, blockFileName(id)+".digest", []byte(digest))
 }
 
 // LoadImageDigest loads image digest from images/<block-id>.digest
 func (s *Store) LoadImageDigest(id string) (string, error) {
-	path := filepath.Join(s.rootPath, ".dockstep", ImagesDir, id+".digest")
-	data, err := os.ReadFile(path)
+	data, err := s.backend.Get(ImagesDir, blockFileName(id)+".digest")
 	if err != nil {
 		return "", err
 	}
 	return string(data), nil
 }
 
-// SaveImageHistory appends an image record to history/<block-id>.jsonl (newline-delimited JSON)
-func (s *Store) SaveImageHistory(id string, rec types.ImageRecord) error {
-	path := filepath.Join(s.rootPath, ".dockstep", HistoryDir, id+".jsonl")
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return err
+// SaveBaseDigest records the registry digest a base image resolved to during a build
+func (s *Store) SaveBaseDigest(image, digest string) error {
+	return s.backend.Update(func(tx Backend) error {
+		digests, err := loadBaseDigests(tx)
+		if err != nil {
+			return err
+		}
+		if digests[image] == digest {
+			return nil
+		}
+		digests[image] = digest
+		return putJSON(tx, ImagesDir, baseDigestsKey, digests)
+	})
+}
+
+// LoadBaseDigests loads the registry digests recorded for base images, keyed by image reference
+func (s *Store) LoadBaseDigests() (map[string]string, error) {
+	return loadBaseDigests(s.backend)
+}
+
+// loadBaseDigests loads images/bases.json from a backend
+func loadBaseDigests(b Backend) (map[string]string, error) {
+	digests := make(map[string]string)
+	if err := getJSON(b, ImagesDir, baseDigestsKey, &digests); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to load base image digests: %w", err)
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	return enc.Encode(rec)
+	return digests, nil
 }
 
-// LoadImageHistory loads image records for a block
+// SaveImageHistory adds an image record to the history of a block
+func (s *Store) SaveImageHistory(id string, rec types.ImageRecord) error {
+	return s.backend.AppendHistory(id, rec)
+}
+
+// LoadImageHistory loads the image records of a block, oldest first. A block without
+// history returns an error satisfying os.IsNotExist.
 func (s *Store) LoadImageHistory(id string) ([]types.ImageRecord, error) {
-	path := filepath.Join(s.rootPath, ".dockstep", HistoryDir, id+".jsonl")
-	f, err := os.Open(path)
+	records, err := s.backend.History(HistoryQuery{Block: id})
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	var out []types.ImageRecord
-	dec := json.NewDecoder(f)
-	for {
-		var rec types.ImageRecord
-		if err := dec.Decode(&rec); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return out, nil
-		}
-		out = append(out, rec)
+	if len(records) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: HistoryDir + "/" + blockFileName(id) + ".jsonl", Err: fs.ErrNotExist}
+	}
+	out := make([]types.ImageRecord, len(records))
+	for i, record := range records {
+		out[i] = record.ImageRecord
 	}
 	return out, nil
 }
 
-// writeJSON writes data as JSON to a file
-func (s *Store) writeJSON(path string, data interface{}) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
+// QueryHistory returns the image records matching a query, oldest first
+func (s *Store) QueryHistory(query HistoryQuery) ([]HistoryRecord, error) {
+	return s.backend.History(query)
+}
+
+// blockFileName escapes characters that are not allowed in file names on common
+// platforms, such as the '/' or ':' that matrix values may contain
+func blockFileName(id string) string {
+	var b strings.Builder
+	for _, r := range id {
+		if r < 0x20 || strings.ContainsRune(`%/\:*?"<>|`, r) {
+			fmt.Fprintf(&b, "%%%02X", r)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// blockIDFromFileName reverses blockFileName
+func blockIDFromFileName(name string) string {
+	if id, err := url.PathUnescape(name); err == nil {
+		return id
 	}
-	defer file.Close()
+	return name
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(data)
+// ComputeBlockHash computes a deterministic cache key for a block
+func ComputeBlockHash(block types.Block, parentDigest string) string {
+	return ComputeBlockHashWithInputs(block, BlockInputs{ParentDigest: parentDigest})
 }
 
-// readJSON reads JSON data from a file
-func (s *Store) readJSON(path string, data interface{}) error {
-	file, err := os.Open(path)
+// SecretFingerprint returns a one-way fingerprint of a secret value, so cache keys
+// change when a secret changes without the value itself being hashed. It is an HMAC
+// under the project's secret key, so a guessed value cannot be checked against a cache
+// key without the key.
+func SecretFingerprint(key []byte, id string, value []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("dockstep-secret:" + id + ":"))
+	h.Write(value)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SecretKey returns the project's key for secret fingerprints, kept in
+// .dockstep/secret.key, creating it on first use
+func (s *Store) SecretKey() ([]byte, error) {
+	path := filepath.Join(s.rootPath, ".dockstep", SecretKeyFile)
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the secret key: %w", err)
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to create a secret key: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		// Another process created it first
+		return s.SecretKey()
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to create a secret key: %w", err)
 	}
-	defer file.Close()
+	defer f.Close()
+	if _, err := f.Write(key); err != nil {
+		return nil, fmt.Errorf("failed to write the secret key: %w", err)
+	}
+	return key, nil
+}
 
-	decoder := json.NewDecoder(file)
-	return decoder.Decode(data)
+// BlockInputs holds everything besides the block definition that its cache key depends on
+type BlockInputs struct {
+	ParentDigest string
+	CopyDigests  map[string]string // copied block reference -> digest of its image
+	Secrets      map[string][]byte
+	SecretKey    []byte // key of the secret fingerprints, see Store.SecretKey
 }
 
-// ComputeBlockHash computes a deterministic cache key for a block
-func ComputeBlockHash(block types.Block, parentDigest string) string {
+// ComputeBlockHashWithInputs computes the cache key for a block from its definition and inputs
+func ComputeBlockHashWithInputs(block types.Block, inputs BlockInputs) string {
+	return blockHash(block, inputs, false)
+}
+
+// SharedBlockHash computes the key of a block in the shared cache. It leaves out the block
+// ID and the names of its parent and of the blocks it copies from, which differ between
+// projects, and hashes only the digests of their images. Blocks that read the build
+// context cannot be shared, since the hash does not cover its files, and return false.
+// Secret fingerprints are keyed per project, so blocks mounting secrets are only shared
+// within their project.
+func SharedBlockHash(block types.Block, inputs BlockInputs) (string, bool) {
+	if readsBuildContext(block) {
+		return "", false
+	}
+	return blockHash(block, inputs, true), true
+}
+
+// readsBuildContext reports whether a block copies, adds or bind mounts files from its
+// build context
+func readsBuildContext(block types.Block) bool {
+	for _, instruction := range block.Instructions {
+		fields := strings.Fields(instruction)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "COPY", "ADD":
+			if !strings.Contains(instruction, "--from=") {
+				return true
+			}
+		case "RUN":
+			if strings.Contains(instruction, "type=bind") && !strings.Contains(instruction, "from=") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// blockHash hashes a block and its inputs; shared hashes leave out names local to a project
+func blockHash(block types.Block, inputs BlockInputs, shared bool) string {
 	// Create a deterministic hash based on block configuration and parent
 	h := sha256.New()
+	if shared {
+		h.Write([]byte("dockstep-shared:"))
+	}
 
 	// Include parent digest
-	h.Write([]byte(parentDigest))
+	h.Write([]byte(inputs.ParentDigest))
 
 	// Include block fields that affect execution
-	h.Write([]byte(block.ID))
+	if !shared {
+		h.Write([]byte(block.ID))
+	}
 	h.Write([]byte(block.From))
-	h.Write([]byte(block.FromBlock))
-	h.Write([]byte(block.Context))
+	if !shared {
+		h.Write([]byte(block.FromBlock))
+		h.Write([]byte(block.Context))
+	}
 
-	// Include instructions
+	// Include instructions; shared hashes name the blocks COPY --from copies by their image
 	for _, instruction := range block.Instructions {
+		if shared {
+			instruction = config.RewriteCopyFrom(instruction, func(ref string) string {
+				if digest, ok := inputs.CopyDigests[ref]; ok {
+					return digest
+				}
+				return ref
+			})
+		}
 		h.Write([]byte(instruction))
 	}
 
+	// Include build args in a stable order
+	names := make([]string, 0, len(block.Args))
+	for name := range block.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.Write([]byte(name + "=" + block.Args[name]))
+	}
+
+	// Include the platform, env and labels; absent ones add nothing so older hashes stay valid
+	if block.Platform != "" {
+		h.Write([]byte("platform:" + block.Platform))
+	}
+	for _, name := range sortedKeys(block.Env) {
+		h.Write([]byte("env:" + name + "=" + block.Env[name]))
+	}
+	for _, key := range sortedKeys(block.Labels) {
+		h.Write([]byte("label:" + key + "=" + block.Labels[key]))
+	}
+
+	// Include copied paths and the images they are copied from; shared hashes name the
+	// copied blocks by their image only
+	for _, entry := range block.CopyFrom {
+		source := entry.Block
+		if shared {
+			source = inputs.CopyDigests[entry.Block]
+		}
+		h.Write([]byte("copy:" + source + ":" + entry.Src + ":" + entry.Dst))
+	}
+	if !shared {
+		refs := make([]string, 0, len(inputs.CopyDigests))
+		for ref := range inputs.CopyDigests {
+			refs = append(refs, ref)
+		}
+		sort.Strings(refs)
+		for _, ref := range refs {
+			h.Write([]byte("copy-digest:" + ref + "=" + inputs.CopyDigests[ref]))
+		}
+	}
+
+	// Include only fingerprints of secret values
+	ids := make([]string, 0, len(inputs.Secrets))
+	for id := range inputs.Secrets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		h.Write([]byte("secret:" + id + "=" + SecretFingerprint(inputs.SecretKey, id, inputs.Secrets[id])))
+	}
+
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
 // GetBlockStates loads all block states from the store
 func (s *Store) GetBlockStates() (map[string]*types.BlockState, error) {
 	states := make(map[string]*types.BlockState)
-
-	stateDir := filepath.Join(s.rootPath, ".dockstep", StateDir)
-	files, err := os.ReadDir(stateDir)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return states, nil // No state files yet
+	err := s.backend.View(func(tx Backend) error {
+		files, err := tx.List(StateDir)
+		if err != nil {
+			return err
 		}
-		return nil, err
-	}
-
-	for _, file := range files {
-		if filepath.Ext(file.Name()) == ".json" {
-			id := file.Name()[:len(file.Name())-5] // Remove .json extension
-			state, err := s.LoadBlockState(id)
-			if err != nil {
-				return nil, fmt.Errorf("failed to load state for block %s: %w", id, err)
+		for name := range files {
+			if filepath.Ext(name) != ".json" {
+				continue
+			}
+			id := blockIDFromFileName(strings.TrimSuffix(name, ".json"))
+			var state types.BlockState
+			if err := getJSON(tx, StateDir, name, &state); err != nil {
+				return fmt.Errorf("failed to load state for block %s: %w", id, err)
 			}
-			states[id] = state
+			states[id] = &state
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
 	return states, nil
 }
 
 // Cleanup removes all state for a block and its descendants
 func (s *Store) Cleanup(blockID string, descendants []string) error {
-	// Remove state files
-	allBlocks := append([]string{blockID}, descendants...)
-
-	for _, id := range allBlocks {
-		// Remove state file
-		statePath := filepath.Join(s.rootPath, ".dockstep", StateDir, id+".json")
-		os.Remove(statePath)
-
-		// Remove logs
-		logPath := filepath.Join(s.rootPath, ".dockstep", LogsDir, id+".log")
-		os.Remove(logPath)
-
-		// No diff files to remove in new schema
+	return s.backend.Update(func(tx Backend) error {
+		for _, id := range append([]string{blockID}, descendants...) {
+			for _, value := range [][2]string{
+				{StateDir, blockFileName(id) + ".json"},
+				{LogsDir, blockFileName(id) + ".log"},
+				{ImagesDir, blockFileName(id) + ".digest"},
+			} {
+				if err := tx.Delete(value[0], value[1]); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
 
-		// Remove image digest
-		imagePath := filepath.Join(s.rootPath, ".dockstep", ImagesDir, id+".digest")
-		os.Remove(imagePath)
+// sortedKeys returns the keys of a string map in sorted order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
 	}
-
-	return nil
+	sort.Strings(keys)
+	return keys
 }
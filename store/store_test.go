@@ -1,6 +1,7 @@
 package store
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -136,4 +137,268 @@ func TestComputeBlockHash(t *testing.T) {
 	if hash1 == hash3 {
 		t.Error("Hash should be different for different commands")
 	}
+
+	// Build args are part of the hash
+	block4 := block
+	block4.Args = map[string]string{"VERSION": "1"}
+	block5 := block
+	block5.Args = map[string]string{"VERSION": "2"}
+	if ComputeBlockHash(block4, parentDigest) == ComputeBlockHash(block5, parentDigest) {
+		t.Error("Hash should be different for different build args")
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := New(tmpDir)
+	store.Init()
+
+	store.AddRedactions([]byte("s3cr3t-token\n"), []byte("line-one\nline-two\n"))
+
+	if err := store.AppendLogs("test-block", []byte("Using token s3cr3t-token\n")); err != nil {
+		t.Fatalf("Failed to append logs: %v", err)
+	}
+	if err := store.AppendLogs("test-block", []byte("config: line-two\n")); err != nil {
+		t.Fatalf("Failed to append logs: %v", err)
+	}
+
+	logs, err := store.LoadLogs("test-block")
+	if err != nil {
+		t.Fatalf("Failed to load logs: %v", err)
+	}
+
+	want := "Using token [REDACTED]\nconfig: [REDACTED]\n"
+	if string(logs) != want {
+		t.Errorf("Expected redacted logs %q, got %q", want, string(logs))
+	}
+}
+
+func TestLogRedactionAcrossChunks(t *testing.T) {
+	store := New(t.TempDir())
+	store.Init()
+	store.AddRedactions([]byte("s3cr3t-token"))
+
+	// The secret is split across two appends; the start of a value that turns out not to
+	// be the secret is written once the build is over
+	for _, chunk := range []string{"Using token s3cr", "3t-token\n", "done, s3c"} {
+		if err := store.AppendLogs("test-block", []byte(chunk)); err != nil {
+			t.Fatalf("Failed to append logs: %v", err)
+		}
+	}
+	logs, _ := store.LoadLogs("test-block")
+	if want := "Using token [REDACTED]\ndone, "; string(logs) != want {
+		t.Errorf("Expected redacted logs %q, got %q", want, string(logs))
+	}
+	if err := store.FlushLogs("test-block"); err != nil {
+		t.Fatal(err)
+	}
+	logs, _ = store.LoadLogs("test-block")
+	if want := "Using token [REDACTED]\ndone, s3c"; string(logs) != want {
+		t.Errorf("Expected flushed logs %q, got %q", want, string(logs))
+	}
+}
+
+func TestComputeBlockHashWithSecrets(t *testing.T) {
+	block := types.Block{
+		ID:           "test-block",
+		From:         "alpine:latest",
+		Instructions: []string{"RUN --mount=type=secret,id=token cat /run/secrets/token"},
+	}
+	key := []byte("project-key")
+	hash := func(key []byte, value string) string {
+		return ComputeBlockHashWithInputs(block, BlockInputs{ParentDigest: "sha256:parent", SecretKey: key, Secrets: map[string][]byte{"token": []byte(value)}})
+	}
+
+	if hash(key, "one") == hash(key, "two") {
+		t.Error("Hash should change when a secret value changes")
+	}
+	if hash(key, "one") != hash(key, "one") {
+		t.Error("Hash should be deterministic for the same key")
+	}
+	if hash(key, "one") == hash([]byte("other-project-key"), "one") {
+		t.Error("Secret fingerprints should depend on the project's key")
+	}
+	if ComputeBlockHashWithInputs(block, BlockInputs{ParentDigest: "sha256:parent"}) != ComputeBlockHash(block, "sha256:parent") {
+		t.Error("Hash without secrets should match ComputeBlockHash")
+	}
+}
+
+func TestSecretKey(t *testing.T) {
+	root := t.TempDir()
+	store := New(root)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.SecretKey()
+	if err != nil || len(key) != 32 {
+		t.Fatalf("Expected a new 32-byte key, got %d bytes, %v", len(key), err)
+	}
+	info, err := os.Stat(filepath.Join(root, ".dockstep", SecretKeyFile))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key to be readable by its owner only, got %v, %v", info, err)
+	}
+	if again, _ := New(root).SecretKey(); !bytes.Equal(again, key) {
+		t.Error("Expected the key to be kept")
+	}
+}
+
+func TestProjectID(t *testing.T) {
+	root := t.TempDir()
+	id := New(root).ProjectID()
+	if again := New(filepath.Join(root, "sub", "..")).ProjectID(); again != id {
+		t.Errorf("Expected the same root to give the same ID, got %s and %s", id, again)
+	}
+	if other := New(t.TempDir()).ProjectID(); other == id {
+		t.Error("Expected another checkout to get another ID")
+	}
+}
+
+func TestComputeBlockHashWithInputs(t *testing.T) {
+	block := types.Block{
+		ID:           "runtime",
+		From:         "alpine:latest",
+		CopyFrom:     []types.CopyFrom{{Block: "builder", Src: "/out/app", Dst: "/usr/bin/app"}},
+		Instructions: []string{"RUN app --version"},
+	}
+
+	hash1 := ComputeBlockHashWithInputs(block, BlockInputs{ParentDigest: "sha256:parent", CopyDigests: map[string]string{"builder": "sha256:one"}})
+	hash2 := ComputeBlockHashWithInputs(block, BlockInputs{ParentDigest: "sha256:parent", CopyDigests: map[string]string{"builder": "sha256:two"}})
+	if hash1 == hash2 {
+		t.Error("Hash should change when a copied block's digest changes")
+	}
+
+	moved := block
+	moved.CopyFrom = []types.CopyFrom{{Block: "builder", Src: "/out/app", Dst: "/opt/app"}}
+	if ComputeBlockHashWithInputs(moved, BlockInputs{ParentDigest: "sha256:parent", CopyDigests: map[string]string{"builder": "sha256:one"}}) == hash1 {
+		t.Error("Hash should change when a copy destination changes")
+	}
+}
+
+func TestComputeBlockHashWithSettings(t *testing.T) {
+	block := types.Block{ID: "base", From: "alpine:latest", Instructions: []string{"RUN echo hello"}}
+	hash := ComputeBlockHash(block, "sha256:parent")
+
+	variants := map[string]types.Block{
+		"platform": {ID: "base", From: "alpine:latest", Instructions: block.Instructions, Platform: "linux/arm64"},
+		"env":      {ID: "base", From: "alpine:latest", Instructions: block.Instructions, Env: map[string]string{"TZ": "UTC"}},
+		"labels":   {ID: "base", From: "alpine:latest", Instructions: block.Instructions, Labels: map[string]string{"team": "web"}},
+	}
+	for name, variant := range variants {
+		if ComputeBlockHash(variant, "sha256:parent") == hash {
+			t.Errorf("Hash should change when the %s changes", name)
+		}
+	}
+
+	// Whether a value was inherited from the settings does not matter
+	inherited := variants["env"]
+	inherited.Inherited.Env = []string{"TZ"}
+	if ComputeBlockHash(inherited, "sha256:parent") != ComputeBlockHash(variants["env"], "sha256:parent") {
+		t.Error("Hash should only depend on the effective values")
+	}
+}
+
+func TestSharedBlockHash(t *testing.T) {
+	block := types.Block{ID: "base", FromBlock: "os", Instructions: []string{"RUN apt-get install -y curl"}}
+	inputs := BlockInputs{ParentDigest: "sha256:ubuntu"}
+	hash, ok := SharedBlockHash(block, inputs)
+	if !ok {
+		t.Fatal("Expected a block that does not read its context to be shared")
+	}
+	if hash == ComputeBlockHashWithInputs(block, inputs) {
+		t.Error("Shared hash should differ from the project hash")
+	}
+
+	// The same block under other names in another project shares the key
+	renamed := block
+	renamed.ID, renamed.FromBlock = "tools", "system"
+	if other, _ := SharedBlockHash(renamed, inputs); other != hash {
+		t.Error("Shared hash should not depend on block names")
+	}
+	if other, _ := SharedBlockHash(block, BlockInputs{ParentDigest: "sha256:debian"}); other == hash {
+		t.Error("Shared hash should change when the parent image changes")
+	}
+
+	for _, instruction := range []string{
+		"COPY . /app",
+		"ADD src /src",
+		"RUN --mount=type=bind,target=/src make",
+	} {
+		reads := block
+		reads.Instructions = []string{instruction}
+		if _, ok := SharedBlockHash(reads, inputs); ok {
+			t.Errorf("Expected %q to keep the block out of the shared cache", instruction)
+		}
+	}
+	copies := block
+	copies.Instructions = []string{"COPY --from=builder /out/app /usr/bin/app"}
+	if _, ok := SharedBlockHash(copies, inputs); !ok {
+		t.Error("Expected copies from other images to be shared")
+	}
+
+	// Copied blocks count by their image, not their name
+	copied := func(source, digest string) string {
+		block := types.Block{ID: "runtime", From: "alpine:3.19",
+			CopyFrom:     []types.CopyFrom{{Block: source, Src: "/out/app", Dst: "/usr/bin/app"}},
+			Instructions: []string{"COPY --from=" + source + " /out/lib /usr/lib/app"}}
+		hash, _ := SharedBlockHash(block, BlockInputs{CopyDigests: map[string]string{source: digest}})
+		return hash
+	}
+	if copied("builder", "sha256:b1") != copied("compile", "sha256:b1") {
+		t.Error("Shared hash should not depend on the names of copied blocks")
+	}
+	if copied("builder", "sha256:b1") == copied("builder", "sha256:b2") {
+		t.Error("Shared hash should change when a copied image changes")
+	}
+}
+
+func TestBaseDigests(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := New(tmpDir)
+	store.Init()
+
+	digests, err := store.LoadBaseDigests()
+	if err != nil {
+		t.Fatalf("Failed to load base digests: %v", err)
+	}
+	if len(digests) != 0 {
+		t.Errorf("Expected no base digests, got %v", digests)
+	}
+
+	if err := store.SaveBaseDigest("alpine:3.19", "sha256:one"); err != nil {
+		t.Fatalf("Failed to save base digest: %v", err)
+	}
+	if err := store.SaveBaseDigest("golang:1.22", "sha256:two"); err != nil {
+		t.Fatalf("Failed to save base digest: %v", err)
+	}
+	if err := store.SaveBaseDigest("alpine:3.19", "sha256:three"); err != nil {
+		t.Fatalf("Failed to save base digest: %v", err)
+	}
+
+	digests, err = store.LoadBaseDigests()
+	if err != nil {
+		t.Fatalf("Failed to load base digests: %v", err)
+	}
+	if digests["alpine:3.19"] != "sha256:three" || digests["golang:1.22"] != "sha256:two" {
+		t.Errorf("Unexpected base digests: %v", digests)
+	}
+}
+
+func TestBlockFileNames(t *testing.T) {
+	tmpDir := t.TempDir()
+	store := New(tmpDir)
+	store.Init()
+
+	id := "deps[platform=linux/amd64,python=3.11]"
+	state := &types.BlockState{ID: id, Status: types.StatusSuccess, Timestamp: time.Now()}
+	if err := store.SaveBlockState(id, state); err != nil {
+		t.Fatalf("Failed to save block state: %v", err)
+	}
+
+	states, err := store.GetBlockStates()
+	if err != nil {
+		t.Fatalf("Failed to load block states: %v", err)
+	}
+	if _, ok := states[id]; !ok {
+		t.Errorf("Expected state for %s, got %v", id, states)
+	}
 }
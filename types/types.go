@@ -2,6 +2,8 @@ package types
 
 import (
 	"time"
+
+	yaml "gopkg.in/yaml.v3"
 )
 
 // BlockStatus represents the execution status of a block
@@ -26,26 +28,203 @@ type ExportConfig struct {
 
 // Block represents a single build step
 type Block struct {
-	ID               string        `yaml:"id"`
-	From             string        `yaml:"from,omitempty"`
-	FromBlock        string        `yaml:"from_block,omitempty"`
-	FromBlockVersion string        `yaml:"from_block_version,omitempty"`
-	Instructions     []string      `yaml:"instructions"`
-	Context          string        `yaml:"context,omitempty"`
-	Export           *ExportConfig `yaml:"export,omitempty"`
+	ID               string              `yaml:"id"`
+	Description      string              `yaml:"description,omitempty"`
+	From             string              `yaml:"from,omitempty"`
+	FromBlock        string              `yaml:"from_block,omitempty"`
+	FromBlockVersion string              `yaml:"from_block_version,omitempty"`
+	Args             map[string]string   `yaml:"args,omitempty"`
+	CopyFrom         []CopyFrom          `yaml:"copy_from,omitempty"`
+	Instructions     []string            `yaml:"instructions"`
+	Context          string              `yaml:"context,omitempty"`
+	Platform         string              `yaml:"platform,omitempty"`
+	Env              map[string]string   `yaml:"env,omitempty"`
+	Labels           map[string]string   `yaml:"labels,omitempty"`
+	Export           *ExportConfig       `yaml:"export,omitempty"`
+	Matrix           map[string][]string `yaml:"matrix,omitempty"`
+
+	// Source is the included file the block was loaded from, empty for the project's own blocks
+	Source string `yaml:"-" json:",omitempty"`
+	// Template is the block as declared when this block is a variant expanded from a matrix
+	Template *Block `yaml:"-" json:"-"`
+	// Variant holds the matrix values of an expanded block
+	Variant map[string]string `yaml:"-" json:",omitempty"`
+	// Position is where the block is declared, and InstructionPositions where each instruction is
+	Position             Position   `yaml:"-" json:"-"`
+	InstructionPositions []Position `yaml:"-" json:"-"`
+	// Inherited records the values the block took from the project settings
+	Inherited Inherited `yaml:"-" json:"-"`
+}
+
+// Inherited records which block values are project settings defaults, so they are not
+// written back to the block
+type Inherited struct {
+	Context  bool
+	Platform bool
+	Env      []string // keys of Env set from the settings
+	Labels   []string // keys of Labels set from the settings
+}
+
+// Position is a line and column in a config file, starting at 1; zero when unknown
+type Position struct {
+	Line   int
+	Column int
+}
+
+// UnmarshalYAML records where the block and its instructions are declared
+func (b *Block) UnmarshalYAML(node *yaml.Node) error {
+	type plain Block
+	if err := node.Decode((*plain)(b)); err != nil {
+		return err
+	}
+	b.Position = Position{Line: node.Line, Column: node.Column}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value != "instructions" {
+			continue
+		}
+		for _, item := range node.Content[i+1].Content {
+			b.InstructionPositions = append(b.InstructionPositions, Position{Line: item.Line, Column: item.Column})
+		}
+	}
+	return nil
+}
+
+// TemplateID returns the ID of the matrix block a variant was expanded from, or its own ID
+func (b Block) TemplateID() string {
+	if b.Template != nil {
+		return b.Template.ID
+	}
+	return b.ID
+}
+
+// CopyFrom copies a path out of another block's image, like COPY --from in a multi-stage build
+type CopyFrom struct {
+	Block string `yaml:"block"`
+	Src   string `yaml:"src"`
+	Dst   string `yaml:"dst"`
+}
+
+// Include pulls blocks from another YAML file or a directory of YAML files.
+// Block IDs are prefixed with Prefix and namespaced as <namespace>.<id>.
+type Include struct {
+	Path      string `yaml:"path"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Prefix    string `yaml:"prefix,omitempty"`
 }
 
-// Settings represents default settings for the project
+// UnmarshalYAML allows an include to be written as a plain path
+func (i *Include) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*i = Include{Path: node.Value}
+		return nil
+	}
+	type plain Include
+	return node.Decode((*plain)(i))
+}
+
+// MarshalYAML writes an include without namespace or prefix as a plain path
+func (i Include) MarshalYAML() (interface{}, error) {
+	if i.Namespace == "" && i.Prefix == "" {
+		return i.Path, nil
+	}
+	type plain Include
+	return plain(i), nil
+}
+
+// Secret describes where the value of a build secret is read from.
+// Exactly one of File or Env must be set.
+type Secret struct {
+	File string `yaml:"file,omitempty"`
+	Env  string `yaml:"env,omitempty"`
+}
+
+// PullPolicy controls when base images are pulled
+type PullPolicy string
+
+const (
+	PullAlways  PullPolicy = "always"  // pull before every build
+	PullMissing PullPolicy = "missing" // pull only when the image is not available locally
+	PullNever   PullPolicy = "never"   // only use local images
+)
+
+// DefaultTagPrefix is the prefix of block image tags when settings do not set one
+const DefaultTagPrefix = "dockstep"
+
+// DefaultRetentionKeep is how many timestamp tags of each block are kept when settings do
+// not set a retention
+const DefaultRetentionKeep = 5
+
+// Labels added to every block image
+const (
+	LabelProject   = "dev.dockstep.project"
+	LabelProjectID = "dev.dockstep.project-id"
+	LabelBlock     = "dev.dockstep.block"
+	LabelHash      = "dev.dockstep.hash"
+)
+
+// Settings are project-wide defaults. Context and platform apply to every block; env and
+// labels are set on every block built from a base image, and are inherited from there.
 type Settings struct {
-	// No settings needed for simplified schema
+	Context     string            `yaml:"context,omitempty"`
+	Platform    string            `yaml:"platform,omitempty"`
+	PullPolicy  PullPolicy        `yaml:"pull_policy,omitempty"`
+	Env         map[string]string `yaml:"env,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	TagPrefix   string            `yaml:"tag_prefix,omitempty"`
+	Retention   Retention         `yaml:"retention,omitempty"`
+	SharedCache bool              `yaml:"shared_cache,omitempty"` // also use the machine-wide cache
+}
+
+// Retention limits how many timestamp tags of each block are kept
+type Retention struct {
+	Keep   *int   `yaml:"keep,omitempty"`    // tags kept per block; 0 keeps all
+	MaxAge string `yaml:"max_age,omitempty"` // age after which older tags are removed, such as 72h or 7d
+}
+
+// KeepCount returns how many timestamp tags of each block are kept; 0 keeps all
+func (r Retention) KeepCount() int {
+	if r.Keep == nil {
+		return DefaultRetentionKeep
+	}
+	return *r.Keep
+}
+
+// Pull returns the pull policy, defaulting to always
+func (s Settings) Pull() PullPolicy {
+	if s.PullPolicy == "" {
+		return PullAlways
+	}
+	return s.PullPolicy
+}
+
+// ImageTagPrefix returns the prefix of block image tags
+func (s Settings) ImageTagPrefix() string {
+	if s.TagPrefix == "" {
+		return DefaultTagPrefix
+	}
+	return s.TagPrefix
+}
+
+// LintConfig adjusts the lint rules: severities by rule ID (error, warning or off) and
+// the rules to ignore for each block
+type LintConfig struct {
+	Rules  map[string]string   `yaml:"rules,omitempty"`
+	Ignore map[string][]string `yaml:"ignore,omitempty"`
 }
 
 // Project represents the complete dockstep configuration
 type Project struct {
-	Version  string   `yaml:"version"`
-	Name     string   `yaml:"name"`
-	Settings Settings `yaml:"settings,omitempty"`
-	Blocks   []Block  `yaml:"blocks"`
+	Version   string            `yaml:"version"`
+	Name      string            `yaml:"name"`
+	Settings  Settings          `yaml:"settings,omitempty"`
+	Include   []Include         `yaml:"include,omitempty"`
+	Variables map[string]string `yaml:"variables,omitempty"`
+	Secrets   map[string]Secret `yaml:"secrets,omitempty"`
+	Lint      *LintConfig       `yaml:"lint,omitempty"`
+	Blocks    []Block           `yaml:"blocks"`
+
+	// IncludedVariables holds variables declared in included files; the project's own variables take precedence
+	IncludedVariables map[string]string `yaml:"-" json:"-"`
 }
 
 // DiffEntry represents a filesystem change
@@ -55,6 +234,16 @@ type DiffEntry struct {
 	Size int64  `json:"size,omitempty"`
 }
 
+// HistoryEntry is one layer of an image's build history
+type HistoryEntry struct {
+	ID        string    `json:"id"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	Tags      []string  `json:"tags,omitempty"`
+	Size      int64     `json:"size"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
 // BlockState represents the execution state of a block
 type BlockState struct {
 	ID        string        `json:"id"`
@@ -65,6 +254,11 @@ type BlockState struct {
 	ExitCode  int           `json:"exit_code,omitempty"`
 	Duration  time.Duration `json:"duration,omitempty"`
 	Error     string        `json:"error,omitempty"`
+	// PID, Host and Heartbeat identify the process running the block, so a run whose
+	// process died can be told from one still in progress
+	PID       int       `json:"pid,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Heartbeat time.Time `json:"heartbeat,omitzero"`
 }
 
 // RunOptions represents options for running a single block
@@ -78,6 +272,10 @@ type UpOptions struct {
 	Force           bool
 	FromBlock       string
 	ContinueOnError bool
+	// Only restricts the run to these blocks (a matrix block ID selects all its variants)
+	Only []string
+	// Resume starts from the first block that did not finish
+	Resume bool
 }
 
 // DockerfileOptions represents options for Dockerfile export
@@ -85,6 +283,17 @@ type DockerfileOptions struct {
 	Output       string
 	CollapseRuns bool
 	PinDigests   bool
+	// MultiStage emits one build stage per block instead of a single flattened stage
+	MultiStage bool
+	// Digests maps base images to the digests they are pinned to when PinDigests is set
+	Digests map[string]string
+	// Variables overrides project variables and block args (e.g. from --set)
+	Variables map[string]string
+}
+
+// Lock pins the base images of a project to registry digests
+type Lock struct {
+	Images map[string]string `yaml:"images"`
 }
 
 // ImageExportOptions represents options for image export
@@ -43,6 +43,14 @@ type StatusItem = {
   error?: string
 }
 
+type LintFinding = {
+  rule: string
+  severity: 'error' | 'warning'
+  block: string
+  index: number
+  message: string
+}
+
 type Project = {
   name: string
   version: string
@@ -710,6 +718,7 @@ function BlockCell({
   const [images, setImages] = useState<{ tag: string; digest: string; timestamp: string; dockerfile?: string }[]>([])
   const [dockerfile, setDockerfile] = useState('')
   const [lineage, setLineage] = useState<{ id: string; from: string; from_block: string; from_block_version: string; digest: string; timestamp: string }[]>([])
+  const [lint, setLint] = useState<LintFinding[]>([])
   const instructions: string[] = (block as any).instructions ?? (block as any).Instructions ?? []
   const cmd: string = instructions.length > 0 ? instructions.join('\n') : ''
   const workdir: string | undefined = (block as any).workdir ?? (block as any).Workdir
@@ -728,6 +737,9 @@ function BlockCell({
   
 
   useEffect(() => {
+    apiFetch(`/api/lint?id=${encodeURIComponent(id)}`).then(r => (r.ok ? r.json() : Promise.resolve([]))).then((arr:any)=>{
+      setLint(Array.isArray(arr) ? arr : [])
+    })
     apiFetch(`/api/logs?id=${encodeURIComponent(id)}`).then(r => (r.ok ? r.text() : Promise.resolve(''))).then(setLogs)
     apiFetch(`/api/diff?id=${encodeURIComponent(id)}`).then(r => (r.ok ? r.json() : Promise.resolve([]))).then((arr:any)=>{
       setDiff(Array.isArray(arr) ? arr : [])
@@ -768,11 +780,15 @@ function BlockCell({
       body.from_block_version = (block as any).from_block_version
     }
     
-    await apiFetch('/api/block', {
+    const resp = await apiFetch('/api/block', {
       method: 'PUT',
       headers: { 'Content-Type': 'application/json' },
       body: JSON.stringify(body)
     })
+    if (resp.ok) {
+      const data = await resp.json().catch(() => null)
+      setLint(Array.isArray(data?.lint) ? data.lint : [])
+    }
   }
 
   // keep a getter for latest editor content; register a save handler so global Save Notebook can persist this block
@@ -900,6 +916,15 @@ function BlockCell({
         getCurrentValueRef.current = get
         currentValueRef.current = get()
       }} />
+      {lint.length > 0 && (
+        <div className="px-3 pt-2 space-y-1">
+          {lint.map((f, i) => (
+            <div key={i} className={`text-xs font-mono ${f.severity === 'error' ? 'text-red-600 dark:text-red-400' : 'text-amber-600 dark:text-amber-400'}`}>
+              {f.severity === 'error' ? '✖' : '⚠'} {f.index >= 0 ? `instruction ${f.index + 1}: ` : ''}{f.message} <span className="opacity-60">[{f.rule}]</span>
+            </div>
+          ))}
+        </div>
+      )}
       <div className="px-3 pt-2">
         <div className="flex items-center gap-2 border-b border-zinc-200/70 dark:border-zinc-800/80">
           <button